@@ -0,0 +1,34 @@
+package catalogue
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/flu-network/client/common"
+)
+
+// writeFileAtomic replaces the catalogue's files. Tests replace it to simulate failed writes.
+var writeFileAtomic = common.WriteFileAtomic
+
+// removeTemporaryFiles removes the temporary files common.WriteFileAtomic leaves behind in the
+// catalogue directory if the process crashes before renaming them. They may be incomplete, and the
+// files they were meant to replace are intact.
+func removeTemporaryFiles(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name, ok := common.TemporaryFileOf(entry.Name())
+		if !ok || !entry.Type().IsRegular() {
+			continue
+		}
+		if name != indexFileName && (&common.Sha1Hash{}).FromStringSafe(name) != nil {
+			continue // not a catalogue file
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package catalogue
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/flu-network/client/common"
+)
+
+// newTestDownload returns a catalogue holding a download of "hello world" in two chunks, the first
+// of which has been saved
+func newTestDownload(t *testing.T, parentDir string) (*Cat, *common.Sha1Hash) {
+	cat, err := NewCat(filepath.Join(parentDir, "catalogue"), filepath.Join(parentDir, "downloads"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cat.Init(); err != nil {
+		t.Fatal(err)
+	}
+	chunkHashes := []common.Sha1Hash{
+		{Data: sha1.Sum([]byte("hello "))},
+		{Data: sha1.Sum([]byte("world"))},
+	}
+	fileHash := sha1HashString("hello world")
+	if _, err := cat.RegisterDownload(11, 2, 6, fileHash, "hello.txt", chunkHashes, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := cat.SaveChunk(fileHash, 0, []byte("hello "), nil); err != nil {
+		t.Fatal(err)
+	}
+	return cat, fileHash
+}
+
+// reopen returns a new Cat for the same directories, as the daemon would have if it crashed and
+// restarted. A crash releases the lock file without saving anything.
+func reopen(t *testing.T, cat *Cat) *Cat {
+	cat.indexFile.lock.Close()
+	result, err := NewCat(cat.DataDir, cat.DefaultDownloadsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := result.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestWriteFaults(t *testing.T) {
+	defer func() { writeFileAtomic = common.WriteFileAtomic }()
+	cat, fileHash := newTestDownload(t, t.TempDir())
+	injected := errors.New("injected fault")
+	writeFileAtomic = func(path string, data []byte, perm os.FileMode) error {
+		return injected
+	}
+
+	if err := cat.SetPaused(fileHash, true); !errors.Is(err, injected) {
+		t.Fatalf("Expected the index file write to fail but got %v\n", err)
+	}
+	if err := cat.SaveChunk(fileHash, 1, []byte("world"), nil); !errors.Is(err, injected) {
+		t.Fatalf("Expected the progress file write to fail but got %v\n", err)
+	}
+	writeFileAtomic = common.WriteFileAtomic
+
+	// the files still hold what they held before the failed writes
+	reopened := reopen(t, cat)
+	rec, err := reopened.Contains(fileHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Paused || rec.Progress.Count() != 1 || !rec.Progress.Get(0) {
+		t.Fatalf("Expected the unpaused download of chunk 0 but got paused %v, chunks %v\n",
+			rec.Paused, rec.Progress.Ranges())
+	}
+	if err := reopened.SaveChunk(fileHash, 1, []byte("world"), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCrashRecovery(t *testing.T) {
+	cat, fileHash := newTestDownload(t, t.TempDir())
+	indexFilePath := filepath.Join(cat.DataDir, indexFileName)
+	progressFilePath := filepath.Join(cat.DataDir, fileHash.String())
+	unrelated := filepath.Join(cat.DataDir, "notes.tmp")
+	if err := os.WriteFile(unrelated, []byte("not ours"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash at any step of a write leaves a temporary file, complete or not, next to the intact
+	// file it was replacing
+	for _, path := range []string{indexFilePath, progressFilePath} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path+".12345"+common.TmpSuffix, data[:len(data)/2], 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cat = reopen(t, cat)
+	if rec, err := cat.Contains(fileHash); err != nil || rec.Progress.Count() != 1 {
+		t.Fatalf("Expected the catalogue to be intact but got %v, %v\n", rec, err)
+	}
+	for _, path := range []string{indexFilePath, progressFilePath} {
+		if _, err := os.Stat(path + ".12345" + common.TmpSuffix); !os.IsNotExist(err) {
+			t.Fatalf("Expected the temporary file of %s to be removed but got %v\n", path, err)
+		}
+	}
+	if _, err := os.Stat(unrelated); err != nil {
+		t.Fatalf("Expected files that are not the catalogue's to be left alone but got %v\n", err)
+	}
+
+	// files written in place by older versions can be truncated. Progress is rebuilt from the
+	// chunks on disk, however little of it is left
+	testCases := map[string][]byte{
+		"empty":     {},
+		"truncated": []byte(progressFileMagic),
+		"too short": append([]byte(progressFileMagic), progressFileVersion, 0, 0, 0, 0, 0, 0, 0, 1),
+	}
+	for name, contents := range testCases {
+		if err := os.WriteFile(progressFilePath, contents, 0664); err != nil {
+			t.Fatal(err)
+		}
+		cat = reopen(t, cat)
+		rec, err := cat.Contains(fileHash)
+		if err != nil || rec.Progress.Count() != 1 || !rec.Progress.Get(0) {
+			t.Fatalf("%s: Expected chunk 0 to be found on disk but got %v, %v\n", name, rec, err)
+		}
+	}
+	if err := os.Remove(progressFilePath); err != nil {
+		t.Fatal(err)
+	}
+	cat = reopen(t, cat)
+	if rec, err := cat.Contains(fileHash); err != nil || rec.Progress.Count() != 1 {
+		t.Fatalf("Expected a missing progress file to be rebuilt but got %v, %v\n", rec, err)
+	}
+
+	// a damaged index is restored from its previous version, which lacks the latest change
+	cat = reopen(t, cat)
+	if err := cat.SetPaused(fileHash, true); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(indexFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(indexFilePath, data[:len(data)/2], 0664); err != nil {
+		t.Fatal(err)
+	}
+	cat = reopen(t, cat)
+	rec, err := cat.Contains(fileHash)
+	if err != nil || rec.Paused || rec.Progress.Count() != 1 {
+		t.Fatalf("Expected the previous index to be restored but got %v, %v\n", rec, err)
+	}
+	corrupt, err := os.ReadFile(indexFilePath + corruptSuffix)
+	if !bytes.Equal(corrupt, data[:len(data)/2]) {
+		t.Fatalf("Expected the damaged index to be kept but got %v\n", err)
+	}
+
+	// without a readable previous version, the catalogue starts empty rather than not at all
+	for _, suffix := range []string{"", backupSuffix} {
+		if err := os.WriteFile(indexFilePath+suffix, []byte(`{"Pid": 1, "Ind`), 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := reopen(t, cat).ListFiles()
+	if err != nil || len(files) != 0 {
+		t.Fatalf("Expected an empty catalogue but got %v, %v\n", files, err)
+	}
+}
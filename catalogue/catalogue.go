@@ -1,7 +1,9 @@
 package catalogue
 
 import (
+	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
 	"sync"
 
@@ -18,9 +20,18 @@ type Cat struct {
 	DataDir             string
 	DefaultDownloadsDir string
 	indexFile           *indexFile
+	chunkSize           int  // the size of the chunks newly shared files are split into
+	closed              bool // set by Close, after which nothing is written
 	lock                sync.Mutex
 }
 
+// ErrClosed is returned by methods that would change the catalogue after it has been closed
+var ErrClosed = errors.New("catalogue is closed")
+
+// ErrNotFound is returned by methods given the hash of a file that is not in the catalogue, which
+// is also what a download sees once its file has been unshared from under it
+var ErrNotFound = errors.New("file not found")
+
 // NewCat returns a Cat struct, initialized to the given data directory
 func NewCat(dir, downloadsDir string) (*Cat, error) {
 	cleanPath, err := filepath.Abs(dir)
@@ -36,15 +47,17 @@ func NewCat(dir, downloadsDir string) (*Cat, error) {
 		DataDir:             cleanPath,
 		DefaultDownloadsDir: cleanDownloadsDir,
 		indexFile:           nil,
+		chunkSize:           DefaultChunkSize,
 		lock:                sync.Mutex{},
 	}, nil
 }
 
 // Init initializes or attempts to acquire an exclusive user-space lock on the on-disk catalogue
-// data. Returns a descriptive error if unable to acquire a lock. This should be called before
-// invoking any other methods on Cat. Note, this lock is different from a mutex. Our user-space
-// lock indicates that the process is unique, not that this thread has exclusive access to some
-// resource.
+// data, repairing any of it that a crash left damaged. Returns a descriptive error if unable to
+// acquire a lock. This should be called before invoking any other methods on Cat, and the lock
+// held until Close by calling RenewLease every few seconds. Note, this lock is different from a
+// mutex. Our user-space lock indicates that the process is unique, not that this thread has
+// exclusive access to some resource.
 func (c *Cat) Init() error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -54,17 +67,99 @@ func (c *Cat) Init() error {
 	if err != nil {
 		return err
 	}
+	if err := c.repairProgressFiles(); err != nil {
+		c.indexFile.release()
+		return err
+	}
 	return nil
 }
 
+// repairProgressFiles loads the progress file of every file in the index, rebuilding those that
+// are missing or damaged. Progress files of newer versions are left alone, and fail to load when
+// they are used.
+func (c *Cat) repairProgressFiles() error {
+	for _, rec := range c.indexFile.index {
+		p, err := deserializeProgressFile(rec, c.DataDir)
+		if errors.Is(err, errCorruptProgress) || os.IsNotExist(err) {
+			fmt.Printf("Rebuilding progress of %s: %v\n", rec.FilePath, err)
+			p, err = rebuildProgressFile(rec, c.DataDir)
+			if err != nil {
+				return fmt.Errorf("failed to rebuild progress of %s: %v", rec.FilePath, err)
+			}
+		}
+		if err == nil {
+			rec.ProgressFile = p
+		}
+	}
+	return nil
+}
+
+// Close saves the index file and the progress of every file whose progress is loaded, and gives
+// up the catalogue so that another process can use it. The catalogue cannot be changed afterwards:
+// methods that would write to disk return ErrClosed from now on.
+// Writes already in progress finish first, so nothing is left half-written. Safe to call more than
+// once.
+func (c *Cat) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+
+	var result error
+	for _, rec := range c.indexFile.index {
+		if rec.ProgressFile == nil {
+			continue // never loaded, so never changed
+		}
+		if err := rec.ProgressFile.save(); err != nil && result == nil {
+			result = err
+		}
+	}
+	if err := c.indexFile.release(); err != nil && result == nil {
+		result = err
+	}
+	return result
+}
+
+// RenewLease keeps other processes from claiming the catalogue. It must be called every few
+// seconds for as long as the catalogue is in use, but only writes to disk when the lease is due to
+// be renewed.
+func (c *Cat) RenewLease() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	return c.indexFile.renew()
+}
+
+// SetChunkSize changes the size of the chunks files are split into when they are shared from now
+// on. Files that are already in the catalogue keep theirs. Sizes beyond MinChunkSize and
+// MaxChunkSize are raised or lowered to them.
+func (c *Cat) SetChunkSize(size int) {
+	if size < MinChunkSize {
+		size = MinChunkSize
+	}
+	if size > MaxChunkSize {
+		size = MaxChunkSize
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.chunkSize = size
+}
+
 // ShareFile generates an IndexRecord for the given filepath (unless an identical file has
 // already been shared) and refreshes the inderlying indexFile. Sharing a file assumes that the
 // file has been downloaded completely.
 func (c *Cat) ShareFile(path string) (*indexRecord, error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
+	if c.closed {
+		return nil, ErrClosed
+	}
 
-	record, err := generateIndexRecordForFile(path)
+	record, err := generateIndexRecordForFile(path, c.chunkSize)
 	if err != nil {
 		return nil, err
 	}
@@ -89,6 +184,9 @@ func (c *Cat) ShareFile(path string) (*indexRecord, error) {
 func (c *Cat) UnshareFile(hash *common.Sha1Hash) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
 
 	rec, err := c.getIndexRecord(hash)
 	if err != nil {
@@ -108,17 +206,66 @@ func (c *Cat) UnshareFile(hash *common.Sha1Hash) error {
 	return nil
 }
 
+// DeleteDownload removes a download from flu's index and deletes both its progress file and the
+// (possibly partial) file it was being downloaded to. Unlike UnshareFile, the file itself is
+// affected, so callers should make sure the download is not complete and no transfers are running.
+func (c *Cat) DeleteDownload(hash *common.Sha1Hash) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+
+	rec, err := c.getIndexRecord(hash)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(rec.FilePath)
+	if err != nil && !os.IsNotExist(err) { // nothing may have been downloaded yet
+		return err
+	}
+
+	err = rec.ProgressFile.delete()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return c.indexFile.RemoveIndexRecord(rec)
+}
+
 // RegisterDownload creates a record of the download in flu's index. This is identical to
-// c.ShareFile except that the progress file will register an empty bitset.
+// c.ShareFile except that the progress file will register an empty bitset. chunkHashes is the
+// trusted hash of every chunk, which chunks are checked against before they are saved. It may be
+// empty if no peer could supply it, in which case chunks are checked against merkleRoot with an
+// inclusion proof instead, or not at all if merkleRoot is nil too. If both are given they must
+// agree.
 func (c *Cat) RegisterDownload(
 	sizeInBytes uint64,
 	chunkCount uint32,
 	chunkSizeInBytes uint32,
 	sha1Hash *common.Sha1Hash,
 	filename string,
+	chunkHashes []common.Sha1Hash,
+	merkleRoot *common.Sha1Hash,
 ) (*IndexRecordExport, error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
+	if c.closed {
+		return nil, ErrClosed
+	}
+
+	if len(chunkHashes) != 0 && len(chunkHashes) != int(chunkCount) {
+		return nil, fmt.Errorf("expected %d chunk hashes but got %d", chunkCount, len(chunkHashes))
+	}
+	if len(chunkHashes) != 0 && merkleRoot != nil &&
+		common.MerkleRoot(chunkHashes).Data != merkleRoot.Data {
+		return nil, fmt.Errorf("chunk hashes of %s do not match merkle root %s",
+			sha1Hash.String(), merkleRoot.String())
+	}
+	if len(chunkHashes) != 0 && merkleRoot == nil {
+		merkleRoot = common.MerkleRoot(chunkHashes)
+	}
 
 	indexRecord := indexRecord{
 		FilePath:     filepath.Join(c.DefaultDownloadsDir, filename),
@@ -126,6 +273,8 @@ func (c *Cat) RegisterDownload(
 		Sha1Hash:     *sha1Hash,
 		ProgressFile: nil,
 		ChunkSize:    int(chunkSizeInBytes),
+		ChunkHashes:  chunkHashes,
+		MerkleRoot:   copyHash(merkleRoot),
 	}
 
 	err := c.indexFile.AddIndexRecord(&indexRecord)
@@ -134,7 +283,7 @@ func (c *Cat) RegisterDownload(
 	}
 
 	indexRecord.ProgressFile = newProgressFile(&indexRecord, c.DataDir)
-	indexRecord.ProgressFile.save()
+	err = indexRecord.ProgressFile.save()
 	if err != nil {
 		return nil, err
 	}
@@ -168,11 +317,17 @@ func (c *Cat) ListFiles() ([]IndexRecordExport, error) {
 // Rehash attempts to recalculate the hash for a given indexRecord. If it fails, a blank hash and an
 // error are returned.
 func (c *Cat) Rehash(hash *common.Sha1Hash) (*common.Sha1Hash, error) {
+	c.lock.Lock()
 	rec, err := c.getIndexRecord(hash)
 	if err != nil {
+		c.lock.Unlock()
 		return nil, err
 	}
-	currentHash, err := common.HashFile(rec.FilePath)
+	path := rec.FilePath
+	c.lock.Unlock()
+
+	// files can be large, so they are hashed without holding the lock
+	currentHash, err := common.HashFile(path)
 	if err != nil {
 		return (&common.Sha1Hash{}).Blank(), err
 	}
@@ -200,33 +355,73 @@ func (c *Cat) Get(hash *common.Sha1Hash) *IndexRecordExport {
 	return result
 }
 
-func (c *Cat) FileComplete(hash *common.Sha1Hash) bool {
+// SetPaused records whether the user has paused the download of the specified file. Paused
+// downloads are not resumed automatically when the daemon restarts.
+func (c *Cat) SetPaused(hash *common.Sha1Hash, paused bool) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
 	ir, err := c.getIndexRecord(hash)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if ir.Paused == paused {
+		return nil
+	}
+	ir.Paused = paused
+	return c.indexFile.save()
+}
+
+// FileComplete reports whether every chunk of the given file has been saved. Returns ErrNotFound
+// if the file is not in the catalogue.
+func (c *Cat) FileComplete(hash *common.Sha1Hash) (bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ir, err := c.getIndexRecord(hash)
+	if err != nil {
+		return false, err
 	}
-	return ir.ProgressFile.Full()
+	return ir.ProgressFile.Full(), nil
 }
 
-// MissingChunks returns a list of ranges of missing chunks for the given hash
+// MissingChunks returns a list of ranges of missing chunks for the given hash, or nil if the file
+// is not in the catalogue
 func (c *Cat) MissingChunks(hash *common.Sha1Hash, maxCount int) []common.Range {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	ir, err := c.getIndexRecord(hash)
 	if err != nil {
-		panic(err)
+		return nil
 	}
 	return ir.ProgressFile.progress.UnfilledRanges()
 }
 
-func (c *Cat) SaveChunk(hash *common.Sha1Hash, chunk uint16, data []byte) error {
+// SaveChunk writes a downloaded chunk to disk and marks it in the progress file. If the file has
+// chunk hashes and the data does not match, nothing is written and an error wrapping
+// ErrCorruptChunk is returned. proof is the chunk's inclusion proof against the file's merkle
+// root, which is only needed (and then required) if the file has a merkle root but no chunk
+// hashes; see IndexRecordExport.NeedsProofs. Returns ErrNotFound if the file has been unshared.
+func (c *Cat) SaveChunk(
+	hash *common.Sha1Hash,
+	chunk uint32,
+	data []byte,
+	proof []common.Sha1Hash,
+) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
 	ir, err := c.getIndexRecord(hash)
 	if err != nil {
-		panic(err)
+		return err
+	}
+
+	err = ir.verifyChunk(int64(chunk), data, proof)
+	if err != nil {
+		return err
 	}
 
 	err = ir.saveChunk(int64(chunk), data)
@@ -238,6 +433,173 @@ func (c *Cat) SaveChunk(hash *common.Sha1Hash, chunk uint16, data []byte) error
 	return ir.ProgressFile.save()
 }
 
+// ChunkLength returns the length in bytes of a chunk of the specified file: its chunk size, or
+// whatever is left of the file for the last chunk
+func (c *Cat) ChunkLength(hash *common.Sha1Hash, chunk uint32) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ir, err := c.getIndexRecord(hash)
+	if err != nil {
+		return 0, err
+	}
+	if int64(chunk) >= int64(ir.ProgressFile.Size()) {
+		return 0, fmt.Errorf("chunk %d out of range: %s has %d chunks", chunk, hash.String(),
+			ir.ProgressFile.Size())
+	}
+	return int(ir.chunkLength(int64(chunk))), nil
+}
+
+// ChunkHashes returns the hash of every chunk of the specified file. Files that were shared before
+// chunk hashes existed have them computed (and checked against the file's hash) on first use,
+// which takes a while for large files. Incomplete downloads without chunk hashes return an error.
+func (c *Cat) ChunkHashes(hash *common.Sha1Hash) ([]common.Sha1Hash, error) {
+	c.lock.Lock()
+	ir, err := c.getIndexRecord(hash)
+	if err != nil {
+		c.lock.Unlock()
+		return nil, err
+	}
+	if len(ir.ChunkHashes) > 0 {
+		result := append([]common.Sha1Hash{}, ir.ChunkHashes...)
+		c.lock.Unlock()
+		return result, nil
+	}
+	if !ir.ProgressFile.Full() {
+		c.lock.Unlock()
+		return nil, fmt.Errorf("no chunk hashes known for incomplete file %s", hash.String())
+	}
+	path, chunkSize := ir.FilePath, ir.ChunkSize
+	c.lock.Unlock()
+
+	// hash without holding the lock, as it could take minutes
+	fileHash, chunkHashes, err := common.HashFileChunks(path, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	if fileHash.Data != hash.Data {
+		return nil, fmt.Errorf("%s has changed since it was shared", path)
+	}
+	if err := c.SetChunkHashes(hash, chunkHashes); err != nil {
+		return nil, err
+	}
+	return chunkHashes, nil
+}
+
+// SetChunkHashes records the hash of every chunk of the specified file, so that chunks are checked
+// before they are saved. Chunks that were saved before are not rechecked. If the file already has
+// a merkle root the chunk hashes must match it; otherwise the root is derived from them.
+func (c *Cat) SetChunkHashes(hash *common.Sha1Hash, chunkHashes []common.Sha1Hash) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	ir, err := c.getIndexRecord(hash)
+	if err != nil {
+		return err
+	}
+	if len(chunkHashes) != ir.ProgressFile.Size() {
+		return fmt.Errorf("expected %d chunk hashes but got %d",
+			ir.ProgressFile.Size(), len(chunkHashes))
+	}
+	root := common.MerkleRoot(chunkHashes)
+	if ir.MerkleRoot != nil && ir.MerkleRoot.Data != root.Data {
+		return fmt.Errorf("chunk hashes of %s do not match merkle root %s",
+			hash.String(), ir.MerkleRoot.String())
+	}
+	ir.ChunkHashes = append([]common.Sha1Hash{}, chunkHashes...)
+	ir.MerkleRoot = root
+	return c.indexFile.save()
+}
+
+// RestartDownload throws away everything downloaded of the specified file, and replaces the chunk
+// hashes and merkle root its chunks are checked against, either or both of which may be nil. It is
+// meant for downloads that did not match their hash once complete, whose chunks must have been
+// checked against hashes that were not the file's. If both are given they must agree.
+func (c *Cat) RestartDownload(
+	hash *common.Sha1Hash,
+	chunkHashes []common.Sha1Hash,
+	merkleRoot *common.Sha1Hash,
+) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	ir, err := c.getIndexRecord(hash)
+	if err != nil {
+		return err
+	}
+	if len(chunkHashes) != 0 && len(chunkHashes) != ir.ProgressFile.Size() {
+		return fmt.Errorf("expected %d chunk hashes but got %d",
+			ir.ProgressFile.Size(), len(chunkHashes))
+	}
+	if len(chunkHashes) != 0 && merkleRoot != nil &&
+		common.MerkleRoot(chunkHashes).Data != merkleRoot.Data {
+		return fmt.Errorf("chunk hashes of %s do not match merkle root %s",
+			hash.String(), merkleRoot.String())
+	}
+	if len(chunkHashes) != 0 && merkleRoot == nil {
+		merkleRoot = common.MerkleRoot(chunkHashes)
+	}
+
+	// forget the chunks first: they must never be taken for the file's, whatever they are checked
+	// against next
+	ir.ProgressFile = newProgressFile(ir, c.DataDir)
+	if err := ir.ProgressFile.save(); err != nil {
+		return err
+	}
+	ir.ChunkHashes = append([]common.Sha1Hash{}, chunkHashes...)
+	ir.MerkleRoot = copyHash(merkleRoot)
+	return c.indexFile.save()
+}
+
+// SetMerkleRoot records the merkle root of the specified file. If the file has chunk hashes they
+// must match it, and a file's merkle root never changes once it is known.
+func (c *Cat) SetMerkleRoot(hash *common.Sha1Hash, root *common.Sha1Hash) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	ir, err := c.getIndexRecord(hash)
+	if err != nil {
+		return err
+	}
+	if ir.MerkleRoot != nil {
+		if ir.MerkleRoot.Data != root.Data {
+			return fmt.Errorf("%s has merkle root %s, not %s", hash.String(),
+				ir.MerkleRoot.String(), root.String())
+		}
+		return nil
+	}
+	if len(ir.ChunkHashes) > 0 && common.MerkleRoot(ir.ChunkHashes).Data != root.Data {
+		return fmt.Errorf("chunk hashes of %s do not match merkle root %s",
+			hash.String(), root.String())
+	}
+	ir.MerkleRoot = copyHash(root)
+	return c.indexFile.save()
+}
+
+// MerkleProof returns the merkle root of the specified file, its number of chunks, and the
+// inclusion proof of the given chunk. Like ChunkHashes, it fails for incomplete downloads without
+// chunk hashes.
+func (c *Cat) MerkleProof(
+	hash *common.Sha1Hash,
+	chunk int,
+) (*common.Sha1Hash, int, []common.Sha1Hash, error) {
+	chunkHashes, err := c.ChunkHashes(hash)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if chunk < 0 || chunk >= len(chunkHashes) {
+		return nil, 0, nil, fmt.Errorf("chunk %d out of range: %s has %d chunks", chunk,
+			hash.String(), len(chunkHashes))
+	}
+	tree := common.NewMerkleTree(chunkHashes)
+	return tree.Root(), len(chunkHashes), tree.Proof(chunk), nil
+}
+
 func (c *Cat) GetChunkReader(hash *common.Sha1Hash, chunk int64) (*common.ChunkReader, error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -253,7 +615,7 @@ func (c *Cat) getIndexRecord(hash *common.Sha1Hash) (*indexRecord, error) {
 		result, err := c.fill(record)
 		return result, err
 	}
-	return nil, fmt.Errorf("file not found")
+	return nil, ErrNotFound
 }
 
 func (c *Cat) fill(rec *indexRecord) (*indexRecord, error) {
@@ -0,0 +1,330 @@
+package catalogue
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/flu-network/client/common"
+	"github.com/flu-network/client/common/bitset"
+)
+
+func TestSaveChunkVerifiesHash(t *testing.T) {
+	parentDir := filepath.Join(string(os.PathSeparator), "tmp", "flu-client-savechunk")
+	defer os.RemoveAll(parentDir)
+	os.RemoveAll(parentDir)
+
+	cat, err := NewCat(filepath.Join(parentDir, "catalogue"), filepath.Join(parentDir, "downloads"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cat.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	chunks := [][]byte{[]byte("hello "), []byte("world")}
+	chunkHashes := make([]common.Sha1Hash, len(chunks))
+	for i, c := range chunks {
+		chunkHashes[i].Data = sha1.Sum(c)
+	}
+	fileHash := sha1HashString("hello world")
+	rec, err := cat.RegisterDownload(11, 2, 6, fileHash, "hello.txt", chunkHashes, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rec.HasChunkHashes || rec.NeedsProofs() {
+		t.Fatalf("Expected registered download to have chunk hashes\n")
+	}
+	if rec.MerkleRoot == nil || *rec.MerkleRoot != *common.MerkleRoot(chunkHashes) {
+		t.Fatalf("Expected merkle root to be derived from the chunk hashes but got %v\n",
+			rec.MerkleRoot)
+	}
+
+	err = cat.SaveChunk(fileHash, 0, []byte("jello "), nil)
+	if !errors.Is(err, ErrCorruptChunk) {
+		t.Fatalf("Expected corrupt chunk to be rejected but got %v\n", err)
+	}
+	if missing := cat.MissingChunks(fileHash, 0); len(missing) != 1 || missing[0].Start != 0 {
+		t.Fatalf("Expected corrupt chunk to remain missing but missing chunks are %v\n", missing)
+	}
+
+	for i, c := range chunks {
+		if err := cat.SaveChunk(fileHash, uint32(i), c, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if complete, err := cat.FileComplete(fileHash); !complete || err != nil {
+		t.Fatalf("Expected file to be complete but got %v, %v\n", complete, err)
+	}
+
+	saved, err := cat.ChunkHashes(fileHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 2 || saved[0] != chunkHashes[0] || saved[1] != chunkHashes[1] {
+		t.Fatalf("Expected chunk hashes %v but got %v\n", chunkHashes, saved)
+	}
+
+	// a download whose file is unshared from under it gets an error rather than a panic
+	if err := cat.UnshareFile(fileHash); err != nil {
+		t.Fatal(err)
+	}
+	if err := cat.SaveChunk(fileHash, 0, chunks[0], nil); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected an unshared file's chunk to be rejected but got %v\n", err)
+	}
+	if _, err := cat.FileComplete(fileHash); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected an unshared file not to be found but got %v\n", err)
+	}
+}
+
+func TestSaveChunkVerifiesLength(t *testing.T) {
+	parentDir := t.TempDir()
+	cat, err := NewCat(filepath.Join(parentDir, "catalogue"), filepath.Join(parentDir, "downloads"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cat.Init(); err != nil {
+		t.Fatal(err)
+	}
+	// without chunk hashes or a merkle root, the length is all that can be checked
+	fileHash := sha1HashString("hello world")
+	rec, err := cat.RegisterDownload(11, 2, 6, fileHash, "hello.txt", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for chunk, expected := range []int{6, 5} {
+		if length, err := cat.ChunkLength(fileHash, uint32(chunk)); err != nil || length != expected {
+			t.Fatalf("Expected chunk %d to be %d bytes long but got %d, %v\n", chunk, expected,
+				length, err)
+		}
+	}
+	if _, err := cat.ChunkLength(fileHash, 2); err == nil {
+		t.Fatal("Expected a chunk past the end of the file to have no length")
+	}
+
+	if err := cat.SaveChunk(fileHash, 1, []byte("world"), nil); err != nil {
+		t.Fatal(err)
+	}
+	for chunk, data := range map[uint32]string{0: "hello world!", 1: "worl"} {
+		err := cat.SaveChunk(fileHash, chunk, []byte(data), nil)
+		if !errors.Is(err, ErrCorruptChunk) {
+			t.Fatalf("Expected chunk %d of the wrong length to be rejected but got %v\n", chunk, err)
+		}
+	}
+	if err := cat.SaveChunk(fileHash, 0, []byte("hello "), nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(rec.FilePath); err != nil || string(data) != "hello world" {
+		t.Fatalf("Expected 'hello world' but got '%s', %v\n", data, err)
+	}
+}
+
+func TestSaveChunkVerifiesMerkleProof(t *testing.T) {
+	parentDir := filepath.Join(string(os.PathSeparator), "tmp", "flu-client-savechunk-merkle")
+	defer os.RemoveAll(parentDir)
+	os.RemoveAll(parentDir)
+
+	cat, err := NewCat(filepath.Join(parentDir, "catalogue"), filepath.Join(parentDir, "downloads"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cat.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	chunks := [][]byte{[]byte("hel"), []byte("lo "), []byte("wor"), []byte("ld")}
+	chunkHashes := make([]common.Sha1Hash, len(chunks))
+	for i, c := range chunks {
+		chunkHashes[i].Data = sha1.Sum(c)
+	}
+	tree := common.NewMerkleTree(chunkHashes)
+	fileHash := sha1HashString("hello world")
+
+	// only the merkle root is known, so every chunk needs a proof
+	rec, err := cat.RegisterDownload(11, 4, 3, fileHash, "hello.txt", nil, tree.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rec.NeedsProofs() {
+		t.Fatalf("Expected a download with only a merkle root to need proofs\n")
+	}
+
+	if err := cat.SaveChunk(fileHash, 1, chunks[1], nil); !errors.Is(err, ErrCorruptChunk) {
+		t.Fatalf("Expected chunk without a proof to be rejected but got %v\n", err)
+	}
+	if err := cat.SaveChunk(fileHash, 1, chunks[1], tree.Proof(2)); !errors.Is(err, ErrCorruptChunk) {
+		t.Fatalf("Expected chunk with another chunk's proof to be rejected but got %v\n", err)
+	}
+	err = cat.SaveChunk(fileHash, 1, []byte("LO "), tree.Proof(1))
+	if !errors.Is(err, ErrCorruptChunk) {
+		t.Fatalf("Expected corrupt chunk to be rejected but got %v\n", err)
+	}
+
+	for i, c := range chunks {
+		if err := cat.SaveChunk(fileHash, uint32(i), c, tree.Proof(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if complete, err := cat.FileComplete(fileHash); !complete || err != nil {
+		t.Fatalf("Expected file to be complete but got %v, %v\n", complete, err)
+	}
+
+	// once complete, the file can serve proofs of its own
+	root, chunkCount, proof, err := cat.MerkleProof(fileHash, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *root != *tree.Root() || chunkCount != 4 ||
+		!common.VerifyMerkleProof(root, &chunkHashes[3], 3, chunkCount, proof) {
+		t.Fatalf("Unexpected merkle proof %v for root %v\n", proof, root)
+	}
+
+	if err := cat.SetMerkleRoot(fileHash, sha1HashString("something else")); err == nil {
+		t.Fatalf("Expected merkle root not to change once known\n")
+	}
+}
+
+func TestLegacyProgressFileMigration(t *testing.T) {
+	parentDir := filepath.Join(string(os.PathSeparator), "tmp", "flu-client-progressfile")
+	defer os.RemoveAll(parentDir)
+	os.RemoveAll(parentDir)
+
+	catalogueDir := filepath.Join(parentDir, "catalogue")
+	downloadDir := filepath.Join(parentDir, "downloads")
+	cat, err := NewCat(catalogueDir, downloadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cat.Init(); err != nil {
+		t.Fatal(err)
+	}
+	fileHash := sha1HashString("a very large file")
+	chunkCount := uint32(70000)
+	if _, err := cat.RegisterDownload(
+		uint64(chunkCount)*4, chunkCount, 4, fileHash, "large.bin", nil, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err := cat.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// overwrite the progress file with one in the format used before it had a header
+	legacy := bitset.NewBitset(int(chunkCount)).Set(3).Set(66000)
+	progressFilePath := filepath.Join(catalogueDir, fileHash.String())
+	if err := os.WriteFile(progressFilePath, legacy.Serialize(), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	cat, err = NewCat(catalogueDir, downloadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cat.Init(); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := cat.Contains(fileHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Progress.Size() != int(chunkCount) || rec.Progress.Count() != 2 ||
+		!rec.Progress.Get(66000) {
+		t.Fatalf("Expected legacy progress to be read but got %d of %d chunks\n",
+			rec.Progress.Count(), rec.Progress.Size())
+	}
+
+	data, err := os.ReadFile(progressFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte{'f', 'l', 'u', 'p', progressFileVersion}) {
+		t.Fatalf("Expected progress file to be migrated but it starts with %x\n", data[:8])
+	}
+
+	if err := cat.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data[4] = progressFileVersion + 1
+	if err := os.WriteFile(progressFilePath, data, 0664); err != nil {
+		t.Fatal(err)
+	}
+	cat, _ = NewCat(catalogueDir, downloadDir)
+	if err := cat.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cat.Contains(fileHash); err == nil {
+		t.Fatalf("Expected a progress file from a newer version to be rejected\n")
+	}
+}
+
+func TestSetChunkSize(t *testing.T) {
+	parentDir := t.TempDir()
+	cat, err := NewCat(filepath.Join(parentDir, "catalogue"), filepath.Join(parentDir, "downloads"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cat.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(parentDir, "file.bin")
+	if err := os.WriteFile(path, bytes.Repeat([]byte("flu"), 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cat.SetChunkSize(1) // too small, so the smallest size is used instead
+	rec, err := cat.ShareFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.ChunkSize != MinChunkSize || len(rec.ChunkHashes) != 3 {
+		t.Fatalf("Expected %d chunks of %d bytes but got %d of %d\n", 3, MinChunkSize,
+			len(rec.ChunkHashes), rec.ChunkSize)
+	}
+}
+
+func TestClose(t *testing.T) {
+	parentDir := t.TempDir()
+	cat, err := NewCat(filepath.Join(parentDir, "catalogue"), filepath.Join(parentDir, "downloads"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cat.Init(); err != nil {
+		t.Fatal(err)
+	}
+	fileHash := sha1HashString("hello world")
+	if _, err := cat.RegisterDownload(11, 2, 6, fileHash, "hello.txt", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := cat.SaveChunk(fileHash, 0, []byte("hello "), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cat.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cat.Close(); err != nil {
+		t.Fatalf("Expected closing twice to be harmless but got %v\n", err)
+	}
+	if err := cat.SaveChunk(fileHash, 1, []byte("world"), nil); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Expected a closed catalogue to refuse chunks but got %v\n", err)
+	}
+	if err := cat.SetPaused(fileHash, true); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Expected a closed catalogue to refuse changes but got %v\n", err)
+	}
+
+	// everything saved before it was closed is there when it is opened again
+	reopened, err := NewCat(cat.DataDir, cat.DefaultDownloadsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.Init(); err != nil {
+		t.Fatal(err)
+	}
+	missing := reopened.MissingChunks(fileHash, 0)
+	if len(missing) != 1 || missing[0].Start != 1 || missing[0].End != 1 {
+		t.Fatalf("Expected only chunk 1 to be missing but got %v\n", missing)
+	}
+}
@@ -0,0 +1,27 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package catalogue
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on an open file, which the operating system releases when the
+// file is closed or the process exits. Returns errLocked if another open file holds it, and false
+// if the file system does not support locks.
+func lockFile(f *os.File) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, syscall.EWOULDBLOCK):
+		return false, errLocked
+	case errors.Is(err, syscall.ENOLCK), errors.Is(err, syscall.ENOTSUP),
+		errors.Is(err, syscall.EOPNOTSUPP):
+		return false, nil
+	default:
+		return false, err
+	}
+}
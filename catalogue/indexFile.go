@@ -2,6 +2,7 @@ package catalogue
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -13,6 +14,27 @@ import (
 
 const indexFileName = "index.json"
 
+// The previous version of the index file is kept with backupSuffix, and index files that cannot
+// be read are moved aside with corruptSuffix
+const (
+	backupSuffix  = ".bak"
+	corruptSuffix = ".corrupt"
+)
+
+// The index file is leased to the process that uses it: the process claims it by writing its pid,
+// and renews its claim by updating lastTouched every leaseRenewal. Other processes may only claim
+// it once the lease has not been renewed for leaseDuration. Where the operating system supports
+// it, the lock file (named lockFileName) is also locked for as long as the index is in use, so that
+// a process that dies releases its claim at once.
+const (
+	leaseDuration = 30 * time.Second
+	leaseRenewal  = 10 * time.Second
+	lockFileName  = "lock"
+)
+
+// errLocked is returned when another process has locked the lock file
+var errLocked = errors.New("locked by another process")
+
 // indexFile is the in-memory representation of the index. The index maps the sha1 hash of a file
 // to the IndexRecord associated with that file. All methods assume the caller has acquired
 // a mutex granting exclusive access.
@@ -24,10 +46,11 @@ type indexFile struct {
 	lastTouched int64 // should be updated regularly by the owner
 	index       map[common.Sha1Hash]*indexRecord
 	dataDir     string
+	lock        *os.File // the open lock file, held until release
 }
 
 // Init attempts to safely claim ownnership of the index file if it already exists. If it
-// does not exist, an index file is created.
+// does not exist, an index file is created. Fails if another process owns it.
 func (ind *indexFile) Init(dataDir string) error {
 	// ensure directory exists
 	if err := os.MkdirAll(dataDir, os.ModePerm); err != nil {
@@ -43,50 +66,158 @@ func (ind *indexFile) Init(dataDir string) error {
 		return fmt.Errorf("DataDir '%s' is not a directory", dataDir)
 	}
 
+	// nothing may be changed until the index is ours
+	if err := ind.claim(dataDir); err != nil {
+		return err
+	}
+
+	// writes that were cut short by a crash left the files they were replacing intact
+	if err := removeTemporaryFiles(dataDir); err != nil {
+		ind.release()
+		return err
+	}
+
 	// ensure the file exists
 	indexFilePath := filepath.Join(dataDir, indexFileName)
-	_, err = os.Stat(indexFilePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			// create it if it doesn't exist
-			ind.pid = os.Getpid()
-			ind.lastTouched = time.Now().Unix()
-			ind.index = map[common.Sha1Hash]*indexRecord{}
-			ind.dataDir = dataDir
-
-			err := ind.save()
-			if err != nil {
-				return err
-			}
-		} else {
-			// if there's some other error just bail out
+	data, err := os.ReadFile(indexFilePath)
+	if os.IsNotExist(err) {
+		// create it if it doesn't exist
+		ind.reset(dataDir)
+	} else if err != nil {
+		// if there's some other error just bail out
+		ind.release()
+		return err
+	} else if err := ind.UnmarshalJSON(data); err != nil {
+		err = ind.restore(dataDir, err)
+		if err != nil {
+			ind.release()
 			return err
 		}
 	}
 
-	data, err := os.ReadFile(indexFilePath)
+	ind.pid = os.Getpid()
+	ind.lastTouched = time.Now().Unix()
+	if err := ind.save(); err != nil {
+		ind.release()
+		return err
+	}
+	return nil
+}
+
+// claim locks the lock file, or, where it cannot be locked, checks that no other process holds the
+// lease on the index. Returns a descriptive error if another process owns the index.
+func (ind *indexFile) claim(dataDir string) error {
+	// the last owner, if the index can be read. Damaged indexes are claimed regardless
+	owner := indexFile{}
+	indexFilePath := filepath.Join(dataDir, indexFileName)
+	if data, err := os.ReadFile(indexFilePath); err == nil {
+		owner.UnmarshalJSON(data)
+	}
+	inUse := func() error {
+		return fmt.Errorf("catalogue %s is in use by another flu daemon (pid %d). Stop it, or "+
+			"give this daemon a catalogue directory of its own", dataDir, owner.pid)
+	}
+
+	lock, err := os.OpenFile(filepath.Join(dataDir, lockFileName), os.O_RDWR|os.O_CREATE, 0664)
 	if err != nil {
 		return err
 	}
+	locked, err := lockFile(lock)
+	if errors.Is(err, errLocked) {
+		lock.Close()
+		return inUse()
+	} else if err != nil {
+		lock.Close()
+		return err
+	}
+	ind.lock = lock
+	if locked {
+		return nil // whoever held the lease has stopped, or it would still hold the lock
+	}
 
-	err = ind.UnmarshalJSON(data)
-	// TODO: assert ownership
-	return err
+	if owner.leased() {
+		ind.release()
+		return inUse()
+	}
+	return nil
 }
 
-func (ind *indexFile) save() error {
-	data, err := json.Marshal(ind)
-	if err != nil {
+// leased returns true if another process holds the lease on the index: it claimed the index and
+// has not released it, and last renewed its lease less than leaseDuration ago
+func (ind *indexFile) leased() bool {
+	touched := time.Since(time.Unix(ind.lastTouched, 0))
+	return ind.pid != 0 && ind.pid != os.Getpid() && touched < leaseDuration
+}
+
+// renew renews the lease on the index, if it is due to be renewed
+func (ind *indexFile) renew() error {
+	if time.Since(time.Unix(ind.lastTouched, 0)) < leaseRenewal {
+		return nil
+	}
+	ind.lastTouched = time.Now().Unix()
+	return ind.save()
+}
+
+// release saves the index and gives it up, so that another process can claim it straight away
+func (ind *indexFile) release() error {
+	if ind.lock == nil {
+		return nil
+	}
+	var result error
+	if ind.index != nil && ind.pid == os.Getpid() {
+		ind.pid, ind.lastTouched = 0, 0
+		result = ind.save()
+	}
+	if err := ind.lock.Close(); err != nil && result == nil {
+		result = err
+	}
+	ind.lock = nil
+	return result
+}
+
+// reset empties the index, and makes the running process its owner
+func (ind *indexFile) reset(dataDir string) {
+	ind.pid = os.Getpid()
+	ind.lastTouched = time.Now().Unix()
+	ind.index = map[common.Sha1Hash]*indexRecord{}
+	ind.dataDir = dataDir
+}
+
+// restore replaces an index file that cannot be read, e.g., because it was truncated by a crash,
+// with the backup of its previous version if that can be read, or else with an empty index. The
+// unreadable file is kept alongside it with the corruptSuffix.
+func (ind *indexFile) restore(dataDir string, cause error) error {
+	indexFilePath := filepath.Join(dataDir, indexFileName)
+	if err := os.Rename(indexFilePath, indexFilePath+corruptSuffix); err != nil {
 		return err
 	}
 
-	indexFilePath := filepath.Join(ind.dataDir, indexFileName)
-	err = os.WriteFile(indexFilePath, data, 0664)
+	data, err := os.ReadFile(indexFilePath + backupSuffix)
+	if err == nil {
+		err = ind.UnmarshalJSON(data)
+	}
+	if err == nil {
+		fmt.Printf("%s is corrupt (%v). Restored its previous version\n", indexFilePath, cause)
+	} else {
+		ind.reset(dataDir)
+		fmt.Printf("%s is corrupt (%v) and has no readable backup. Started an empty index. The "+
+			"corrupt file was kept as %s\n", indexFilePath, cause, indexFilePath+corruptSuffix)
+	}
+	return ind.save()
+}
+
+// save writes the index file atomically. The version it replaces is kept with the backupSuffix,
+// so that the index can be restored if the file is ever damaged anyway.
+func (ind *indexFile) save() error {
+	data, err := json.Marshal(ind)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	indexFilePath := filepath.Join(ind.dataDir, indexFileName)
+	os.Remove(indexFilePath + backupSuffix)
+	os.Link(indexFilePath, indexFilePath+backupSuffix) // best effort: not every file system can
+	return writeFileAtomic(indexFilePath, data, 0664)
 }
 
 // AddIndexRecord adds an indexRecord to the underlying file, and reloads the in-memory
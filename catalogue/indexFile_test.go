@@ -29,6 +29,9 @@ func TestMarshalling(t *testing.T) {
 		SizeInBytes:  13243546,
 		Sha1Hash:     *sha1HashString("bat"),
 		ProgressFile: nil,
+		Paused:       true,
+		ChunkHashes:  []common.Sha1Hash{*sha1HashString("b"), *sha1HashString("at")},
+		MerkleRoot:   sha1HashString("root"),
 	}
 
 	// serialize it
@@ -85,7 +88,73 @@ func TestInit(t *testing.T) {
 		}
 	})
 
-	// TODO: cover the unhappy cases
+	t.Run("Fails while another process owns the file", func(t *testing.T) {
+		cleanup()
+		defer cleanup()
+		owner := &indexFile{}
+		if err := owner.Init(dataDir); err != nil {
+			t.Fatal(err)
+		}
+		if locked, _ := lockFile(owner.lock); !locked {
+			t.Skip("files cannot be locked here, and this process may claim its own lease")
+		}
+
+		// the owner locks the file through another open file, as another process would
+		if err := (&indexFile{}).Init(dataDir); err == nil {
+			t.Fatalf("Expected a second owner to be refused\n")
+		}
+
+		if err := owner.release(); err != nil {
+			t.Fatal(err)
+		}
+		next := &indexFile{}
+		if err := next.Init(dataDir); err != nil {
+			t.Fatalf("Expected a released file to be claimed but got %v\n", err)
+		}
+		next.release()
+	})
+}
+
+func TestLease(t *testing.T) {
+	now, stale := time.Now().Unix(), time.Now().Add(-leaseDuration).Unix()
+	testCases := []struct {
+		name     string
+		subject  indexFile
+		expected bool
+	}{
+		{"another process", indexFile{pid: os.Getpid() + 1, lastTouched: now}, true},
+		{"this process", indexFile{pid: os.Getpid(), lastTouched: now}, false},
+		{"expired", indexFile{pid: os.Getpid() + 1, lastTouched: stale}, false},
+		{"released", indexFile{pid: 0, lastTouched: 0}, false},
+	}
+	for _, tc := range testCases {
+		if result := tc.subject.leased(); result != tc.expected {
+			t.Fatalf("%s: Expected leased to be %v but got %v\n", tc.name, tc.expected, result)
+		}
+	}
+
+	dir := t.TempDir()
+	subject := &indexFile{}
+	if err := subject.Init(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer subject.release()
+	subject.lastTouched = stale
+	if err := subject.renew(); err != nil {
+		t.Fatal(err)
+	}
+	saved := indexFile{}
+	data, err := os.ReadFile(filepath.Join(dir, indexFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saved.UnmarshalJSON(data); err != nil {
+		t.Fatal(err)
+	}
+	if saved.pid != os.Getpid() || time.Now().Unix()-saved.lastTouched > 1 {
+		t.Fatalf("Expected the renewed lease to be saved but got pid %d, lastTouched %d\n",
+			saved.pid, saved.lastTouched)
+	}
 }
 
 func sha1HashString(str string) *common.Sha1Hash {
@@ -1,6 +1,8 @@
 package catalogue
 
 import (
+	"crypto/sha1"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -10,7 +12,16 @@ import (
 	"github.com/flu-network/client/common/bitset"
 )
 
-const defaultChunkSize = int(1 << 22) // 4mb in bytes
+// DefaultChunkSize is the size of the chunks files are split into when they are shared, unless
+// the Cat is told otherwise. MinChunkSize and MaxChunkSize bound the sizes it can be told.
+const (
+	DefaultChunkSize = int(1 << 22) // 4mb in bytes
+	MinChunkSize     = int(1 << 10)
+	MaxChunkSize     = int(1 << 30)
+)
+
+// ErrCorruptChunk is returned when a chunk's data does not match its hash
+var ErrCorruptChunk = errors.New("chunk does not match its hash")
 
 // indexRecord describes a file that is 'known' by the flu client. The existence of an indexRecord
 // does not imply that the file exists locally. To find out which chunks of the file are
@@ -23,6 +34,14 @@ type indexRecord struct {
 	Sha1Hash     common.Sha1Hash
 	ProgressFile *progressFile
 	ChunkSize    int
+	Paused       bool // true if the user stopped the download. Paused downloads are not resumed
+	// ChunkHashes holds the sha1 hash of every chunk. Chunks that do not match are never saved.
+	// Empty for downloads registered before chunk hashes existed, until they are fetched.
+	ChunkHashes []common.Sha1Hash
+	// MerkleRoot is the root of the merkle tree over ChunkHashes, which identifies the file as well
+	// as Sha1Hash does. Downloads that know it but not ChunkHashes verify each chunk against it
+	// with an inclusion proof instead. Nil if neither are known.
+	MerkleRoot *common.Sha1Hash
 }
 
 // IndexRecordExport is a copy of an underlying indexRecord intended for read-only access.
@@ -31,25 +50,77 @@ type indexRecord struct {
 // the underlying object it represents. For strong guarantees of consistency, use the appropriate
 // method on the catalogue.
 type IndexRecordExport struct {
-	FilePath    string
-	SizeInBytes int64
-	Sha1Hash    common.Sha1Hash
-	Progress    bitset.Bitset
-	ChunkSize   int
+	FilePath       string
+	SizeInBytes    int64
+	Sha1Hash       common.Sha1Hash
+	Progress       bitset.Bitset
+	ChunkSize      int
+	Paused         bool
+	HasChunkHashes bool // true if chunks are checked against their hashes before they are saved
+	// MerkleRoot is nil if unknown
+	MerkleRoot *common.Sha1Hash
 }
 
 // export returns an IndexRecordExport, which is safe for consumption outside of the catalogue
 func (ir *indexRecord) export() *IndexRecordExport {
 	return &IndexRecordExport{
-		FilePath:    ir.FilePath,
-		SizeInBytes: ir.SizeInBytes,
-		Sha1Hash:    ir.Sha1Hash,
-		Progress:    *ir.ProgressFile.Export(),
-		ChunkSize:   ir.ChunkSize,
+		FilePath:       ir.FilePath,
+		SizeInBytes:    ir.SizeInBytes,
+		Sha1Hash:       ir.Sha1Hash,
+		Progress:       *ir.ProgressFile.Export(),
+		ChunkSize:      ir.ChunkSize,
+		Paused:         ir.Paused,
+		HasChunkHashes: len(ir.ChunkHashes) > 0,
+		MerkleRoot:     copyHash(ir.MerkleRoot),
+	}
+}
+
+// NeedsProofs returns true if chunks of the file can only be saved along with an inclusion proof
+// against its merkle root
+func (ire *IndexRecordExport) NeedsProofs() bool {
+	return !ire.HasChunkHashes && ire.MerkleRoot != nil
+}
+
+func copyHash(hash *common.Sha1Hash) *common.Sha1Hash {
+	if hash == nil {
+		return nil
 	}
+	result := *hash
+	return &result
+}
+
+// verifyChunk returns an error wrapping ErrCorruptChunk if data is not as long as the chunk, if it
+// does not match the chunk's hash, or if the record only has a merkle root and proof does not show
+// that data belongs under it. Chunks of records with neither can only be checked for length.
+func (ir *indexRecord) verifyChunk(chunk int64, data []byte, proof []common.Sha1Hash) error {
+	chunkCount := int64(ir.ProgressFile.Size())
+	if chunk < 0 || chunk >= chunkCount {
+		return fmt.Errorf("chunk %d out of range: %s has %d chunks", chunk, ir.Sha1Hash.String(),
+			chunkCount)
+	}
+	if length := ir.chunkLength(chunk); int64(len(data)) != length {
+		return fmt.Errorf("%w: chunk %d of %s is %d bytes long instead of %d", ErrCorruptChunk,
+			chunk, ir.Sha1Hash.String(), len(data), length)
+	}
+	chunkHash := common.Sha1Hash{Data: sha1.Sum(data)}
+	if len(ir.ChunkHashes) > 0 {
+		if chunkHash.Data != ir.ChunkHashes[chunk].Data {
+			return fmt.Errorf("%w: chunk %d of %s", ErrCorruptChunk, chunk, ir.Sha1Hash.String())
+		}
+		return nil
+	}
+	if ir.MerkleRoot != nil &&
+		!common.VerifyMerkleProof(ir.MerkleRoot, &chunkHash, int(chunk), int(chunkCount), proof) {
+		return fmt.Errorf("%w: chunk %d of %s is not proven to belong to merkle root %s",
+			ErrCorruptChunk, chunk, ir.Sha1Hash.String(), ir.MerkleRoot.String())
+	}
+	return nil
 }
 
 func (ir *indexRecord) saveChunk(chunk int64, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(ir.FilePath), os.ModePerm); err != nil {
+		return err
+	}
 	fd, err := os.OpenFile(ir.FilePath, os.O_RDWR|os.O_CREATE, 0777)
 	if err != nil {
 		return err
@@ -63,7 +134,28 @@ func (ir *indexRecord) saveChunk(chunk int64, data []byte) error {
 	if wrote != len(data) {
 		return fmt.Errorf("wrote only %d of %d bytes", wrote, len(data))
 	}
-	return nil
+	// the chunk is marked in the progress file next, which must never claim data that a crash
+	// could still lose
+	return fd.Sync()
+}
+
+// chunkCount returns the number of chunks the file is split into
+func (ir *indexRecord) chunkCount() int {
+	result := int(ir.SizeInBytes / int64(ir.ChunkSize))
+	if ir.SizeInBytes%int64(ir.ChunkSize) != 0 {
+		result++
+	}
+	return result
+}
+
+// chunkLength returns the length in bytes of a chunk: the chunk size, except for the last chunk,
+// which holds whatever is left of the file
+func (ir *indexRecord) chunkLength(chunk int64) int64 {
+	remaining := ir.SizeInBytes - chunk*int64(ir.ChunkSize)
+	if remaining < int64(ir.ChunkSize) {
+		return remaining
+	}
+	return int64(ir.ChunkSize)
 }
 
 // getChunkReader returns a ChunkReader. It should be called via the catalogue so we know it is
@@ -87,7 +179,7 @@ func (ir *indexRecord) getChunkReader(chunk int64) (*common.ChunkReader, error)
 	return common.NewChunkReader(secReader), nil
 }
 
-func generateIndexRecordForFile(path string) (*indexRecord, error) {
+func generateIndexRecordForFile(path string, chunkSize int) (*indexRecord, error) {
 	cleanPath, err := filepath.Abs(path)
 	if err != nil {
 		return nil, err
@@ -98,7 +190,7 @@ func generateIndexRecordForFile(path string) (*indexRecord, error) {
 		return nil, err
 	}
 
-	hash, err := common.HashFile(cleanPath)
+	hash, chunkHashes, err := common.HashFileChunks(cleanPath, chunkSize)
 	if err != nil {
 		return nil, err
 	}
@@ -108,19 +200,30 @@ func generateIndexRecordForFile(path string) (*indexRecord, error) {
 		SizeInBytes:  fileStats.Size(),
 		Sha1Hash:     *hash,
 		ProgressFile: nil,
-		ChunkSize:    defaultChunkSize,
+		ChunkSize:    chunkSize,
+		ChunkHashes:  chunkHashes,
+		MerkleRoot:   common.MerkleRoot(chunkHashes),
 	}, nil
 
 }
 
 // toJSON returns an indexRecordJSON, which can natively be marshalled into JSON
 func (ir *indexRecord) toJSON() *indexRecordJSON {
-	return &indexRecordJSON{
+	result := &indexRecordJSON{
 		FilePath:    ir.FilePath,
 		SizeInBytes: ir.SizeInBytes,
 		Sha1Hash:    ir.Sha1Hash.String(),
 		ChunkSize:   ir.ChunkSize,
+		Paused:      ir.Paused,
+		ChunkHashes: make([]string, len(ir.ChunkHashes)),
+	}
+	for i := range ir.ChunkHashes {
+		result.ChunkHashes[i] = ir.ChunkHashes[i].String()
+	}
+	if ir.MerkleRoot != nil {
+		result.MerkleRoot = ir.MerkleRoot.String()
 	}
+	return result
 }
 
 // UnmarshalJSON conforms to the Marshaler interface
@@ -131,12 +234,29 @@ func (irj *indexRecordJSON) fromJSON() (*indexRecord, error) {
 		Sha1Hash:     common.Sha1Hash{},
 		ProgressFile: nil,
 		ChunkSize:    irj.ChunkSize,
+		Paused:       irj.Paused,
 	}
 
 	err := result.Sha1Hash.FromStringSafe(irj.Sha1Hash)
 	if err != nil {
 		return nil, err
 	}
+
+	if len(irj.ChunkHashes) > 0 {
+		result.ChunkHashes = make([]common.Sha1Hash, len(irj.ChunkHashes))
+		for i, str := range irj.ChunkHashes {
+			if err := result.ChunkHashes[i].FromStringSafe(str); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if irj.MerkleRoot != "" {
+		result.MerkleRoot = &common.Sha1Hash{}
+		if err := result.MerkleRoot.FromStringSafe(irj.MerkleRoot); err != nil {
+			return nil, err
+		}
+	}
 	return &result, nil
 }
 
@@ -147,4 +267,7 @@ type indexRecordJSON struct {
 	SizeInBytes int64
 	Sha1Hash    string
 	ChunkSize   int
+	Paused      bool
+	ChunkHashes []string `json:",omitempty"`
+	MerkleRoot  string   `json:",omitempty"`
 }
@@ -1,13 +1,30 @@
 package catalogue
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
 
+	"github.com/flu-network/client/common"
 	"github.com/flu-network/client/common/bitset"
 )
 
+// Progress files start with a header of progressFileMagic followed by a one-byte version, then the
+// serialized bitset. Files written before the header existed hold only the bitset, which starts
+// with its size as a big-endian uint64, so they can never start with the magic. They are still
+// read, and are rewritten with the header the first time they are.
+const (
+	progressFileMagic   = "flup"
+	progressFileVersion = 1
+)
+
+// errCorruptProgress is wrapped by the errors of progress files that are truncated or otherwise
+// damaged, which rebuildProgressFile can replace
+var errCorruptProgress = errors.New("progress file is corrupt")
+
 // progressFile is an in-memory representation of a file on disk containing a bitset, which shows
 // which 'chunks' of a file has been downloaded. If the entire file has been downloaded, all bits
 // in the set are 'on'. Serialization and deserialization methods assume the caller has already
@@ -46,10 +63,10 @@ func (p *progressFile) Count() int {
 	return p.progress.Count()
 }
 
-// Overlap takes a sorted  list of ranges ([]uint16 of even length) where each consecutive pair of
+// Overlap takes a sorted  list of ranges ([]uint32 of even length) where each consecutive pair of
 // numbers represents an inclusive range [start, end] of bits. The return value is a sorted list of
 // non-overallping ranges that are set to 'on' within the underlying bitset
-func (p *progressFile) Overlap(ranges []uint16) []uint16 {
+func (p *progressFile) Overlap(ranges []uint32) []uint32 {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 	return p.progress.Overlap(ranges)
@@ -57,13 +74,13 @@ func (p *progressFile) Overlap(ranges []uint16) []uint16 {
 
 // Ranges returns a sorted, non-overallping list of ranges of the underlying bitset that are set to
 // true.
-func (p *progressFile) Ranges() []uint16 {
+func (p *progressFile) Ranges() []uint32 {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 	return p.progress.Ranges()
 }
 
-func (p *progressFile) UnfilledItems(count int) []uint16 {
+func (p *progressFile) UnfilledItems(count int) []uint32 {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 	return p.progress.UnfilledItems(count)
@@ -76,12 +93,7 @@ func (p *progressFile) Export() *bitset.Bitset {
 // newProgressFile returns a new progressFile for the given IndexRecord, assuming the IndexRecord
 // is intact and preset in full.
 func newProgressFile(record *indexRecord, dataDir string) *progressFile {
-	sizeInBytes := int(record.SizeInBytes)
-	chunkCount := sizeInBytes / record.ChunkSize
-	if sizeInBytes%record.ChunkSize != 0 {
-		chunkCount++
-	}
-	set := *bitset.NewBitset(int(chunkCount))
+	set := *bitset.NewBitset(record.chunkCount())
 	return &progressFile{
 		lock:     sync.Mutex{},
 		progress: set,
@@ -90,21 +102,17 @@ func newProgressFile(record *indexRecord, dataDir string) *progressFile {
 }
 
 func (p *progressFile) save() error {
-	data := p.progress.Serialize()
-	progressFilePath := filepath.Join(p.filePath)
-	err := os.WriteFile(progressFilePath, data, 0664)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	data := append([]byte(progressFileMagic), progressFileVersion)
+	data = append(data, p.progress.Serialize()...)
+	return writeFileAtomic(p.filePath, data, 0664)
 }
 
 func (p *progressFile) delete() error {
 	return os.Remove(filepath.Join(p.filePath))
 }
 
-// deserializeProgressFile reads bytes on disk into an in-memory progressFile.
+// deserializeProgressFile reads bytes on disk into an in-memory progressFile. Files in the legacy
+// format are migrated to the current one.
 func deserializeProgressFile(record *indexRecord, dataDir string) (*progressFile, error) {
 	progressFilePath := filepath.Join(dataDir, record.Sha1Hash.String())
 
@@ -113,14 +121,57 @@ func deserializeProgressFile(record *indexRecord, dataDir string) (*progressFile
 		return nil, err
 	}
 
+	legacy := !bytes.HasPrefix(data, []byte(progressFileMagic))
+	if !legacy {
+		data = data[len(progressFileMagic):]
+		if len(data) == 0 {
+			return nil, fmt.Errorf("%w: %s is truncated", errCorruptProgress, progressFilePath)
+		}
+		if data[0] != progressFileVersion {
+			return nil, fmt.Errorf("progress file %s has an unsupported version", progressFilePath)
+		}
+		data = data[1:]
+	}
+
 	set, err := bitset.Deserialize(data)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %s: %v", errCorruptProgress, progressFilePath, err)
+	}
+	if set.Size() != record.chunkCount() {
+		return nil, fmt.Errorf("%w: %s has %d chunks, not %d", errCorruptProgress,
+			progressFilePath, set.Size(), record.chunkCount())
 	}
 
-	return &progressFile{
+	result := &progressFile{
 		lock:     sync.Mutex{},
 		progress: *set,
 		filePath: progressFilePath,
-	}, nil
+	}
+	if legacy {
+		if err := result.save(); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// rebuildProgressFile works out which chunks of a file are on disk by hashing it, and saves the
+// result as its progress file. Chunks are checked against the file's chunk hashes. Files without
+// them are only known to be complete if they match their hash, and are otherwise downloaded again
+// from scratch.
+func rebuildProgressFile(record *indexRecord, dataDir string) (*progressFile, error) {
+	result := newProgressFile(record, dataDir)
+	fileHash, chunkHashes, err := common.HashFileChunks(record.FilePath, record.ChunkSize)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil && len(record.ChunkHashes) == 0 && fileHash.Data == record.Sha1Hash.Data {
+		result.progress.Fill()
+	}
+	for i := 0; i < len(chunkHashes) && i < len(record.ChunkHashes); i++ {
+		if chunkHashes[i] == record.ChunkHashes[i] {
+			result.progress.Set(uint64(i))
+		}
+	}
+	return result, result.save()
 }
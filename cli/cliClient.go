@@ -2,7 +2,7 @@ package cli
 
 import (
 	"fmt"
-	"net"
+	"net/netip"
 	"net/rpc"
 	"os"
 	"reflect"
@@ -61,24 +61,29 @@ func (c *Client) Run(cmdArgs []string) {
 		callClientMethodAndPrintResponse(client, "Methods.Clean", &req, &res)
 
 	// List lists the files availble for download. If an IP address is supplied, it lists the files
-	// available on the node at that IP address. If not, it lists the files available on the local
-	// daemon. Right now, it only supports IPV4 addresses.
+	// available on the node at that IP address, which listens on the same port as the local daemon
+	// unless one is given. If not, it lists the files available on the local daemon.
 	// Usage:
 	// 	- flu list 					# list files indexed on local daemon
 	// 	- flu list 192.168.86.39 	# list files on 192.168.86,39
+	// 	- flu list 192.168.86.39:61697 	# list files on the daemon at port 61697 of 192.168.86.39
+	// 	- flu list [fe80::1%eth0]:61697
 	case "list":
 		req := ListRequest{
-			IP:       []byte{},
 			Sha1Hash: (&common.Sha1Hash{}).Blank(),
 		}
 		res := ListResponse{Items: []ListItem{}}
 		if len(args) > 0 {
-			addr := net.ParseIP(args[0])
-			if addr == nil {
-				prettyPrintError(fmt.Errorf("invalid IP Address: %s", args[0]))
-				return
+			addr, err := netip.ParseAddr(args[0])
+			if err != nil {
+				addrPort, portErr := netip.ParseAddrPort(args[0])
+				if portErr != nil || addrPort.Port() == 0 {
+					prettyPrintError(fmt.Errorf("invalid IP Address: %s", args[0]))
+					return
+				}
+				addr, req.Port = addrPort.Addr(), addrPort.Port()
 			}
-			req.IP = addr
+			req.Address = addr.Unmap()
 		}
 		if len(args) > 1 {
 			err := req.Sha1Hash.FromStringSafe(args[1])
@@ -90,26 +95,136 @@ func (c *Client) Run(cmdArgs []string) {
 	// been started Get does not affect it. Get runs in the background so will run whenever the flu
 	// daemon is running until the file is downloaded. Get implicitly also shares the file that is
 	// being downloaded.
+	// The order in which chunks are fetched can be chosen with --policy: 'rarest' (the default)
+	// protects the swarm from losing chunks, 'sequential' lets media be previewed while it
+	// downloads and 'random' spreads load evenly.
 	// Usage:
 	//   - flu get A0F1490A20D0211C997B44BC357E1972DEAB8AE3 # get file with this sha1 hash
 	//   - flu get A0F1490A20D0211C997B44BC357E1972DEAB8AE3 --sercet # get this file and don't share
+	//   - flu get A0F1490A20D0211C997B44BC357E1972DEAB8AE3 --policy sequential
+	//   - flu get A0F1490A20D0211C997B44BC357E1972DEAB8AE3 \
+	//       --root 9C1185A5C5E9FC54612808977EE8F548B2258D31 # trust only chunks under this root
 	case "get":
 		req := GetRequest{
 			Sha1Hash: &common.Sha1Hash{},
 		}
 		res := GetResponse{}
+		req.Policy, args = stringFlag("--policy", args)
+		root, args := stringFlag("--root", args)
+		validateArgCount("Get", struct{ Sha1Hash string }{}, args)
 		err := req.Sha1Hash.FromStringSafe(args[0])
 		validate(err)
-		validateArgCount("Clean", GetRequest{}, args)
+		if root != "" {
+			req.MerkleRoot = &common.Sha1Hash{}
+			validate(req.MerkleRoot.FromStringSafe(root))
+		}
 		callClientMethodAndPrintResponse(client, "Methods.Get", &req, &res)
 
-	// Chims lists available hosts on the LAN, including the local daemon. If gives hosts a few
-	// seconds to responds and then prints the response from all hosts that replied.
+	// Pause stops downloading the specified file, keeping everything downloaded so far. Paused
+	// downloads can be restarted with `flu resume`.
+	// Usage:
+	//   - flu pause A0F1490A20D0211C997B44BC357E1972DEAB8AE3
+	case "pause":
+		validateArgCount("Pause", PauseRequest{}, args)
+		req := PauseRequest{Sha1Hash: &common.Sha1Hash{}}
+		res := PauseResponse{}
+		validate(req.Sha1Hash.FromStringSafe(args[0]))
+		callClientMethodAndPrintResponse(client, "Methods.Pause", &req, &res)
+
+	// Resume restarts a download that was stopped with `flu pause`.
+	// Usage:
+	//   - flu resume A0F1490A20D0211C997B44BC357E1972DEAB8AE3
+	case "resume":
+		validateArgCount("Resume", ResumeRequest{}, args)
+		req := ResumeRequest{Sha1Hash: &common.Sha1Hash{}}
+		res := ResumeResponse{}
+		validate(req.Sha1Hash.FromStringSafe(args[0]))
+		callClientMethodAndPrintResponse(client, "Methods.Resume", &req, &res)
+
+	// Cancel stops a running or paused download and forgets its progress, so unlike a paused
+	// download it cannot be resumed. Peers that were sending chunks are told to stop. The
+	// partially-downloaded file is left on disk, unless --delete is given.
+	// Usage:
+	//   - flu cancel A0F1490A20D0211C997B44BC357E1972DEAB8AE3
+	//   - flu cancel A0F1490A20D0211C997B44BC357E1972DEAB8AE3 --delete
+	case "cancel":
+		req := CancelRequest{Sha1Hash: &common.Sha1Hash{}}
+		res := CancelResponse{}
+		req.Delete, args = boolFlag("--delete", args)
+		validateArgCount("Cancel", struct{ Sha1Hash string }{}, args)
+		validate(req.Sha1Hash.FromStringSafe(args[0]))
+		callClientMethodAndPrintResponse(client, "Methods.Cancel", &req, &res)
+
+	// Limit shows or changes the daemon's bandwidth limits. Rates are in bytes per second with an
+	// optional K, M or G suffix, and 'off' removes a limit. Several limits can be changed at once.
+	// Usage:
+	//   - flu limit                             # show current limits
+	//   - flu limit upload 500K                 # cap total upload at 500KB/s
+	//   - flu limit peer-upload 100K download off
+	//   - flu limit file-download 1M
+	case "limit":
+		if len(args)%2 != 0 {
+			fmt.Println("Limit expects pairs of limit names and rates")
+			os.Exit(2)
+		}
+		req := LimitRequest{Changes: make(map[string]string)}
+		res := LimitResponse{}
+		for i := 0; i < len(args); i += 2 {
+			req.Changes[args[i]] = args[i+1]
+		}
+		callClientMethodAndPrintResponse(client, "Methods.Limit", &req, &res)
+
+	// Status shows the daemon's bandwidth schedule, the schedule rule currently in force and the
+	// resulting bandwidth limits.
+	// Usage:
+	//   - flu status
+	case "status":
+		validateArgCount("Status", StatusRequest{}, args)
+		req := StatusRequest{}
+		res := StatusResponse{}
+		callClientMethodAndPrintResponse(client, "Methods.Status", &req, &res)
+
+	// Peers shows the daemon's peer table: every peer it has heard from recently, with the
+	// smoothed round trip time of pings, the speed chunks downloaded from it at, and how many
+	// chunks it failed to deliver.
+	// Usage:
+	//   - flu peers
+	case "peers":
+		validateArgCount("Peers", PeersRequest{}, args)
+		req := PeersRequest{}
+		res := PeersResponse{}
+		callClientMethodAndPrintResponse(client, "Methods.Peers", &req, &res)
+
+	// Config changes or removes a setting in the daemon's config file, which the daemon then
+	// reloads. Settings are named as the daemon's command-line flags, without the dash.
+	// Usage:
+	//   - flu config set max-upload 500K
+	//   - flu config set discovery-timeout 5s
+	//   - flu config unset max-upload # back to the default
+	case "config":
+		req := ConfigRequest{}
+		switch {
+		case len(args) == 3 && args[0] == "set":
+			req.Name, req.Value = args[1], args[2]
+		case len(args) == 2 && args[0] == "unset":
+			req.Name, req.Unset = args[1], true
+		default:
+			fmt.Println("Config expects: set <setting> <value>, or unset <setting>")
+			os.Exit(2)
+		}
+		res := ConfigResponse{}
+		callClientMethodAndPrintResponse(client, "Methods.Config", &req, &res)
+
+	// Chims lists available hosts on the LAN, including the local daemon. Hosts announce
+	// themselves, so the daemon answers from what it already knows. With --probe, it gives hosts a
+	// few seconds to respond and then prints the response from all hosts that replied.
 	// Usage:
 	// 	- flu chims # list available hosts
+	// 	- flu chims <hash> --probe # ask every host afresh which chunks of a file it has
 	case "chims":
 		req := ChimRequest{}
 		res := ChimResponseList{}
+		req.Probe, args = boolFlag("--probe", args)
 		hash := common.Sha1Hash{}
 		if len(args) > 0 {
 			err := hash.FromStringSafe(args[0])
@@ -142,6 +257,34 @@ func validateArgCount(method string, request interface{}, args []string) {
 	}
 }
 
+// boolFlag removes name from args and reports whether it was present, along with the remaining
+// args.
+func boolFlag(name string, args []string) (bool, []string) {
+	for i, arg := range args {
+		if arg == name {
+			return true, append(append([]string{}, args[:i]...), args[i+1:]...)
+		}
+	}
+	return false, args
+}
+
+// stringFlag removes `name value` from args and returns the value along with the remaining args.
+// If the flag is absent, the value is an empty string. Exits if the flag has no value.
+func stringFlag(name string, args []string) (string, []string) {
+	for i, arg := range args {
+		if arg != name {
+			continue
+		}
+		if i+1 >= len(args) {
+			fmt.Printf("%s expects a value\n", name)
+			os.Exit(2)
+		}
+		rest := append(append([]string{}, args[:i]...), args[i+2:]...)
+		return args[i+1], rest
+	}
+	return "", args
+}
+
 func validate(err error) {
 	if err != nil {
 		// handle error
@@ -20,9 +20,12 @@ type Methods struct {
 
 	// Used to access the flu-network's UDP interface
 	fluServer *flu.Server
+
+	// Used to change the daemon's settings
+	config Configurer
 }
 
 // NewMethods returns a NewMethods instance. cat is expected to be initialized by the caller.
-func NewMethods(cat *catalogue.Cat, fluServer *flu.Server) *Methods {
-	return &Methods{cat: cat, fluServer: fluServer}
+func NewMethods(cat *catalogue.Cat, fluServer *flu.Server, config Configurer) *Methods {
+	return &Methods{cat: cat, fluServer: fluServer, config: config}
 }
@@ -0,0 +1,42 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/flu-network/client/common"
+)
+
+// CancelRequest identifies the download to cancel
+type CancelRequest struct {
+	Sha1Hash *common.Sha1Hash // sha1 hash of the file being downloaded
+	Delete   bool             // if true, the partial file is deleted as well
+}
+
+// CancelResponse echoes the request that was carried out
+type CancelResponse struct {
+	Sha1Hash common.Sha1Hash
+	Deleted  bool
+}
+
+// Sprintf returns a pretty-printed, user-facing string representation of a CancelResponse
+func (res *CancelResponse) Sprintf() string {
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("Flu transfer cancelled: %s\n", res.Sha1Hash.String()))
+	if res.Deleted {
+		b.WriteString("  - Partially-downloaded file deleted\n")
+	}
+	return b.String()
+}
+
+// Cancel stops a running or paused download and forgets its progress, and optionally deletes what
+// was downloaded so far
+func (m *Methods) Cancel(req *CancelRequest, res *CancelResponse) error {
+	err := m.fluServer.CancelDownload(req.Sha1Hash, req.Delete)
+	if err != nil {
+		return err
+	}
+	res.Sha1Hash = *req.Sha1Hash
+	res.Deleted = req.Delete
+	return nil
+}
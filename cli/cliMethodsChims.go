@@ -2,6 +2,7 @@ package cli
 
 import (
 	"fmt"
+	"net/netip"
 	"strings"
 
 	"github.com/flu-network/client/common"
@@ -13,21 +14,22 @@ import (
 type ChimRequest struct {
 	// if provided, only hosts with info on this file will respond.
 	Sha1Hash *common.Sha1Hash
+	// if true, hosts are asked afresh rather than looked up in the daemon's peer table
+	Probe bool
 }
 
 // ChimResponse lists the available hosts on the network. If a sha1Hash was provided, hosts will
 // include the chunks of that file that they have available.
 type ChimResponse struct {
-	HostIP   [4]byte
+	HostIP   netip.Addr
 	HostPort uint16
-	Chunks   []uint16
+	Chunks   []uint32
 }
 
 // Sprintf returns a pretty-printed, user-facing string representation of a ChimResponse
 func (c *ChimResponse) Sprintf() string {
 	var b strings.Builder
-	b.WriteString(fmt.Sprintf("IP: %d.%d.%d.%d:%d\n",
-		c.HostIP[0], c.HostIP[1], c.HostIP[2], c.HostIP[3], c.HostPort))
+	b.WriteString(fmt.Sprintf("IP: %s\n", netip.AddrPortFrom(c.HostIP, c.HostPort)))
 	for i := 0; i < len(c.Chunks); i += 2 {
 		b.WriteString(fmt.Sprintf("  %d:%d\n", c.Chunks[i], c.Chunks[i+1]))
 	}
@@ -49,9 +51,10 @@ func (c *ChimResponseList) Sprintf() string {
 }
 
 // Chims lists available hosts on the network. If a sha1 is provided, only hosts that have at least
-// some of that file will respond, and their responses will be scoped to that one file.
+// some of that file will respond, and their responses will be scoped to that one file. Hosts are
+// looked up in the daemon's peer table unless a probe is requested.
 func (m *Methods) Chims(req *ChimRequest, resp *ChimResponseList) error {
-	r := m.fluServer.DiscoverHosts(req.Sha1Hash, []uint16{})
+	r := m.fluServer.DiscoverHosts(req.Sha1Hash, []uint32{}, req.Probe)
 	resp.Responses = make([]ChimResponse, len(r))
 	for i, peer := range r {
 		resp.Responses[i] = ChimResponse{
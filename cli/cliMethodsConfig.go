@@ -0,0 +1,56 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ConfigRequest contains a setting to change in the daemon's config file, named as its
+// command-line flag without the dash, e.g., "max-upload", and its new value
+type ConfigRequest struct {
+	Name  string
+	Value string
+	Unset bool // remove the setting from the config file instead, so that its default applies
+}
+
+// ConfigResponse describes what became of a change to the daemon's config file
+type ConfigResponse struct {
+	Path       string   // the config file
+	Applied    []string // settings whose new values are now in force
+	Restart    []string // settings whose new values take effect when the daemon restarts
+	Overridden bool     // the setting is given on the command line or in the environment instead
+}
+
+// Sprintf returns a pretty-printed, user-facing string representation of a ConfigResponse
+func (res *ConfigResponse) Sprintf() string {
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprintf("Saved to %s\n", res.Path))
+	if res.Overridden {
+		sb.WriteString("Not applied: given on the daemon's command line or in its environment\n")
+	}
+	if len(res.Applied) > 0 {
+		sb.WriteString(fmt.Sprintf("Applied: %s\n", strings.Join(res.Applied, ", ")))
+	}
+	if len(res.Restart) > 0 {
+		sb.WriteString(fmt.Sprintf("Applied when the daemon restarts: %s\n",
+			strings.Join(res.Restart, ", ")))
+	}
+	return sb.String()
+}
+
+// Configurer changes the daemon's settings
+type Configurer interface {
+	// SetConfig validates a change to the config file, saves it and applies the settings that
+	// changed as a result
+	SetConfig(req ConfigRequest) (ConfigResponse, error)
+}
+
+// Config changes or removes a setting in the daemon's config file. The daemon reloads the file,
+// and the settings whose values changed as a result are applied straight away, except for those
+// that can only be applied by restarting it. Invalid values are rejected and the file is left
+// untouched.
+func (m *Methods) Config(req *ConfigRequest, res *ConfigResponse) error {
+	var err error
+	*res, err = m.config.SetConfig(*req)
+	return err
+}
@@ -1,10 +1,17 @@
 package cli
 
-import "github.com/flu-network/client/common"
+import (
+	"github.com/flu-network/client/common"
+	"github.com/flu-network/client/flu/picker"
+)
 
 // GetRequest contains the information necessary to initiate a flu transfer to get a file
 type GetRequest struct {
 	Sha1Hash *common.Sha1Hash // sha1 hash of the file being downloaded
+	Policy   string           // chunk selection policy: rarest, sequential or random. Optional.
+	// MerkleRoot, if given, is trusted to identify the file, so every chunk is verified against it
+	// no matter which peer it comes from. Optional.
+	MerkleRoot *common.Sha1Hash
 }
 
 // GetResponse is an empty struct
@@ -17,5 +24,13 @@ func (res *GetResponse) Sprintf() string {
 
 // Get initiates a flu transfer for the specified file
 func (m *Methods) Get(req *GetRequest, res *GetResponse) error {
-	return m.fluServer.StartDownload(req.Sha1Hash)
+	policy := picker.Default
+	if req.Policy != "" {
+		p, err := picker.ParsePolicy(req.Policy)
+		if err != nil {
+			return err
+		}
+		policy = p
+	}
+	return m.fluServer.StartDownload(req.Sha1Hash, policy, req.MerkleRoot)
 }
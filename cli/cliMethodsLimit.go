@@ -0,0 +1,52 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/flu-network/client/flu"
+	"github.com/flu-network/client/flu/ratelimit"
+)
+
+// LimitRequest contains the bandwidth limits to change. With no changes, the current limits are
+// returned untouched.
+type LimitRequest struct {
+	Changes map[string]string // limit name -> rate, e.g., "upload" -> "500K" or "download" -> "off"
+}
+
+// LimitResponse contains the bandwidth limits in force after the request
+type LimitResponse struct {
+	Limits flu.Limits
+}
+
+// Sprintf returns a pretty-printed, user-facing string representation of a LimitResponse
+func (res *LimitResponse) Sprintf() string {
+	sb := strings.Builder{}
+	for _, name := range flu.LimitNames {
+		rate, _ := res.Limits.Field(name)
+		sb.WriteString(fmt.Sprintf("%-14s %s\n", name, ratelimit.FormatRate(*rate)))
+	}
+	return sb.String()
+}
+
+// Limit changes the daemon's bandwidth limits, and reports the limits in force. Changes apply
+// immediately, including to transfers that are already running.
+func (m *Methods) Limit(req *LimitRequest, res *LimitResponse) error {
+	limits := m.fluServer.Limits()
+	for name, value := range req.Changes {
+		field, err := limits.Field(name)
+		if err != nil {
+			return err
+		}
+		rate, err := ratelimit.ParseRate(value)
+		if err != nil {
+			return err
+		}
+		*field = rate
+	}
+	if len(req.Changes) > 0 {
+		m.fluServer.SetLimits(limits)
+	}
+	res.Limits = m.fluServer.Limits()
+	return nil
+}
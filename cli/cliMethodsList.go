@@ -1,7 +1,7 @@
 package cli
 
 import (
-	"net"
+	"net/netip"
 	"strings"
 
 	"github.com/flu-network/client/common"
@@ -10,7 +10,8 @@ import (
 // ListRequest contains the information necessary for the daemon to find, hash, index and List the
 // file pointed to by FilePath.
 type ListRequest struct {
-	IP       net.IP
+	Address  netip.Addr // the host to list the files of, IPv4 or IPv6. The zero Addr means this one
+	Port     uint16     // the port the host listens on. 0 means the same port as this daemon
 	Sha1Hash *common.Sha1Hash
 }
 
@@ -33,7 +34,7 @@ func (lr *ListResponse) Sprintf() string {
 // List lists the files that have been indexed by the daemon. Not all indexed files have been
 // downloaded in their entirety.
 func (m *Methods) List(req *ListRequest, resp *ListResponse) error {
-	if req.IP == nil {
+	if !req.Address.IsValid() {
 		records, err := m.cat.ListFiles()
 		if err != nil {
 			return err
@@ -49,11 +50,16 @@ func (m *Methods) List(req *ListRequest, resp *ListResponse) error {
 				ChunkSizeInBytes: rec.ChunkSize,
 				ChunksDownloaded: rec.Progress.Count(),
 			}
+			if rec.MerkleRoot != nil {
+				resp.Items[i].MerkleRoot = rec.MerkleRoot.String()
+			}
 		}
 	} else {
-		addr := req.IP.To4()
-		ip := [4]byte{addr[0], addr[1], addr[2], addr[3]}
-		r, err := m.fluServer.ListFilesOnHost(ip, uint16(m.fluServer.Port()), req.Sha1Hash)
+		port := req.Port
+		if port == 0 {
+			port = uint16(m.fluServer.Port())
+		}
+		r, err := m.fluServer.ListFilesOnHost(req.Address, port, req.Sha1Hash)
 		if err != nil {
 			return err
 		}
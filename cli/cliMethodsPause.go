@@ -0,0 +1,32 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/flu-network/client/common"
+)
+
+// PauseRequest identifies the download to pause
+type PauseRequest struct {
+	Sha1Hash *common.Sha1Hash // sha1 hash of the file being downloaded
+}
+
+// PauseResponse echoes the hash of the paused download
+type PauseResponse struct {
+	Sha1Hash common.Sha1Hash
+}
+
+// Sprintf returns a pretty-printed, user-facing string representation of a PauseResponse
+func (res *PauseResponse) Sprintf() string {
+	return fmt.Sprintf("Flu transfer paused: %s\n", res.Sha1Hash.String())
+}
+
+// Pause stops a running download without discarding anything downloaded so far
+func (m *Methods) Pause(req *PauseRequest, res *PauseResponse) error {
+	err := m.fluServer.PauseDownload(req.Sha1Hash)
+	if err != nil {
+		return err
+	}
+	res.Sha1Hash = *req.Sha1Hash
+	return nil
+}
@@ -0,0 +1,55 @@
+package cli
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/flu-network/client/flu"
+	"github.com/flu-network/client/flu/ratelimit"
+)
+
+// PeersRequest is an empty struct
+type PeersRequest struct{}
+
+// PeersResponse contains the daemon's peer table
+type PeersResponse struct {
+	Peers []flu.PeerStats
+}
+
+// Sprintf returns a pretty-printed, user-facing string representation of a PeersResponse
+func (res *PeersResponse) Sprintf() string {
+	if len(res.Peers) == 0 {
+		return "No known peers\n"
+	}
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprintf("%-21s %-10s %-9s %-12s %-7s %s\n",
+		"Peer", "Last seen", "RTT", "Throughput", "Chunks", "Failures"))
+	for _, p := range res.Peers {
+		address := netip.AddrPortFrom(p.Address, p.Port).String()
+		rtt := "-"
+		if p.RTT > 0 {
+			rtt = p.RTT.Round(100 * time.Microsecond).String()
+		}
+		throughput := "-"
+		if p.Throughput > 0 {
+			throughput = ratelimit.FormatRate(int64(p.Throughput))
+		}
+		failures := fmt.Sprintf("%d", p.Failures)
+		if p.ConsecutiveFailures > 0 {
+			failures += fmt.Sprintf(" (%d in a row)", p.ConsecutiveFailures)
+		}
+		sb.WriteString(fmt.Sprintf("%-21s %-10s %-9s %-12s %-7d %s\n", address,
+			time.Since(p.LastSeen).Round(time.Second).String()+" ago", rtt, throughput, p.Chunks,
+			failures))
+	}
+	return sb.String()
+}
+
+// Peers lists the peers the daemon knows about, along with how responsive and how fast each one
+// has been
+func (m *Methods) Peers(req *PeersRequest, res *PeersResponse) error {
+	res.Peers = m.fluServer.Peers()
+	return nil
+}
@@ -0,0 +1,32 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/flu-network/client/common"
+)
+
+// ResumeRequest identifies the paused download to resume
+type ResumeRequest struct {
+	Sha1Hash *common.Sha1Hash // sha1 hash of the file being downloaded
+}
+
+// ResumeResponse echoes the hash of the resumed download
+type ResumeResponse struct {
+	Sha1Hash common.Sha1Hash
+}
+
+// Sprintf returns a pretty-printed, user-facing string representation of a ResumeResponse
+func (res *ResumeResponse) Sprintf() string {
+	return fmt.Sprintf("Flu transfer resumed: %s\n", res.Sha1Hash.String())
+}
+
+// Resume restarts a paused download
+func (m *Methods) Resume(req *ResumeRequest, res *ResumeResponse) error {
+	err := m.fluServer.ResumeDownload(req.Sha1Hash)
+	if err != nil {
+		return err
+	}
+	res.Sha1Hash = *req.Sha1Hash
+	return nil
+}
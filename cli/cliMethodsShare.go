@@ -18,6 +18,7 @@ type ListItem struct {
 	FilePath         string
 	SizeInBytes      int64
 	Sha1Hash         [20]byte
+	MerkleRoot       string // hex-encoded root of the merkle tree over chunk hashes, if known
 	ChunkCount       int
 	ChunkSizeInBytes int // ChunkCount * ChunkSizeInBytes == SizeInBytes
 	// The number of chunks of the file that are downloaded and available for sharing
@@ -32,11 +33,16 @@ func (li *ListItem) Sprintf() string {
 		fmt.Sprintf("	Path: %s\n", li.FilePath),
 		fmt.Sprintf("	Size (bytes): %d\n", li.SizeInBytes),
 		fmt.Sprintf("	Sha1 Hash: %s\n", hex.EncodeToString(li.Sha1Hash[:])),
+	}
+	if li.MerkleRoot != "" {
+		output = append(output, fmt.Sprintf("	Merkle Root: %s\n", li.MerkleRoot))
+	}
+	output = append(output,
 		fmt.Sprintf("	Chunk Count: %d\n", li.ChunkCount),
 		fmt.Sprintf("	Chunks Downloaded: %d\n", li.ChunksDownloaded),
 		fmt.Sprintf("	Chunk Size: %d\n", li.ChunkSizeInBytes),
 		fmt.Sprintf("	Integrity: %d%%\n", (li.ChunksDownloaded*100/li.ChunkCount*100)/100),
-	}
+	)
 
 	var b strings.Builder
 	for _, line := range output {
@@ -58,6 +64,9 @@ func (m *Methods) Share(req *ShareRequest, resp *ListItem) error {
 	resp.FilePath = record.FilePath
 	resp.SizeInBytes = record.SizeInBytes
 	resp.Sha1Hash = *record.Sha1Hash.Array()
+	if record.MerkleRoot != nil {
+		resp.MerkleRoot = record.MerkleRoot.String()
+	}
 	resp.ChunkCount = record.ProgressFile.Size()
 	resp.ChunkSizeInBytes = record.ChunkSize
 	resp.ChunksDownloaded = record.ProgressFile.Count()
@@ -0,0 +1,58 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/flu-network/client/flu"
+	"github.com/flu-network/client/flu/ratelimit"
+)
+
+// StatusRequest is an empty struct
+type StatusRequest struct{}
+
+// StatusResponse describes the daemon's bandwidth schedule and the limits in force, and how many
+// datagrams it has dropped
+type StatusResponse struct {
+	Schedule flu.ScheduleStatus
+	Dropped  flu.DatagramStats
+}
+
+// Sprintf returns a pretty-printed, user-facing string representation of a StatusResponse
+func (res *StatusResponse) Sprintf() string {
+	sb := strings.Builder{}
+	sched := res.Schedule
+	if sched.Schedule == "" {
+		sb.WriteString("Bandwidth schedule: none\n")
+	} else {
+		sb.WriteString(fmt.Sprintf("Bandwidth schedule: %s\n", sched.Schedule))
+	}
+	if sched.ActiveRule == "" {
+		sb.WriteString("Active rule: none\n")
+	} else {
+		sb.WriteString(fmt.Sprintf("Active rule: %s\n", sched.ActiveRule))
+	}
+
+	sb.WriteString("Limits in force:\n")
+	for _, name := range flu.LimitNames {
+		effective, _ := sched.Effective.Field(name)
+		configured, _ := sched.Configured.Field(name)
+		line := fmt.Sprintf("  %-14s %s", name, ratelimit.FormatRate(*effective))
+		if *effective != *configured {
+			line += fmt.Sprintf(" (configured: %s)", ratelimit.FormatRate(*configured))
+		}
+		sb.WriteString(line + "\n")
+	}
+
+	sb.WriteString(fmt.Sprintf("Dropped datagrams: %d malformed, %d from incompatible peers\n",
+		res.Dropped.Malformed, res.Dropped.Incompatible))
+	return sb.String()
+}
+
+// Status reports the daemon's bandwidth schedule, the rule in force and the resulting limits, and
+// how many datagrams it has dropped
+func (m *Methods) Status(req *StatusRequest, res *StatusResponse) error {
+	res.Schedule = m.fluServer.ScheduleStatus()
+	res.Dropped = m.fluServer.DroppedDatagrams()
+	return nil
+}
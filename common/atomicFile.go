@@ -0,0 +1,144 @@
+package common
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// TmpSuffix ends the name of the temporary files WriteFileAtomic writes to before they replace the
+// file itself. They are named after the file, with a random number and TmpSuffix appended, e.g.,
+// config.json.123456.tmp.
+const TmpSuffix = ".tmp"
+
+// writeStep is a step of WriteFileAtomic
+type writeStep int
+
+const (
+	stepCreate writeStep = iota // create the temporary file
+	stepWrite                   // write the data to it
+	stepSync                    // flush it to disk
+	stepClose                   // close it
+	stepRename                  // replace the file with it
+)
+
+// injectWriteFault, if set, is called before every step of WriteFileAtomic, which fails at that
+// step if it returns an error. A failed write leaves half the data written. Tests use it to
+// simulate faults; it is nil otherwise.
+var injectWriteFault func(path string, step writeStep) error
+
+// WriteFileAtomic replaces the file at path with data, so that the file holds either its old or
+// its new contents if the process or the machine crashes at any point. The data is written to a
+// temporary file in the same directory, flushed to disk, and then renamed over the file, and the
+// rename is flushed to disk too. The temporary file is removed if any step fails, but is left
+// behind by a crash; see RemoveTemporaryFiles.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) (err error) {
+	fault := func(step writeStep) error {
+		if injectWriteFault == nil {
+			return nil
+		}
+		return injectWriteFault(path, step)
+	}
+
+	if err := fault(stepCreate); err != nil {
+		return err
+	}
+	// a name of its own, so that concurrent writes of the file do not write to the same one
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*"+TmpSuffix)
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	closed := false
+	defer func() {
+		if err != nil {
+			if !closed {
+				f.Close()
+			}
+			os.Remove(tmp)
+		}
+	}()
+
+	if err := f.Chmod(perm); err != nil {
+		return err
+	}
+	if err := fault(stepWrite); err != nil {
+		f.Write(data[:len(data)/2])
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := fault(stepSync); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := fault(stepClose); err != nil {
+		return err
+	}
+	closed = true
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := fault(stepRename); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// TemporaryFileOf returns the name of the file that a temporary file WriteFileAtomic wrote to was
+// meant to replace, and false if the name is not that of such a temporary file
+func TemporaryFileOf(name string) (string, bool) {
+	trimmed := strings.TrimSuffix(name, TmpSuffix)
+	dot := strings.LastIndexByte(trimmed, '.')
+	if trimmed == name || dot <= 0 {
+		return "", false
+	}
+	if _, err := strconv.ParseUint(trimmed[dot+1:], 10, 64); err != nil {
+		return "", false
+	}
+	return trimmed[:dot], true
+}
+
+// RemoveTemporaryFiles removes the temporary files that WriteFileAtomic leaves next to the file at
+// path if the process crashes before renaming them. They may be incomplete, and the file they
+// were meant to replace is intact. They should only be removed while nothing is writing the file.
+func RemoveTemporaryFiles(path string) error {
+	dir := filepath.Dir(path)
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name, ok := TemporaryFileOf(entry.Name())
+		if !ok || name != filepath.Base(path) || !entry.Type().IsRegular() {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncDir flushes a directory to disk, so that files renamed into it stay renamed after a crash.
+// Best effort: not every platform can sync directories, and the file itself is already safe.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
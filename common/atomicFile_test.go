@@ -0,0 +1,87 @@
+package common
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	defer func() { injectWriteFault = nil }()
+	path := filepath.Join(t.TempDir(), "file.json")
+	failHard(WriteFileAtomic(path, []byte("old"), 0644))
+
+	// a write that fails at any step leaves the file as it was, and nothing else behind
+	for _, step := range []writeStep{stepCreate, stepWrite, stepSync, stepClose, stepRename} {
+		injected := errors.New("injected fault")
+		injectWriteFault = func(path string, s writeStep) error {
+			if s == step {
+				return injected
+			}
+			return nil
+		}
+		if err := WriteFileAtomic(path, []byte("new"), 0644); !errors.Is(err, injected) {
+			t.Fatalf("Expected step %d to fail but got %v\n", step, err)
+		}
+		if data, err := os.ReadFile(path); err != nil || string(data) != "old" {
+			t.Fatalf("Expected the old contents after step %d failed but got %q, %v\n", step,
+				data, err)
+		}
+		if entries, err := os.ReadDir(filepath.Dir(path)); err != nil || len(entries) != 1 {
+			t.Fatalf("Expected the temporary file to be removed after step %d failed but got "+
+				"%v, %v\n", step, entries, err)
+		}
+	}
+	injectWriteFault = nil
+
+	failHard(WriteFileAtomic(path, []byte("new"), 0644))
+	if data, err := os.ReadFile(path); err != nil || string(data) != "new" {
+		t.Fatalf("Expected the new contents but got %q, %v\n", data, err)
+	}
+}
+
+func TestRemoveTemporaryFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file.json")
+	failHard(WriteFileAtomic(path, []byte("old"), 0644))
+
+	// a crash leaves the temporary file it was writing to behind
+	injectWriteFault = func(path string, s writeStep) error {
+		if s == stepRename {
+			panic("crash")
+		}
+		return nil
+	}
+	func() {
+		defer func() { recover() }()
+		WriteFileAtomic(path, []byte("new"), 0644)
+	}()
+	injectWriteFault = nil
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 2 {
+		t.Fatalf("Expected a temporary file next to the file but got %v, %v\n", entries, err)
+	}
+
+	others := []string{"file.json.tmp", "file.json.old.tmp", "other.json.123.tmp", "notes.tmp"}
+	for _, name := range others {
+		failHard(os.WriteFile(filepath.Join(dir, name), nil, 0644))
+	}
+	failHard(RemoveTemporaryFiles(path))
+	entries, err := os.ReadDir(dir)
+	failHard(err)
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	expected := append([]string{"file.json"}, others...)
+	sort.Strings(expected)
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Expected only the crashed write's temporary file to be removed but got %v\n",
+			names)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "old" {
+		t.Fatalf("Expected the old contents but got %q, %v\n", data, err)
+	}
+}
@@ -147,39 +147,48 @@ func (b *Bitset) Intersect(a *Bitset) *Bitset {
 	return &Bitset{data: result}
 }
 
-// Overlap takes a sorted  list of ranges ([]uint16 of even length) where each consecutive pair of
+// Overlap takes a sorted  list of ranges ([]uint32 of even length) where each consecutive pair of
 // numbers represents an inclusive range [start, end] of bits. The return value is a sorted list of
-// non-overallping ranges that are set to 'on' within the underlying bitset
-func (b *Bitset) Overlap(ranges []uint16) []uint16 {
-	result := make([]uint16, 0, len(ranges))
-	for i := 0; i < len(ranges); i += 2 {
-		start, end := ranges[i], ranges[i+1]
-		result = append(result, b.filledRanges(int(start), int(end))...)
+// non-overallping ranges that are set to 'on' within the underlying bitset. Ranges usually come off
+// the wire, so those beyond the end of the bitset are ignored rather than iterated over.
+func (b *Bitset) Overlap(ranges []uint32) []uint32 {
+	result := make([]uint32, 0, len(ranges))
+	for i := 0; i+1 < len(ranges); i += 2 {
+		start, end := int(ranges[i]), int(ranges[i+1])
+		if start >= b.size || end < start {
+			continue
+		}
+		result = append(result, b.filledRanges(start, end)...)
 	}
 	return result
 }
 
 // Ranges returns a sorted, non-overallping list of ranges of the underlying bitset that are set to
 // true.
-func (b *Bitset) Ranges() []uint16 {
+func (b *Bitset) Ranges() []uint32 {
 	return b.filledRanges(0, b.size)
 }
 
-func (b *Bitset) filledRanges(start, end int) []uint16 {
-	result := make([]uint16, 0, 2)
+// filledRanges returns the ranges of set bits within the inclusive range [start, end], which is
+// clamped to the size of the bitset
+func (b *Bitset) filledRanges(start, end int) []uint32 {
+	if end >= b.size {
+		end = b.size - 1
+	}
+	result := make([]uint32, 0, 2)
 	rStart, rEnd := start, start-1
 	for i := start; i <= end; i++ {
 		if b.Get(uint64(i)) {
 			rEnd = i
 		} else {
 			if rEnd >= rStart {
-				result = append(result, uint16(rStart), uint16(rEnd))
+				result = append(result, uint32(rStart), uint32(rEnd))
 			}
 			rStart = i + 1
 		}
 	}
 	if rEnd >= rStart {
-		result = append(result, uint16(rStart), uint16(rEnd))
+		result = append(result, uint32(rStart), uint32(rEnd))
 	}
 	return result
 }
@@ -195,13 +204,13 @@ func (b *Bitset) UnfilledRanges() []common.Range {
 			rEnd = i
 		} else {
 			if rEnd >= rStart {
-				result = append(result, common.NewRange(uint16(rStart), uint16(rEnd)))
+				result = append(result, common.NewRange(uint32(rStart), uint32(rEnd)))
 			}
 			rStart = i + 1
 		}
 	}
 	if rEnd >= rStart {
-		result = append(result, common.NewRange(uint16(rStart), uint16(rEnd)))
+		result = append(result, common.NewRange(uint32(rStart), uint32(rEnd)))
 	}
 	return result
 }
@@ -209,12 +218,12 @@ func (b *Bitset) UnfilledRanges() []common.Range {
 // UnfilledItems returns the first `count` items in the bitset that are set to false. If there are
 // fewer than `count` items it returns that many.
 // TODO: this is super gross and inefficient... do something better
-func (b *Bitset) UnfilledItems(count int) []uint16 {
-	result := make([]uint16, 0, count)
+func (b *Bitset) UnfilledItems(count int) []uint32 {
+	result := make([]uint32, 0, count)
 
 	for i := (uint64(0)); i < uint64(b.size) && len(result) < cap(result); i++ {
 		if !b.Get(i) {
-			result = append(result, uint16(i))
+			result = append(result, uint32(i))
 		}
 	}
 
@@ -254,6 +263,9 @@ func (b *Bitset) Serialize() []byte {
 
 // Deserialize converts a previously-serialized bitset into a realized bitset.
 func Deserialize(data []byte) (*Bitset, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("bitset data must be at least 8 bytes long. Got %d", len(data))
+	}
 	size := int(binary.BigEndian.Uint64(data[:8]))
 
 	if l := len(data[8:]); l%8 != 0 {
@@ -261,6 +273,9 @@ func Deserialize(data []byte) (*Bitset, error) {
 	}
 
 	setData := make([]uint64, len(data[8:])/8)
+	if size < 0 || (size+wordSize-1)/wordSize > len(setData) {
+		return nil, fmt.Errorf("bitset of size %d needs more than %d bytes of data", size, len(data))
+	}
 	for i := 0; i < len(setData); i++ {
 		byteIndex := 8 + (i * 8)
 		setData[i] = binary.BigEndian.Uint64(data[byteIndex : byteIndex+8])
@@ -5,6 +5,7 @@ import (
 	"math/rand"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/flu-network/client/common"
 )
@@ -292,40 +293,64 @@ func TestOverlap(t *testing.T) {
 	type expectation struct {
 		desc   string
 		bitset Bitset
-		input  []uint16
-		output []uint16
+		input  []uint32
+		output []uint32
 	}
 
 	testCases := []expectation{
 		{
 			desc:   "no overlap",
 			bitset: *NewBitset(10).Fill(),
-			input:  []uint16{11, 15},
-			output: []uint16{},
+			input:  []uint32{11, 15},
+			output: []uint32{},
 		},
 		{
 			desc:   "full overlap",
 			bitset: *NewBitset(10).Fill(),
-			input:  []uint16{0, 9},
-			output: []uint16{0, 9},
+			input:  []uint32{0, 9},
+			output: []uint32{0, 9},
 		},
 		{
 			desc:   "overlap with start of query",
 			bitset: *NewBitset(10).Fill(),
-			input:  []uint16{5, 15},
-			output: []uint16{5, 9},
+			input:  []uint32{5, 15},
+			output: []uint32{5, 9},
 		},
 		{
 			desc:   "overlap with end of query",
 			bitset: *NewBitset(10).Fill().Unset(0).Unset(1),
-			input:  []uint16{0, 5},
-			output: []uint16{2, 5},
+			input:  []uint32{0, 5},
+			output: []uint32{2, 5},
 		},
 		{
 			desc:   "disjoint overlap",
 			bitset: *NewBitset(10).Fill().Unset(1).Unset(5).Unset(8),
-			input:  []uint16{0, 9},
-			output: []uint16{0, 0, 2, 4, 6, 7, 9, 9},
+			input:  []uint32{0, 9},
+			output: []uint32{0, 0, 2, 4, 6, 7, 9, 9},
+		},
+		{
+			desc:   "beyond 16 bits",
+			bitset: *NewBitset(70000).Set(65535).Set(65536).Set(69999),
+			input:  []uint32{65000, 69998},
+			output: []uint32{65535, 65536},
+		},
+		{
+			desc:   "beyond the end",
+			bitset: *NewBitset(10).Fill(),
+			input:  []uint32{10, 10, 12, 4294967295, 4294967295, 4294967295},
+			output: []uint32{},
+		},
+		{
+			desc:   "huge range",
+			bitset: *NewBitset(10).Fill().Unset(9),
+			input:  []uint32{3, 4294967295},
+			output: []uint32{3, 8},
+		},
+		{
+			desc:   "backwards range",
+			bitset: *NewBitset(10).Fill(),
+			input:  []uint32{5, 2},
+			output: []uint32{},
 		},
 	}
 
@@ -337,6 +362,19 @@ func TestOverlap(t *testing.T) {
 			}
 		})
 	}
+
+	// as many huge ranges as fit in a datagram only cost as much as the bitset is long
+	huge := make([]uint32, 0, 240)
+	for i := 0; i < 120; i++ {
+		huge = append(huge, 0, 4294967295)
+	}
+	deadline := time.Now().Add(time.Second)
+	if result := NewBitset(1000).Fill().Overlap(huge); len(result) != 240 {
+		t.Fatalf("Expected every range to be clamped to the bitset but got %d\n", len(result))
+	}
+	if time.Now().After(deadline) {
+		t.Fatal("Expected huge ranges to be clamped to the bitset")
+	}
 }
 
 func TestRanges(t *testing.T) {
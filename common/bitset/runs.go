@@ -0,0 +1,60 @@
+package bitset
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Runs are a compact encoding of the ranges a bitset has set, which stays small however fragmented
+// the ranges are. Each range is written as the length of the gap before it followed by its own
+// length, as uvarints. Since ranges never touch, every gap but the first and every range is at
+// least one long, so one is subtracted from each of them before they are written. As a result
+// every even-length sequence of uvarints decodes to a valid list of ranges.
+
+// EncodeRuns encodes a sorted list of ranges ([]uint32 of even length) where each consecutive pair
+// of numbers represents an inclusive range [start, end] of bits, as returned by Bitset.Ranges.
+// Returns false if the ranges are unsorted, overlap or touch, since decoding them would not give
+// back the same list.
+func EncodeRuns(ranges []uint32) ([]byte, bool) {
+	result := make([]byte, 0, len(ranges))
+	buf := make([]byte, binary.MaxVarintLen64)
+	next := uint64(0) // the lowest bit the next range may start at
+	for i := 0; i+1 < len(ranges); i += 2 {
+		start, end := uint64(ranges[i]), uint64(ranges[i+1])
+		if start < next || end < start {
+			return nil, false
+		}
+		result = append(result, buf[:binary.PutUvarint(buf, start-next)]...)
+		result = append(result, buf[:binary.PutUvarint(buf, end-start)]...)
+		next = end + 2
+	}
+	return result, true
+}
+
+// DecodeRuns returns the ranges encoded by EncodeRuns. Fails if the data is truncated or the
+// ranges go beyond the largest uint32.
+func DecodeRuns(data []byte) ([]uint32, error) {
+	result := make([]uint32, 0, 2)
+	next := uint64(0)
+	for offset := 0; offset < len(data); {
+		gap, n := binary.Uvarint(data[offset:])
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid run at byte %d", offset)
+		}
+		offset += n
+		length, n := binary.Uvarint(data[offset:])
+		if n <= 0 {
+			return nil, fmt.Errorf("missing or invalid run at byte %d", offset)
+		}
+		offset += n
+
+		if gap > math.MaxUint32 || length > math.MaxUint32 || next+gap+length > math.MaxUint32 {
+			return nil, fmt.Errorf("runs go beyond bit %d", uint64(math.MaxUint32))
+		}
+		start := next + gap
+		result = append(result, uint32(start), uint32(start+length))
+		next = start + length + 2
+	}
+	return result, nil
+}
@@ -0,0 +1,54 @@
+package bitset
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestRuns(t *testing.T) {
+	b := NewBitset(1000)
+	for i := uint64(0); i < 1000; i += 3 {
+		b.Set(i)
+	}
+	b.Set(1).Set(998)
+
+	ranges := b.Ranges()
+	data, ok := EncodeRuns(ranges)
+	if !ok {
+		t.Fatalf("Expected the ranges of a bitset to be encodable\n")
+	}
+	if len(data) != len(ranges) {
+		t.Fatalf("Expected one byte per run but got %d bytes for %d runs\n", len(data), len(ranges))
+	}
+	result, err := DecodeRuns(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result, ranges) {
+		t.Fatalf("Expected %v but got %v\n", ranges, result)
+	}
+
+	extremes := []uint32{0, 0, 2, 70000, math.MaxUint32 - 1, math.MaxUint32}
+	data, _ = EncodeRuns(extremes)
+	if result, err := DecodeRuns(data); err != nil || !reflect.DeepEqual(result, extremes) {
+		t.Fatalf("Expected %v but got %v, %v\n", extremes, result, err)
+	}
+
+	for _, invalid := range [][]uint32{{5, 4}, {0, 5, 6, 7}, {0, 5, 3, 7}, {4, 5, 0, 1}} {
+		if _, ok := EncodeRuns(invalid); ok {
+			t.Fatalf("Expected %v not to be encodable\n", invalid)
+		}
+	}
+
+	for _, invalid := range [][]byte{
+		{0},                                  // missing length
+		{0x80},                               // truncated uvarint
+		{0xff, 0xff, 0xff, 0xff, 0x0f, 0x01}, // beyond the largest uint32
+		{0xfe, 0xff, 0xff, 0xff, 0x0f, 0x00, 0x00, 0x00},
+	} {
+		if _, err := DecodeRuns(invalid); err == nil {
+			t.Fatalf("Expected % x not to be decodable\n", invalid)
+		}
+	}
+}
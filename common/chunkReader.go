@@ -38,6 +38,12 @@ func (cr *ChunkReader) Read(buffer []byte) (int, uint32, error) {
 	return bytesRead, offset, err
 }
 
+// ReadAt reads into buffer from the given offset within the chunk, without moving the position
+// used by Read. Useful for re-reading data that has already been read, e.g., to retransmit it.
+func (cr *ChunkReader) ReadAt(buffer []byte, offset uint32) (int, error) {
+	return cr.Reader.ReadAt(buffer, int64(offset))
+}
+
 func (cr *ChunkReader) Reset() error {
 	_, err := cr.Reader.Seek(0, 0)
 
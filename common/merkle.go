@@ -0,0 +1,125 @@
+package common
+
+import (
+	"crypto/sha1"
+)
+
+// Merkle trees are built over the chunk hashes of a file as described in RFC 6962: leaves are
+// hashed with a 0x00 prefix and interior nodes with a 0x01 prefix, so that a leaf can never be
+// passed off as an interior node. A node without a sibling is promoted to the next level as is.
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+// MerkleTree holds every level of a merkle tree over a file's chunk hashes, from the leaves up to
+// the root. It is immutable once built.
+type MerkleTree struct {
+	chunkCount int
+	levels     [][]Sha1Hash // levels[0] holds the leaves, the last level holds only the root
+}
+
+// NewMerkleTree builds the merkle tree over the given chunk hashes, in chunk order
+func NewMerkleTree(chunkHashes []Sha1Hash) *MerkleTree {
+	if len(chunkHashes) == 0 {
+		// the root of an empty tree is the hash of nothing at all
+		return &MerkleTree{levels: [][]Sha1Hash{{Sha1Hash{Data: sha1.Sum(nil)}}}}
+	}
+
+	level := make([]Sha1Hash, len(chunkHashes))
+	for i := range chunkHashes {
+		level[i] = merkleLeaf(&chunkHashes[i])
+	}
+	levels := [][]Sha1Hash{level}
+	for len(level) > 1 {
+		next := make([]Sha1Hash, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+			} else {
+				next = append(next, merkleNode(&level[i], &level[i+1]))
+			}
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return &MerkleTree{chunkCount: len(chunkHashes), levels: levels}
+}
+
+// MerkleRoot returns the root of the merkle tree over the given chunk hashes
+func MerkleRoot(chunkHashes []Sha1Hash) *Sha1Hash {
+	return NewMerkleTree(chunkHashes).Root()
+}
+
+// Root returns the root hash of the tree, which identifies the file it was built over
+func (t *MerkleTree) Root() *Sha1Hash {
+	root := t.levels[len(t.levels)-1][0]
+	return &root
+}
+
+// Proof returns the inclusion proof of the given chunk: the sibling of every node on the path from
+// the chunk's leaf to the root, starting at the bottom. Returns nil if the chunk is out of range.
+func (t *MerkleTree) Proof(chunk int) []Sha1Hash {
+	if chunk < 0 || chunk >= t.chunkCount {
+		return nil
+	}
+	result := []Sha1Hash{}
+	index := chunk
+	for _, level := range t.levels[:len(t.levels)-1] {
+		sibling := index ^ 1
+		if sibling < len(level) {
+			result = append(result, level[sibling])
+		}
+		index /= 2
+	}
+	return result
+}
+
+// VerifyMerkleProof returns true if proof shows that chunkHash is the hash of the given chunk of a
+// file with chunkCount chunks and the given merkle root. See RFC 9162 section 2.1.3.2.
+func VerifyMerkleProof(
+	root *Sha1Hash,
+	chunkHash *Sha1Hash,
+	chunk int,
+	chunkCount int,
+	proof []Sha1Hash,
+) bool {
+	if chunk < 0 || chunk >= chunkCount {
+		return false
+	}
+	index, last := chunk, chunkCount-1
+	node := merkleLeaf(chunkHash)
+	for i := range proof {
+		if last == 0 {
+			return false // the proof is longer than the tree is tall
+		}
+		if index%2 == 1 || index == last {
+			node = merkleNode(&proof[i], &node)
+			// skip the levels where this node has no sibling and is promoted as is
+			for index%2 == 0 && index != 0 {
+				index /= 2
+				last /= 2
+			}
+		} else {
+			node = merkleNode(&node, &proof[i])
+		}
+		index /= 2
+		last /= 2
+	}
+	return last == 0 && node.Data == root.Data
+}
+
+func merkleLeaf(chunkHash *Sha1Hash) Sha1Hash {
+	data := make([]byte, 0, 21)
+	data = append(data, merkleLeafPrefix)
+	data = append(data, chunkHash.Data[:]...)
+	return Sha1Hash{Data: sha1.Sum(data)}
+}
+
+func merkleNode(left, right *Sha1Hash) Sha1Hash {
+	data := make([]byte, 0, 41)
+	data = append(data, merkleNodePrefix)
+	data = append(data, left.Data[:]...)
+	data = append(data, right.Data[:]...)
+	return Sha1Hash{Data: sha1.Sum(data)}
+}
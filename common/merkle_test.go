@@ -0,0 +1,77 @@
+package common
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"testing"
+)
+
+// rfc6962Root computes a merkle root straight from the recursive definition in RFC 6962
+func rfc6962Root(leaves []Sha1Hash) Sha1Hash {
+	if len(leaves) == 1 {
+		return merkleLeaf(&leaves[0])
+	}
+	k := 1
+	for k*2 < len(leaves) {
+		k *= 2
+	}
+	left, right := rfc6962Root(leaves[:k]), rfc6962Root(leaves[k:])
+	return merkleNode(&left, &right)
+}
+
+func testChunkHashes(count int) []Sha1Hash {
+	result := make([]Sha1Hash, count)
+	for i := range result {
+		result[i] = Sha1Hash{Data: sha1.Sum([]byte(fmt.Sprintf("chunk %d", i)))}
+	}
+	return result
+}
+
+func TestMerkleRoot(t *testing.T) {
+	if MerkleRoot(nil).Data != sha1.Sum(nil) {
+		t.Fatalf("Expected the root of an empty tree to be the hash of nothing\n")
+	}
+	for count := 1; count <= 33; count++ {
+		hashes := testChunkHashes(count)
+		if actual, expected := MerkleRoot(hashes), rfc6962Root(hashes); actual.Data != expected.Data {
+			t.Fatalf("%d chunks: expected root %v but got %v\n", count, &expected, actual)
+		}
+	}
+}
+
+func TestMerkleProof(t *testing.T) {
+	for count := 1; count <= 33; count++ {
+		hashes := testChunkHashes(count)
+		tree := NewMerkleTree(hashes)
+		root := tree.Root()
+		for chunk := range hashes {
+			proof := tree.Proof(chunk)
+			if !VerifyMerkleProof(root, &hashes[chunk], chunk, count, proof) {
+				t.Fatalf("%d chunks: proof of chunk %d rejected\n", count, chunk)
+			}
+
+			// the proof must not vouch for any other chunk or data
+			other := (chunk + 1) % count
+			if other != chunk && VerifyMerkleProof(root, &hashes[other], chunk, count, proof) {
+				t.Fatalf("%d chunks: proof of chunk %d accepted the hash of chunk %d\n",
+					count, chunk, other)
+			}
+			if other != chunk && VerifyMerkleProof(root, &hashes[chunk], other, count, proof) {
+				t.Fatalf("%d chunks: proof of chunk %d accepted as chunk %d\n", count, chunk, other)
+			}
+			if len(proof) > 0 {
+				tampered := append([]Sha1Hash{}, proof...)
+				tampered[len(tampered)-1].Data[0] ^= 1
+				if VerifyMerkleProof(root, &hashes[chunk], chunk, count, tampered) {
+					t.Fatalf("%d chunks: tampered proof of chunk %d accepted\n", count, chunk)
+				}
+			}
+		}
+		if tree.Proof(count) != nil || tree.Proof(-1) != nil {
+			t.Fatalf("%d chunks: expected no proof of chunks out of range\n", count)
+		}
+		if VerifyMerkleProof(root, &hashes[0], count, count, tree.Proof(0)) {
+			t.Fatalf("%d chunks: accepted a chunk out of range\n", count)
+		}
+	}
+}
@@ -1,14 +1,15 @@
 package common
 
-// Range is a tuple of inclusive start and end indices, each of which is limited to 16 bits
+// Range is a tuple of inclusive start and end indices, each of which is limited to 32 bits
 type Range struct {
-	Start uint16
-	End   uint16
+	Start uint32
+	End   uint32
 }
 
-// NewRange returns a range by value. Note: Since a Range is only 32 bits (smaller than a pointer),
-// it is returned by value and not by pointer
-func NewRange(start, end uint16) Range {
+// NewRange returns a range by value. A Range is two uint32s, so copying it costs about as much as
+// copying a pointer, and unlike a pointer, a copy needs no heap allocation and cannot be changed
+// through another reference to it
+func NewRange(start, end uint32) Range {
 	return Range{
 		Start: start,
 		End:   end,
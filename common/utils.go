@@ -43,6 +43,39 @@ func HashFile(path string) (*Sha1Hash, error) {
 	return (&Sha1Hash{}).FromSlice(hash.Sum(nil)), nil
 }
 
+// HashFileChunks hashes a file in a single pass, returning both the sha1 hash of the whole file and
+// the sha1 hash of every chunkSize-byte chunk of it. The last chunk may be shorter than chunkSize.
+// An empty file has no chunks.
+func HashFileChunks(path string, chunkSize int) (*Sha1Hash, []Sha1Hash, error) {
+	if chunkSize <= 0 {
+		return nil, nil, fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	fileHash := sha1.New()
+	chunkHashes := []Sha1Hash{}
+	for {
+		chunkHash := sha1.New()
+		copied, err := io.CopyN(io.MultiWriter(fileHash, chunkHash), f, int64(chunkSize))
+		if copied > 0 {
+			chunkHashes = append(chunkHashes, *(&Sha1Hash{}).FromSlice(chunkHash.Sum(nil)))
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return (&Sha1Hash{}).FromSlice(fileHash.Sum(nil)), chunkHashes, nil
+}
+
 func failHard(err error) {
 	if err != nil {
 		panic(err)
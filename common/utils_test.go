@@ -0,0 +1,46 @@
+package common
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestHashFileChunks(t *testing.T) {
+	const chunkSize = 1000
+
+	for _, fileSize := range []int{0, 3, chunkSize, 2*chunkSize + 1} {
+		t.Run(fmt.Sprintf("%d bytes", fileSize), func(t *testing.T) {
+			testFilePath := fmt.Sprintf("/tmp/flu_chunks_%d.txt", fileSize)
+			genStableRandomishData(fileSize, testFilePath)
+			defer os.Remove(testFilePath)
+
+			fileHash, chunkHashes, err := HashFileChunks(testFilePath, chunkSize)
+			failHard(err)
+
+			expectedFileHash, err := HashFile(testFilePath)
+			failHard(err)
+			if fileHash.Data != expectedFileHash.Data {
+				t.Fatalf("Expected file hash %v but got %v\n", expectedFileHash, fileHash)
+			}
+
+			data, err := os.ReadFile(testFilePath)
+			failHard(err)
+			expectedChunks := (fileSize + chunkSize - 1) / chunkSize
+			if len(chunkHashes) != expectedChunks {
+				t.Fatalf("Expected %d chunk hashes but got %d\n", expectedChunks, len(chunkHashes))
+			}
+			for i := range chunkHashes {
+				end := (i + 1) * chunkSize
+				if end > len(data) {
+					end = len(data)
+				}
+				expected := sha1.Sum(data[i*chunkSize : end])
+				if chunkHashes[i].Data != expected {
+					t.Fatalf("Chunk %d: expected hash %x but got %v\n", i, expected, chunkHashes[i])
+				}
+			}
+		})
+	}
+}
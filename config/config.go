@@ -0,0 +1,131 @@
+// Package config reads the settings of the flu daemon and CLI. Every setting is a command-line flag
+// that can also be given as an environment variable or in the config file, in that order of
+// precedence.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/flu-network/client/common"
+)
+
+// EnvPrefix starts the name of the environment variable of every setting
+const EnvPrefix = "FLU_"
+
+// EnvName returns the name of the environment variable a setting can be given in, e.g., FLU_PORT
+// for -port and FLU_PEER_PORTS for -peer-ports
+func EnvName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// LoadEnv sets every flag of a parsed FlagSet that was not given on the command line from its
+// environment variable. Returns the names of the flags given either way, whose values the config
+// file does not change.
+func LoadEnv(flags *flag.FlagSet) (map[string]bool, error) {
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	var result error
+	flags.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(EnvName(f.Name))
+		if result != nil || given[f.Name] || !ok {
+			return
+		}
+		if err := flags.Set(f.Name, value); err != nil {
+			result = fmt.Errorf("%s: %v", EnvName(f.Name), err)
+		}
+		given[f.Name] = true
+	})
+	return given, result
+}
+
+// File is a config file. It holds a JSON object with a member for each setting it gives, named as
+// its command-line flag without the dash, e.g., {"port": 61697, "max-upload": "500K"}.
+type File struct {
+	Path     string
+	Settings map[string]string // setting name -> value, as it would be given on the command line
+}
+
+// ReadFile reads a config file. A file that does not exist holds no settings.
+func ReadFile(path string) (*File, error) {
+	result := &File{Path: path, Settings: make(map[string]string)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return result, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	members := make(map[string]interface{})
+	if err := json.Unmarshal(data, &members); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for name, member := range members {
+		switch value := member.(type) {
+		case string:
+			result.Settings[name] = value
+		case float64:
+			result.Settings[name] = strconv.FormatFloat(value, 'f', -1, 64)
+		case bool:
+			result.Settings[name] = strconv.FormatBool(value)
+		default:
+			return nil, fmt.Errorf("%s: %s must be a string, number or boolean", path, name)
+		}
+	}
+	return result, nil
+}
+
+// Apply sets the flags of a FlagSet from the config file, except for those that are skipped.
+// Fails if the file has a setting that is not a flag, or if any value is invalid, but sets every
+// flag it can regardless.
+func (f *File) Apply(flags *flag.FlagSet, skip map[string]bool) error {
+	names := make([]string, 0, len(f.Settings))
+	for name := range f.Settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var result error
+	for _, name := range names {
+		var err error
+		if flags.Lookup(name) == nil {
+			err = fmt.Errorf("%s: unknown setting %q", f.Path, name)
+		} else if !skip[name] {
+			if err = flags.Set(name, f.Settings[name]); err != nil {
+				err = fmt.Errorf("%s: %s: %v", f.Path, name, err)
+			}
+		}
+		if result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// Write saves the config file. The file is replaced atomically, so that it is never seen
+// half-written, even after a crash, and any temporary files earlier writes left behind when they
+// crashed are removed. Only one process may write the file at a time.
+func (f *File) Write() error {
+	data, err := json.MarshalIndent(f.Settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(f.Path), os.ModePerm); err != nil {
+		return err
+	}
+	if err := common.RemoveTemporaryFiles(f.Path); err != nil {
+		return err
+	}
+	return common.WriteFileAtomic(f.Path, append(data, '\n'), 0644)
+}
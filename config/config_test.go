@@ -0,0 +1,125 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestEnvName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"port":       "FLU_PORT",
+		"peer-ports": "FLU_PEER_PORTS",
+	} {
+		if result := EnvName(name); result != expected {
+			t.Fatalf("Expected %s for %s but got %s\n", expected, name, result)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	contents := `{"port": 61697, "socket": "/tmp/from-file.sock", "downloads": "/tmp/downloads"}`
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FLU_SOCKET", "/tmp/from-env.sock")
+	t.Setenv("FLU_DOWNLOADS", "/tmp/from-env")
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	port := flags.Int("port", 61696, "")
+	socket := flags.String("socket", "/tmp/flu-network.sock", "")
+	downloads := flags.String("downloads", "", "")
+	catalogue := flags.String("catalogue", "/tmp/catalogue", "")
+	if err := flags.Parse([]string{"-downloads", "/tmp/from-flag"}); err != nil {
+		t.Fatal(err)
+	}
+
+	given, err := LoadEnv(flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Apply(flags, given); err != nil {
+		t.Fatal(err)
+	}
+	if *port != 61697 {
+		t.Fatalf("Expected the port from the config file but got %d\n", *port)
+	}
+	if *socket != "/tmp/from-env.sock" {
+		t.Fatalf("Expected the environment to override the config file but got %s\n", *socket)
+	}
+	if *downloads != "/tmp/from-flag" {
+		t.Fatalf("Expected flags to override everything else but got %s\n", *downloads)
+	}
+	if *catalogue != "/tmp/catalogue" {
+		t.Fatalf("Expected settings given nowhere to keep their default but got %s\n", *catalogue)
+	}
+}
+
+func TestInvalidFile(t *testing.T) {
+	dir := t.TempDir()
+	testCases := map[string]string{
+		"not json":        "port = 61697\n",
+		"not an object":   `[61697]`,
+		"nested value":    `{"port": {"value": 61697}}`,
+		"unknown setting": `{"colour": "blue"}`,
+		"invalid value":   `{"port": "f100"}`,
+	}
+	for name, contents := range testCases {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+			flags := flag.NewFlagSet("test", flag.ContinueOnError)
+			flags.Int("port", 61696, "")
+			file, err := ReadFile(path)
+			if err == nil {
+				err = file.Apply(flags, nil)
+			}
+			if err == nil {
+				t.Fatalf("Expected %q to be rejected\n", contents)
+			}
+		})
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flu", "config.json")
+	file, err := ReadFile(path)
+	if err != nil || len(file.Settings) != 0 {
+		t.Fatalf("Expected a missing config file to be empty but got %v, %v\n", file, err)
+	}
+	file.Settings["max-upload"] = "500K"
+	file.Settings["peer-chunks"] = "4"
+	if err := file.Write(); err != nil {
+		t.Fatal(err)
+	}
+
+	reread, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reread, file) {
+		t.Fatalf("Expected %v to be read back but got %v\n", file, reread)
+	}
+
+	// a write cut short by a crash leaves a temporary file, which the next write removes
+	crashed := path + ".12345.tmp"
+	if err := os.WriteFile(crashed, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Write(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil || len(entries) != 1 || entries[0].Name() != "config.json" {
+		t.Fatalf("Expected no temporary files to be left behind but got %v, %v\n", entries, err)
+	}
+}
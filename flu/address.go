@@ -0,0 +1,35 @@
+package flu
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// Hosts are identified by netip.Addr, which holds IPv4 and IPv6 addresses alike and can be used as
+// a map key. IPv4 addresses are always held in their 4-byte form, even when they arrive on a
+// dual-stack socket as IPv4-mapped IPv6 addresses. Link-local IPv6 addresses carry the zone
+// (interface) they were reached on, without which they cannot be used.
+
+// addrOf returns the address of the host a datagram came from
+func addrOf(udpAddr *net.UDPAddr) (netip.Addr, error) {
+	addr := udpAddr.AddrPort().Addr()
+	if !addr.IsValid() {
+		return addr, fmt.Errorf("invalid IP address %v", udpAddr.IP)
+	}
+	return addr.Unmap(), nil
+}
+
+// udpAddrOf returns the UDP address of a port on a host
+func udpAddrOf(addr netip.Addr, port uint16) *net.UDPAddr {
+	return net.UDPAddrFromAddrPort(netip.AddrPortFrom(addr, port))
+}
+
+// withZone returns an address a host reported as its own, which is link-local, as reached over the
+// interface the report arrived on. Other addresses are returned untouched.
+func withZone(addr netip.Addr, via *net.UDPAddr) netip.Addr {
+	if addr.Is6() && addr.Zone() == "" && (addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast()) {
+		return addr.WithZone(via.Zone)
+	}
+	return addr
+}
@@ -0,0 +1,149 @@
+package flu
+
+import (
+	"time"
+)
+
+// Congestion control parameters. Flu is a background "scavenger" protocol in the spirit of LEDBAT
+// (RFC 6817): it grows its window while the round-trip time stays close to the smallest one seen,
+// and shrinks it as soon as queues start building up. This lets other traffic (video calls, etc.)
+// take priority on busy networks. Packet loss is treated as in TCP: the window is halved, at most
+// once per round trip.
+const (
+	initialCongestionWindow = 4 // packets
+	minCongestionWindow     = 2 // packets
+	ledbatTarget            = 25 * time.Millisecond
+	ledbatGain              = 1.0
+	minRTO                  = 200 * time.Millisecond
+)
+
+// congestionController decides how many packets a SenderConnection may have in flight. It is
+// driven entirely by the events reported to it, so it has no notion of wall-clock time.
+// Not threadsafe.
+type congestionController struct {
+	cwnd      float64 // congestion window, in packets
+	slowStart bool    // the window grows exponentially until queues build up or it reaches ssthresh
+	ssthresh  float64
+	baseRTT   time.Duration
+	srtt      time.Duration
+	rttvar    time.Duration
+	lastRTT   time.Duration
+
+	// losses of packets sent before this sequence number belong to a round trip whose loss has
+	// already been reacted to
+	recoverySeq uint64
+}
+
+func newCongestionController() *congestionController {
+	return &congestionController{
+		cwnd:      initialCongestionWindow,
+		slowStart: true,
+		ssthresh:  1 << 16,
+	}
+}
+
+// window returns the number of packets that may be in flight, never exceeding the receiver's cap
+func (cc *congestionController) window(windowCap uint16) int {
+	result := int(cc.cwnd)
+	if result > int(windowCap) {
+		result = int(windowCap)
+	}
+	if result < 1 {
+		result = 1
+	}
+	return result
+}
+
+// onRTTSample records a round-trip time measured from a packet that was sent exactly once
+func (cc *congestionController) onRTTSample(rtt time.Duration) {
+	if rtt <= 0 {
+		rtt = time.Microsecond
+	}
+	cc.lastRTT = rtt
+	if cc.baseRTT == 0 || rtt < cc.baseRTT {
+		cc.baseRTT = rtt
+	}
+
+	// smoothed RTT and variance, as in RFC 6298
+	if cc.srtt == 0 {
+		cc.srtt = rtt
+		cc.rttvar = rtt / 2
+		return
+	}
+	delta := cc.srtt - rtt
+	if delta < 0 {
+		delta = -delta
+	}
+	cc.rttvar = (3*cc.rttvar + delta) / 4
+	cc.srtt = (7*cc.srtt + rtt) / 8
+}
+
+// queuingDelay estimates how long packets currently spend queued somewhere along the path
+func (cc *congestionController) queuingDelay() time.Duration {
+	return cc.lastRTT - cc.baseRTT
+}
+
+// onAck grows or shrinks the window after the given number of packets were newly acknowledged
+func (cc *congestionController) onAck(packets int) {
+	if packets <= 0 {
+		return
+	}
+	delay := cc.queuingDelay()
+
+	if cc.slowStart {
+		if delay < ledbatTarget/2 && cc.cwnd < cc.ssthresh {
+			cc.cwnd += float64(packets)
+			return
+		}
+		cc.slowStart = false // queues are building; switch to delay-based control
+	}
+
+	offTarget := float64(ledbatTarget-delay) / float64(ledbatTarget)
+	if offTarget < -1 {
+		offTarget = -1
+	}
+	cc.cwnd += ledbatGain * offTarget * float64(packets) / cc.cwnd
+	if cc.cwnd < minCongestionWindow {
+		cc.cwnd = minCongestionWindow
+	}
+}
+
+// onLoss halves the window in response to the loss of the packet sent with sequence number seq.
+// nextSeq is the sequence number the next packet will be sent with.
+func (cc *congestionController) onLoss(seq, nextSeq uint64) {
+	if seq < cc.recoverySeq {
+		return // already reacted to this round trip's losses
+	}
+	cc.cwnd /= 2
+	if cc.cwnd < minCongestionWindow {
+		cc.cwnd = minCongestionWindow
+	}
+	cc.slowStart = false
+	cc.recoverySeq = nextSeq
+}
+
+// onTimeout collapses the window after the retransmission timer expired
+func (cc *congestionController) onTimeout(nextSeq uint64) {
+	cc.ssthresh = cc.cwnd / 2
+	if cc.ssthresh < minCongestionWindow {
+		cc.ssthresh = minCongestionWindow
+	}
+	cc.cwnd = minCongestionWindow
+	cc.slowStart = true
+	cc.recoverySeq = nextSeq
+}
+
+// rto returns the retransmission timeout suggested by the RTTs measured so far
+func (cc *congestionController) rto() time.Duration {
+	if cc.srtt == 0 {
+		return initialRTO
+	}
+	result := cc.srtt + 4*cc.rttvar
+	if result < minRTO {
+		result = minRTO
+	}
+	if result > maxRTO {
+		result = maxRTO
+	}
+	return result
+}
@@ -0,0 +1,111 @@
+package flu
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCongestionController(t *testing.T) {
+	t.Run("slow start grows the window while delay is low", func(t *testing.T) {
+		cc := newCongestionController()
+		for i := 0; i < 10; i++ {
+			cc.onRTTSample(time.Millisecond)
+			cc.onAck(1)
+		}
+		if cc.window(1024) != initialCongestionWindow+10 {
+			t.Fatalf("Expected window %d but got %d\n", initialCongestionWindow+10, cc.window(1024))
+		}
+	})
+
+	t.Run("window never exceeds the receiver's cap", func(t *testing.T) {
+		cc := newCongestionController()
+		cc.onRTTSample(time.Millisecond)
+		cc.onAck(100)
+		if cc.window(16) != 16 {
+			t.Fatalf("Expected window 16 but got %d\n", cc.window(16))
+		}
+	})
+
+	t.Run("rising delay shrinks the window", func(t *testing.T) {
+		cc := newCongestionController()
+		cc.onRTTSample(time.Millisecond)
+		cc.onAck(60) // cwnd = 64
+		before := cc.cwnd
+
+		// other traffic starts queuing ahead of ours
+		for i := 0; i < 100; i++ {
+			cc.onRTTSample(time.Millisecond + 2*ledbatTarget)
+			cc.onAck(1)
+		}
+		if cc.cwnd >= before {
+			t.Fatalf("Expected window to shrink below %v but got %v\n", before, cc.cwnd)
+		}
+		if cc.slowStart {
+			t.Fatalf("Expected slow start to have ended\n")
+		}
+
+		// and once it goes away, the window grows again
+		shrunk := cc.cwnd
+		for i := 0; i < 100; i++ {
+			cc.onRTTSample(time.Millisecond)
+			cc.onAck(1)
+		}
+		if cc.cwnd <= shrunk {
+			t.Fatalf("Expected window to grow above %v but got %v\n", shrunk, cc.cwnd)
+		}
+	})
+
+	t.Run("loss halves the window once per round trip", func(t *testing.T) {
+		cc := newCongestionController()
+		cc.onRTTSample(time.Millisecond)
+		cc.onAck(28) // cwnd = 32
+
+		cc.onLoss(10, 40)
+		if cc.cwnd != 16 {
+			t.Fatalf("Expected window 16 after loss but got %v\n", cc.cwnd)
+		}
+		cc.onLoss(11, 41) // sent before the first reduction
+		if cc.cwnd != 16 {
+			t.Fatalf("Expected second loss in the same round trip to be ignored but got %v\n", cc.cwnd)
+		}
+		cc.onLoss(40, 50)
+		if cc.cwnd != 8 {
+			t.Fatalf("Expected window 8 after loss in a later round trip but got %v\n", cc.cwnd)
+		}
+	})
+
+	t.Run("timeout collapses the window", func(t *testing.T) {
+		cc := newCongestionController()
+		cc.onRTTSample(time.Millisecond)
+		cc.onAck(28) // cwnd = 32
+
+		cc.onTimeout(40)
+		if cc.window(1024) != minCongestionWindow || cc.ssthresh != 16 {
+			t.Fatalf("Expected window %d and ssthresh 16 but got %d and %v\n",
+				minCongestionWindow, cc.window(1024), cc.ssthresh)
+		}
+		for i := 0; i < 1000; i++ {
+			cc.onLoss(uint64(i), 40)
+		}
+		if cc.window(1024) != minCongestionWindow {
+			t.Fatalf("Expected window to stay at the minimum but got %d\n", cc.window(1024))
+		}
+	})
+
+	t.Run("rto follows measured rtt", func(t *testing.T) {
+		cc := newCongestionController()
+		if cc.rto() != initialRTO {
+			t.Fatalf("Expected initial rto %v but got %v\n", initialRTO, cc.rto())
+		}
+		cc.onRTTSample(time.Millisecond)
+		if cc.rto() != minRTO {
+			t.Fatalf("Expected rto to be clamped to %v but got %v\n", minRTO, cc.rto())
+		}
+		for i := 0; i < 50; i++ {
+			cc.onRTTSample(time.Second)
+		}
+		if cc.rto() < time.Second || cc.rto() > maxRTO {
+			t.Fatalf("Expected rto between 1s and %v but got %v\n", maxRTO, cc.rto())
+		}
+	})
+}
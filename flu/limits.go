@@ -0,0 +1,158 @@
+package flu
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/flu-network/client/common"
+	"github.com/flu-network/client/flu/ratelimit"
+)
+
+// Limits caps the bandwidth flu uses, in bytes per second. A limit of ratelimit.Unlimited
+// disables it.
+type Limits struct {
+	Upload          int64 // total upload to all peers
+	Download        int64 // total download of all files
+	UploadPerPeer   int64 // upload to any single peer
+	DownloadPerFile int64 // download of any single file
+}
+
+// LimitNames are the user-facing names of the fields of Limits, as accepted by Limits.Field
+var LimitNames = []string{"upload", "download", "peer-upload", "file-download"}
+
+// Field returns a pointer to the limit with the given user-facing name
+func (l *Limits) Field(name string) (*int64, error) {
+	switch name {
+	case "upload":
+		return &l.Upload, nil
+	case "download":
+		return &l.Download, nil
+	case "peer-upload":
+		return &l.UploadPerPeer, nil
+	case "file-download":
+		return &l.DownloadPerFile, nil
+	}
+	return nil, fmt.Errorf("unknown limit '%s'. Expected one of %s",
+		name, strings.Join(LimitNames, ", "))
+}
+
+// limiter holds the token buckets that enforce a Server's Limits. Buckets are handed out to
+// transfers and updated in place, so new limits apply to transfers that are already running.
+// The limits in force are the configured ones, overridden by the active schedule rule (if any).
+type limiter struct {
+	limits       Limits        // as configured by SetLimits
+	schedule     Schedule      // rules that override limits at certain times
+	active       *ScheduleRule // the schedule rule in force, or nil
+	clock        func() time.Time
+	effective    Limits // limits overridden by the active rule
+	upload       *ratelimit.Bucket
+	download     *ratelimit.Bucket
+	peerUploads  map[netip.Addr]*ratelimit.Bucket
+	peerUsedAt   map[netip.Addr]time.Time // when each of peerUploads was last handed out
+	fileDownload map[common.Sha1Hash]*ratelimit.Bucket
+}
+
+func newLimiter() *limiter {
+	return &limiter{
+		clock:        time.Now,
+		upload:       ratelimit.NewBucket(ratelimit.Unlimited),
+		download:     ratelimit.NewBucket(ratelimit.Unlimited),
+		peerUploads:  make(map[netip.Addr]*ratelimit.Bucket),
+		peerUsedAt:   make(map[netip.Addr]time.Time),
+		fileDownload: make(map[common.Sha1Hash]*ratelimit.Bucket),
+	}
+}
+
+// Limits returns the configured bandwidth limits. The active schedule rule may override them; see
+// ScheduleStatus.
+func (s *Server) Limits() Limits {
+	s.limitLock.Lock()
+	defer s.limitLock.Unlock()
+	return s.limiter.limits
+}
+
+// SetLimits changes the configured bandwidth limits. They take effect immediately (except where
+// the active schedule rule overrides them), including for transfers that are already running.
+// Negative limits are treated as ratelimit.Unlimited.
+func (s *Server) SetLimits(limits Limits) {
+	s.limitLock.Lock()
+	defer s.limitLock.Unlock()
+	s.limiter.limits = limits
+	s.limiter.apply()
+}
+
+// apply sets every bucket's rate to the limits in force. Callers must hold limitLock.
+func (l *limiter) apply() {
+	l.effective = l.limits
+	if l.active != nil {
+		l.effective = l.active.Overrides.apply(l.limits)
+	}
+	l.upload.SetRate(l.effective.Upload)
+	l.download.SetRate(l.effective.Download)
+	for _, b := range l.peerUploads {
+		b.SetRate(l.effective.UploadPerPeer)
+	}
+	for _, b := range l.fileDownload {
+		b.SetRate(l.effective.DownloadPerFile)
+	}
+}
+
+// uploadBuckets returns the buckets every datagram sent to peer must draw from. Peers are
+// identified by address alone because receivers dial from a new port for every chunk.
+func (s *Server) uploadBuckets(peer netip.Addr) []*ratelimit.Bucket {
+	s.limitLock.Lock()
+	defer s.limitLock.Unlock()
+	l := s.limiter
+	b, ok := l.peerUploads[peer]
+	if !ok {
+		b = ratelimit.NewBucket(l.effective.UploadPerPeer)
+		l.peerUploads[peer] = b
+	}
+	l.peerUsedAt[peer] = l.clock()
+	return []*ratelimit.Bucket{l.upload, b}
+}
+
+// forgetIdleUploadBuckets drops the per-peer buckets of peers that nothing has been uploaded to
+// for as long as the peer table remembers peers. Buckets of peers with uploads in progress are
+// kept however old they are, so that every upload to a peer draws from the same bucket.
+func (s *Server) forgetIdleUploadBuckets() {
+	s.transferLock.Lock()
+	defer s.transferLock.Unlock()
+	uploading := make(map[netip.Addr]bool, len(s.uploads))
+	for key := range s.uploads {
+		uploading[key.remoteHost] = true
+	}
+
+	s.limitLock.Lock()
+	defer s.limitLock.Unlock()
+	l := s.limiter
+	now := l.clock()
+	for peer, usedAt := range l.peerUsedAt {
+		if !uploading[peer] && now.Sub(usedAt) > peerExpiry {
+			delete(l.peerUploads, peer)
+			delete(l.peerUsedAt, peer)
+		}
+	}
+}
+
+// downloadBuckets returns the buckets every datagram received for the given file must draw from
+func (s *Server) downloadBuckets(hash *common.Sha1Hash) []*ratelimit.Bucket {
+	s.limitLock.Lock()
+	defer s.limitLock.Unlock()
+	l := s.limiter
+	b, ok := l.fileDownload[*hash]
+	if !ok {
+		b = ratelimit.NewBucket(l.effective.DownloadPerFile)
+		l.fileDownload[*hash] = b
+	}
+	return []*ratelimit.Bucket{l.download, b}
+}
+
+// forgetDownloadBucket drops the per-file bucket of a download that is no longer running
+func (s *Server) forgetDownloadBucket(hash *common.Sha1Hash) {
+	s.limitLock.Lock()
+	defer s.limitLock.Unlock()
+	delete(s.limiter.fileDownload, *hash)
+}
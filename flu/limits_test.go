@@ -0,0 +1,40 @@
+package flu
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestForgetIdleUploadBuckets(t *testing.T) {
+	clock := &fakeClock{t: at(time.Monday, 12, 0)}
+	s := NewServer(61690, nil)
+	s.limiter.clock = clock.now
+	s.SetLimits(Limits{UploadPerPeer: 1 << 20})
+	idle := netip.MustParseAddr("10.0.0.2")
+	busy := netip.MustParseAddr("10.0.0.3")
+	idleBucket := s.uploadBuckets(idle)[1]
+	busyBucket := s.uploadBuckets(busy)[1]
+	s.uploads[uploadKey{remoteHost: busy, remotePort: 50000}] = &SenderConnection{}
+
+	clock.advance(peerExpiry / 2)
+	s.forgetIdleUploadBuckets()
+	if len(s.limiter.peerUploads) != 2 {
+		t.Fatalf("Expected recently used buckets to be kept but got %v\n", s.limiter.peerUploads)
+	}
+
+	// buckets are dropped once their peer has not been uploaded to for a while, unless an upload
+	// to it is still running
+	clock.advance(peerExpiry/2 + time.Second)
+	s.forgetIdleUploadBuckets()
+	if _, ok := s.limiter.peerUploads[idle]; ok || len(s.limiter.peerUploads) != 1 {
+		t.Fatalf("Expected only the idle peer's bucket to be dropped but got %v\n",
+			s.limiter.peerUploads)
+	}
+	if s.uploadBuckets(busy)[1] != busyBucket {
+		t.Fatal("Expected new uploads to a busy peer to share its bucket")
+	}
+	if b := s.uploadBuckets(idle)[1]; b == idleBucket || b.Rate() != 1<<20 {
+		t.Fatalf("Expected a new bucket at the configured rate but got %d\n", b.Rate())
+	}
+}
@@ -1,11 +1,62 @@
 package messages
 
+import (
+	"errors"
+	"hash/crc32"
+)
+
 // Message describes the methods that all flu messages have in common.
 type Message interface {
 	Serialize() []byte // Serialize converts its subject into a []byte for transmission
 	Type() uint8       // Type returns a uint8 that identidies the type of message
 }
 
+// ProtocolVersion is the version of the wire protocol spoken by this daemon. It is incremented
+// whenever the format of an existing message changes, once per release rather than per change.
+// Peers that speak different versions settle on the lower one with a Hello exchange.
+//
+//	1: datagrams start with a version header, and peers exchange Hellos
+//	2: datagrams end with a CRC-32C trailer, files are listed page by page, chunk indices are 32
+//	   bits, chunk availability may be sent as run lengths, addresses may be IPv6, and
+//	   DiscoverHostRequests carry the port the asker listens on
+const ProtocolVersion = uint8(2)
+
+// MinProtocolVersion is the oldest version of the wire protocol this daemon still understands.
+// Only the layouts of the current version are parsed, so it is lowered only when a newer version
+// is released alongside the layouts of the one before it. Peers that speak an older version can
+// still exchange Hellos with this daemon, whatever their layout, which is how both find out they
+// have no version in common.
+const MinProtocolVersion = uint8(2)
+
+// checksumVersion is the first protocol version whose datagrams end with a trailer. Hellos from
+// older peers have none.
+const checksumVersion = uint8(2)
+
+// Every datagram starts with a header: a version byte followed by the message type. The high
+// nibble of the version byte is always versionMagic, which tells versioned datagrams apart from
+// those sent by daemons that predate versioning, whose first byte is the (small) message type.
+// Every datagram ends with a trailer: the CRC-32C of everything before it.
+const (
+	versionMagic = uint8(0xF0)
+	versionMask  = uint8(0x0F)
+	headerSize   = 2
+	trailerSize  = 4
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// MaxDatagramSize is the size of the buffers flu reads datagrams into, so no message may be larger.
+// DataPackets are the exception: they are only ever read by the connection they were requested on.
+const MaxDatagramSize = 1024
+
+// ErrIncompatibleVersion is returned when parsing a datagram sent by a peer that speaks a version
+// of the protocol this daemon does not understand
+var ErrIncompatibleVersion = errors.New("incompatible flu protocol version")
+
+// ErrMalformed is returned when parsing a datagram that is truncated, fails its checksum, or
+// otherwise does not hold the message it claims to
+var ErrMalformed = errors.New("malformed flu message")
+
 // message type identifiers
 const discoverHostRequest = uint8(0)
 const discoverHostResponse = uint8(1)
@@ -14,3 +65,14 @@ const listFilesResponse = uint8(3)
 const openLineRequest = uint8(4)
 const dataPacket = uint8(5)
 const dataPacketAck = uint8(6)
+const closeConnectionRequest = uint8(7)
+const chunkHashesRequest = uint8(8)
+const chunkHashesResponse = uint8(9)
+const merkleProofRequest = uint8(10)
+const merkleProofResponse = uint8(11)
+const helloRequest = uint8(12)
+const helloResponse = uint8(13)
+const haveAnnouncement = uint8(14)
+const pingRequest = uint8(15)
+const pingResponse = uint8(16)
+const presenceAnnouncement = uint8(17)
@@ -0,0 +1,74 @@
+package messages
+
+import (
+	"github.com/flu-network/client/common"
+)
+
+// MaxChunkHashesPerResponse is the number of chunk hashes that fit in a single ChunkHashesResponse
+// without exceeding MaxDatagramSize.
+const MaxChunkHashesPerResponse = 48
+
+// ChunkHashesRequest asks a host for the sha1 hash of every chunk of a file, starting with chunk
+// Start. A file with more chunks than fit in a single response is fetched with several requests.
+type ChunkHashesRequest struct {
+	// The requestID is only used by the client to tie a response to an outgoing request
+	RequestID uint16
+	Sha1Hash  *common.Sha1Hash
+	Start     uint32 // index of the first chunk whose hash is wanted
+}
+
+// Serialize converts its subject into a []byte for transmission over the wire
+func (r *ChunkHashesRequest) Serialize() []byte {
+	w := newByteWriter(chunkHashesRequest, 26)
+	w.writeUint16(r.RequestID)
+	w.writeSha1Hash(r.Sha1Hash)
+	w.writeUint32(r.Start) // first chunk
+	return w.finish()
+}
+
+// Type returns a uint8 that identifies this message type
+func (r *ChunkHashesRequest) Type() byte {
+	return chunkHashesRequest
+}
+
+// ResponseType returns a uint8 that identidies the type of response expected for this message
+func (r *ChunkHashesRequest) ResponseType() byte {
+	return chunkHashesResponse
+}
+
+// ChunkHashesResponse contains the hashes of consecutive chunks of a file, starting with chunk
+// Start. A Total of 0 means the host does not know the file's chunk hashes.
+type ChunkHashesResponse struct {
+	RequestID uint16
+	Sha1Hash  *common.Sha1Hash
+	Start     uint32 // index of the chunk Hashes[0] belongs to
+	Total     uint32 // number of chunks in the file
+	Hashes    []common.Sha1Hash
+}
+
+// Type returns a uint8 that identifies this message type
+func (r *ChunkHashesResponse) Type() byte {
+	return chunkHashesResponse
+}
+
+// Serialize converts its subject into a []byte for transmission over the wire. At most
+// MaxChunkHashesPerResponse hashes are included.
+func (r *ChunkHashesResponse) Serialize() []byte {
+	count := len(r.Hashes)
+	if count > MaxChunkHashesPerResponse {
+		count = MaxChunkHashesPerResponse
+	}
+	w := newByteWriter(chunkHashesResponse, 31+count*20)
+	w.writeUint16(r.RequestID)
+	w.writeSha1Hash(r.Sha1Hash)
+
+	// first chunk and number of chunks
+	w.writeUint32(r.Start)
+	w.writeUint32(r.Total)
+
+	w.writeByte(uint8(count))
+	for i := 0; i < count; i++ {
+		w.writeSha1Hash(&r.Hashes[i])
+	}
+	return w.finish()
+}
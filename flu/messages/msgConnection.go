@@ -1,33 +1,21 @@
 package messages
 
 import (
-	"encoding/binary"
-
 	"github.com/flu-network/client/common"
 )
 
 type OpenConnectionRequest struct {
 	Sha1Hash  *common.Sha1Hash // which file we want
-	Chunk     uint16           // which chunk of that file we want
+	Chunk     uint32           // which chunk of that file we want
 	WindowCap uint16           // how many unacked requests we'll allow
 }
 
 func (r *OpenConnectionRequest) Serialize() []byte {
-	result := make([]byte, 32)
-
-	// message type
-	result[0] = openLineRequest
-
-	// sha1hash
-	copy(result[1:21], r.Sha1Hash.Slice())
-
-	// Chunk
-	binary.BigEndian.PutUint16(result[21:23], r.Chunk)
-
-	// window cap
-	binary.BigEndian.PutUint16(result[23:32], r.WindowCap)
-
-	return result
+	w := newByteWriter(openLineRequest, 26)
+	w.writeSha1Hash(r.Sha1Hash)
+	w.writeUint32(r.Chunk)
+	w.writeUint16(r.WindowCap)
+	return w.finish()
 }
 
 // Type returns a uint8 that identifies this message type
@@ -39,3 +27,24 @@ func (r *OpenConnectionRequest) Type() byte {
 func (r *OpenConnectionRequest) ResponseType() byte {
 	return dataPacket
 }
+
+// CloseConnectionRequest is sent by a receiver to tell the sender to stop sending the chunk it
+// requested with an OpenConnectionRequest, e.g., because the download was paused or cancelled.
+// The sender identifies the connection by the address the request came from.
+type CloseConnectionRequest struct {
+	Sha1Hash *common.Sha1Hash // which file the connection was for
+	Chunk    uint32           // which chunk of that file the connection was for
+}
+
+// Serialize converts its subject into a []byte for transmission over the wire
+func (r *CloseConnectionRequest) Serialize() []byte {
+	w := newByteWriter(closeConnectionRequest, 24)
+	w.writeSha1Hash(r.Sha1Hash)
+	w.writeUint32(r.Chunk)
+	return w.finish()
+}
+
+// Type returns a uint8 that identifies this message type
+func (r *CloseConnectionRequest) Type() byte {
+	return closeConnectionRequest
+}
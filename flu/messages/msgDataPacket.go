@@ -2,6 +2,7 @@ package messages
 
 import (
 	"encoding/binary"
+	"fmt"
 
 	"github.com/flu-network/client/common"
 )
@@ -27,18 +28,10 @@ func (r *DataPacket) Type() byte {
 
 // Serialize converts its subject into a []byte for transmission over the wire
 func (r *DataPacket) Serialize() []byte {
-	result := make([]byte, 5+len(r.Data))
-
-	// message type
-	result[0] = dataPacket
-
-	// offset
-	binary.BigEndian.PutUint32(result[1:5], r.Offset)
-
-	// data
-	copy(result[5:], r.Data)
-
-	return result
+	w := newByteWriter(dataPacket, 4+len(r.Data))
+	w.writeUint32(r.Offset)
+	w.writeBytes(r.Data)
+	return w.finish()
 }
 
 // Split interprets the DataPacket as the first message with a zero offset and returns the
@@ -52,32 +45,62 @@ func (r *DataPacket) Split() (*common.Sha1Hash, uint32, []byte) {
 	return &hash, chunkSize, data
 }
 
-// ParseAsDataPacket takes raw bytes from the wire and parses them as a DataPacket. It skips over
-// the first byte since that's used to indicate what type the message is, and this function assumes
-// the caller already has good reason to know this is a DataPacket and not something else.
-func ParseAsDataPacket(data []byte) *DataPacket {
-	return &DataPacket{
-		Offset: binary.BigEndian.Uint32(data[1:5]),
-		Data:   data[5:],
+// DataPacketOverhead is the number of bytes a serialized DataPacket adds to its Data
+const DataPacketOverhead = headerSize + 4 + trailerSize
+
+// ParseAsDataPacket takes raw bytes from the wire and parses them as a DataPacket. It is used
+// instead of Parse by receivers that expect nothing but DataPackets, and returns an error wrapping
+// ErrMalformed if the datagram is anything else. The DataPacket's Data is not copied.
+func ParseAsDataPacket(data []byte) (*DataPacket, error) {
+	body, err := checkTrailer(data)
+	if err != nil {
+		return nil, err
+	}
+	reader := byteReader{Data: body}
+	header, _ := reader.readBytes(headerSize)
+	if version := header[0] & versionMask; header[0]&^versionMask != versionMagic ||
+		version < MinProtocolVersion || version > ProtocolVersion {
+		return nil, fmt.Errorf("%w: data packet with version byte %d", ErrIncompatibleVersion,
+			header[0])
+	}
+	if header[1] != dataPacket {
+		return nil, fmt.Errorf("%w: expected a data packet but got a message of type %d",
+			ErrMalformed, header[1])
+	}
+	offset, err := reader.readUint32()
+	if err != nil {
+		return nil, err
 	}
+	return &DataPacket{Offset: offset, Data: body[reader.index:]}, nil
 }
 
 // DataPacketAck is sent by the receiver to the sender with flow control and retransmission
-// information
+// information. It is a selective acknowledgement: Offset acknowledges every byte before it, and
+// Ranges lists blocks of bytes beyond Offset that have also been received. Any bytes between
+// Offset and the end of the last range that are not covered by a range are missing.
 type DataPacketAck struct {
-	Offset uint32
+	Offset uint32   // every byte before Offset has been received
+	Ranges []uint32 // non-overlapping [start, end) pairs received beyond Offset
 }
 
-func (ack *DataPacketAck) Serialize() []byte {
-	result := make([]byte, 5)
-
-	// message type
-	result[0] = dataPacketAck
-
-	// offset
-	binary.BigEndian.PutUint32(result[1:], ack.Offset)
+// MaxAckRanges is the largest number of [start, end) pairs a DataPacketAck can carry within
+// MaxDatagramSize, after its offset and range count
+const MaxAckRanges = (MaxDatagramSize - headerSize - 5 - trailerSize) / 8
 
-	return result
+// Serialize converts its subject into a []byte for transmission over the wire. Only the first
+// MaxAckRanges ranges are sent.
+func (ack *DataPacketAck) Serialize() []byte {
+	rangeCount := len(ack.Ranges) / 2
+	if rangeCount > MaxAckRanges {
+		rangeCount = MaxAckRanges
+	}
+	w := newByteWriter(dataPacketAck, 5+rangeCount*8)
+	w.writeUint32(ack.Offset)
+	w.writeByte(uint8(rangeCount))
+	for i := 0; i < rangeCount*2; i++ {
+		w.writeUint32(ack.Ranges[i])
+	}
+	return w.finish()
 }
 
 func (ack *DataPacketAck) Type() byte {
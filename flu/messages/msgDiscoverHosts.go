@@ -1,11 +1,34 @@
 package messages
 
 import (
-	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"sort"
 
 	"github.com/flu-network/client/common"
+	"github.com/flu-network/client/common/bitset"
 )
 
+// Chunk ranges are sent in whichever of two encodings is smaller: a list of [start, end] pairs, or
+// the run lengths of bitset.EncodeRuns, which is far more compact for fragmented availability.
+// Either is preceded by a byte saying which it is, and a two-byte count of ranges or bytes.
+const (
+	availabilityRanges = 0
+	availabilityRuns   = 1
+
+	// maxAvailabilitySize is the number of bytes chunk ranges may take in a DiscoverHostRequest,
+	// DiscoverHostResponse or HaveAnnouncement without exceeding MaxDatagramSize, including the
+	// encoding and count
+	maxAvailabilitySize = MaxDatagramSize - headerSize - 24 - trailerSize
+	maxRunsSize         = maxAvailabilitySize - 3
+)
+
+// MaxChunkRanges is the number of chunk ranges that fit in a DiscoverHostRequest or
+// DiscoverHostResponse when they are sent as a list. Sorted ranges that do not touch, such as
+// those returned by bitset.Bitset.Ranges, are sent as run lengths if that is smaller, and then
+// usually many more fit. Chunks too fragmented to fit either way are cut down by FitAvailability.
+const MaxChunkRanges = (maxAvailabilitySize - 3) / 8
+
 // DiscoverHostRequest is broadcast to all hosts on the LAN to ask participating hosts which chunks
 // in the given range they have of the specified file hash.
 type DiscoverHostRequest struct {
@@ -16,36 +39,23 @@ type DiscoverHostRequest struct {
 	// to respond with information about all files they have available
 	Sha1Hash common.Sha1Hash
 
-	// The ranges of chunks we're interested in. If no chunks are specified then hosts are requested
-	// to return the ranges of all chunks that they have
-	Chunks []uint16
+	// The port the requesting host listens on, which responses are sent to. Hosts may listen on
+	// different ports, so the port a request came from says nothing about it.
+	Port uint16
+
+	// The ranges of chunks we're interested in, as inclusive [start, end] pairs. If no chunks are
+	// specified then hosts are requested to return the ranges of all chunks that they have
+	Chunks []uint32
 }
 
 // Serialize converts its subject into a []byte for transmission over the wire
 func (r *DiscoverHostRequest) Serialize() []byte {
-	result := make([]byte, 24)
-
-	// message type
-	result[0] = discoverHostRequest
-
-	// request ID
-	binary.BigEndian.PutUint16(result[1:3], r.RequestID)
-
-	// sha1 hash
-	copy(result[3:23], r.Sha1Hash.Slice())
-
-	// chunk count
-	result[23] = uint8(len(r.Chunks))
-
-	// chunks
-	chunks := make([]byte, len(r.Chunks)*2)
-	for i, chunkVal := range r.Chunks {
-		index := i * 2
-		binary.BigEndian.PutUint16(chunks[index:index+2], chunkVal)
-	}
-	result = append(result, chunks...)
-
-	return result
+	w := newByteWriter(discoverHostRequest, 27+len(r.Chunks)*4)
+	w.writeUint16(r.RequestID)
+	w.writeSha1Hash(&r.Sha1Hash)
+	w.writeUint16(r.Port)
+	writeAvailability(w, r.Chunks)
+	return w.finish()
 }
 
 // Type returns a uint8 that identifies this message type
@@ -60,43 +70,124 @@ func (r *DiscoverHostRequest) ResponseType() byte {
 
 // DiscoverHostResponse is returned in response to a DiscoverHostRequest
 type DiscoverHostResponse struct {
-	Address   [4]byte
+	// Address is the responding host's address on the interface the request reached it on, IPv4 or
+	// IPv6. Link-local IPv6 addresses are sent without a zone, since zones only mean something to
+	// the host that holds the address.
+	Address   netip.Addr
 	Port      uint16
 	RequestID uint16
-	Chunks    []uint16 // Chunks are only returned if a file is specified in the request
+	Chunks    []uint32 // Chunk ranges are only returned if a file is specified in the request
 }
 
 // Serialize converts its subject into a []byte for transmission over the wire
 func (r *DiscoverHostResponse) Serialize() []byte {
-	result := make([]byte, 10)
-
-	// message type
-	result[0] = discoverHostResponse
-
-	// request ID
-	binary.BigEndian.PutUint16(result[1:3], r.RequestID)
+	w := newByteWriter(discoverHostResponse, 23+len(r.Chunks)*4)
+	w.writeUint16(r.RequestID)
+	w.writeAddr(r.Address)
+	w.writeUint16(r.Port)
+	writeAvailability(w, r.Chunks)
+	return w.finish()
+}
 
-	// address
-	copy(result[3:7], r.Address[:])
+// Type returns a uint8 that identifies this message type
+func (r *DiscoverHostResponse) Type() byte {
+	return discoverHostResponse
+}
 
-	// port
-	binary.BigEndian.PutUint16(result[7:9], r.Port)
+// FitAvailability returns the chunk ranges that fit in a DiscoverHostRequest, DiscoverHostResponse
+// or HaveAnnouncement, and whether any had to be left out to make them fit. If so, the result is
+// whichever reports more chunks of the longest prefix that fits as run lengths and the longest
+// ranges that fit as a list, so that as few chunks as possible go unreported. Callers should say
+// so, since the receiver cannot tell.
+func FitAvailability(ranges []uint32) ([]uint32, bool) {
+	ranges = ranges[:len(ranges)/2*2]
+	runs, ok := bitset.EncodeRuns(ranges)
+	if len(ranges)/2 <= MaxChunkRanges || ok && len(runs) <= maxRunsSize {
+		return ranges, false
+	}
 
-	// chunk count
-	result[9] = uint8(len(r.Chunks))
+	// the longest ranges, in their original order
+	byLength := make([]int, len(ranges)/2)
+	for i := range byLength {
+		byLength[i] = i
+	}
+	sort.SliceStable(byLength, func(i, j int) bool {
+		a, b := byLength[i]*2, byLength[j]*2
+		return ranges[a+1]-ranges[a] > ranges[b+1]-ranges[b]
+	})
+	kept := byLength[:MaxChunkRanges]
+	sort.Ints(kept)
+	result := make([]uint32, 0, MaxChunkRanges*2)
+	for _, i := range kept {
+		result = append(result, ranges[i*2], ranges[i*2+1])
+	}
 
-	// chunks
-	chunks := make([]byte, len(r.Chunks)*2)
-	for i, chunkVal := range r.Chunks {
-		index := i * 2
-		binary.BigEndian.PutUint16(chunks[index:index+2], chunkVal)
+	if ok {
+		// the first range that no longer fits as runs
+		fit := sort.Search(len(ranges)/2, func(i int) bool {
+			prefix, _ := bitset.EncodeRuns(ranges[:(i+1)*2])
+			return len(prefix) > maxRunsSize
+		})
+		if prefix := ranges[:fit*2]; chunkCount(prefix) > chunkCount(result) {
+			return prefix, true
+		}
 	}
-	result = append(result, chunks...)
+	return result, true
+}
 
+// chunkCount returns the number of chunks in a list of inclusive chunk ranges
+func chunkCount(ranges []uint32) uint64 {
+	result := uint64(0)
+	for i := 0; i+1 < len(ranges); i += 2 {
+		result += uint64(ranges[i+1]) - uint64(ranges[i]) + 1
+	}
 	return result
 }
 
-// Type returns a uint8 that identifies this message type
-func (r *DiscoverHostResponse) Type() byte {
-	return discoverHostResponse
+// writeAvailability writes chunk ranges in whichever encoding is smaller. Ranges that do not fit
+// are left out, as by FitAvailability, which callers use first to find out whether any are.
+func writeAvailability(w *byteWriter, ranges []uint32) {
+	ranges, _ = FitAvailability(ranges)
+	runs, ok := bitset.EncodeRuns(ranges)
+	smaller := len(ranges)/2 > MaxChunkRanges || len(runs) < len(ranges)*4 // than a list
+	if ok && len(runs) <= maxRunsSize && smaller {
+		w.writeByte(availabilityRuns)
+		w.writeUint16(uint16(len(runs)))
+		w.writeBytes(runs)
+	} else {
+		w.writeByte(availabilityRanges)
+		w.writeRanges(ranges)
+	}
+}
+
+// readAvailability reads chunk ranges written by writeAvailability
+func readAvailability(reader *byteReader) ([]uint32, error) {
+	encoding, err := reader.readByte()
+	if err != nil {
+		return nil, err
+	}
+	switch encoding {
+	case availabilityRanges:
+		return reader.readRanges()
+	case availabilityRuns:
+		length, err := reader.readUint16()
+		if err != nil {
+			return nil, err
+		}
+		if length > maxRunsSize {
+			return nil, fmt.Errorf("%w: %d bytes of runs do not fit in a datagram", ErrMalformed,
+				length)
+		}
+		data, err := reader.readBytes(int(length))
+		if err != nil {
+			return nil, err
+		}
+		result, err := bitset.DecodeRuns(data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+		}
+		return result, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown chunk range encoding %d", ErrMalformed, encoding)
+	}
 }
@@ -0,0 +1,29 @@
+package messages
+
+import (
+	"github.com/flu-network/client/common"
+)
+
+// HaveAnnouncement is pushed to the peers a host is exchanging a file with whenever it finishes
+// downloading chunks of that file, so that they can request those chunks straight away instead of
+// waiting to rediscover the swarm. It is only sent to peers with CapHaveAnnouncements, and is
+// never answered.
+type HaveAnnouncement struct {
+	Sha1Hash *common.Sha1Hash // the file the chunks belong to
+	Port     uint16           // the port the announcing host listens on
+	Chunks   []uint32         // ranges of newly completed chunks, as inclusive [start, end] pairs
+}
+
+// Serialize converts its subject into a []byte for transmission over the wire
+func (r *HaveAnnouncement) Serialize() []byte {
+	w := newByteWriter(haveAnnouncement, 25+len(r.Chunks)*4)
+	w.writeSha1Hash(r.Sha1Hash)
+	w.writeUint16(r.Port)
+	writeAvailability(w, r.Chunks)
+	return w.finish()
+}
+
+// Type returns a uint8 that identifies this message type
+func (r *HaveAnnouncement) Type() byte {
+	return haveAnnouncement
+}
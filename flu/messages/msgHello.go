@@ -0,0 +1,102 @@
+package messages
+
+import "strings"
+
+// Capabilities is a set of optional protocol features, advertised in a Hello exchange so that
+// peers only use features both sides support. Unknown flags are ignored, which lets new features
+// roll out across a network gradually.
+type Capabilities uint32
+
+const (
+	// CapSelectiveAck means DataPacketAcks carry the ranges received beyond their Offset
+	CapSelectiveAck Capabilities = 1 << iota
+	// CapChunkHashes means the peer answers ChunkHashesRequests
+	CapChunkHashes
+	// CapMerkleProofs means the peer answers MerkleProofRequests
+	CapMerkleProofs
+	// CapCompression means the peer accepts compressed data packets. Reserved.
+	CapCompression
+	// CapEncryption means the peer accepts encrypted connections. Reserved.
+	CapEncryption
+	// CapHaveAnnouncements means the peer understands HaveAnnouncements
+	CapHaveAnnouncements
+	// CapPing means the peer answers PingRequests
+	CapPing
+)
+
+// SupportedCapabilities are the optional features this daemon supports
+const SupportedCapabilities = CapSelectiveAck | CapChunkHashes | CapMerkleProofs |
+	CapHaveAnnouncements | CapPing
+
+var capabilityNames = []string{
+	"sack", "chunk-hashes", "merkle-proofs", "compression", "encryption", "have", "ping",
+}
+
+// Has returns true if every capability in other is also in c
+func (c Capabilities) Has(other Capabilities) bool {
+	return c&other == other
+}
+
+// String returns the names of the capabilities in c, separated by commas
+func (c Capabilities) String() string {
+	names := []string{}
+	for i, name := range capabilityNames {
+		if c.Has(1 << i) {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// HelloRequest introduces a peer: the newest protocol version it speaks and the optional features
+// it supports. Unlike other messages, Hellos are understood whatever the version in their header,
+// so their layout must never change; that is what lets peers that speak different versions agree
+// on one. Version 1 peers send them without a trailer, and ignore the trailer on those they
+// receive.
+type HelloRequest struct {
+	// The requestID is only used by the client to tie a response to an outgoing request
+	RequestID    uint16
+	Version      uint8
+	Capabilities Capabilities
+}
+
+// Serialize converts its subject into a []byte for transmission over the wire
+func (r *HelloRequest) Serialize() []byte {
+	w := newByteWriter(helloRequest, 7)
+	w.writeUint16(r.RequestID)
+	w.writeByte(r.Version)
+	w.writeUint32(uint32(r.Capabilities))
+	return w.finish()
+}
+
+// Type returns a uint8 that identifies this message type
+func (r *HelloRequest) Type() byte {
+	return helloRequest
+}
+
+// ResponseType returns a uint8 that identidies the type of response expected for this message
+func (r *HelloRequest) ResponseType() byte {
+	return helloResponse
+}
+
+// HelloResponse answers a HelloRequest with the responder's own version and capabilities. Both
+// peers then use the lower of the two versions and the capabilities they have in common.
+type HelloResponse struct {
+	RequestID    uint16
+	Version      uint8
+	Capabilities Capabilities
+}
+
+// Serialize converts its subject into a []byte for transmission over the wire
+func (r *HelloResponse) Serialize() []byte {
+	w := newByteWriter(helloResponse, 7)
+	w.writeUint16(r.RequestID)
+	w.writeByte(r.Version)
+	w.writeUint32(uint32(r.Capabilities))
+	return w.finish()
+}
+
+// Type returns a uint8 that identifies this message type
+func (r *HelloResponse) Type() byte {
+	return helloResponse
+}
@@ -1,33 +1,32 @@
 package messages
 
 import (
-	"encoding/binary"
-
 	"github.com/flu-network/client/common"
 )
 
 // ListFilesRequest is sent to a single host requesting them to list the files they have available
-// to download. Returned file may be partially or completely available.
+// to download. Returned file may be partially or completely available. Hosts list their files in
+// ascending order of hash, as many as fit in a datagram at a time, so listing every file may take
+// several requests: each asks for the files after the last one received.
 type ListFilesRequest struct {
 	// The requestID is only used by the client to tie a response to an outgoing request
 	RequestID uint16
-	Sha1Hash  *common.Sha1Hash
+	Sha1Hash  *common.Sha1Hash // the file to list. FFF... lists every file
+	After     *common.Sha1Hash // only files with a greater hash are listed. Nil lists from the start
 }
 
 // Serialize converts its subject into a []byte for transmission over the wire
 func (r *ListFilesRequest) Serialize() []byte {
-	result := make([]byte, 23)
-
-	// message type
-	result[0] = listFilesRequest
-
-	// request ID
-	binary.BigEndian.PutUint16(result[1:3], r.RequestID)
-
-	// sha1 hash
-	copy(result[3:23], r.Sha1Hash.Data[:])
-
-	return result
+	w := newByteWriter(listFilesRequest, 43)
+	w.writeUint16(r.RequestID)
+	w.writeSha1Hash(r.Sha1Hash)
+	if r.After == nil {
+		w.writeByte(0)
+	} else {
+		w.writeByte(1)
+		w.writeSha1Hash(r.After)
+	}
+	return w.finish()
 }
 
 // Type returns a uint8 that identifies this message type
@@ -51,24 +50,57 @@ type ListFilesEntry struct {
 	FileName         string
 }
 
-// Serialize converts its subject into a []byte for transmission over the wire
+// Serialize converts its subject into the []byte it occupies in a ListFilesResponse
 func (lfe *ListFilesEntry) Serialize() []byte {
-	name := SerializeString255(lfe.FileName)
-	result := make([]byte, 40, len(name)+40)
+	w := byteWriter{}
+	lfe.write(&w)
+	return w.Data
+}
 
-	binary.BigEndian.PutUint64(result[0:8], lfe.SizeInBytes)
-	binary.BigEndian.PutUint32(result[8:12], lfe.ChunkCount)
-	binary.BigEndian.PutUint32(result[12:16], lfe.ChunkSizeInBytes)
-	binary.BigEndian.PutUint32(result[16:20], lfe.ChunksDownloaded)
-	copy(result[20:40], lfe.Sha1Hash.Array()[:])
-	result = append(result, name...)
+// write appends the entry to a message being serialized
+func (lfe *ListFilesEntry) write(w *byteWriter) {
+	w.writeUint64(lfe.SizeInBytes)
+	w.writeUint32(lfe.ChunkCount)
+	w.writeUint32(lfe.ChunkSizeInBytes)
+	w.writeUint32(lfe.ChunksDownloaded)
+	w.writeSha1Hash(lfe.Sha1Hash)
+	w.writeString255(lfe.FileName)
+}
 
-	return result
+// size returns the number of bytes the entry occupies in a ListFilesResponse
+func (lfe *ListFilesEntry) size() int {
+	nameLength := len(lfe.FileName)
+	if nameLength > 255 {
+		nameLength = 255
+	}
+	return minListFilesEntrySize + nameLength
+}
+
+// minListFilesEntrySize is the size of a ListFilesEntry with an empty file name
+const minListFilesEntrySize = 41
+
+// listFilesResponseSize is the size of a ListFilesResponse without any entries
+const listFilesResponseSize = headerSize + 5 + trailerSize
+
+// FitListFilesEntries returns how many of the given entries, starting with the first, fit in a
+// ListFilesResponse no larger than MaxDatagramSize. It is always at least one (if there are any),
+// because even an entry with the longest possible file name fits.
+func FitListFilesEntries(entries []ListFilesEntry) int {
+	size := listFilesResponseSize
+	for i := range entries {
+		size += entries[i].size()
+		if size > MaxDatagramSize {
+			return i
+		}
+	}
+	return len(entries)
 }
 
-// ListFilesResponse contains a list of files availble in the index
+// ListFilesResponse contains a list of files availble in the index, in ascending order of hash.
+// If More is set, the host has more files to list after the last one.
 type ListFilesResponse struct {
 	RequestID uint16
+	More      bool
 	Files     []ListFilesEntry
 }
 
@@ -79,20 +111,19 @@ func (r *ListFilesResponse) Type() byte {
 
 // Serialize converts its subject into a []byte for transmission over the wire
 func (r *ListFilesResponse) Serialize() []byte {
-	result := make([]byte, 5)
-
-	// message type
-	result[0] = listFilesResponse
-
-	// request ID
-	binary.BigEndian.PutUint16(result[1:3], r.RequestID)
+	w := newByteWriter(listFilesResponse, 5+len(r.Files)*64)
+	w.writeUint16(r.RequestID)
+	if r.More {
+		w.writeByte(1)
+	} else {
+		w.writeByte(0)
+	}
 
 	// number of entries. Implicit: you cannot store more than ~65k files
-	binary.BigEndian.PutUint16(result[3:5], uint16(len(r.Files)))
+	w.writeUint16(uint16(len(r.Files)))
 
-	for _, entry := range r.Files {
-		result = append(result, entry.Serialize()...)
+	for i := range r.Files {
+		r.Files[i].write(w)
 	}
-
-	return result
+	return w.finish()
 }
@@ -0,0 +1,77 @@
+package messages
+
+import (
+	"github.com/flu-network/client/common"
+)
+
+// maxMerkleProofLength is the longest inclusion proof a MerkleProofResponse carries, enough for a
+// file with 2^32 chunks
+const maxMerkleProofLength = 32
+
+// MerkleProofRequest asks a host for the merkle root of a file and the inclusion proof of one of
+// its chunks, which lets the chunk be verified against the root before it is saved.
+type MerkleProofRequest struct {
+	// The requestID is only used by the client to tie a response to an outgoing request
+	RequestID uint16
+	Sha1Hash  *common.Sha1Hash
+	Chunk     uint32
+}
+
+// Serialize converts its subject into a []byte for transmission over the wire
+func (r *MerkleProofRequest) Serialize() []byte {
+	w := newByteWriter(merkleProofRequest, 26)
+	w.writeUint16(r.RequestID)
+	w.writeSha1Hash(r.Sha1Hash)
+	w.writeUint32(r.Chunk)
+	return w.finish()
+}
+
+// Type returns a uint8 that identifies this message type
+func (r *MerkleProofRequest) Type() byte {
+	return merkleProofRequest
+}
+
+// ResponseType returns a uint8 that identidies the type of response expected for this message
+func (r *MerkleProofRequest) ResponseType() byte {
+	return merkleProofResponse
+}
+
+// MerkleProofResponse contains the merkle root of a file and the inclusion proof of one of its
+// chunks, as produced by common.MerkleTree. A ChunkCount of 0 means the host does not know the
+// file's merkle tree.
+type MerkleProofResponse struct {
+	RequestID  uint16
+	Sha1Hash   *common.Sha1Hash
+	Root       *common.Sha1Hash
+	Chunk      uint32
+	ChunkCount uint32 // number of chunks in the file, which the proof depends on
+	Proof      []common.Sha1Hash
+}
+
+// Type returns a uint8 that identifies this message type
+func (r *MerkleProofResponse) Type() byte {
+	return merkleProofResponse
+}
+
+// Serialize converts its subject into a []byte for transmission over the wire. Proofs longer than
+// maxMerkleProofLength are truncated, which makes them fail verification.
+func (r *MerkleProofResponse) Serialize() []byte {
+	count := len(r.Proof)
+	if count > maxMerkleProofLength {
+		count = maxMerkleProofLength
+	}
+	w := newByteWriter(merkleProofResponse, 51+count*20)
+	w.writeUint16(r.RequestID)
+	w.writeSha1Hash(r.Sha1Hash)
+	w.writeSha1Hash(r.Root)
+
+	// chunk and number of chunks
+	w.writeUint32(r.Chunk)
+	w.writeUint32(r.ChunkCount)
+
+	w.writeByte(uint8(count))
+	for i := 0; i < count; i++ {
+		w.writeSha1Hash(&r.Proof[i])
+	}
+	return w.finish()
+}
@@ -0,0 +1,42 @@
+package messages
+
+// PingRequest asks a host to answer with a PingResponse straight away, so that the round trip time
+// to it can be measured. It is only sent to peers with CapPing.
+type PingRequest struct {
+	// The requestID is only used by the client to tie a response to an outgoing request
+	RequestID uint16
+}
+
+// Serialize converts its subject into a []byte for transmission over the wire
+func (r *PingRequest) Serialize() []byte {
+	w := newByteWriter(pingRequest, 2)
+	w.writeUint16(r.RequestID)
+	return w.finish()
+}
+
+// Type returns a uint8 that identifies this message type
+func (r *PingRequest) Type() byte {
+	return pingRequest
+}
+
+// ResponseType returns a uint8 that identidies the type of response expected for this message
+func (r *PingRequest) ResponseType() byte {
+	return pingResponse
+}
+
+// PingResponse answers a PingRequest (the 'pong')
+type PingResponse struct {
+	RequestID uint16
+}
+
+// Serialize converts its subject into a []byte for transmission over the wire
+func (r *PingResponse) Serialize() []byte {
+	w := newByteWriter(pingResponse, 2)
+	w.writeUint16(r.RequestID)
+	return w.finish()
+}
+
+// Type returns a uint8 that identifies this message type
+func (r *PingResponse) Type() byte {
+	return pingResponse
+}
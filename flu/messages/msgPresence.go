@@ -0,0 +1,33 @@
+package messages
+
+// Presence states a host can announce
+const (
+	// PresenceJoining is announced once when a host starts. Hosts that hear it reply straight away
+	// with a PresenceAlive announcement of their own, so the new host learns the network at once.
+	PresenceJoining = uint8(0)
+	// PresenceAlive is announced periodically by every running host
+	PresenceAlive = uint8(1)
+	// PresenceLeaving is announced when a host shuts down, so that others forget it at once
+	PresenceLeaving = uint8(2)
+)
+
+// PresenceAnnouncement is broadcast by every host when it starts, periodically while it runs and
+// when it stops, so that the hosts on the network are known without having to look for them. It
+// is never answered, except by another announcement when a host joins.
+type PresenceAnnouncement struct {
+	Port   uint16 // the port the announcing host listens on
+	Status uint8  // one of PresenceJoining, PresenceAlive or PresenceLeaving
+}
+
+// Serialize converts its subject into a []byte for transmission over the wire
+func (r *PresenceAnnouncement) Serialize() []byte {
+	w := newByteWriter(presenceAnnouncement, 3)
+	w.writeUint16(r.Port)
+	w.writeByte(r.Status)
+	return w.finish()
+}
+
+// Type returns a uint8 that identifies this message type
+func (r *PresenceAnnouncement) Type() byte {
+	return presenceAnnouncement
+}
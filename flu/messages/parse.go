@@ -1,77 +1,381 @@
 package messages
 
-import "fmt"
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
 
-// Parse attempts to parse a serialized message into a flu messages.Message
+// Parse attempts to parse a serialized message into a flu messages.Message. Datagrams that are
+// truncated, fail their checksum, or hold anything but exactly one message are rejected with an
+// error wrapping ErrMalformed. Datagrams from peers that speak a protocol version this daemon does
+// not understand are rejected with an error wrapping ErrIncompatibleVersion, except for Hellos,
+// which is how such peers find out. Hellos from peers that predate checksums are accepted without
+// a trailer.
 func Parse(data []byte) (msg Message, err error) {
-	reader := byteReader{Data: data}
-	msgType := reader.readByte()
-
-	switch msgType {
-	case discoverHostRequest:
-		reqID := reader.readUint16()
-		hash := reader.readSha1Hash()
-		chunks := reader.readSliceUint16()
-		return &DiscoverHostRequest{
-			Sha1Hash:  *hash,
-			RequestID: reqID,
-			Chunks:    chunks,
-		}, nil
-
-	case discoverHostResponse:
-		reqID := reader.readUint16()
-		addr := reader.readBytes(4)
-		port := reader.readUint16()
-		chunks := reader.readSliceUint16()
-		return &DiscoverHostResponse{
-			Address:   [4]byte{addr[0], addr[1], addr[2], addr[3]},
-			Port:      port,
-			RequestID: reqID,
-			Chunks:    chunks,
-		}, nil
-
-	case listFilesRequest:
-		reqID := reader.readUint16()
-		hash := reader.readSha1Hash()
-		return &ListFilesRequest{
-			RequestID: reqID,
-			Sha1Hash:  hash,
-		}, nil
-
-	case listFilesResponse:
-		reqID := reader.readUint16()
-		entryCount := reader.readUint16()
-		entries := make([]ListFilesEntry, entryCount)
-		for i := 0; i < int(entryCount); i++ {
-			entries[i] = ListFilesEntry{
-				SizeInBytes:      reader.readUint64(),
-				ChunkCount:       reader.readUint32(),
-				ChunkSizeInBytes: reader.readUint32(),
-				ChunksDownloaded: reader.readUint32(),
-				Sha1Hash:         reader.readSha1Hash(),
-				FileName:         reader.readString256(),
-			}
+	if len(data) > 0 && data[0]&^versionMask != versionMagic {
+		return nil, fmt.Errorf("%w: unversioned message (of type %d) from a daemon that predates "+
+			"protocol versioning", ErrIncompatibleVersion, data[0])
+	}
+	if len(data) < headerSize {
+		return nil, fmt.Errorf("%w: datagram of %d bytes is too short", ErrMalformed, len(data))
+	}
+	version := data[0] & versionMask
+	msgType := data[1]
+	hello := msgType == helloRequest || msgType == helloResponse
+
+	if (version < MinProtocolVersion || version > ProtocolVersion) && !hello {
+		return nil, fmt.Errorf("%w: message of type %d is version %d but versions %d to %d "+
+			"are supported", ErrIncompatibleVersion, msgType, version, MinProtocolVersion,
+			ProtocolVersion)
+	}
+	body := data // Hellos from peers that predate checksums have no trailer
+	if !hello || version >= checksumVersion {
+		if body, err = checkTrailer(data); err != nil {
+			return nil, err
+		}
+	}
+
+	reader := byteReader{Data: body, index: headerSize}
+	parse, ok := parsers[msgType]
+	if !ok {
+		return nil, fmt.Errorf("%w: message of unknown type %d", ErrMalformed, msgType)
+	}
+	msg, err = parse(&reader)
+	if err != nil {
+		return nil, fmt.Errorf("message of type %d: %w", msgType, err)
+	}
+	if reader.remaining() != 0 {
+		return nil, fmt.Errorf("%w: %d unexpected bytes after message of type %d",
+			ErrMalformed, reader.remaining(), msgType)
+	}
+	return msg, nil
+}
+
+// checkTrailer returns the datagram without its checksum trailer, or an error if the checksum
+// does not match or the datagram is too short to hold a header and a trailer
+func checkTrailer(data []byte) ([]byte, error) {
+	if len(data) < headerSize+trailerSize {
+		return nil, fmt.Errorf("%w: datagram of %d bytes is too short", ErrMalformed, len(data))
+	}
+	body := data[:len(data)-trailerSize]
+	expected := binary.BigEndian.Uint32(data[len(body):])
+	if crc32.Checksum(body, crc32cTable) != expected {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrMalformed)
+	}
+	return body, nil
+}
+
+// parsers parse the body of each type of message that Parse understands
+var parsers = map[uint8]func(*byteReader) (Message, error){
+	discoverHostRequest:    parseDiscoverHostRequest,
+	discoverHostResponse:   parseDiscoverHostResponse,
+	listFilesRequest:       parseListFilesRequest,
+	listFilesResponse:      parseListFilesResponse,
+	openLineRequest:        parseOpenConnectionRequest,
+	closeConnectionRequest: parseCloseConnectionRequest,
+	dataPacketAck:          parseDataPacketAck,
+	chunkHashesRequest:     parseChunkHashesRequest,
+	chunkHashesResponse:    parseChunkHashesResponse,
+	merkleProofRequest:     parseMerkleProofRequest,
+	merkleProofResponse:    parseMerkleProofResponse,
+	helloRequest:           parseHelloRequest,
+	helloResponse:          parseHelloResponse,
+	haveAnnouncement:       parseHaveAnnouncement,
+	pingRequest:            parsePingRequest,
+	pingResponse:           parsePingResponse,
+	presenceAnnouncement:   parsePresenceAnnouncement,
+}
+
+func parseDiscoverHostRequest(reader *byteReader) (Message, error) {
+	result := DiscoverHostRequest{}
+	var err error
+	if result.RequestID, err = reader.readUint16(); err != nil {
+		return nil, err
+	}
+	hash, err := reader.readSha1Hash()
+	if err != nil {
+		return nil, err
+	}
+	result.Sha1Hash = *hash
+	if result.Port, err = reader.readUint16(); err != nil {
+		return nil, err
+	}
+	if result.Chunks, err = readAvailability(reader); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func parseDiscoverHostResponse(reader *byteReader) (Message, error) {
+	result := DiscoverHostResponse{}
+	var err error
+	if result.RequestID, err = reader.readUint16(); err != nil {
+		return nil, err
+	}
+	if result.Address, err = reader.readAddr(); err != nil {
+		return nil, err
+	}
+	if result.Port, err = reader.readUint16(); err != nil {
+		return nil, err
+	}
+	if result.Chunks, err = readAvailability(reader); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func parseListFilesRequest(reader *byteReader) (Message, error) {
+	result := ListFilesRequest{}
+	var err error
+	if result.RequestID, err = reader.readUint16(); err != nil {
+		return nil, err
+	}
+	if result.Sha1Hash, err = reader.readSha1Hash(); err != nil {
+		return nil, err
+	}
+	hasCursor, err := reader.readFlag()
+	if err != nil {
+		return nil, err
+	}
+	if hasCursor {
+		if result.After, err = reader.readSha1Hash(); err != nil {
+			return nil, err
+		}
+	}
+	return &result, nil
+}
+
+func parseListFilesResponse(reader *byteReader) (Message, error) {
+	result := ListFilesResponse{}
+	var err error
+	if result.RequestID, err = reader.readUint16(); err != nil {
+		return nil, err
+	}
+	if result.More, err = reader.readFlag(); err != nil {
+		return nil, err
+	}
+	entryCount, err := reader.readUint16()
+	if err != nil {
+		return nil, err
+	}
+	if int(entryCount)*minListFilesEntrySize > reader.remaining() {
+		return nil, fmt.Errorf("%w: %d files do not fit in the %d bytes that remain",
+			ErrMalformed, entryCount, reader.remaining())
+	}
+	result.Files = make([]ListFilesEntry, entryCount)
+	for i := range result.Files {
+		entry := &result.Files[i]
+		if entry.SizeInBytes, err = reader.readUint64(); err != nil {
+			return nil, err
 		}
-		return &ListFilesResponse{
-			RequestID: reqID,
-			Files:     entries,
-		}, nil
-
-	case openLineRequest:
-		sha1Hash := reader.readSha1Hash()
-		chunk := reader.readUint16()
-		cap := reader.readUint16()
-		return &OpenConnectionRequest{
-			Sha1Hash:  sha1Hash,
-			Chunk:     chunk,
-			WindowCap: cap,
-		}, nil
-
-	case dataPacketAck:
-		offset := reader.readUint32()
-		return &DataPacketAck{Offset: offset}, nil
-
-	default:
-		return nil, fmt.Errorf("Message of unknown type discarded: %d", msgType)
+		if entry.ChunkCount, err = reader.readUint32(); err != nil {
+			return nil, err
+		}
+		if entry.ChunkSizeInBytes, err = reader.readUint32(); err != nil {
+			return nil, err
+		}
+		if entry.ChunksDownloaded, err = reader.readUint32(); err != nil {
+			return nil, err
+		}
+		if entry.Sha1Hash, err = reader.readSha1Hash(); err != nil {
+			return nil, err
+		}
+		if entry.FileName, err = reader.readString256(); err != nil {
+			return nil, err
+		}
+	}
+	return &result, nil
+}
+
+func parseOpenConnectionRequest(reader *byteReader) (Message, error) {
+	result := OpenConnectionRequest{}
+	var err error
+	if result.Sha1Hash, err = reader.readSha1Hash(); err != nil {
+		return nil, err
+	}
+	if result.Chunk, err = reader.readUint32(); err != nil {
+		return nil, err
+	}
+	if result.WindowCap, err = reader.readUint16(); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func parseCloseConnectionRequest(reader *byteReader) (Message, error) {
+	result := CloseConnectionRequest{}
+	var err error
+	if result.Sha1Hash, err = reader.readSha1Hash(); err != nil {
+		return nil, err
+	}
+	if result.Chunk, err = reader.readUint32(); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func parseDataPacketAck(reader *byteReader) (Message, error) {
+	result := DataPacketAck{}
+	var err error
+	if result.Offset, err = reader.readUint32(); err != nil {
+		return nil, err
+	}
+	if result.Ranges, err = reader.readSliceUint32Pairs(); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func parseChunkHashesRequest(reader *byteReader) (Message, error) {
+	result := ChunkHashesRequest{}
+	var err error
+	if result.RequestID, err = reader.readUint16(); err != nil {
+		return nil, err
+	}
+	if result.Sha1Hash, err = reader.readSha1Hash(); err != nil {
+		return nil, err
+	}
+	if result.Start, err = reader.readUint32(); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func parseChunkHashesResponse(reader *byteReader) (Message, error) {
+	result := ChunkHashesResponse{}
+	var err error
+	if result.RequestID, err = reader.readUint16(); err != nil {
+		return nil, err
+	}
+	if result.Sha1Hash, err = reader.readSha1Hash(); err != nil {
+		return nil, err
+	}
+	if result.Start, err = reader.readUint32(); err != nil {
+		return nil, err
+	}
+	if result.Total, err = reader.readUint32(); err != nil {
+		return nil, err
+	}
+	if result.Hashes, err = reader.readSliceSha1Hash(); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func parseMerkleProofRequest(reader *byteReader) (Message, error) {
+	result := MerkleProofRequest{}
+	var err error
+	if result.RequestID, err = reader.readUint16(); err != nil {
+		return nil, err
+	}
+	if result.Sha1Hash, err = reader.readSha1Hash(); err != nil {
+		return nil, err
+	}
+	if result.Chunk, err = reader.readUint32(); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func parseMerkleProofResponse(reader *byteReader) (Message, error) {
+	result := MerkleProofResponse{}
+	var err error
+	if result.RequestID, err = reader.readUint16(); err != nil {
+		return nil, err
+	}
+	if result.Sha1Hash, err = reader.readSha1Hash(); err != nil {
+		return nil, err
+	}
+	if result.Root, err = reader.readSha1Hash(); err != nil {
+		return nil, err
+	}
+	if result.Chunk, err = reader.readUint32(); err != nil {
+		return nil, err
+	}
+	if result.ChunkCount, err = reader.readUint32(); err != nil {
+		return nil, err
+	}
+	if result.Proof, err = reader.readSliceSha1Hash(); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func parseHelloRequest(reader *byteReader) (Message, error) {
+	result := HelloRequest{}
+	var err error
+	if result.RequestID, err = reader.readUint16(); err != nil {
+		return nil, err
+	}
+	if result.Version, err = reader.readByte(); err != nil {
+		return nil, err
+	}
+	capabilities, err := reader.readUint32()
+	if err != nil {
+		return nil, err
+	}
+	result.Capabilities = Capabilities(capabilities)
+	return &result, nil
+}
+
+func parseHelloResponse(reader *byteReader) (Message, error) {
+	req, err := parseHelloRequest(reader) // same layout
+	if err != nil {
+		return nil, err
+	}
+	hello := req.(*HelloRequest)
+	return &HelloResponse{
+		RequestID:    hello.RequestID,
+		Version:      hello.Version,
+		Capabilities: hello.Capabilities,
+	}, nil
+}
+
+func parseHaveAnnouncement(reader *byteReader) (Message, error) {
+	result := HaveAnnouncement{}
+	var err error
+	if result.Sha1Hash, err = reader.readSha1Hash(); err != nil {
+		return nil, err
+	}
+	if result.Port, err = reader.readUint16(); err != nil {
+		return nil, err
+	}
+	if result.Chunks, err = readAvailability(reader); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func parsePingRequest(reader *byteReader) (Message, error) {
+	result := PingRequest{}
+	var err error
+	if result.RequestID, err = reader.readUint16(); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func parsePingResponse(reader *byteReader) (Message, error) {
+	result := PingResponse{}
+	var err error
+	if result.RequestID, err = reader.readUint16(); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func parsePresenceAnnouncement(reader *byteReader) (Message, error) {
+	result := PresenceAnnouncement{}
+	var err error
+	if result.Port, err = reader.readUint16(); err != nil {
+		return nil, err
+	}
+	if result.Status, err = reader.readByte(); err != nil {
+		return nil, err
+	}
+	if result.Status > PresenceLeaving {
+		return nil, fmt.Errorf("%w: unknown presence status %d", ErrMalformed, result.Status)
 	}
+	return &result, nil
 }
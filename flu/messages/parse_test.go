@@ -1,7 +1,10 @@
 package messages
 
 import (
+	"errors"
+	"net/netip"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/flu-network/client/common"
@@ -13,7 +16,8 @@ func TestDiscoverHostRequest(t *testing.T) {
 	msg := &DiscoverHostRequest{
 		RequestID: 123,
 		Sha1Hash:  h,
-		Chunks:    []uint16{4, 5, 60123},
+		Port:      61697,
+		Chunks:    []uint32{4, 5, 70123, 70200, 4000000000, 4000000001},
 	}
 
 	serialized := msg.Serialize()
@@ -26,19 +30,139 @@ func TestDiscoverHostRequest(t *testing.T) {
 }
 
 func TestDiscoverHostResponse(t *testing.T) {
-	msg := &DiscoverHostResponse{
-		Address:   [4]byte{192, 168, 86, 34},
-		Port:      61690,
-		RequestID: 45678,
-		Chunks:    []uint16{},
+	type testCase struct {
+		address  string
+		expected string // the address the receiver sees
+	}
+	testCases := []testCase{
+		{"192.168.86.34", "192.168.86.34"},
+		{"fd00::2", "fd00::2"},
+		{"fe80::fc:ff:fe00:1%eth0", "fe80::fc:ff:fe00:1"}, // zones stay behind
+		{"::ffff:10.0.0.1", "10.0.0.1"},
 	}
+	for _, c := range testCases {
+		msg := &DiscoverHostResponse{
+			Address:   netip.MustParseAddr(c.address),
+			Port:      61690,
+			RequestID: 45678,
+			Chunks:    []uint32{},
+		}
 
-	serialized := msg.Serialize()
-	result, err := Parse(serialized)
-	check(err, t)
+		serialized := msg.Serialize()
+		result, err := Parse(serialized)
+		check(err, t)
 
-	if !reflect.DeepEqual(result, msg) {
-		t.Fatalf("msg does not match result. \nmsg:%v \nres:%v \n", msg, result)
+		msg.Address = netip.MustParseAddr(c.expected)
+		if !reflect.DeepEqual(result, msg) {
+			t.Fatalf("msg does not match result. \nmsg:%v \nres:%v \n", msg, result)
+		}
+	}
+
+	// addresses are either 4 or 16 bytes long
+	serialized := (&DiscoverHostResponse{Address: netip.MustParseAddr("10.0.0.1")}).Serialize()
+	serialized[4] = 5
+	if _, err := Parse(serialized); !errors.Is(err, ErrMalformed) {
+		t.Fatalf("Expected a 5-byte address to be malformed but got %v\n", err)
+	}
+}
+
+func TestDiscoverHostResponseRangeLimit(t *testing.T) {
+	// ranges returns count ranges of two chunks each, spaced apart by the given number of chunks
+	ranges := func(count int, spacing uint32) []uint32 {
+		result := make([]uint32, count*2)
+		for i := 0; i < count; i++ {
+			result[i*2] = uint32(i) * spacing
+			result[i*2+1] = uint32(i)*spacing + 1
+		}
+		return result
+	}
+	overlapping := make([]uint32, (MaxChunkRanges+10)*2)
+	for i := range overlapping {
+		overlapping[i] = uint32(i / 2)
+	}
+
+	type testCase struct {
+		desc     string
+		chunks   []uint32
+		expected []uint32
+	}
+	testCases := []testCase{
+		{"fragmented", ranges(400, 3), ranges(400, 3)},
+		{"few", ranges(3, 1<<30), ranges(3, 1<<30)},
+		{"overlapping ranges are listed", overlapping, overlapping[:MaxChunkRanges*2]},
+		// every range but the first takes five bytes as runs, which still beats eight as a list
+		{"too many to fit", ranges(1000, 1<<22), ranges(1000, 1<<22)[:(1+(maxRunsSize-2)/5)*2]},
+	}
+	for _, c := range testCases {
+		t.Run(c.desc, func(t *testing.T) {
+			msg := &DiscoverHostResponse{Port: 61690, RequestID: 45678, Chunks: c.chunks}
+			serialized := msg.Serialize()
+			if len(serialized) > MaxDatagramSize {
+				t.Fatalf("Expected response to fit in a datagram but it is %d bytes\n",
+					len(serialized))
+			}
+			result, err := Parse(serialized)
+			check(err, t)
+			if actual := result.(*DiscoverHostResponse).Chunks; !reflect.DeepEqual(
+				actual, c.expected) {
+				t.Fatalf("Expected %d ranges but got %d: %v\n", len(c.expected)/2,
+					len(actual)/2, actual)
+			}
+
+			request := &DiscoverHostRequest{Chunks: c.chunks}
+			if serialized := request.Serialize(); len(serialized) > MaxDatagramSize {
+				t.Fatalf("Expected request to fit in a datagram but it is %d bytes\n",
+					len(serialized))
+			}
+		})
+	}
+}
+
+func TestFitAvailability(t *testing.T) {
+	// ranges of chunks, of the given lengths, with a chunk missing between each of them
+	ranges := func(lengths ...uint32) []uint32 {
+		result := make([]uint32, 0, len(lengths)*2)
+		next := uint32(0)
+		for _, length := range lengths {
+			result = append(result, next, next+length-1)
+			next += length + 1
+		}
+		return result
+	}
+	repeat := func(n int, length uint32) []uint32 {
+		lengths := make([]uint32, n)
+		for i := range lengths {
+			lengths[i] = length
+		}
+		return lengths
+	}
+
+	if fit, truncated := FitAvailability(ranges(repeat(400, 2)...)); truncated || len(fit) != 800 {
+		t.Fatalf("Expected 400 ranges to fit as runs but got %d, %v\n", len(fit)/2, truncated)
+	}
+
+	// too many short ranges to fit: the prefix that fits as runs reports the most chunks
+	short := ranges(repeat(2000, 1<<20)...)
+	fit, truncated := FitAvailability(short)
+	if !truncated || len(fit) <= MaxChunkRanges*2 || !reflect.DeepEqual(fit, short[:len(fit)]) {
+		t.Fatalf("Expected a prefix of more than %d ranges but got %d, %v\n", MaxChunkRanges,
+			len(fit)/2, truncated)
+	}
+
+	// a few long ranges among many short ones are kept, wherever they are
+	lengths := append(repeat(2000, 1<<16), repeat(3, 1<<28)...)
+	lengths[0], lengths[1500] = 1<<28, 1<<28
+	fit, truncated = FitAvailability(ranges(lengths...))
+	if !truncated || chunkCount(fit) < 5<<28 {
+		t.Fatalf("Expected the long ranges to be kept but got %d chunks, %v\n", chunkCount(fit),
+			truncated)
+	}
+	msg := &DiscoverHostResponse{Port: 61690, RequestID: 1, Chunks: fit}
+	result, err := Parse(msg.Serialize())
+	check(err, t)
+	if actual := result.(*DiscoverHostResponse).Chunks; !reflect.DeepEqual(actual, fit) {
+		t.Fatalf("Expected the fitted ranges to be sent in full but got %d of %d\n",
+			len(actual)/2, len(fit)/2)
 	}
 }
 
@@ -47,7 +171,7 @@ func TestOpenLineRequest(t *testing.T) {
 	h.FromString("F10E2821BBBEA527EA02200352313BC059445190")
 	msg := &OpenConnectionRequest{
 		Sha1Hash:  &h,
-		Chunk:     654,
+		Chunk:     70654,
 		WindowCap: 213,
 	}
 
@@ -60,12 +184,12 @@ func TestOpenLineRequest(t *testing.T) {
 	}
 }
 
-func TestListFilesRequest(t *testing.T) {
+func TestCloseConnectionRequest(t *testing.T) {
 	h := common.Sha1Hash{}
 	h.FromString("F10E2821BBBEA527EA02200352313BC059445190")
-	msg := &ListFilesRequest{
-		RequestID: 123,
-		Sha1Hash:  &h,
+	msg := &CloseConnectionRequest{
+		Sha1Hash: &h,
+		Chunk:    70654,
 	}
 
 	serialized := msg.Serialize()
@@ -77,6 +201,70 @@ func TestListFilesRequest(t *testing.T) {
 	}
 }
 
+func TestDataPacketAck(t *testing.T) {
+	type testCase struct {
+		desc  string
+		input DataPacketAck
+	}
+
+	testCases := []*testCase{
+		{
+			desc:  "cumulative only",
+			input: DataPacketAck{Offset: 4096, Ranges: []uint32{}},
+		},
+		{
+			desc:  "selective",
+			input: DataPacketAck{Offset: 1000, Ranges: []uint32{2024, 3048, 5096, 4194304}},
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.desc, func(t *testing.T) {
+			serialized := c.input.Serialize()
+			result, err := Parse(serialized)
+			check(err, t)
+			if !reflect.DeepEqual(result, &c.input) {
+				t.Fatalf("msg does not match result. \nmsg:%v \nres:%v \n", c.input, result)
+			}
+		})
+	}
+
+	// acks with more ranges than fit in a datagram only carry the first ones
+	ranges := make([]uint32, (MaxAckRanges+10)*2)
+	for i := range ranges {
+		ranges[i] = uint32(i) * 1024
+	}
+	serialized := (&DataPacketAck{Offset: 0, Ranges: ranges}).Serialize()
+	if len(serialized) > MaxDatagramSize {
+		t.Fatalf("Expected ack to fit in a datagram but it is %d bytes\n", len(serialized))
+	}
+	result, err := Parse(serialized)
+	check(err, t)
+	if actual := result.(*DataPacketAck).Ranges; !reflect.DeepEqual(actual,
+		ranges[:MaxAckRanges*2]) {
+		t.Fatalf("Expected the first %d ranges but got %d\n", MaxAckRanges, len(actual)/2)
+	}
+}
+
+func TestListFilesRequest(t *testing.T) {
+	h := common.Sha1Hash{}
+	h.FromString("F10E2821BBBEA527EA02200352313BC059445190")
+	after := common.Sha1Hash{}
+	after.FromString("0A0E2821BBBEA527EA02200352313BC059445190")
+	for _, msg := range []*ListFilesRequest{
+		{RequestID: 123, Sha1Hash: &h},
+		{RequestID: 124, Sha1Hash: &h, After: &after},
+	} {
+		serialized := msg.Serialize()
+		result, err := Parse(serialized)
+		check(err, t)
+
+		if !reflect.DeepEqual(result, msg) {
+			t.Fatalf("msg does not match result. \nmsg:%v \nres:%v \n", msg, result)
+		}
+	}
+}
+
 func TestListFilesResponse(t *testing.T) {
 	type testCase struct {
 		desc  string
@@ -111,6 +299,7 @@ func TestListFilesResponse(t *testing.T) {
 			desc: "full response",
 			input: ListFilesResponse{
 				RequestID: 45678,
+				More:      true,
 				Files: []ListFilesEntry{
 					{
 						SizeInBytes:      123,
@@ -150,3 +339,401 @@ func check(e error, t *testing.T) {
 		t.Fatal(e)
 	}
 }
+
+func TestChunkHashesRequest(t *testing.T) {
+	h := common.Sha1Hash{}
+	h.FromString("F10E2821BBBEA527EA02200352313BC059445190")
+	msg := &ChunkHashesRequest{
+		RequestID: 4321,
+		Sha1Hash:  &h,
+		Start:     96,
+	}
+
+	serialized := msg.Serialize()
+	result, err := Parse(serialized)
+	check(err, t)
+
+	if !reflect.DeepEqual(result, msg) {
+		t.Fatalf("msg does not match result. \nmsg:%v \nres:%v \n", msg, result)
+	}
+}
+
+func TestChunkHashesResponse(t *testing.T) {
+	h := common.Sha1Hash{}
+	h.FromString("F10E2821BBBEA527EA02200352313BC059445190")
+	hashes := make([]common.Sha1Hash, MaxChunkHashesPerResponse+2)
+	for i := range hashes {
+		hashes[i].Data[0] = byte(i)
+	}
+	msg := &ChunkHashesResponse{
+		RequestID: 4321,
+		Sha1Hash:  &h,
+		Start:     96,
+		Total:     1000,
+		Hashes:    hashes,
+	}
+
+	serialized := msg.Serialize()
+	if len(serialized) > 1024 {
+		t.Fatalf("Expected response to fit in a 1024-byte datagram but it is %d bytes\n",
+			len(serialized))
+	}
+	result, err := Parse(serialized)
+	check(err, t)
+
+	msg.Hashes = msg.Hashes[:MaxChunkHashesPerResponse] // the rest don't fit
+	if !reflect.DeepEqual(result, msg) {
+		t.Fatalf("msg does not match result. \nmsg:%v \nres:%v \n", msg, result)
+	}
+
+	empty := &ChunkHashesResponse{RequestID: 1, Sha1Hash: &h, Hashes: []common.Sha1Hash{}}
+	result, err = Parse(empty.Serialize())
+	check(err, t)
+	if !reflect.DeepEqual(result, empty) {
+		t.Fatalf("msg does not match result. \nmsg:%v \nres:%v \n", empty, result)
+	}
+}
+
+func TestMerkleProofRequest(t *testing.T) {
+	h := common.Sha1Hash{}
+	h.FromString("F10E2821BBBEA527EA02200352313BC059445190")
+	msg := &MerkleProofRequest{
+		RequestID: 4321,
+		Sha1Hash:  &h,
+		Chunk:     70000,
+	}
+
+	serialized := msg.Serialize()
+	result, err := Parse(serialized)
+	check(err, t)
+
+	if !reflect.DeepEqual(result, msg) {
+		t.Fatalf("msg does not match result. \nmsg:%v \nres:%v \n", msg, result)
+	}
+}
+
+func TestMerkleProofResponse(t *testing.T) {
+	h := common.Sha1Hash{}
+	h.FromString("F10E2821BBBEA527EA02200352313BC059445190")
+	root := common.Sha1Hash{}
+	root.FromString("A0F1490A20D0211C997B44BC357E1972DEAB8AE3")
+	proof := make([]common.Sha1Hash, maxMerkleProofLength)
+	for i := range proof {
+		proof[i].Data[0] = byte(i)
+	}
+	msg := &MerkleProofResponse{
+		RequestID:  4321,
+		Sha1Hash:   &h,
+		Root:       &root,
+		Chunk:      70000,
+		ChunkCount: 1 << 31,
+		Proof:      proof,
+	}
+
+	serialized := msg.Serialize()
+	if len(serialized) > 1024 {
+		t.Fatalf("Expected response to fit in a 1024-byte datagram but it is %d bytes\n",
+			len(serialized))
+	}
+	result, err := Parse(serialized)
+	check(err, t)
+
+	if !reflect.DeepEqual(result, msg) {
+		t.Fatalf("msg does not match result. \nmsg:%v \nres:%v \n", msg, result)
+	}
+}
+
+func TestHaveAnnouncement(t *testing.T) {
+	h := common.Sha1Hash{}
+	h.FromString("F10E2821BBBEA527EA02200352313BC059445190")
+	for _, msg := range []*HaveAnnouncement{
+		{Sha1Hash: &h, Port: 61690, Chunks: []uint32{70000, 70000}},
+		{Sha1Hash: &h, Port: 61690, Chunks: []uint32{1, 2, 5, 5, 9, 4000000000}},
+		{Sha1Hash: &h, Port: 61690, Chunks: []uint32{}},
+	} {
+		result, err := Parse(msg.Serialize())
+		check(err, t)
+		if !reflect.DeepEqual(result, msg) {
+			t.Fatalf("msg does not match result. \nmsg:%v \nres:%v \n", msg, result)
+		}
+	}
+}
+
+func TestPing(t *testing.T) {
+	for _, msg := range []Message{&PingRequest{RequestID: 4321}, &PingResponse{RequestID: 4321}} {
+		result, err := Parse(msg.Serialize())
+		check(err, t)
+		if !reflect.DeepEqual(result, msg) {
+			t.Fatalf("msg does not match result. \nmsg:%v \nres:%v \n", msg, result)
+		}
+	}
+}
+
+func TestPresence(t *testing.T) {
+	for _, status := range []uint8{PresenceJoining, PresenceAlive, PresenceLeaving} {
+		msg := &PresenceAnnouncement{Port: 61690, Status: status}
+		result, err := Parse(msg.Serialize())
+		check(err, t)
+		if !reflect.DeepEqual(result, msg) {
+			t.Fatalf("msg does not match result. \nmsg:%v \nres:%v \n", msg, result)
+		}
+	}
+
+	unknown := (&PresenceAnnouncement{Port: 61690, Status: PresenceLeaving + 1}).Serialize()
+	if _, err := Parse(unknown); !errors.Is(err, ErrMalformed) {
+		t.Fatalf("Expected an unknown status to be malformed but got %v\n", err)
+	}
+}
+
+func TestHello(t *testing.T) {
+	for _, msg := range []Message{
+		&HelloRequest{RequestID: 4321, Version: ProtocolVersion, Capabilities: 1<<31 | CapChunkHashes},
+		&HelloResponse{RequestID: 4321, Version: 9, Capabilities: SupportedCapabilities},
+	} {
+		result, err := Parse(msg.Serialize())
+		check(err, t)
+		if !reflect.DeepEqual(result, msg) {
+			t.Fatalf("msg does not match result. \nmsg:%v \nres:%v \n", msg, result)
+		}
+	}
+
+	if s := (CapSelectiveAck | CapMerkleProofs | 1<<31).String(); s != "sack,merkle-proofs" {
+		t.Fatalf("Unexpected capabilities '%s'\n", s)
+	}
+	if !SupportedCapabilities.Has(CapChunkHashes|CapMerkleProofs) ||
+		SupportedCapabilities.Has(CapChunkHashes|CapEncryption) {
+		t.Fatalf("Unexpected supported capabilities %s\n", SupportedCapabilities)
+	}
+}
+
+func TestParseRejectsIncompatibleVersions(t *testing.T) {
+	h := common.Sha1Hash{}
+	h.FromString("F10E2821BBBEA527EA02200352313BC059445190")
+	serialized := (&ListFilesRequest{RequestID: 1, Sha1Hash: &h}).Serialize()
+
+	// daemons that predate versioning send the message type first
+	_, err := Parse(serialized[1:])
+	if !errors.Is(err, ErrIncompatibleVersion) {
+		t.Fatalf("Expected unversioned message to be rejected but got %v\n", err)
+	}
+
+	_, err = Parse(withVersion(serialized, ProtocolVersion+1))
+	if !errors.Is(err, ErrIncompatibleVersion) {
+		t.Fatalf("Expected message from a newer version to be rejected but got %v\n", err)
+	}
+	_, err = Parse(withVersion(serialized, MinProtocolVersion-1))
+	if !errors.Is(err, ErrIncompatibleVersion) {
+		t.Fatalf("Expected message from an older version to be rejected but got %v\n", err)
+	}
+
+	// Hellos are understood whatever their version, so newer peers can downgrade
+	hello := (&HelloRequest{RequestID: 1, Version: ProtocolVersion + 1}).Serialize()
+	result, err := Parse(withVersion(hello, ProtocolVersion+1))
+	check(err, t)
+	if result.(*HelloRequest).Version != ProtocolVersion+1 {
+		t.Fatalf("Unexpected hello %v\n", result)
+	}
+
+	// including those from version 1 peers, which have no trailer
+	for _, msgType := range []uint8{helloRequest, helloResponse} {
+		old := []byte{versionMagic | 1, msgType, 0x12, 0x34, 1, 0, 0, 0, byte(CapChunkHashes)}
+		result, err := Parse(old)
+		check(err, t)
+		expected := []Message{
+			&HelloRequest{RequestID: 0x1234, Version: 1, Capabilities: CapChunkHashes},
+			&HelloResponse{RequestID: 0x1234, Version: 1, Capabilities: CapChunkHashes},
+		}[msgType-helloRequest]
+		if !reflect.DeepEqual(result, expected) {
+			t.Fatalf("Expected %v but got %v\n", expected, result)
+		}
+	}
+	_, err = Parse(serialized[:len(serialized)-trailerSize])
+	if err == nil {
+		t.Fatalf("Expected a message without a trailer to be rejected\n")
+	}
+}
+
+// withVersion returns a copy of a serialized message that claims to be of the given version
+func withVersion(serialized []byte, version uint8) []byte {
+	w := byteWriter{Data: append([]byte{}, serialized[:len(serialized)-trailerSize]...)}
+	w.Data[0] = versionMagic | version
+	return w.finish()
+}
+
+func TestFitListFilesEntries(t *testing.T) {
+	h := common.Sha1Hash{}
+	h.FromString("F10E2821BBBEA527EA02200352313BC059445190")
+	entries := make([]ListFilesEntry, 100)
+	for i := range entries {
+		entries[i] = ListFilesEntry{Sha1Hash: &h, FileName: strings.Repeat("x", i)}
+	}
+
+	for start := 0; start < len(entries); {
+		fit := FitListFilesEntries(entries[start:])
+		if fit == 0 {
+			t.Fatalf("Expected at least one entry to fit at %d\n", start)
+		}
+		serialized := (&ListFilesResponse{Files: entries[start : start+fit]}).Serialize()
+		if len(serialized) > MaxDatagramSize {
+			t.Fatalf("Expected %d entries from %d to fit in a datagram but they take %d bytes\n",
+				fit, start, len(serialized))
+		}
+		if start+fit < len(entries) {
+			serialized = (&ListFilesResponse{Files: entries[start : start+fit+1]}).Serialize()
+			if len(serialized) <= MaxDatagramSize {
+				t.Fatalf("Expected more than %d entries from %d to fit\n", fit, start)
+			}
+		}
+		start += fit
+	}
+
+	longest := []ListFilesEntry{{Sha1Hash: &h, FileName: strings.Repeat("x", 1000)}}
+	if FitListFilesEntries(longest) != 1 {
+		t.Fatalf("Expected an entry with the longest possible file name to fit\n")
+	}
+}
+
+// testMessages returns one of every kind of message Parse understands
+func testMessages() []Message {
+	h := common.Sha1Hash{}
+	h.FromString("F10E2821BBBEA527EA02200352313BC059445190")
+	return []Message{
+		&DiscoverHostRequest{RequestID: 1, Sha1Hash: h, Port: 61697, Chunks: []uint32{1, 2, 4, 9}},
+		&DiscoverHostResponse{RequestID: 2, Address: netip.MustParseAddr("10.0.0.1"), Port: 61690,
+			Chunks: []uint32{4, 5, 5, 6}},
+		&ListFilesRequest{RequestID: 3, Sha1Hash: &h, After: &h},
+		&ListFilesResponse{RequestID: 4, More: true, Files: []ListFilesEntry{
+			{SizeInBytes: 10, ChunkCount: 1, ChunkSizeInBytes: 10, Sha1Hash: &h, FileName: "a"},
+			{SizeInBytes: 20, ChunkCount: 2, ChunkSizeInBytes: 10, Sha1Hash: &h, FileName: "b"},
+		}},
+		&OpenConnectionRequest{Sha1Hash: &h, Chunk: 5, WindowCap: 6},
+		&CloseConnectionRequest{Sha1Hash: &h, Chunk: 7},
+		&DataPacketAck{Offset: 8, Ranges: []uint32{10, 20}},
+		&ChunkHashesRequest{RequestID: 9, Sha1Hash: &h, Start: 10},
+		&ChunkHashesResponse{RequestID: 11, Sha1Hash: &h, Start: 0, Total: 1,
+			Hashes: []common.Sha1Hash{h}},
+		&MerkleProofRequest{RequestID: 12, Sha1Hash: &h, Chunk: 13},
+		&MerkleProofResponse{RequestID: 14, Sha1Hash: &h, Root: &h, Chunk: 1, ChunkCount: 2,
+			Proof: []common.Sha1Hash{h}},
+		&HelloRequest{RequestID: 15, Version: ProtocolVersion, Capabilities: CapChunkHashes},
+		&HelloResponse{RequestID: 16, Version: ProtocolVersion, Capabilities: CapMerkleProofs},
+		&HaveAnnouncement{Sha1Hash: &h, Port: 61690, Chunks: []uint32{17, 17}},
+		&PingRequest{RequestID: 18},
+		&PingResponse{RequestID: 19},
+		&PresenceAnnouncement{Port: 61690, Status: PresenceAlive},
+	}
+}
+
+func TestParseRejectsMalformedMessages(t *testing.T) {
+	for _, msg := range testMessages() {
+		serialized := msg.Serialize()
+		if _, err := Parse(serialized); err != nil {
+			t.Fatalf("Expected %T to parse but got %v\n", msg, err)
+		}
+
+		for i := 0; i < len(serialized); i++ {
+			if _, err := Parse(serialized[:i]); !errors.Is(err, ErrMalformed) {
+				t.Fatalf("Expected %T truncated to %d bytes to be rejected but got %v\n",
+					msg, i, err)
+			}
+		}
+
+		for i := headerSize; i < len(serialized); i++ {
+			corrupt := append([]byte{}, serialized...)
+			corrupt[i] ^= 0x10
+			if _, err := Parse(corrupt); !errors.Is(err, ErrMalformed) {
+				t.Fatalf("Expected %T with byte %d flipped to be rejected but got %v\n",
+					msg, i, err)
+			}
+		}
+
+		// a valid checksum over the wrong amount of data is still rejected
+		body := serialized[:len(serialized)-trailerSize]
+		for _, wrong := range [][]byte{
+			body[:len(body)-1],
+			append(append([]byte{}, body...), 0),
+		} {
+			w := byteWriter{Data: append([]byte{}, wrong...)}
+			if _, err := Parse(w.finish()); !errors.Is(err, ErrMalformed) {
+				t.Fatalf("Expected %T of the wrong length to be rejected but got %v\n", msg, err)
+			}
+		}
+	}
+
+	// lengths read off the wire are checked against what is actually there
+	w := newByteWriter(listFilesResponse, 4)
+	w.writeUint16(1)
+	w.writeUint16(65535)
+	if _, err := Parse(w.finish()); !errors.Is(err, ErrMalformed) {
+		t.Fatalf("Expected response with a fake file count to be rejected but got %v\n", err)
+	}
+	w = newByteWriter(discoverHostRequest, 24)
+	w.writeUint16(1)
+	w.writeBytes(make([]byte, 20))
+	w.writeByte(255)
+	if _, err := Parse(w.finish()); !errors.Is(err, ErrMalformed) {
+		t.Fatalf("Expected request with a fake chunk count to be rejected but got %v\n", err)
+	}
+
+	w = newByteWriter(255, 0)
+	if _, err := Parse(w.finish()); !errors.Is(err, ErrMalformed) {
+		t.Fatalf("Expected message of unknown type to be rejected but got %v\n", err)
+	}
+}
+
+func TestParseAsDataPacket(t *testing.T) {
+	msg := &DataPacket{Offset: 1024, Data: []byte("some data")}
+	serialized := msg.Serialize()
+	if len(serialized) != len(msg.Data)+DataPacketOverhead {
+		t.Fatalf("Expected %d bytes of overhead but got %d\n", DataPacketOverhead,
+			len(serialized)-len(msg.Data))
+	}
+	result, err := ParseAsDataPacket(serialized)
+	check(err, t)
+	if !reflect.DeepEqual(result, msg) {
+		t.Fatalf("msg does not match result. \nmsg:%v \nres:%v \n", msg, result)
+	}
+
+	for i := 0; i < len(serialized); i++ {
+		if _, err := ParseAsDataPacket(serialized[:i]); !errors.Is(err, ErrMalformed) {
+			t.Fatalf("Expected packet truncated to %d bytes to be rejected but got %v\n", i, err)
+		}
+	}
+	ack := (&DataPacketAck{Offset: 1}).Serialize()
+	if _, err := ParseAsDataPacket(ack); !errors.Is(err, ErrMalformed) {
+		t.Fatalf("Expected an ack to be rejected but got %v\n", err)
+	}
+}
+
+// FuzzParse checks that Parse never panics, whatever it is given, and that anything it accepts
+// survives a round trip. Inputs are parsed as they are, and again with a valid checksum appended
+// so that the fuzzer gets past the checksum. Run it with `go test -fuzz FuzzParse ./flu/messages`.
+func FuzzParse(f *testing.F) {
+	for _, msg := range testMessages() {
+		serialized := msg.Serialize()
+		f.Add(serialized[:len(serialized)-trailerSize])
+	}
+	packet := (&DataPacket{Offset: 1, Data: []byte("data")}).Serialize()
+	f.Add(packet[:len(packet)-trailerSize])
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		withTrailer := (&byteWriter{Data: append([]byte{}, data...)}).finish()
+		for _, datagram := range [][]byte{data, withTrailer} {
+			ParseAsDataPacket(datagram)
+			msg, err := Parse(datagram)
+			if err != nil {
+				if !errors.Is(err, ErrMalformed) && !errors.Is(err, ErrIncompatibleVersion) {
+					t.Fatalf("Unexpected kind of error %v\n", err)
+				}
+				continue
+			}
+			result, err := Parse(msg.Serialize())
+			if err != nil {
+				t.Fatalf("Failed to parse reserialized %T: %v\n", msg, err)
+			}
+			if !reflect.DeepEqual(result, msg) {
+				t.Fatalf("msg does not match result. \nmsg:%v \nres:%v \n", msg, result)
+			}
+		}
+	})
+}
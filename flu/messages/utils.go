@@ -2,72 +2,274 @@ package messages
 
 import (
 	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"net/netip"
 
 	"github.com/flu-network/client/common"
 )
 
 // byteReader is a wrapper around a []byte that makes it easier to parse things if you know what
 // data to expect. For example, if you know the message contains two uint8s and a sha1Hash you could
-// just call br.readByte(); br.readByte(); br.readSha1Hash() in that order.
+// just call br.readByte(); br.readByte(); br.readSha1Hash() in that order. Every method checks
+// that enough data remains and returns an error wrapping ErrMalformed if not, so lengths read off
+// the wire can never cause a panic.
 type byteReader struct {
 	Data  []byte
 	index int
 }
 
-func (b *byteReader) readByte() uint8 {
-	result := b.Data[b.index]
-	b.index++
-	return result
+// remaining returns the number of bytes that have not been read yet
+func (b *byteReader) remaining() int {
+	return len(b.Data) - b.index
 }
 
-func (b *byteReader) readBytes(count int) []byte {
+// take returns the next count bytes, or an error if fewer remain
+func (b *byteReader) take(count int) ([]byte, error) {
+	if count < 0 || count > b.remaining() {
+		return nil, fmt.Errorf("%w: wanted %d bytes at offset %d but only %d remain",
+			ErrMalformed, count, b.index, b.remaining())
+	}
 	result := b.Data[b.index : b.index+count]
 	b.index += count
-	return result
+	return result, nil
 }
 
-func (b *byteReader) readSha1Hash() *common.Sha1Hash {
-	hashData := b.Data[b.index : b.index+20]
-	b.index += 20
-	return (&common.Sha1Hash{}).FromSlice(hashData)
+func (b *byteReader) readByte() (uint8, error) {
+	data, err := b.take(1)
+	if err != nil {
+		return 0, err
+	}
+	return data[0], nil
 }
 
-func (b *byteReader) readUint16() uint16 {
-	result := binary.BigEndian.Uint16(b.Data[b.index : b.index+2])
-	b.index += 2
-	return result
+// readFlag reads a byte that must be 0 (false) or 1 (true)
+func (b *byteReader) readFlag() (bool, error) {
+	v, err := b.readByte()
+	if err != nil {
+		return false, err
+	}
+	if v > 1 {
+		return false, fmt.Errorf("%w: expected a flag but got %d", ErrMalformed, v)
+	}
+	return v == 1, nil
 }
 
-func (b *byteReader) readUint32() uint32 {
-	result := binary.BigEndian.Uint32(b.Data[b.index : b.index+4])
-	b.index += 4
-	return result
+func (b *byteReader) readBytes(count int) ([]byte, error) {
+	return b.take(count)
 }
 
-func (b *byteReader) readUint64() uint64 {
-	result := binary.BigEndian.Uint64(b.Data[b.index : b.index+8])
-	b.index += 8
-	return result
+func (b *byteReader) readSha1Hash() (*common.Sha1Hash, error) {
+	data, err := b.take(20)
+	if err != nil {
+		return nil, err
+	}
+	return (&common.Sha1Hash{}).FromSlice(data), nil
 }
 
-func (b *byteReader) readSliceUint16() []uint16 {
-	length := int(b.readByte())
-	result := make([]uint16, length)
-	for i := 0; i < length; i++ {
-		result[i] = b.readUint16()
+// readAddr reads an IPv4 or IPv6 address, preceded by its length in bytes
+func (b *byteReader) readAddr() (netip.Addr, error) {
+	length, err := b.readByte()
+	if err != nil {
+		return netip.Addr{}, err
 	}
-	return result
+	if length != 4 && length != 16 {
+		return netip.Addr{}, fmt.Errorf("%w: %d-byte IP address", ErrMalformed, length)
+	}
+	data, err := b.take(int(length))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	addr, _ := netip.AddrFromSlice(data)
+	return addr, nil
 }
 
-func (b *byteReader) readString256() string {
-	length := int(b.readByte())
-	result := string(b.Data[b.index : b.index+length])
-	b.index += length
-	return result
+func (b *byteReader) readUint16() (uint16, error) {
+	data, err := b.take(2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(data), nil
+}
+
+func (b *byteReader) readUint32() (uint32, error) {
+	data, err := b.take(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(data), nil
+}
+
+func (b *byteReader) readUint64() (uint64, error) {
+	data, err := b.take(8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(data), nil
+}
+
+// readCount reads a one-byte count of items that are each at least itemSize bytes long, and
+// checks that that many could fit in what remains
+func (b *byteReader) readCount(itemSize int) (int, error) {
+	count, err := b.readByte()
+	if err != nil {
+		return 0, err
+	}
+	if int(count)*itemSize > b.remaining() {
+		return 0, fmt.Errorf("%w: %d items of %d bytes do not fit in the %d bytes that remain",
+			ErrMalformed, count, itemSize, b.remaining())
+	}
+	return int(count), nil
+}
+
+// readRanges reads a two-byte count of chunk ranges followed by that many inclusive [start, end]
+// pairs of uint32s, as written by byteWriter.writeRanges
+func (b *byteReader) readRanges() ([]uint32, error) {
+	count, err := b.readUint16()
+	if err != nil {
+		return nil, err
+	}
+	if int(count) > MaxChunkRanges || int(count)*8 > b.remaining() {
+		return nil, fmt.Errorf("%w: %d chunk ranges do not fit in a datagram", ErrMalformed, count)
+	}
+	result := make([]uint32, int(count)*2)
+	for i := range result {
+		if result[i], err = b.readUint32(); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// readSliceUint32Pairs reads a one-byte count of pairs followed by that many pairs of uint32s
+func (b *byteReader) readSliceUint32Pairs() ([]uint32, error) {
+	pairs, err := b.readCount(8)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]uint32, pairs*2)
+	for i := range result {
+		if result[i], err = b.readUint32(); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// readSliceSha1Hash reads a one-byte count followed by that many sha1 hashes
+func (b *byteReader) readSliceSha1Hash() ([]common.Sha1Hash, error) {
+	length, err := b.readCount(20)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]common.Sha1Hash, length)
+	for i := range result {
+		hash, err := b.readSha1Hash()
+		if err != nil {
+			return nil, err
+		}
+		result[i] = *hash
+	}
+	return result, nil
+}
+
+func (b *byteReader) readString256() (string, error) {
+	length, err := b.readByte()
+	if err != nil {
+		return "", err
+	}
+	data, err := b.take(int(length))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
 }
 
 // Serialization utilities
 
+// byteWriter is the counterpart of byteReader: it appends big-endian values to a []byte in the
+// order they should be read back.
+type byteWriter struct {
+	Data []byte
+}
+
+// newByteWriter returns a byteWriter that has already written the header every datagram starts
+// with: the protocol version followed by the message type. capacity is a hint for the size of the
+// rest of the message. Call finish to add the trailer once the rest is written.
+func newByteWriter(msgType uint8, capacity int) *byteWriter {
+	result := byteWriter{Data: make([]byte, 0, headerSize+capacity+trailerSize)}
+	result.writeByte(versionMagic | ProtocolVersion)
+	result.writeByte(msgType)
+	return &result
+}
+
+// finish appends the checksum trailer every datagram ends with, and returns the datagram
+func (w *byteWriter) finish() []byte {
+	w.writeUint32(crc32.Checksum(w.Data, crc32cTable))
+	return w.Data
+}
+
+func (w *byteWriter) writeByte(v uint8) {
+	w.Data = append(w.Data, v)
+}
+
+func (w *byteWriter) writeBytes(v []byte) {
+	w.Data = append(w.Data, v...)
+}
+
+func (w *byteWriter) writeSha1Hash(v *common.Sha1Hash) {
+	w.Data = append(w.Data, v.Slice()...)
+}
+
+// writeAddr writes an IPv4 or IPv6 address as read by byteReader.readAddr. IPv4 addresses take 4
+// bytes, even if they are held as IPv4-mapped IPv6 addresses. Zones only mean something to the
+// host that holds the address, so they are not written. The zero Addr is written as 0.0.0.0.
+func (w *byteWriter) writeAddr(v netip.Addr) {
+	if !v.IsValid() {
+		v = netip.IPv4Unspecified()
+	}
+	data := v.Unmap().AsSlice()
+	w.writeByte(uint8(len(data)))
+	w.writeBytes(data)
+}
+
+func (w *byteWriter) writeUint16(v uint16) {
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], v)
+	w.Data = append(w.Data, buf[:]...)
+}
+
+func (w *byteWriter) writeUint32(v uint32) {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	w.Data = append(w.Data, buf[:]...)
+}
+
+func (w *byteWriter) writeUint64(v uint64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	w.Data = append(w.Data, buf[:]...)
+}
+
+// writeRanges writes a two-byte count followed by up to MaxChunkRanges chunk ranges, as read by
+// byteReader.readRanges. Callers fit ranges with FitAvailability first; any beyond MaxChunkRanges
+// are ignored, as is the last value of an odd-length list.
+func (w *byteWriter) writeRanges(v []uint32) {
+	count := len(v) / 2
+	if count > MaxChunkRanges {
+		count = MaxChunkRanges
+	}
+	w.writeUint16(uint16(count))
+	for _, x := range v[:count*2] {
+		w.writeUint32(x)
+	}
+}
+
+// writeString255 writes the first 255 bytes of a string, as read by byteReader.readString256
+func (w *byteWriter) writeString255(s string) {
+	w.writeBytes(SerializeString255(s))
+}
+
 // SerializeString255 serializaes the first 255 bytes of a string. Later bytes are ignored.
 func SerializeString255(s string) []byte {
 	strLen := len(s)
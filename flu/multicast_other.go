@@ -0,0 +1,14 @@
+//go:build !(aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris || windows)
+
+package flu
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+)
+
+// joinGroup is not supported on this platform, so hosts can only be discovered over IPv4
+func joinGroup(conn *net.UDPConn, group netip.Addr, ifindex int) error {
+	return errors.New("multicast is not supported on this platform")
+}
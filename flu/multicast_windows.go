@@ -0,0 +1,25 @@
+package flu
+
+import (
+	"net"
+	"net/netip"
+	"syscall"
+)
+
+// joinGroup makes a socket receive the datagrams sent to an IPv6 multicast group on an interface
+func joinGroup(conn *net.UDPConn, group netip.Addr, ifindex int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	mreq := &syscall.IPv6Mreq{Multiaddr: group.As16(), Interface: uint32(ifindex)}
+	var joinErr error
+	err = raw.Control(func(fd uintptr) {
+		joinErr = syscall.SetsockoptIPv6Mreq(syscall.Handle(fd), syscall.IPPROTO_IPV6,
+			syscall.IPV6_JOIN_GROUP, mreq)
+	})
+	if err != nil {
+		return err
+	}
+	return joinErr
+}
@@ -0,0 +1,124 @@
+package picker
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"github.com/flu-network/client/common"
+)
+
+// Policy decides the order in which the missing chunks of a file are requested from the swarm.
+type Policy uint8
+
+const (
+	// Default defers to whichever policy the daemon is configured with
+	Default Policy = iota
+	// RarestFirst requests the chunks held by the fewest peers first, so that the swarm does not
+	// lose the last copy of a chunk when a seeder leaves. Ties are broken randomly.
+	RarestFirst
+	// Sequential requests chunks in order. Useful for previewing media while it downloads.
+	Sequential
+	// Random requests chunks in a random order.
+	Random
+)
+
+var policyNames = map[Policy]string{
+	Default:     "default",
+	RarestFirst: "rarest",
+	Sequential:  "sequential",
+	Random:      "random",
+}
+
+// String returns the name of the policy, as accepted by ParsePolicy
+func (p Policy) String() string {
+	if name, ok := policyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(p))
+}
+
+// ParsePolicy returns the Policy with the given name. Names are case-insensitive.
+func ParsePolicy(name string) (Policy, error) {
+	for p, n := range policyNames {
+		if strings.EqualFold(n, name) {
+			return p, nil
+		}
+	}
+	return Default, fmt.Errorf("unknown policy '%s'. Expected rarest, sequential or random", name)
+}
+
+// Availability counts how many peers hold each chunk of a single file. It is built from the
+// chunk ranges peers advertise (a sorted []uint32 of inclusive [start, end] pairs) and is not
+// threadsafe.
+type Availability struct {
+	counts []int
+}
+
+// NewAvailability returns an empty Availability for a file with chunkCount chunks
+func NewAvailability(chunkCount int) *Availability {
+	return &Availability{counts: make([]int, chunkCount)}
+}
+
+// Add records that a peer holds the given ranges of chunks. Chunks beyond the end of the file
+// are ignored.
+func (a *Availability) Add(ranges []uint32) {
+	a.apply(ranges, 1)
+}
+
+// Remove undoes a previous call to Add with the same ranges, e.g., when a peer leaves.
+func (a *Availability) Remove(ranges []uint32) {
+	a.apply(ranges, -1)
+}
+
+// Count returns the number of peers known to hold the given chunk
+func (a *Availability) Count(chunk uint32) int {
+	if int(chunk) >= len(a.counts) {
+		return 0
+	}
+	return a.counts[chunk]
+}
+
+func (a *Availability) apply(ranges []uint32, delta int) {
+	for i := 0; i+1 < len(ranges); i += 2 {
+		for c := int(ranges[i]); c <= int(ranges[i+1]) && c < len(a.counts); c++ {
+			a.counts[c] += delta
+		}
+	}
+}
+
+// Order returns the chunks in missing that at least one peer holds, in the order the policy
+// wants them requested. rng is used for tie-breaking and shuffling; if nil a shared source is
+// used. Default is treated as RarestFirst.
+func (a *Availability) Order(missing []common.Range, policy Policy, rng *rand.Rand) []uint32 {
+	result := make([]uint32, 0)
+	for _, r := range missing {
+		for c := int(r.Start); c <= int(r.End); c++ {
+			if a.Count(uint32(c)) > 0 {
+				result = append(result, uint32(c))
+			}
+		}
+	}
+
+	shuffle := rand.Shuffle
+	if rng != nil {
+		shuffle = rng.Shuffle
+	}
+
+	switch policy {
+	case Sequential:
+		// missing ranges are already sorted
+	case Random:
+		shuffle(len(result), func(i, j int) { result[i], result[j] = result[j], result[i] })
+	default:
+		// shuffle first so that the stable sort breaks ties randomly, which spreads peers that
+		// run the same policy over different chunks
+		shuffle(len(result), func(i, j int) { result[i], result[j] = result[j], result[i] })
+		sort.SliceStable(result, func(i, j int) bool {
+			return a.counts[result[i]] < a.counts[result[j]]
+		})
+	}
+
+	return result
+}
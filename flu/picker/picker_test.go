@@ -0,0 +1,99 @@
+package picker
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/flu-network/client/common"
+)
+
+func TestAvailabilityCounts(t *testing.T) {
+	a := NewAvailability(10)
+	a.Add([]uint32{0, 9})
+	a.Add([]uint32{2, 3, 8, 12}) // overhangs the end of the file
+	a.Add([]uint32{3, 3})
+
+	expected := []int{1, 1, 2, 3, 1, 1, 1, 1, 2, 2}
+	if !reflect.DeepEqual(a.counts, expected) {
+		t.Fatalf("Expected counts %v but got %v\n", expected, a.counts)
+	}
+
+	a.Remove([]uint32{3, 3})
+	if c := a.Count(3); c != 2 {
+		t.Fatalf("Expected count 2 after Remove but got %d\n", c)
+	}
+
+	if c := a.Count(400); c != 0 {
+		t.Fatalf("Expected out-of-range chunk to have count 0 but got %d\n", c)
+	}
+}
+
+func TestOrder(t *testing.T) {
+	a := NewAvailability(10)
+	a.Add([]uint32{0, 9})
+	a.Add([]uint32{0, 5})
+	a.Add([]uint32{0, 2})
+	// chunks 0-2 have 3 peers, 3-5 have 2 peers, 6-9 have 1 peer
+
+	missing := []common.Range{common.NewRange(1, 4), common.NewRange(7, 8)}
+	rng := rand.New(rand.NewSource(1))
+
+	t.Run("sequential", func(t *testing.T) {
+		result := a.Order(missing, Sequential, rng)
+		expected := []uint32{1, 2, 3, 4, 7, 8}
+		if !reflect.DeepEqual(result, expected) {
+			t.Fatalf("Expected %v to equal %v\n", result, expected)
+		}
+	})
+
+	t.Run("rarest first", func(t *testing.T) {
+		for _, policy := range []Policy{RarestFirst, Default} {
+			result := a.Order(missing, policy, rng)
+			for i := 1; i < len(result); i++ {
+				if a.Count(result[i-1]) > a.Count(result[i]) {
+					t.Fatalf("%v: chunk %d is rarer than %d but came later: %v\n",
+						policy, result[i], result[i-1], result)
+				}
+			}
+			if len(result) != 6 {
+				t.Fatalf("%v: expected 6 chunks but got %v\n", policy, result)
+			}
+		}
+	})
+
+	t.Run("random", func(t *testing.T) {
+		result := a.Order(missing, Random, rng)
+		sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+		expected := []uint32{1, 2, 3, 4, 7, 8}
+		if !reflect.DeepEqual(result, expected) {
+			t.Fatalf("Expected random order to be a permutation of %v but got %v\n", expected, result)
+		}
+	})
+
+	t.Run("unavailable chunks are skipped", func(t *testing.T) {
+		b := NewAvailability(10)
+		b.Add([]uint32{4, 4})
+		result := b.Order(missing, RarestFirst, rng)
+		if !reflect.DeepEqual(result, []uint32{4}) {
+			t.Fatalf("Expected only chunk 4 but got %v\n", result)
+		}
+	})
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, p := range []Policy{Default, RarestFirst, Sequential, Random} {
+		parsed, err := ParsePolicy(p.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed != p {
+			t.Fatalf("Expected %v to round-trip but got %v\n", p, parsed)
+		}
+	}
+
+	if _, err := ParsePolicy("fastest"); err == nil {
+		t.Fatalf("Expected an error for an unknown policy\n")
+	}
+}
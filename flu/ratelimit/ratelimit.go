@@ -0,0 +1,168 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Unlimited is the rate of a Bucket that never delays anyone
+const Unlimited = 0
+
+// burstDuration is how much unused allowance a Bucket saves up, e.g., a 1MB/s bucket can send
+// 100KB at once after a quiet spell. Keeping it short keeps traffic smooth on slow links.
+const burstDuration = 100 * time.Millisecond
+
+// Bucket is a threadsafe token bucket that refills at a fixed rate of bytes per second. Callers
+// take the tokens they need up front and may leave the bucket in debt, in which case they (and
+// anyone after them) wait until the debt has been paid off by the refill.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   int64   // bytes per second, or Unlimited
+	tokens float64 // may be negative
+	last   time.Time
+	now    func() time.Time // overridden in tests
+}
+
+// NewBucket returns a full Bucket that refills at rate bytes per second
+func NewBucket(rate int64) *Bucket {
+	b := &Bucket{now: time.Now}
+	b.last = b.now()
+	b.SetRate(rate)
+	return b
+}
+
+// Rate returns the rate the bucket refills at, in bytes per second
+func (b *Bucket) Rate() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate
+}
+
+// SetRate changes the rate the bucket refills at. Any debt is forgiven, so that lifting a limit
+// takes effect immediately, and a previously unlimited bucket starts out full.
+func (b *Bucket) SetRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if rate < 0 {
+		rate = Unlimited
+	}
+	b.refill()
+	wasUnlimited := b.rate == Unlimited
+	b.rate = rate
+	if wasUnlimited || b.tokens < 0 || b.tokens > b.burst() {
+		b.tokens = b.burst()
+	}
+}
+
+// take removes n tokens from the bucket and returns how long the caller must wait before the
+// bucket is out of debt
+func (b *Bucket) take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate == Unlimited {
+		return 0
+	}
+	b.refill()
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+}
+
+// refill adds the tokens accrued since the last refill. Callers must hold mu.
+func (b *Bucket) refill() {
+	now := b.now()
+	if b.rate != Unlimited {
+		b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+		if b.tokens > b.burst() {
+			b.tokens = b.burst()
+		}
+	}
+	b.last = now
+}
+
+// burst returns the most tokens the bucket can hold. Callers must hold mu.
+func (b *Bucket) burst() float64 {
+	return float64(b.rate) * burstDuration.Seconds()
+}
+
+// Wait takes n tokens from every one of the buckets and blocks until all of them are out of
+// debt, or until ctx is done. Nil buckets are ignored.
+func Wait(ctx context.Context, n int, buckets ...*Bucket) error {
+	var delay time.Duration
+	for _, b := range buckets {
+		if b == nil {
+			continue
+		}
+		if d := b.take(n); d > delay {
+			delay = d
+		}
+	}
+	if delay <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+var rateUnits = []struct {
+	suffix string
+	scale  int64
+}{
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+	{"B", 1},
+}
+
+// ParseRate parses a rate in bytes per second, such as "500K" or "2M". A "/s" suffix is
+// optional, units are powers of 1024 and are case-insensitive. "0", "off" and "unlimited" all
+// mean Unlimited.
+func ParseRate(s string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	str = strings.TrimSuffix(str, "/S")
+	if str == "OFF" || str == "UNLIMITED" {
+		return Unlimited, nil
+	}
+
+	scale := int64(1)
+	for _, unit := range rateUnits {
+		if strings.HasSuffix(str, unit.suffix) {
+			str = strings.TrimSuffix(str, unit.suffix)
+			scale = unit.scale
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(str, 64)
+	if err != nil || value < 0 || math.IsNaN(value) || value*float64(scale) >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid rate '%s'. Expected e.g. 500K, 2M or off", s)
+	}
+	return int64(value * float64(scale)), nil
+}
+
+// FormatRate returns a human-readable representation of a rate, as accepted by ParseRate
+func FormatRate(rate int64) string {
+	if rate <= Unlimited {
+		return "unlimited"
+	}
+	for _, unit := range rateUnits {
+		if rate >= unit.scale && unit.scale > 1 {
+			return fmt.Sprintf("%.4g%s/s", float64(rate)/float64(unit.scale), unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB/s", rate)
+}
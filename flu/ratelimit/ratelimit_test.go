@@ -0,0 +1,120 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only moves when told to
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func newFakeBucket(rate int64) (*Bucket, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	b := &Bucket{now: clock.now, last: clock.t}
+	b.SetRate(rate)
+	return b, clock
+}
+
+func TestBucket(t *testing.T) {
+	t.Run("unlimited never waits", func(t *testing.T) {
+		b, _ := newFakeBucket(Unlimited)
+		for i := 0; i < 100; i++ {
+			if d := b.take(1 << 20); d != 0 {
+				t.Fatalf("Expected no wait but got %v\n", d)
+			}
+		}
+	})
+
+	t.Run("burst is free and debt is paid at the refill rate", func(t *testing.T) {
+		b, _ := newFakeBucket(10000) // 1000 byte burst
+		if d := b.take(1000); d != 0 {
+			t.Fatalf("Expected burst to be free but waited %v\n", d)
+		}
+		if d := b.take(5000); d != 500*time.Millisecond {
+			t.Fatalf("Expected to wait 500ms but got %v\n", d)
+		}
+		if d := b.take(1000); d != 600*time.Millisecond {
+			t.Fatalf("Expected to wait 600ms behind earlier debt but got %v\n", d)
+		}
+	})
+
+	t.Run("refills over time up to the burst", func(t *testing.T) {
+		b, clock := newFakeBucket(10000)
+		b.take(3000)
+		clock.t = clock.t.Add(200 * time.Millisecond) // debt of 2000 paid off exactly
+		if d := b.take(0); d != 0 {
+			t.Fatalf("Expected debt to be paid off but got %v\n", d)
+		}
+		clock.t = clock.t.Add(time.Hour)
+		if d := b.take(1001); d != 100*time.Microsecond {
+			t.Fatalf("Expected only a burst's worth of tokens but got wait %v\n", d)
+		}
+	})
+
+	t.Run("changing the rate forgives debt", func(t *testing.T) {
+		b, _ := newFakeBucket(1000)
+		b.take(1 << 20)
+		b.SetRate(Unlimited)
+		if d := b.take(1 << 20); d != 0 {
+			t.Fatalf("Expected no wait after lifting the limit but got %v\n", d)
+		}
+		b.SetRate(1000)
+		if d := b.take(100); d != 0 {
+			t.Fatalf("Expected no wait after setting a new limit but got %v\n", d)
+		}
+	})
+}
+
+func TestWait(t *testing.T) {
+	fast, _ := newFakeBucket(1 << 30)
+	slow, _ := newFakeBucket(1000)
+	slow.take(100) // empty the burst
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := Wait(ctx, 1000, fast, nil, slow); err != context.Canceled {
+		t.Fatalf("Expected the slowest bucket to block until cancelled but got %v\n", err)
+	}
+	if err := Wait(context.Background(), 0, fast, nil); err != nil {
+		t.Fatalf("Expected no error but got %v\n", err)
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	testCases := map[string]int64{
+		"0":         Unlimited,
+		"off":       Unlimited,
+		"unlimited": Unlimited,
+		"512":       512,
+		"512B":      512,
+		"500K":      500 << 10,
+		"500k/s":    500 << 10,
+		"1.5M":      3 << 19,
+		"2G":        2 << 30,
+	}
+	for in, expected := range testCases {
+		actual, err := ParseRate(in)
+		if err != nil || actual != expected {
+			t.Fatalf("Expected %s to parse as %d but got %d, %v\n", in, expected, actual, err)
+		}
+	}
+
+	for _, in := range []string{"", "fast", "-1K", "1X", "NaN", "nanM", "Inf", "+infinity",
+		"1e30G"} {
+		if _, err := ParseRate(in); err == nil {
+			t.Fatalf("Expected %q to be rejected\n", in)
+		}
+	}
+
+	for _, rate := range []int64{Unlimited, 512, 500 << 10, 3 << 19} {
+		actual, err := ParseRate(FormatRate(rate))
+		if err != nil || actual != rate {
+			t.Fatalf("Expected %s to round-trip to %d but got %d, %v\n", FormatRate(rate), rate, actual, err)
+		}
+	}
+}
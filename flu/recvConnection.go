@@ -3,6 +3,8 @@ package flu
 import (
 	"fmt"
 	"net"
+	"net/netip"
+	"sync"
 	"time"
 
 	"github.com/flu-network/client/common"
@@ -11,58 +13,141 @@ import (
 
 type RecvConnection struct {
 	conn          *net.UDPConn
-	hash          *common.Sha1Hash
+	fileHash      *common.Sha1Hash // the file being downloaded
+	chunk         uint32           // the chunk of that file being downloaded
+	hash          *common.Sha1Hash // the chunk's hash, as reported by the sender
 	bytesReceived int
 	buffer        []byte
 	windowCap     int
 	outChan       chan *messages.DataPacket
+	closed        chan struct{}
+	closeOnce     sync.Once
 }
 
-func (r *RecvConnection) Ack(offset uint32) {
-	ack := messages.DataPacketAck{
-		Offset: offset,
-	}
+func (r *RecvConnection) Ack(ack *messages.DataPacketAck) {
 	r.conn.Write(ack.Serialize())
 }
 
 func (r *RecvConnection) Read() (*messages.DataPacket, bool) {
-	result := <-r.outChan
-	if result == nil {
-		return result, false
+	select {
+	case result := <-r.outChan:
+		if result == nil {
+			return result, false
+		}
+		return result, true
+	case <-r.closed:
+		return nil, false
+	}
+}
+
+// write copies data received at the given offset into the connection's buffer
+func (r *RecvConnection) write(offset uint32, data []byte) error {
+	if int(offset)+len(data) > len(r.buffer) {
+		return fmt.Errorf("chunk %d: %d bytes at offset %d overflow %d-byte chunk",
+			r.chunk, len(data), offset, len(r.buffer))
 	}
-	return result, true
+	r.bytesReceived += copy(r.buffer[offset:], data)
+	return nil
+}
+
+// Cancel tells the sender to stop sending and then closes the connection. Safe to call more than
+// once, and after Close.
+func (r *RecvConnection) Cancel() {
+	select {
+	case <-r.closed:
+		return
+	default:
+	}
+	msg := messages.CloseConnectionRequest{Sha1Hash: r.fileHash, Chunk: r.chunk}
+	r.conn.Write(msg.Serialize()) // best effort: the sender times out eventually anyway
+	r.Close()
+}
+
+// Close stops the connection. Pending and future calls to Read return false. Safe to call more
+// than once.
+func (r *RecvConnection) Close() {
+	r.closeOnce.Do(func() {
+		close(r.closed)
+		r.conn.Close()
+	})
 }
 
-func DialPeer(ip [4]byte, port uint16, hash *common.Sha1Hash, chunk uint16) (*RecvConnection, error) {
-	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: ip[:], Port: int(port)})
+// DialPeer asks a peer for a chunk of a file and returns the connection its DataPackets arrive
+// on. The peer may send up to cfg.WindowCap packets ahead of acknowledgements, and the connection
+// is closed if it sends none for cfg.ReadTimeout. Datagrams that are not valid DataPackets are
+// passed to dropped (which may be nil) and otherwise ignored.
+func DialPeer(
+	ip netip.Addr,
+	port uint16,
+	hash *common.Sha1Hash,
+	chunk uint32,
+	cfg TransferConfig,
+	dropped func(error),
+) (*RecvConnection, error) {
+	conn, err := net.DialUDP("udp", nil, udpAddrOf(ip, port))
 	if err != nil {
 		return nil, err
 	}
 
 	result := RecvConnection{
 		conn:          conn,
+		fileHash:      hash,
+		chunk:         chunk,
 		hash:          nil,
 		bytesReceived: 0,
 		buffer:        nil,
-		windowCap:     1024,
+		windowCap:     int(cfg.WindowCap),
 		outChan:       make(chan *messages.DataPacket, 10),
+		closed:        make(chan struct{}),
 	}
 
-	kickstartMsg := messages.OpenConnectionRequest{Sha1Hash: hash, Chunk: chunk, WindowCap: 1024}
+	kickstartMsg := messages.OpenConnectionRequest{
+		Sha1Hash:  hash,
+		Chunk:     chunk,
+		WindowCap: cfg.WindowCap,
+	}
 	result.conn.Write(kickstartMsg.Serialize())
 
 	go func() {
+		// the request may get lost, so it is repeated (with backoff) until the sender responds
+		requestTimeout, requestsSent, started := initialRTO, 1, false
+
 		for {
-			buffer := make([]byte, 1029) // NOT 1024: the serialization overhead is 5 bytes
-			result.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+			buffer := make([]byte, packetDataSize+messages.DataPacketOverhead)
+			if started {
+				result.conn.SetReadDeadline(time.Now().Add(cfg.ReadTimeout))
+			} else {
+				result.conn.SetReadDeadline(time.Now().Add(requestTimeout))
+			}
 			n, _, err := result.conn.ReadFromUDP(buffer)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && !started && requestsSent < maxTimeouts {
+				result.conn.Write(kickstartMsg.Serialize())
+				requestsSent++
+				requestTimeout *= 2
+				continue
+			}
+			started = true
 			if err != nil {
-				result.conn.Close()
-				result.outChan <- nil
-				fmt.Printf("Connection closed: %v-%d:%v\n", hash, chunk, err)
-				break
-			} else {
-				result.outChan <- messages.ParseAsDataPacket(buffer[:n])
+				select {
+				case <-result.closed: // closed deliberately; nobody is listening any more
+				default:
+					fmt.Printf("Connection closed: %v-%d:%v\n", hash, chunk, err)
+					result.Close()
+				}
+				return
+			}
+
+			packet, err := messages.ParseAsDataPacket(buffer[:n])
+			if err != nil {
+				if dropped != nil {
+					dropped(err)
+				}
+				continue
+			}
+			select {
+			case result.outChan <- packet:
+			case <-result.closed:
+				return
 			}
 		}
 	}()
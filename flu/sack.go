@@ -0,0 +1,89 @@
+package flu
+
+import (
+	"sort"
+
+	"github.com/flu-network/client/flu/messages"
+)
+
+// maxSackBlocks bounds the number of received blocks reported in a single DataPacketAck, well
+// below messages.MaxAckRanges. As in TCP, the block containing the most recently received data is
+// always reported first, so the sender hears about every packet at least once. The remaining
+// blocks closest to the cumulative offset follow, since they describe the oldest gaps.
+const maxSackBlocks = 32
+
+// byteRange is a half-open range [start, end) of byte offsets within a chunk
+type byteRange struct {
+	start uint32
+	end   uint32
+}
+
+// sackScoreboard tracks which bytes of a chunk a receiver has received, so that they can be
+// reported to the sender as a selective acknowledgement. Senders without CapSelectiveAck are only
+// told the cumulative offset, and rely on their retransmission timer to recover lost packets. Not
+// threadsafe.
+type sackScoreboard struct {
+	cumulative     uint32      // every byte before this offset has been received
+	blocks         []byteRange // sorted, non-adjacent blocks received beyond cumulative
+	latest         int         // index of the block holding the most recently received data, or -1
+	cumulativeOnly bool        // the sender does not understand ranges, so none are reported
+}
+
+// add records that the bytes in [start, end) have been received
+func (s *sackScoreboard) add(start, end uint32) {
+	s.latest = -1
+	if end <= s.cumulative || start >= end {
+		return
+	}
+	if start < s.cumulative {
+		start = s.cumulative
+	}
+
+	// find the first block that could touch [start, end), and merge every block that does
+	i := sort.Search(len(s.blocks), func(i int) bool { return s.blocks[i].end >= start })
+	j := i
+	for j < len(s.blocks) && s.blocks[j].start <= end {
+		if s.blocks[j].start < start {
+			start = s.blocks[j].start
+		}
+		if s.blocks[j].end > end {
+			end = s.blocks[j].end
+		}
+		j++
+	}
+
+	merged := append([]byteRange{}, s.blocks[:i]...)
+	merged = append(merged, byteRange{start: start, end: end})
+	s.blocks = append(merged, s.blocks[j:]...)
+	s.latest = i
+
+	// advance the cumulative offset if the gap in front of the first block has closed
+	if s.blocks[0].start <= s.cumulative {
+		s.cumulative = s.blocks[0].end
+		s.blocks = s.blocks[1:]
+		s.latest--
+	}
+}
+
+// ack returns a DataPacketAck describing everything received so far
+func (s *sackScoreboard) ack() *messages.DataPacketAck {
+	count := len(s.blocks)
+	if s.cumulativeOnly {
+		return &messages.DataPacketAck{Offset: s.cumulative}
+	}
+	if count > maxSackBlocks {
+		count = maxSackBlocks
+	}
+
+	result := messages.DataPacketAck{Offset: s.cumulative, Ranges: make([]uint32, 0, count*2)}
+	if s.latest >= 0 && s.latest < len(s.blocks) {
+		b := s.blocks[s.latest]
+		result.Ranges = append(result.Ranges, b.start, b.end)
+	}
+	for i := 0; i < len(s.blocks) && len(result.Ranges) < count*2; i++ {
+		if i != s.latest {
+			result.Ranges = append(result.Ranges, s.blocks[i].start, s.blocks[i].end)
+		}
+	}
+	return &result
+}
@@ -0,0 +1,113 @@
+package flu
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestSackScoreboard(t *testing.T) {
+	type testCase struct {
+		desc       string
+		adds       [][2]uint32
+		cumulative uint32
+		ranges     []uint32
+	}
+
+	testCases := []testCase{
+		{
+			desc:       "in order",
+			adds:       [][2]uint32{{0, 10}, {10, 20}, {20, 30}},
+			cumulative: 30,
+			ranges:     []uint32{},
+		},
+		{
+			desc:       "single gap",
+			adds:       [][2]uint32{{0, 10}, {20, 30}},
+			cumulative: 10,
+			ranges:     []uint32{20, 30},
+		},
+		{
+			desc:       "adjacent blocks merge",
+			adds:       [][2]uint32{{0, 10}, {30, 40}, {20, 30}},
+			cumulative: 10,
+			ranges:     []uint32{20, 40},
+		},
+		{
+			desc:       "gap filled",
+			adds:       [][2]uint32{{0, 10}, {20, 30}, {40, 50}, {10, 20}},
+			cumulative: 30,
+			ranges:     []uint32{40, 50},
+		},
+		{
+			desc:       "duplicates are ignored",
+			adds:       [][2]uint32{{0, 10}, {0, 10}, {20, 30}, {20, 30}, {5, 8}},
+			cumulative: 10,
+			ranges:     []uint32{20, 30},
+		},
+		{
+			desc:       "most recent block first",
+			adds:       [][2]uint32{{10, 20}, {30, 40}},
+			cumulative: 0,
+			ranges:     []uint32{30, 40, 10, 20},
+		},
+		{
+			desc:       "overlapping blocks merge",
+			adds:       [][2]uint32{{10, 20}, {30, 40}, {15, 35}},
+			cumulative: 0,
+			ranges:     []uint32{10, 40},
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.desc, func(t *testing.T) {
+			s := sackScoreboard{}
+			for _, a := range c.adds {
+				s.add(a[0], a[1])
+			}
+			ack := s.ack()
+			if ack.Offset != c.cumulative {
+				t.Fatalf("Expected cumulative offset %d but got %d\n", c.cumulative, ack.Offset)
+			}
+			if !reflect.DeepEqual(ack.Ranges, c.ranges) {
+				t.Fatalf("Expected ranges %v but got %v\n", c.ranges, ack.Ranges)
+			}
+		})
+	}
+
+	t.Run("random order converges", func(t *testing.T) {
+		packets := make([][2]uint32, 1000)
+		for i := range packets {
+			packets[i] = [2]uint32{uint32(i * 1024), uint32((i + 1) * 1024)}
+		}
+		rand.Shuffle(len(packets), func(i, j int) { packets[i], packets[j] = packets[j], packets[i] })
+
+		s := sackScoreboard{}
+		for _, p := range packets {
+			s.add(p[0], p[1])
+			ack := s.ack()
+			if len(ack.Ranges) > maxSackBlocks*2 {
+				t.Fatalf("Ack reported more than %d blocks\n", maxSackBlocks)
+			}
+			if p[1] > ack.Offset && !rangesCover(ack.Ranges, p[0], p[1]) {
+				t.Fatalf("Ack %v does not acknowledge the packet that triggered it: %v\n", ack, p)
+			}
+		}
+		if s.cumulative != 1000*1024 || len(s.blocks) != 0 {
+			t.Fatalf("Expected everything to be acknowledged but got %d, %v\n", s.cumulative, s.blocks)
+		}
+	})
+
+	t.Run("cumulative only", func(t *testing.T) {
+		s := sackScoreboard{cumulativeOnly: true}
+		s.add(0, 10)
+		s.add(20, 30)
+		ack := s.ack()
+		if ack.Offset != 10 || len(ack.Ranges) != 0 {
+			t.Fatalf("Expected a cumulative ack of offset 10 but got %v\n", ack)
+		}
+		if s.blocks[0] != (byteRange{start: 20, end: 30}) {
+			t.Fatalf("Expected the block beyond the offset to be remembered but got %v\n", s.blocks)
+		}
+	})
+}
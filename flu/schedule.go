@@ -0,0 +1,283 @@
+package flu
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/flu-network/client/flu/ratelimit"
+)
+
+// Schedule is an ordered list of rules that override the configured bandwidth limits at certain
+// times of the week. The first rule that matches wins; when none match, the configured limits
+// apply unchanged.
+type Schedule []*ScheduleRule
+
+// ScheduleRule overrides some of the bandwidth limits on certain days between two times of day,
+// e.g., "weekdays 09:00-18:00 upload=1M".
+type ScheduleRule struct {
+	Days      [7]bool       // indexed by time.Weekday. The day the rule's window starts on.
+	Start     time.Duration // since midnight
+	End       time.Duration // since midnight. If before Start, the window ends the next day.
+	Overrides LimitOverrides
+	text      string // as parsed
+}
+
+// LimitOverrides holds the limits a ScheduleRule changes. Nil fields are left as configured.
+type LimitOverrides struct {
+	Upload          *int64
+	Download        *int64
+	UploadPerPeer   *int64
+	DownloadPerFile *int64
+}
+
+// apply returns limits with every override applied
+func (o LimitOverrides) apply(limits Limits) Limits {
+	for _, f := range []struct {
+		override *int64
+		limit    *int64
+	}{
+		{o.Upload, &limits.Upload},
+		{o.Download, &limits.Download},
+		{o.UploadPerPeer, &limits.UploadPerPeer},
+		{o.DownloadPerFile, &limits.DownloadPerFile},
+	} {
+		if f.override != nil {
+			*f.limit = *f.override
+		}
+	}
+	return limits
+}
+
+// Active returns the first rule that applies at the given time, or nil if none do
+func (s Schedule) Active(now time.Time) *ScheduleRule {
+	for _, rule := range s {
+		if rule.Contains(now) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// String returns the schedule in the form accepted by ParseSchedule
+func (s Schedule) String() string {
+	rules := make([]string, len(s))
+	for i, rule := range s {
+		rules[i] = rule.String()
+	}
+	return strings.Join(rules, "; ")
+}
+
+// Contains returns true if the rule applies at the given time
+func (r *ScheduleRule) Contains(now time.Time) bool {
+	// wall-clock time rather than elapsed time, so that rules follow daylight saving changes
+	sinceMidnight := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute +
+		time.Duration(now.Second())*time.Second
+	today := now.Weekday()
+	yesterday := (today + 6) % 7
+
+	if r.Start <= r.End {
+		return r.Days[today] && r.Start <= sinceMidnight && sinceMidnight < r.End
+	}
+	// the window wraps past midnight, e.g., 22:00-06:00
+	return (r.Days[today] && sinceMidnight >= r.Start) ||
+		(r.Days[yesterday] && sinceMidnight < r.End)
+}
+
+// String returns the rule in the form accepted by ParseScheduleRule
+func (r *ScheduleRule) String() string {
+	return r.text
+}
+
+var dayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// ParseSchedule parses a list of rules separated by semicolons, e.g.,
+// "weekdays 09:00-18:00 upload=1M; sat,sun 10:00-16:00 upload=5M download=off"
+func ParseSchedule(s string) (Schedule, error) {
+	result := Schedule{}
+	for _, text := range strings.Split(s, ";") {
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		rule, err := ParseScheduleRule(text)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, rule)
+	}
+	return result, nil
+}
+
+// ParseScheduleRule parses a rule made of days, a time window and the limits to override, e.g.,
+// "weekdays 09:00-18:00 upload=1M peer-upload=200K". Days are 'daily', 'weekdays', 'weekends', or
+// a comma-separated list of days and ranges of days such as 'mon-wed,fri'. Limit names are those
+// in LimitNames, and rates are as accepted by ratelimit.ParseRate.
+func ParseScheduleRule(s string) (*ScheduleRule, error) {
+	fields := strings.Fields(strings.ToLower(s))
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("invalid schedule rule '%s'. Expected e.g. "+
+			"'weekdays 09:00-18:00 upload=1M'", strings.TrimSpace(s))
+	}
+
+	result := ScheduleRule{text: strings.Join(fields, " ")}
+	days, err := parseDays(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	result.Days = days
+
+	window := strings.Split(fields[1], "-")
+	if len(window) != 2 {
+		return nil, fmt.Errorf("invalid time window '%s'. Expected e.g. 09:00-18:00", fields[1])
+	}
+	if result.Start, err = parseTimeOfDay(window[0]); err != nil {
+		return nil, err
+	}
+	if result.End, err = parseTimeOfDay(window[1]); err != nil {
+		return nil, err
+	}
+	if result.Start == result.End {
+		return nil, fmt.Errorf("time window '%s' is empty", fields[1])
+	}
+
+	limits := Limits{}
+	set := make(map[string]bool)
+	for _, override := range fields[2:] {
+		kv := strings.SplitN(override, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid limit '%s'. Expected e.g. upload=1M", override)
+		}
+		field, err := limits.Field(kv[0])
+		if err != nil {
+			return nil, err
+		}
+		if *field, err = ratelimit.ParseRate(kv[1]); err != nil {
+			return nil, err
+		}
+		set[kv[0]] = true
+	}
+	if set["upload"] {
+		result.Overrides.Upload = &limits.Upload
+	}
+	if set["download"] {
+		result.Overrides.Download = &limits.Download
+	}
+	if set["peer-upload"] {
+		result.Overrides.UploadPerPeer = &limits.UploadPerPeer
+	}
+	if set["file-download"] {
+		result.Overrides.DownloadPerFile = &limits.DownloadPerFile
+	}
+
+	return &result, nil
+}
+
+// parseDays parses the days a schedule rule applies on
+func parseDays(s string) ([7]bool, error) {
+	result := [7]bool{}
+	switch s {
+	case "daily":
+		return [7]bool{true, true, true, true, true, true, true}, nil
+	case "weekdays":
+		return [7]bool{false, true, true, true, true, true, false}, nil
+	case "weekends":
+		return [7]bool{true, false, false, false, false, false, true}, nil
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.Split(part, "-")
+		if len(bounds) > 2 {
+			return result, fmt.Errorf("invalid days '%s'", s)
+		}
+		first, err := parseDay(bounds[0])
+		if err != nil {
+			return result, err
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = parseDay(bounds[1]); err != nil {
+				return result, err
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 { // ranges may wrap, e.g., fri-mon
+			result[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+func parseDay(s string) (time.Weekday, error) {
+	for i, name := range dayNames {
+		if s == name {
+			return time.Weekday(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid day '%s'. Expected one of %s, daily, weekdays or weekends",
+		s, strings.Join(dayNames, ", "))
+}
+
+// parseTimeOfDay parses HH:MM into the time since midnight. 24:00 is allowed as an end time.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	var hours, minutes int
+	n, err := fmt.Sscanf(s, "%d:%d", &hours, &minutes)
+	if err != nil || n != 2 || len(s) != 5 || hours < 0 || minutes < 0 || minutes > 59 ||
+		hours > 24 || (hours == 24 && minutes != 0) {
+		return 0, fmt.Errorf("invalid time '%s'. Expected HH:MM", s)
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute, nil
+}
+
+// ScheduleStatus describes the bandwidth schedule and the limits in force
+type ScheduleStatus struct {
+	Schedule   string // every rule, as accepted by ParseSchedule
+	ActiveRule string // the rule in force, or empty if none is
+	Configured Limits // the limits set in the daemon config or with SetLimits
+	Effective  Limits // the configured limits, overridden by the active rule
+}
+
+// SetSchedule replaces the bandwidth schedule. The rule it selects takes effect immediately.
+func (s *Server) SetSchedule(schedule Schedule) {
+	s.limitLock.Lock()
+	defer s.limitLock.Unlock()
+	s.limiter.schedule = schedule
+	s.limiter.active = schedule.Active(s.limiter.clock())
+	s.limiter.apply()
+}
+
+// ApplySchedule switches to whichever schedule rule applies now, if it differs from the rule
+// currently in force. It should be called periodically.
+func (s *Server) ApplySchedule() {
+	s.limitLock.Lock()
+	defer s.limitLock.Unlock()
+	l := s.limiter
+	active := l.schedule.Active(l.clock())
+	if active == l.active {
+		return
+	}
+	l.active = active
+	l.apply()
+	if active != nil {
+		fmt.Printf("Bandwidth schedule: applying '%s'\n", active)
+	} else {
+		fmt.Println("Bandwidth schedule: no rule applies, using configured limits")
+	}
+}
+
+// ScheduleStatus returns the bandwidth schedule, the rule in force and the resulting limits
+func (s *Server) ScheduleStatus() ScheduleStatus {
+	s.limitLock.Lock()
+	defer s.limitLock.Unlock()
+	l := s.limiter
+	result := ScheduleStatus{
+		Schedule:   l.schedule.String(),
+		Configured: l.limits,
+		Effective:  l.effective,
+	}
+	if l.active != nil {
+		result.ActiveRule = l.active.String()
+	}
+	return result
+}
@@ -0,0 +1,197 @@
+package flu
+
+import (
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flu-network/client/flu/ratelimit"
+)
+
+// fakeClock is a clock that only moves when told to
+type fakeClock struct {
+	t      time.Time
+	timers []fakeTimer // started by after and not yet fired
+	lock   sync.Mutex
+}
+
+// fakeTimer fires at a time on a fakeClock
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.t
+}
+
+// after is time.After on the fake clock: the channel receives the time once the clock has been
+// advanced by d
+func (c *fakeClock) after(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ch := make(chan time.Time, 1)
+	c.timers = append(c.timers, fakeTimer{at: c.t.Add(d), ch: ch})
+	return ch
+}
+
+// advance moves the clock on by d, firing every timer that is then due
+func (c *fakeClock) advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.t = c.t.Add(d)
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.at.After(c.t) {
+			pending = append(pending, timer)
+		} else {
+			timer.ch <- c.t
+		}
+	}
+	c.timers = pending
+}
+
+// waits returns how long each timer that has yet to fire waits for
+func (c *fakeClock) waits() []time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	result := make([]time.Duration, len(c.timers))
+	for i, timer := range c.timers {
+		result[i] = timer.at.Sub(c.t)
+	}
+	return result
+}
+
+// at returns the given time of day in the week of Monday 2021-03-01
+func at(weekday time.Weekday, hour, minute int) time.Time {
+	day := 1 + (int(weekday)+6)%7 // Monday is the 1st
+	return time.Date(2021, time.March, day, hour, minute, 0, 0, time.Local)
+}
+
+func TestParseScheduleRule(t *testing.T) {
+	rule, err := ParseScheduleRule("  Weekdays 09:00-18:00 upload=1M  peer-upload=200k ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.String() != "weekdays 09:00-18:00 upload=1m peer-upload=200k" {
+		t.Fatalf("Unexpected rule text '%s'\n", rule)
+	}
+	if rule.Days != [7]bool{false, true, true, true, true, true, false} {
+		t.Fatalf("Expected weekdays but got %v\n", rule.Days)
+	}
+	if rule.Start != 9*time.Hour || rule.End != 18*time.Hour {
+		t.Fatalf("Expected 09:00-18:00 but got %v-%v\n", rule.Start, rule.End)
+	}
+	o := rule.Overrides
+	if *o.Upload != 1<<20 || *o.UploadPerPeer != 200<<10 ||
+		o.Download != nil || o.DownloadPerFile != nil {
+		t.Fatalf("Unexpected overrides %+v\n", o)
+	}
+
+	rule, err = ParseScheduleRule("fri-mon,wed 22:00-06:00 download=off")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.Days != [7]bool{true, true, false, true, false, true, true} {
+		t.Fatalf("Expected fri-mon and wed but got %v\n", rule.Days)
+	}
+
+	for _, invalid := range []string{
+		"",
+		"weekdays 09:00-18:00",
+		"someday 09:00-18:00 upload=1M",
+		"weekdays 9-18 upload=1M",
+		"weekdays 09:00-25:00 upload=1M",
+		"weekdays 09:00-09:00 upload=1M",
+		"weekdays 09:00-18:00 upload",
+		"weekdays 09:00-18:00 sideload=1M",
+		"weekdays 09:00-18:00 upload=fast",
+	} {
+		if _, err := ParseScheduleRule(invalid); err == nil {
+			t.Fatalf("Expected '%s' to be rejected\n", invalid)
+		}
+	}
+}
+
+func TestScheduleActive(t *testing.T) {
+	schedule, err := ParseSchedule(
+		"weekdays 09:00-18:00 upload=1M; fri 22:00-06:00 upload=5M; daily 00:00-24:00 download=2M")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type testCase struct {
+		desc     string
+		now      time.Time
+		expected *ScheduleRule
+	}
+	testCases := []testCase{
+		{"working hours", at(time.Tuesday, 9, 0), schedule[0]},
+		{"end of working hours", at(time.Tuesday, 18, 0), schedule[2]},
+		{"weekend", at(time.Saturday, 12, 0), schedule[2]},
+		{"friday night", at(time.Friday, 23, 0), schedule[1]},
+		{"friday night, after midnight", at(time.Saturday, 5, 59), schedule[1]},
+		{"thursday night is not friday night", at(time.Friday, 5, 0), schedule[2]},
+	}
+	for _, c := range testCases {
+		if actual := schedule.Active(c.now); actual != c.expected {
+			t.Fatalf("%s: expected rule '%v' but got '%v'\n", c.desc, c.expected, actual)
+		}
+	}
+
+	if rule := (Schedule{schedule[0]}).Active(at(time.Sunday, 12, 0)); rule != nil {
+		t.Fatalf("Expected no rule to apply but got '%s'\n", rule)
+	}
+}
+
+func TestServerApplySchedule(t *testing.T) {
+	clock := &fakeClock{t: at(time.Monday, 8, 59)}
+	s := NewServer(0, nil)
+	s.limiter.clock = clock.now
+
+	schedule, err := ParseSchedule("weekdays 09:00-18:00 upload=1M peer-upload=off")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configured := Limits{Upload: 10 << 20, UploadPerPeer: 100 << 10, Download: 3 << 20}
+	s.SetLimits(configured)
+	s.SetSchedule(schedule)
+	peerBuckets := s.uploadBuckets(netip.MustParseAddr("10.0.0.1"))
+
+	status := s.ScheduleStatus()
+	if status.ActiveRule != "" || status.Effective != configured {
+		t.Fatalf("Expected configured limits before 09:00 but got %+v\n", status)
+	}
+
+	clock.t = at(time.Monday, 9, 0)
+	s.ApplySchedule()
+	status = s.ScheduleStatus()
+	expected := Limits{Upload: 1 << 20, UploadPerPeer: ratelimit.Unlimited, Download: 3 << 20}
+	if status.ActiveRule != schedule[0].String() || status.Effective != expected {
+		t.Fatalf("Expected %+v under '%s' but got %+v\n", expected, schedule[0], status)
+	}
+	if status.Configured != configured || s.Limits() != configured {
+		t.Fatalf("Expected configured limits to be untouched but got %+v\n", status.Configured)
+	}
+	if peerBuckets[0].Rate() != 1<<20 || peerBuckets[1].Rate() != ratelimit.Unlimited {
+		t.Fatalf("Expected running transfers to be limited by the rule but got %d, %d\n",
+			peerBuckets[0].Rate(), peerBuckets[1].Rate())
+	}
+
+	// configured limits changed while a rule is active are only overridden where the rule says
+	s.SetLimits(Limits{Upload: 20 << 20, Download: 4 << 20})
+	if s.ScheduleStatus().Effective.Upload != 1<<20 || s.ScheduleStatus().Effective.Download != 4<<20 {
+		t.Fatalf("Unexpected effective limits %+v\n", s.ScheduleStatus().Effective)
+	}
+
+	clock.t = at(time.Monday, 18, 0)
+	s.ApplySchedule()
+	status = s.ScheduleStatus()
+	if status.ActiveRule != "" || status.Effective.Upload != 20<<20 ||
+		peerBuckets[0].Rate() != 20<<20 {
+		t.Fatalf("Expected configured limits after 18:00 but got %+v\n", status)
+	}
+}
@@ -0,0 +1,424 @@
+package flu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"sort"
+	"time"
+
+	"github.com/flu-network/client/catalogue"
+	"github.com/flu-network/client/common"
+	"github.com/flu-network/client/flu/messages"
+	"github.com/flu-network/client/flu/picker"
+)
+
+// SchedulerConfig bounds how much work a download scheduler hands out at once. A chunk is
+// 'in-flight' from the moment it is assigned to a peer until it is saved or abandoned.
+type SchedulerConfig struct {
+	MaxInFlightPerPeer int           // chunks requested concurrently from any single peer
+	MaxInFlightPerFile int           // chunks requested concurrently for a single file
+	Policy             picker.Policy // order in which chunks are requested, unless overridden per file
+}
+
+// DefaultSchedulerConfig returns limits that keep a handful of peers busy without flooding any
+// one of them.
+func DefaultSchedulerConfig() SchedulerConfig {
+	return SchedulerConfig{
+		MaxInFlightPerPeer: 2,
+		MaxInFlightPerFile: 16,
+		Policy:             picker.RarestFirst,
+	}
+}
+
+// peerRefreshInterval is how often a running download re-discovers the swarm, so that new seeders
+// (and peers that have since downloaded more chunks) are put to work.
+const peerRefreshInterval = 15 * time.Second
+
+// idleRefreshInterval is how long a download that has nothing to request waits for peers to
+// announce new chunks before it re-discovers the swarm anyway
+const idleRefreshInterval = 5 * time.Second
+
+// maxQueuedHaves is the number of announcements from peers that may wait for the scheduler to
+// get to them
+const maxQueuedHaves = 64
+
+// maxDownloadAttempts is the number of times a file that does not match its hash is downloaded
+// before it is paused
+const maxDownloadAttempts = 3
+
+// maxPeerFailures is the number of consecutive failed chunks after which a peer is ignored until
+// the next peer refresh.
+const maxPeerFailures = 3
+
+// chunkResult is reported by a worker when it is done with a chunk, successfully or not.
+type chunkResult struct {
+	chunk uint32
+	peer  peerKey
+	err   error
+}
+
+// haveNotice reports chunks a peer announced it has completed
+type haveNotice struct {
+	peer   peerKey
+	chunks []uint32 // inclusive [start, end] pairs
+}
+
+// scheduler drives the download of a single file. It assigns missing chunks to peers that have
+// them in the order dictated by its policy, keeping at most MaxInFlightPerPeer chunks in flight
+// per peer and MaxInFlightPerFile in flight overall, and refills work as chunks complete. All of
+// its state is owned by the goroutine executing run, so it needs no locks of its own.
+// Cancelling the scheduler's context stops the download: in-flight chunks are abandoned and their
+// senders are told to stop.
+type scheduler struct {
+	server  *Server
+	hash    *common.Sha1Hash
+	ownIP   netip.Addr
+	cfg     SchedulerConfig
+	rng     *rand.Rand
+	ctx     context.Context
+	cancel  context.CancelFunc
+	stopped chan struct{} // closed once run has returned and no chunks are in flight
+	haves   chan haveNotice
+
+	chunkCount   int
+	peers        []*messages.DiscoverHostResponse
+	availability *picker.Availability        // how many peers hold each chunk
+	inFlight     map[uint32]peerKey          // chunk -> peer it was assigned to
+	peerLoad     map[peerKey]int             // peer -> number of chunks in flight from that peer
+	failures     map[peerKey]int             // peer -> consecutive failures
+	corrupt      map[uint32]map[peerKey]bool // chunk -> peers that sent a corrupt copy of it
+	results      chan chunkResult
+	refreshedAt  time.Time // when the peers were last discovered
+}
+
+func newScheduler(
+	s *Server,
+	hash *common.Sha1Hash,
+	ownIP netip.Addr,
+	cfg SchedulerConfig,
+	chunkCount int,
+	peers []*messages.DiscoverHostResponse,
+) *scheduler {
+	hashCopy := *hash // the caller's hash may be reused once we return
+	ctx, cancel := context.WithCancel(context.Background())
+	result := &scheduler{
+		server:       s,
+		hash:         &hashCopy,
+		ownIP:        ownIP,
+		cfg:          cfg,
+		rng:          rand.New(rand.NewSource(time.Now().UnixNano())),
+		ctx:          ctx,
+		cancel:       cancel,
+		stopped:      make(chan struct{}),
+		haves:        make(chan haveNotice, maxQueuedHaves),
+		chunkCount:   chunkCount,
+		availability: picker.NewAvailability(chunkCount),
+		inFlight:     make(map[uint32]peerKey),
+		peerLoad:     make(map[peerKey]int),
+		failures:     make(map[peerKey]int),
+		corrupt:      make(map[uint32]map[peerKey]bool),
+		// buffered so that workers never block on reporting, even if run is busy discovering
+		results:     make(chan chunkResult, cfg.MaxInFlightPerFile),
+		refreshedAt: time.Now(),
+	}
+	result.setPeers(peers)
+	return result
+}
+
+// run downloads chunks until the file is complete and matches its hash, or the scheduler is
+// stopped. It blocks, so it should be called in its own goroutine.
+func (sc *scheduler) run() {
+	defer close(sc.stopped)
+	defer sc.cancel() // release the context's resources once the download is complete
+
+	refresh := time.NewTicker(peerRefreshInterval)
+	defer refresh.Stop()
+
+	for attempt := 1; sc.downloadChunks(refresh.C); attempt++ {
+		err := sc.server.verifyDownload(sc.hash)
+		if err == nil {
+			fmt.Printf("Download complete: %v\n", sc.hash)
+			return
+		} else if !errors.Is(err, errWrongFile) {
+			fmt.Printf("Download complete, but it could not be checked: %v: %v\n", sc.hash, err)
+			return
+		}
+
+		// the file is not the one we asked for, so no peer should be sent any of it
+		fmt.Printf("Downloading %v again: %v\n", sc.hash, err)
+		if err := sc.server.restartDownload(sc.hash, sc.peers); err != nil {
+			fmt.Printf("Could not restart %v: %v\n", sc.hash, err)
+			return
+		}
+		if attempt == maxDownloadAttempts {
+			fmt.Printf("Giving up on %v after %d attempts. Pausing it\n", sc.hash, attempt)
+			if err := sc.server.cat.SetPaused(sc.hash, true); err != nil {
+				fmt.Println(err)
+			}
+			return
+		}
+	}
+	fmt.Printf("Download stopped: %v\n", sc.hash)
+}
+
+// downloadChunks downloads chunks until every chunk of the file has been saved, and returns false
+// if the scheduler is stopped first.
+func (sc *scheduler) downloadChunks(refresh <-chan time.Time) bool {
+	for {
+		if sc.ctx.Err() != nil {
+			sc.drain()
+			return false
+		}
+		complete, err := sc.server.cat.FileComplete(sc.hash)
+		if err != nil {
+			// the file was unshared from under the download, so its chunks have nowhere to go
+			fmt.Printf("Stopping download of %s: %v\n", sc.hash.String(), err)
+			sc.cancel()
+			continue
+		} else if complete {
+			return true
+		}
+
+		var idle <-chan time.Time // fires when it is time to stop waiting for announcements
+		if sc.assign() == 0 && len(sc.inFlight) == 0 {
+			// Nothing is in flight and nothing can be started. The swarm has nothing we want right
+			// now, so wait a little for peers to announce new chunks, then look for more peers
+			// (this blocks if the network has to be probed).
+			wait := idleRefreshInterval - time.Since(sc.refreshedAt)
+			if wait <= 0 {
+				sc.refreshPeers()
+				continue
+			}
+			idle = time.After(wait)
+		}
+
+		select {
+		case res := <-sc.results:
+			sc.complete(res)
+		case have := <-sc.haves:
+			sc.addHave(have)
+		case <-refresh:
+			sc.refreshPeers()
+		case <-idle:
+			sc.refreshPeers()
+		case <-sc.ctx.Done():
+		}
+	}
+}
+
+// stop cancels the download and blocks until every in-flight chunk has been abandoned
+func (sc *scheduler) stop() {
+	sc.cancel()
+	<-sc.stopped
+}
+
+// drain waits for every in-flight chunk to be reported, so nothing is written to the catalogue
+// after run returns.
+func (sc *scheduler) drain() {
+	for len(sc.inFlight) > 0 {
+		sc.complete(<-sc.results)
+	}
+}
+
+// assign hands out as many missing chunks to peers as the in-flight limits allow, and returns the
+// number of chunks it started.
+func (sc *scheduler) assign() int {
+	started := 0
+	missing := sc.server.cat.MissingChunks(sc.hash, 0)
+	stats := sc.server.peerStats(sc.peerKeys())
+	for _, chunk := range sc.availability.Order(missing, sc.cfg.Policy, sc.rng) {
+		if len(sc.inFlight) >= sc.cfg.MaxInFlightPerFile {
+			return started
+		}
+
+		if _, ok := sc.inFlight[chunk]; ok {
+			continue
+		}
+
+		peer, ok := sc.pickPeer(chunk, stats)
+		if !ok {
+			continue
+		}
+
+		sc.inFlight[chunk] = peer
+		sc.peerLoad[peer]++
+		started++
+		go sc.fetch(peer, chunk)
+	}
+	return started
+}
+
+// pickPeer returns the fastest healthy peer that has the given chunk and spare capacity, going by
+// the peer table's stats. Ties go to the least-loaded peer. Peers that already sent a corrupt copy
+// of the chunk are not asked for it again.
+func (sc *scheduler) pickPeer(chunk uint32, stats map[peerKey]PeerStats) (peerKey, bool) {
+	var best peerKey
+	found := false
+	for _, p := range sc.peers {
+		key := peerKey{address: p.Address, port: p.Port}
+		if sc.failures[key] >= maxPeerFailures || sc.peerLoad[key] >= sc.cfg.MaxInFlightPerPeer {
+			continue
+		}
+		if sc.corrupt[chunk][key] {
+			continue
+		}
+		if !rangesContain(p.Chunks, chunk) {
+			continue
+		}
+		if !found || fasterPeer(stats[key], stats[best]) ||
+			(!fasterPeer(stats[best], stats[key]) && sc.peerLoad[key] < sc.peerLoad[best]) {
+			best, found = key, true
+		}
+	}
+	return best, found
+}
+
+// peerKeys returns the key of every peer known to have some of the file
+func (sc *scheduler) peerKeys() []peerKey {
+	result := make([]peerKey, len(sc.peers))
+	for i, p := range sc.peers {
+		result[i] = peerKey{address: p.Address, port: p.Port}
+	}
+	return result
+}
+
+// fetch downloads a single chunk from a single peer and reports the outcome to run.
+func (sc *scheduler) fetch(peer peerKey, chunk uint32) {
+	err := sc.server.fetchChunk(sc.ctx, peer.address, peer.port, sc.hash, chunk)
+	sc.results <- chunkResult{chunk: chunk, peer: peer, err: err}
+}
+
+// complete releases the capacity held by a finished chunk. Failed chunks are simply no longer in
+// flight, so the next call to assign will hand them out again. Corrupt chunks are handed out to a
+// different peer.
+func (sc *scheduler) complete(res chunkResult) {
+	delete(sc.inFlight, res.chunk)
+	sc.peerLoad[res.peer]--
+
+	if errors.Is(res.err, context.Canceled) || errors.Is(res.err, catalogue.ErrNotFound) {
+		return // not the peer's fault. A file that is gone stops the download in downloadChunks
+	} else if errors.Is(res.err, catalogue.ErrCorruptChunk) {
+		if sc.corrupt[res.chunk] == nil {
+			sc.corrupt[res.chunk] = make(map[peerKey]bool)
+		}
+		sc.corrupt[res.chunk][res.peer] = true
+		sc.failures[res.peer]++
+		sc.server.recordFailure(res.peer)
+		fmt.Printf("Chunk %d from %v was corrupt. Refetching from another peer: %v\n",
+			res.chunk, res.peer, res.err)
+	} else if res.err != nil {
+		sc.failures[res.peer]++
+		sc.server.recordFailure(res.peer)
+		fmt.Printf("Chunk %d from %v failed: %v\n", res.chunk, res.peer, res.err)
+	} else {
+		sc.failures[res.peer] = 0
+		sc.server.announceHave(sc.hash, res.chunk, sc.partialPeers())
+	}
+}
+
+// notifyHave passes chunks a peer announced to run. Announcements that arrive while too many are
+// queued are dropped; the next peer refresh catches up with them.
+func (sc *scheduler) notifyHave(have haveNotice) {
+	select {
+	case sc.haves <- have:
+	default:
+	}
+}
+
+// addHave records that a peer has the announced chunks, adding the peer if it is new
+func (sc *scheduler) addHave(have haveNotice) {
+	ownPeer := peerKey{address: sc.ownIP, port: uint16(sc.server.port)}
+	if have.peer == ownPeer || sc.server.isSelf(have.peer) {
+		return
+	}
+	for _, p := range sc.peers {
+		if p.Address == have.peer.address && p.Port == have.peer.port {
+			sc.availability.Remove(p.Chunks)
+			p.Chunks = unionRanges(p.Chunks, have.chunks)
+			sc.availability.Add(p.Chunks)
+			return
+		}
+	}
+	peer := &messages.DiscoverHostResponse{
+		Address: have.peer.address,
+		Port:    have.peer.port,
+		Chunks:  unionRanges(nil, have.chunks),
+	}
+	sc.peers = append(sc.peers, peer)
+	sc.availability.Add(peer.Chunks)
+}
+
+// partialPeers returns the peers the file is being downloaded from that do not have all of it
+func (sc *scheduler) partialPeers() []peerKey {
+	result := make([]peerKey, 0, len(sc.peers))
+	for _, p := range sc.peers {
+		complete := len(p.Chunks) == 2 && p.Chunks[0] == 0 &&
+			int64(p.Chunks[1]) >= int64(sc.chunkCount)-1
+		if !complete {
+			result = append(result, peerKey{address: p.Address, port: p.Port})
+		}
+	}
+	return result
+}
+
+// refreshPeers re-discovers the peers that have the file. Peers that were ignored for failing, or
+// for sending corrupt chunks, are given another chance, since the damage may have been done in
+// transit.
+func (sc *scheduler) refreshPeers() {
+	sc.setPeers(sc.server.getGoodHosts(sc.hash, []uint32{}, sc.ownIP))
+	sc.failures = make(map[peerKey]int)
+	sc.corrupt = make(map[uint32]map[peerKey]bool)
+	sc.refreshedAt = time.Now()
+}
+
+// setPeers replaces the known peers and rebuilds the availability model from what they hold
+func (sc *scheduler) setPeers(peers []*messages.DiscoverHostResponse) {
+	for _, p := range sc.peers {
+		sc.availability.Remove(p.Chunks)
+	}
+	sc.peers = peers
+	for _, p := range sc.peers {
+		sc.availability.Add(p.Chunks)
+	}
+}
+
+// rangesContain returns true if the chunk falls within one of the inclusive [start, end] pairs in
+// ranges.
+func rangesContain(ranges []uint32, chunk uint32) bool {
+	for i := 0; i+1 < len(ranges); i += 2 {
+		if ranges[i] <= chunk && chunk <= ranges[i+1] {
+			return true
+		}
+	}
+	return false
+}
+
+// unionRanges returns the sorted, non-overlapping ranges covering every chunk in either a or b,
+// both of which are lists of inclusive [start, end] pairs in any order
+func unionRanges(a, b []uint32) []uint32 {
+	pairs := make([][2]uint32, 0, (len(a)+len(b))/2)
+	for _, ranges := range [][]uint32{a, b} {
+		for i := 0; i+1 < len(ranges); i += 2 {
+			if ranges[i] <= ranges[i+1] {
+				pairs = append(pairs, [2]uint32{ranges[i], ranges[i+1]})
+			}
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i][0] < pairs[j][0] })
+
+	result := make([]uint32, 0, len(pairs)*2)
+	for _, p := range pairs {
+		last := len(result) - 1
+		if last > 0 && uint64(p[0]) <= uint64(result[last])+1 {
+			if p[1] > result[last] {
+				result[last] = p[1]
+			}
+			continue
+		}
+		result = append(result, p[0], p[1])
+	}
+	return result
+}
@@ -0,0 +1,325 @@
+package flu
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/flu-network/client/catalogue"
+	"github.com/flu-network/client/common"
+	"github.com/flu-network/client/flu/messages"
+	"github.com/flu-network/client/flu/picker"
+)
+
+const testChunkSize = 4
+
+// chunkData returns the contents stub peers send for a chunk
+func chunkData(chunk uint32) []byte {
+	return bytes.Repeat([]byte{byte(chunk)}, testChunkSize)
+}
+
+// newTestDownload returns a server whose catalogue holds an empty download of chunkCount chunks
+func newTestDownload(t *testing.T, chunkCount uint32) (*Server, *common.Sha1Hash) {
+	dir := t.TempDir()
+	cat, err := catalogue.NewCat(filepath.Join(dir, "catalogue"), filepath.Join(dir, "downloads"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cat.Init(); err != nil {
+		t.Fatal(err)
+	}
+	file := []byte{}
+	chunkHashes := make([]common.Sha1Hash, chunkCount)
+	for i := range chunkHashes {
+		file = append(file, chunkData(uint32(i))...)
+		chunkHashes[i].Data = sha1.Sum(chunkData(uint32(i)))
+	}
+	hash := &common.Sha1Hash{Data: sha1.Sum(file)}
+	size := uint64(chunkCount) * testChunkSize
+	if _, err := cat.RegisterDownload(size, chunkCount, testChunkSize, hash, "file.bin",
+		chunkHashes, nil); err != nil {
+		t.Fatal(err)
+	}
+	return NewServer(61690, cat), hash
+}
+
+// stubPeers stands in for the peers a file is downloaded from. Chunks are saved as soon as they
+// are asked for, unless fail returns an error for them. They hold what data returns, if set, or
+// else chunkData.
+type stubPeers struct {
+	server *Server
+	hash   *common.Sha1Hash
+	hosts  []*messages.DiscoverHostResponse
+	keys   []peerKey
+	fail   func(ctx context.Context, peer peerKey, chunk uint32) error
+	data   func(chunk uint32) []byte
+}
+
+// newStubPeers puts n stub peers, each of which has every chunk of the download, in the server's
+// peer table, and has the server download from them. They are discovered without a probe.
+func newStubPeers(s *Server, hash *common.Sha1Hash, chunkCount uint32, n int) *stubPeers {
+	result := &stubPeers{server: s, hash: hash}
+	discovered := []messages.DiscoverHostResponse{}
+	for i := 0; i < n; i++ {
+		address := netip.AddrFrom4([4]byte{10, 0, 0, byte(2 + i)})
+		host := messages.DiscoverHostResponse{Address: address, Port: 61690,
+			Chunks: []uint32{0, chunkCount - 1}}
+		result.hosts = append(result.hosts, &host)
+		result.keys = append(result.keys, peerKey{address: address, port: 61690})
+		discovered = append(discovered, host)
+		s.seePeer(result.keys[i])
+	}
+	s.recordDiscovery(hash, discovered)
+	s.fetchChunk = result.fetch
+	return result
+}
+
+func (p *stubPeers) fetch(
+	ctx context.Context,
+	ip netip.Addr,
+	port uint16,
+	hash *common.Sha1Hash,
+	chunk uint32,
+) error {
+	if p.fail != nil {
+		if err := p.fail(ctx, peerKey{address: ip, port: port}, chunk); err != nil {
+			return err
+		}
+	}
+	data := chunkData(chunk)
+	if p.data != nil {
+		data = p.data(chunk)
+	}
+	return p.server.cat.SaveChunk(hash, chunk, data, nil)
+}
+
+// newStubbedScheduler returns a scheduler for the download that fetches from n stub peers
+func newStubbedScheduler(
+	s *Server,
+	hash *common.Sha1Hash,
+	cfg SchedulerConfig,
+	chunkCount uint32,
+	n int,
+) (*scheduler, *stubPeers, []peerKey) {
+	peers := newStubPeers(s, hash, chunkCount, n)
+	sc := newScheduler(s, hash, netip.MustParseAddr("10.0.0.1"), cfg, int(chunkCount),
+		peers.hosts)
+	return sc, peers, peers.keys
+}
+
+// collect waits for n chunks to be reported by the scheduler's workers
+func collect(t *testing.T, sc *scheduler, n int) []chunkResult {
+	result := make([]chunkResult, 0, n)
+	for len(result) < n {
+		select {
+		case res := <-sc.results:
+			result = append(result, res)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %d chunks to be reported but got %v\n", n, result)
+		}
+	}
+	return result
+}
+
+func TestSchedulerAssign(t *testing.T) {
+	s, hash := newTestDownload(t, 8)
+	cfg := SchedulerConfig{MaxInFlightPerPeer: 2, MaxInFlightPerFile: 5, Policy: picker.Sequential}
+	sc, peers, keys := newStubbedScheduler(s, hash, cfg, 8, 3)
+
+	// three peers could take six chunks, but the file may only have five in flight
+	if started := sc.assign(); started != 5 {
+		t.Fatalf("Expected 5 chunks to be started but got %d\n", started)
+	}
+	for _, key := range keys {
+		if sc.peerLoad[key] > cfg.MaxInFlightPerPeer {
+			t.Fatalf("Expected at most %d chunks in flight from %v but got %d\n",
+				cfg.MaxInFlightPerPeer, key, sc.peerLoad[key])
+		}
+	}
+	results := collect(t, sc, 5)
+	if started := sc.assign(); started != 0 {
+		t.Fatalf("Expected nothing to start while the file is at its limit but got %d\n", started)
+	}
+
+	// each completed chunk makes room for the next one
+	sc.complete(results[0])
+	if started := sc.assign(); started != 1 {
+		t.Fatalf("Expected a completed chunk to be replaced but got %d\n", started)
+	}
+	if _, ok := sc.inFlight[5]; !ok {
+		t.Fatalf("Expected chunk 5 to be in flight but got %v\n", sc.inFlight)
+	}
+	for _, res := range append(results[1:], collect(t, sc, 1)...) {
+		sc.complete(res)
+	}
+	if len(sc.inFlight) != 0 {
+		t.Fatalf("Expected nothing in flight but got %v\n", sc.inFlight)
+	}
+
+	// a chunk that fails is handed to another peer
+	peers.fail = func(ctx context.Context, peer peerKey, chunk uint32) error {
+		if peer == keys[0] {
+			return errors.New("timed out")
+		}
+		return nil
+	}
+	sc.assign()
+	failed := uint32(0)
+	for _, res := range collect(t, sc, len(sc.inFlight)) {
+		if res.err != nil {
+			failed = res.chunk
+		}
+		sc.complete(res)
+	}
+	if got := sc.failures[keys[0]]; got != 1 {
+		t.Fatalf("Expected the peer to have failed once but got %d\n", got)
+	}
+	if started := sc.assign(); started != 1 {
+		t.Fatalf("Expected the failed chunk to be started again but got %d\n", started)
+	}
+	if peer := sc.inFlight[failed]; peer == keys[0] {
+		t.Fatalf("Expected chunk %d to be handed to another peer but got %v\n", failed, peer)
+	}
+	for _, res := range collect(t, sc, 1) {
+		sc.complete(res)
+	}
+	if missing := s.cat.MissingChunks(hash, 0); len(missing) != 0 {
+		t.Fatalf("Expected the download to be complete but %v are missing\n", missing)
+	}
+}
+
+func TestSchedulerGivesUpOnPeers(t *testing.T) {
+	s, hash := newTestDownload(t, 8)
+	cfg := SchedulerConfig{MaxInFlightPerPeer: 1, MaxInFlightPerFile: 1, Policy: picker.Sequential}
+	sc, peers, _ := newStubbedScheduler(s, hash, cfg, 8, 1)
+
+	// a peer that sends a corrupt chunk is not asked for that chunk again, but still for others.
+	// Every other chunk times out.
+	key := sc.peerKeys()[0]
+	peers.fail = func(ctx context.Context, peer peerKey, chunk uint32) error {
+		if chunk == 0 {
+			return fmt.Errorf("chunk %d: %w", chunk, catalogue.ErrCorruptChunk)
+		}
+		return errors.New("timed out")
+	}
+	sc.assign()
+	sc.complete(collect(t, sc, 1)[0])
+	if started := sc.assign(); started != 1 {
+		t.Fatalf("Expected the next chunk to be started but got %d\n", started)
+	}
+	if _, ok := sc.inFlight[1]; !ok {
+		t.Fatalf("Expected chunk 1 rather than the corrupt chunk 0 but got %v\n", sc.inFlight)
+	}
+	sc.complete(collect(t, sc, 1)[0])
+
+	// a peer that keeps failing is given up on
+	for sc.failures[key] < maxPeerFailures {
+		if started := sc.assign(); started != 1 {
+			t.Fatalf("Expected the peer to be retried after %d failures but got %d\n",
+				sc.failures[key], started)
+		}
+		sc.complete(collect(t, sc, 1)[0])
+	}
+	if started := sc.assign(); started != 0 {
+		t.Fatalf("Expected the peer to be given up on after %d failures but %d chunks started\n",
+			maxPeerFailures, started)
+	}
+
+	// until the peers are refreshed
+	sc.failures = make(map[peerKey]int)
+	sc.corrupt = make(map[uint32]map[peerKey]bool)
+	peers.fail = nil
+	if started := sc.assign(); started != 1 || sc.inFlight[0] != key {
+		t.Fatalf("Expected chunk 0 to be asked for again but got %v\n", sc.inFlight)
+	}
+	sc.complete(collect(t, sc, 1)[0])
+}
+
+func TestSchedulerVerifiesFile(t *testing.T) {
+	s, hash := newTestDownload(t, 8)
+	cfg := SchedulerConfig{MaxInFlightPerPeer: 2, MaxInFlightPerFile: 4, Policy: picker.Sequential}
+	sc, peers, keys := newStubbedScheduler(s, hash, cfg, 8, 2)
+	for _, key := range keys {
+		// none of the peers can supply chunk hashes, so they are not asked for them over the network
+		if _, err := s.recordHello(key, messages.ProtocolVersion, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a peer supplied chunk hashes of another file, whose chunks they serve
+	wrongData := func(chunk uint32) []byte { return bytes.Repeat([]byte{0xFF}, testChunkSize) }
+	wrongHashes := make([]common.Sha1Hash, 8)
+	for i := range wrongHashes {
+		wrongHashes[i].Data = sha1.Sum(wrongData(uint32(i)))
+	}
+	if err := s.cat.RestartDownload(hash, wrongHashes, nil); err != nil {
+		t.Fatal(err)
+	}
+	peers.data = func(chunk uint32) []byte {
+		if s.cat.Get(hash).HasChunkHashes {
+			return wrongData(chunk)
+		}
+		return chunkData(chunk)
+	}
+
+	// the wrong file is thrown away along with the chunk hashes, and the right one downloaded
+	sc.run()
+	rec := s.cat.Get(hash)
+	if !rec.Progress.Full() || rec.Paused || rec.HasChunkHashes || rec.MerkleRoot != nil {
+		t.Fatalf("Expected the right file to be downloaded without the wrong chunk hashes but got "+
+			"chunks %v, paused %v, chunk hashes %v, merkle root %v\n", rec.Progress.Ranges(),
+			rec.Paused, rec.HasChunkHashes, rec.MerkleRoot)
+	}
+	if actual, err := s.cat.Rehash(hash); err != nil || *actual != *hash {
+		t.Fatalf("Expected the file to match its hash but got %v, %v\n", actual, err)
+	}
+
+	// a file that never matches is given up on, and none of it is kept
+	if err := s.cat.RestartDownload(hash, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	sc, peers, _ = newStubbedScheduler(s, hash, cfg, 8, 2)
+	peers.data = wrongData
+	sc.run()
+	if rec := s.cat.Get(hash); rec.Progress.Count() != 0 || !rec.Paused {
+		t.Fatalf("Expected the download to be paused with nothing kept but got chunks %v, "+
+			"paused %v\n", rec.Progress.Ranges(), rec.Paused)
+	}
+}
+
+func TestSchedulerStopsWhenUnshared(t *testing.T) {
+	s, hash := newTestDownload(t, 8)
+	cfg := SchedulerConfig{MaxInFlightPerPeer: 1, MaxInFlightPerFile: 1, Policy: picker.Sequential}
+	sc, peers, _ := newStubbedScheduler(s, hash, cfg, 8, 1)
+
+	// the file is unshared while chunk 2 is being downloaded, so it cannot be saved
+	peers.fail = func(ctx context.Context, peer peerKey, chunk uint32) error {
+		if chunk == 2 {
+			return s.cat.UnshareFile(hash)
+		}
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		sc.run()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the download to stop once its file was unshared\n")
+	}
+	if sc.ctx.Err() == nil || len(sc.inFlight) != 0 {
+		t.Fatalf("Expected the scheduler to be stopped with nothing in flight but got %v\n",
+			sc.inFlight)
+	}
+	if _, err := s.cat.Contains(hash); !errors.Is(err, catalogue.ErrNotFound) {
+		t.Fatalf("Expected the file to stay unshared but got %v\n", err)
+	}
+}
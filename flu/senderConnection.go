@@ -1,37 +1,87 @@
 package flu
 
 import (
+	"context"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"net"
+	"sort"
+	"time"
 
 	"github.com/flu-network/client/common"
 	"github.com/flu-network/client/flu/messages"
+	"github.com/flu-network/client/flu/ratelimit"
 )
 
+// packetDataSize is the largest amount of data sent in a single DataPacket. The 0-offset packet
+// spends firstPacketHeaderSize of it on the chunk's hash and size.
+const packetDataSize = 1024
+const firstPacketHeaderSize = 24
+
+// Retransmission parameters. A packet is presumed lost once dupAckThreshold packets sent after it
+// have been acknowledged, or once no acknowledgement has arrived for a retransmission timeout.
+// The timeout is derived from measured RTTs, doubles every time it expires, and the connection is
+// abandoned after maxTimeouts consecutive expiries.
+const dupAckThreshold = 3
+const initialRTO = 250 * time.Millisecond
+const maxRTO = 4 * time.Second
+const maxTimeouts = 5
+
+// inflightPacket is a packet that has been sent but not yet acknowledged
+type inflightPacket struct {
+	length        uint32    // bytes of chunk data the packet carries
+	seq           uint64    // the order in which the packet was (last) sent
+	sentAt        time.Time // when the packet was (last) sent
+	retransmitted bool      // RTTs are not sampled from retransmissions, as they are ambiguous
+	lost          bool      // presumed lost and awaiting retransmission
+}
+
 type SenderConnection struct {
 	reader     *common.ChunkReader
-	windowSize uint16
+	hash       *common.Sha1Hash // hash of the chunk being sent
+	size       uint32           // size of the chunk being sent
 	windowCap  uint16
 	conn       *net.UDPConn
 	addr       *net.UDPAddr
 	packetChan chan messages.DataPacketAck
-	cancelChan chan struct{}
+	buckets    []*ratelimit.Bucket // bandwidth limits every datagram is subject to
+	ctx        context.Context     // cancelled to stop sending
+	cancel     context.CancelFunc
+	done       chan struct{} // closed once the connection stops sending
+
+	// retransmission state. Only accessed by the worker goroutine once kickstarted.
+	inflight        map[uint32]*inflightPacket // offset -> unacknowledged packet
+	lostQueue       []uint32                   // offsets of lost packets, lowest first
+	pipe            int                        // packets in flight that are not presumed lost
+	nextOffset      uint32                     // offset of the first byte not yet sent
+	nextSeq         uint64
+	highestAckedSeq uint64 // highest seq of any acknowledged packet
+	rto             time.Duration
+	timeouts        int // consecutive retransmission timeouts
+	cc              *congestionController
 }
 
 func NewSenderConnection(reader *common.ChunkReader,
 	windowCap uint16,
 	conn *net.UDPConn,
 	addr *net.UDPAddr,
+	buckets []*ratelimit.Bucket,
 ) *SenderConnection {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &SenderConnection{
 		reader:     reader,
-		windowSize: 0,
 		windowCap:  windowCap,
 		conn:       conn,
 		addr:       addr,
 		packetChan: make(chan messages.DataPacketAck, windowCap),
-		cancelChan: make(chan struct{}, 1),
+		buckets:    buckets,
+		ctx:        ctx,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+		inflight:   make(map[uint32]*inflightPacket),
+		rto:        initialRTO,
+		cc:         newCongestionController(),
 	}
 }
 
@@ -42,43 +92,49 @@ func (sc *SenderConnection) kickstart(
 	hash *common.Sha1Hash,
 	size int64,
 ) error {
-	sc.reader.Reset()
-
-	firstPacket := messages.DataPacket{
-		Offset: 0,
-		Data:   make([]byte, 1024),
-	}
-
-	copy(firstPacket.Data[:20], hash.Slice())
-	binary.BigEndian.PutUint32(firstPacket.Data[20:24], uint32(size))
-
-	actualDataSpace := firstPacket.Data[24:]
-	byteCount, _, err := sc.reader.Read(actualDataSpace)
+	sc.hash = hash
+	sc.size = uint32(size)
 
-	if err != nil && err != io.EOF {
-		// EOF is fine because the goroutine handling the error will exit when it tries to read
-		// again and gets its own EOF with 0 bytes of data
-		return err
-	}
-
-	firstPacket.Data = firstPacket.Data[:24+byteCount]
-
-	_, err = sc.conn.WriteTo(firstPacket.Serialize(), sc.addr)
+	err := sc.fillWindow() // the 0-offset packet goes first
 	if err != nil {
+		sc.cancel()
+		close(sc.done)
 		return err
 	}
 
-	sc.windowSize++
-
 	go func() {
+		defer close(sc.done)
+		defer sc.cancel()
+		timer := time.NewTimer(sc.rto)
+		defer timer.Stop()
+
 		for {
 			select {
 			case ack := <-sc.packetChan:
-				err := sc.kick(ack)
+				done, progressed, err := sc.kick(ack)
+				if sc.ctx.Err() != nil {
+					return // terminated while waiting for bandwidth
+				}
 				if err != nil {
-					panic(err) // TODO: Do something with these errors
+					fmt.Printf("Upload to %v aborted: %v\n", sc.addr, err)
+					return
+				}
+				if done {
+					return
 				}
-			case <-sc.cancelChan:
+				if progressed {
+					resetTimer(timer, sc.rto)
+				}
+			case <-timer.C:
+				if err := sc.timeout(); err != nil {
+					if sc.ctx.Err() != nil {
+						return
+					}
+					fmt.Printf("Upload to %v aborted: %v\n", sc.addr, err)
+					return
+				}
+				timer.Reset(sc.rto)
+			case <-sc.ctx.Done():
 				return
 			}
 		}
@@ -87,38 +143,187 @@ func (sc *SenderConnection) kickstart(
 	return nil
 }
 
+// terminate stops the connection. Safe to call more than once.
 func (sc *SenderConnection) terminate() {
-	sc.cancelChan <- struct{}{}
+	sc.cancel()
 }
 
-// kick receives an ack from the client and responds accordingly. Passed by value because acks are
-// << 64 bits
-func (sc *SenderConnection) kick(ack messages.DataPacketAck) error {
-	sc.windowSize--
-
-	packet := messages.DataPacket{Offset: 0, Data: nil}
-	packetBuffer := make([]byte, 1024)
+// kick receives an ack from the client and responds accordingly: acknowledged packets are
+// forgotten, packets the ack shows to be missing are marked lost, and the congestion window is
+// filled with retransmissions and new data. Reports whether the receiver has the whole chunk, and
+// whether the ack acknowledged anything new. Passed by value because acks are small.
+func (sc *SenderConnection) kick(ack messages.DataPacketAck) (bool, bool, error) {
+	now := time.Now()
+	acked := 0
+	var newest *inflightPacket // the most recently sent packet this ack covers, for RTT sampling
+	for offset, p := range sc.inflight {
+		end := offset + p.length
+		if end <= ack.Offset || rangesCover(ack.Ranges, offset, end) {
+			if p.seq > sc.highestAckedSeq {
+				sc.highestAckedSeq = p.seq
+			}
+			if !p.retransmitted && (newest == nil || p.seq > newest.seq) {
+				newest = p
+			}
+			if !p.lost {
+				sc.pipe--
+			}
+			delete(sc.inflight, offset)
+			acked++
+		}
+	}
+	progressed := acked > 0
 
-	for sc.windowSize < sc.windowCap {
+	if ack.Offset >= sc.size {
+		return true, progressed, nil // the receiver has everything
+	}
 
-		byteCount, offset, err := sc.reader.Read(packetBuffer)
+	if newest != nil {
+		sc.cc.onRTTSample(now.Sub(newest.sentAt))
+	}
+	sc.cc.onAck(acked)
+	if progressed {
+		sc.timeouts = 0
+		sc.rto = sc.cc.rto()
+	}
 
-		if err == io.EOF {
-			defer sc.terminate() // make this the last message
-		} else if err != nil {
-			return err
+	// packets overtaken by enough acknowledged packets are presumed lost
+	for offset, p := range sc.inflight {
+		if !p.lost && p.seq+dupAckThreshold <= sc.highestAckedSeq {
+			sc.cc.onLoss(p.seq, sc.nextSeq)
+			sc.markLost(offset, p)
 		}
+	}
+	sort.Slice(sc.lostQueue, func(i, j int) bool { return sc.lostQueue[i] < sc.lostQueue[j] })
 
-		packet.Data = packetBuffer[:byteCount] // clip to number of bytes read
-		packet.Offset = offset
+	return false, progressed, sc.fillWindow()
+}
+
+// timeout is called when the retransmission timer expires. Every unacknowledged packet is presumed
+// lost, the window collapses and the timer backs off, or the connection gives up if the receiver
+// has been silent for too long.
+func (sc *SenderConnection) timeout() error {
+	sc.timeouts++
+	if sc.timeouts > maxTimeouts {
+		return fmt.Errorf("no acknowledgement after %d retransmissions", maxTimeouts)
+	}
+
+	for offset, p := range sc.inflight {
+		sc.markLost(offset, p)
+	}
+	sort.Slice(sc.lostQueue, func(i, j int) bool { return sc.lostQueue[i] < sc.lostQueue[j] })
+	sc.cc.onTimeout(sc.nextSeq)
 
-		_, err = sc.conn.WriteTo(packet.Serialize(), sc.addr)
-		if err != nil {
+	sc.rto *= 2
+	if sc.rto > maxRTO {
+		sc.rto = maxRTO
+	}
+	return sc.fillWindow()
+}
+
+// markLost queues an in-flight packet for retransmission
+func (sc *SenderConnection) markLost(offset uint32, p *inflightPacket) {
+	if p.lost {
+		return
+	}
+	p.lost = true
+	sc.pipe--
+	sc.lostQueue = append(sc.lostQueue, offset)
+}
+
+// fillWindow sends packets until the congestion window is full. Lost packets are retransmitted
+// before any new data is sent.
+func (sc *SenderConnection) fillWindow() error {
+	window := sc.cc.window(sc.windowCap)
+	for sc.pipe < window {
+		if len(sc.lostQueue) > 0 {
+			offset := sc.lostQueue[0]
+			sc.lostQueue = sc.lostQueue[1:]
+			if p, ok := sc.inflight[offset]; !ok || !p.lost {
+				continue // acknowledged after all
+			}
+			if err := sc.transmit(offset); err != nil {
+				return err
+			}
+			continue
+		}
+		if sc.nextOffset >= sc.size {
+			return nil // nothing left to send
+		}
+		if err := sc.transmit(sc.nextOffset); err != nil {
 			return err
 		}
+		sc.nextOffset += sc.inflight[sc.nextOffset].length
+	}
+	return nil
+}
 
-		sc.windowSize++
+// transmit (re)sends the packet at the given offset and records it as in flight. By convention
+// the 0-offset packet also carries the hash and size of the chunk.
+func (sc *SenderConnection) transmit(offset uint32) error {
+	packet := messages.DataPacket{Offset: offset, Data: make([]byte, packetDataSize)}
+	headerSize := 0
+	if offset == 0 {
+		copy(packet.Data[:20], sc.hash.Slice())
+		binary.BigEndian.PutUint32(packet.Data[20:24], sc.size)
+		headerSize = firstPacketHeaderSize
+	}
+	dataSpace := packet.Data[headerSize:]
+	if remaining := sc.size - offset; uint32(len(dataSpace)) > remaining {
+		dataSpace = dataSpace[:remaining]
 	}
 
+	byteCount, err := sc.reader.ReadAt(dataSpace, offset)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if byteCount < len(dataSpace) {
+		return fmt.Errorf("chunk ended at %d bytes but should be %d", offset+uint32(byteCount), sc.size)
+	}
+	packet.Data = packet.Data[:headerSize+byteCount] // clip to number of bytes read
+	serialized := packet.Serialize()
+
+	if err := ratelimit.Wait(sc.ctx, len(serialized), sc.buckets...); err != nil {
+		return err
+	}
+	_, err = sc.conn.WriteTo(serialized, sc.addr)
+	if err != nil {
+		return err
+	}
+
+	previous, resent := sc.inflight[offset]
+	if resent && !previous.lost {
+		sc.pipe-- // replaced below
+	}
+	sc.inflight[offset] = &inflightPacket{
+		length:        uint32(byteCount),
+		seq:           sc.nextSeq,
+		sentAt:        time.Now(),
+		retransmitted: resent,
+	}
+	sc.pipe++
+	sc.nextSeq++
 	return nil
 }
+
+// rangesCover returns true if [start, end) falls entirely within one of the [start, end) pairs in
+// ranges.
+func rangesCover(ranges []uint32, start, end uint32) bool {
+	for i := 0; i+1 < len(ranges); i += 2 {
+		if ranges[i] <= start && end <= ranges[i+1] {
+			return true
+		}
+	}
+	return false
+}
+
+// resetTimer safely resets a timer that may or may not have fired
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
@@ -1,10 +1,15 @@
 package flu
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/netip"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/flu-network/client/catalogue"
 	"github.com/flu-network/client/common"
@@ -19,6 +24,10 @@ const maxRequestID = int(1 << 16)
 // so many conversations can occur concurrently.
 // All incoming UDP messages should be sent to Server for handling.
 type Server struct {
+	// dropped counts datagrams that could not be parsed. Updated atomically, so it comes first to
+	// keep it 64-bit aligned on 32-bit platforms.
+	dropped DatagramStats
+
 	port int
 	cat  *catalogue.Cat
 
@@ -30,14 +39,54 @@ type Server struct {
 	// resMap and resMapLock are responsible for mapping outgoing requests to incoming responses.
 	// They map an outgoing requestID and response type to an incoming message and deliver the
 	// response to the Message chan stored in the map.
-	resMap     map[requestKey]chan messages.Message
+	resMap     map[requestKey]pendingRequest
 	resMapLock sync.Mutex
 
 	// transfer lock, downloads and uploads ensures safe access to the download and upload maps.
 	// These maps are used to keep track on ongoing transfers, irrespective of their state.
 	transferLock sync.Mutex
-	downloads    map[downloadKey]struct{} // corresponds to a single chunk from a single host
+	downloads    map[downloadKey]*RecvConnection // corresponds to a single chunk from a single host
 	uploads      map[uploadKey]*SenderConnection
+	schedulers   map[common.Sha1Hash]*scheduler         // corresponds to a single file from many hosts
+	paused       map[common.Sha1Hash]SchedulerConfig    // config to resume each paused download with
+	resuming     map[common.Sha1Hash]context.CancelFunc // downloads waiting for peers to resume
+	closing      bool                                   // set by Shutdown: no transfers may start
+
+	// after is time.After, except in tests, which replace it to control how long downloads wait to
+	// be resumed
+	after func(d time.Duration) <-chan time.Time
+
+	// fetchChunk downloads a chunk of a file from a peer and saves it. It is downloadChunk, except
+	// in tests, which replace it to stub out peers.
+	fetchChunk func(ctx context.Context, ip netip.Addr, port uint16, hash *common.Sha1Hash,
+		chunk uint32) error
+
+	// haveAudiences holds the peers that recently requested chunks of each file, and when they last
+	// did. Guarded by transferLock.
+	haveAudiences map[common.Sha1Hash]map[peerKey]time.Time
+
+	// schedulerConfig bounds the concurrency of new downloads, and transferConfig tunes new
+	// transfers. Guarded by transferLock.
+	schedulerConfig SchedulerConfig
+	transferConfig  TransferConfig
+
+	// limiter enforces bandwidth limits on every transfer. Guarded by limitLock.
+	limiter   *limiter
+	limitLock sync.Mutex
+
+	// hellos holds what each peer said about itself in its latest Hello. Guarded by helloLock.
+	hellos    map[peerKey]peerHello
+	helloLock sync.Mutex
+
+	// peers is the peer table, and discoveries hold what the hosts in it were found to have of
+	// each file. Guarded by peerLock, as are the fields below them.
+	peers               map[peerKey]*PeerStats
+	discoveries         map[common.Sha1Hash]*discovery
+	peersMaintainedAt   time.Time
+	presenceAnnouncedAt time.Time
+	interfaceFilter     InterfaceFilter // chooses the interfaces hosts are discovered on
+	peerPorts           []uint16        // the ports other daemons listen on besides this one's
+	peerLock            sync.Mutex
 }
 
 // requestKey is used to uniquely identify a request that is awaiting one or more responses in a
@@ -47,29 +96,70 @@ type requestKey struct {
 	messageType uint8
 }
 
+// pendingRequest is where the responses to an outgoing request are delivered. done is closed once
+// the request stops waiting for them.
+type pendingRequest struct {
+	responses chan messages.Message
+	done      chan struct{}
+}
+
 type downloadKey struct {
 	hash       common.Sha1Hash
-	remoteHost ipv4
+	remoteHost peerKey
+	chunk      uint32
+}
+
+// peerKey uniquely identifies a flu daemon on the network
+type peerKey struct {
+	address netip.Addr
+	port    uint16
 }
 
 type uploadKey struct {
-	remoteHost ipv4
+	remoteHost netip.Addr
 	remotePort uint16
 }
 
 // NewServer returns a *Server
 func NewServer(port int, cat *catalogue.Cat) *Server {
-	return &Server{
-		port:         port,
-		cat:          cat,
-		reqID:        0,
-		reqIDLock:    sync.Mutex{},
-		resMap:       make(map[requestKey](chan messages.Message)),
-		resMapLock:   sync.Mutex{},
-		transferLock: sync.Mutex{},
-		downloads:    make(map[downloadKey]struct{}),
-		uploads:      make(map[uploadKey]*SenderConnection),
+	result := &Server{
+		port:            port,
+		cat:             cat,
+		reqID:           0,
+		reqIDLock:       sync.Mutex{},
+		resMap:          make(map[requestKey]pendingRequest),
+		resMapLock:      sync.Mutex{},
+		transferLock:    sync.Mutex{},
+		downloads:       make(map[downloadKey]*RecvConnection),
+		uploads:         make(map[uploadKey]*SenderConnection),
+		schedulers:      make(map[common.Sha1Hash]*scheduler),
+		paused:          make(map[common.Sha1Hash]SchedulerConfig),
+		resuming:        make(map[common.Sha1Hash]context.CancelFunc),
+		after:           time.After,
+		haveAudiences:   make(map[common.Sha1Hash]map[peerKey]time.Time),
+		schedulerConfig: DefaultSchedulerConfig(),
+		transferConfig:  DefaultTransferConfig(),
+		limiter:         newLimiter(),
+		hellos:          make(map[peerKey]peerHello),
+		peers:           make(map[peerKey]*PeerStats),
+		discoveries:     make(map[common.Sha1Hash]*discovery),
+	}
+	result.fetchChunk = result.downloadChunk
+	return result
+}
+
+// SetSchedulerConfig changes the concurrency limits used by downloads started after this call.
+// Limits below 1 are raised to 1.
+func (s *Server) SetSchedulerConfig(cfg SchedulerConfig) {
+	if cfg.MaxInFlightPerPeer < 1 {
+		cfg.MaxInFlightPerPeer = 1
+	}
+	if cfg.MaxInFlightPerFile < 1 {
+		cfg.MaxInFlightPerFile = 1
 	}
+	s.transferLock.Lock()
+	defer s.transferLock.Unlock()
+	s.schedulerConfig = cfg
 }
 
 func (s *Server) generateRequestID() uint16 {
@@ -85,7 +175,7 @@ func (s *Server) registerResponseChan(reqID uint16, msgType uint8) chan messages
 	s.resMapLock.Lock()
 	defer s.resMapLock.Unlock()
 	responseChan := make(chan messages.Message, 1)
-	s.resMap[key] = responseChan
+	s.resMap[key] = pendingRequest{responses: responseChan, done: make(chan struct{})}
 	return responseChan
 }
 
@@ -93,23 +183,38 @@ func (s *Server) unregisterResponseChan(reqID uint16, msgType uint8) {
 	key := requestKey{reqID: reqID, messageType: msgType}
 	s.resMapLock.Lock()
 	defer s.resMapLock.Unlock()
-	delete(s.resMap, key)
+	if pending, ok := s.resMap[key]; ok {
+		close(pending.done)
+		delete(s.resMap, key)
+	}
 }
 
-// deliverResponse delivers a response message to the goRoutine that originally sent the request
+// deliverResponse delivers a response message to the goRoutine that originally sent the request.
+// Requests may be answered more than once, e.g., by a host that heard a broadcast on several
+// interfaces, so the response is dropped if the request stops waiting before it is read.
 func (s *Server) deliverResponse(reqID uint16, msg messages.Message) error {
 	key := requestKey{reqID: reqID, messageType: msg.Type()}
 	s.resMapLock.Lock()
-	defer s.resMapLock.Unlock()
-	if responseChan, ok := s.resMap[key]; ok {
-		responseChan <- msg
+	pending, ok := s.resMap[key]
+	s.resMapLock.Unlock()
+	if !ok {
+		return fmt.Errorf("ResponseChan {%d:%d} expired", reqID, msg)
+	}
+	select {
+	case pending.responses <- msg:
 		return nil
+	case <-pending.done:
+		return fmt.Errorf("ResponseChan {%d:%d} expired", reqID, msg)
 	}
-	return fmt.Errorf("ResponseChan {%d:%d} expired", reqID, msg)
 }
 
-func (s *Server) sendToPeer(ip net.IP, message []byte) error {
-	sock, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: ip, Port: s.port})
+func (s *Server) sendToPeer(addr netip.Addr, message []byte) error {
+	return s.sendToPeerAt(addr, uint16(s.port), message)
+}
+
+// sendToPeerAt sends a message to a peer that listens on the given port
+func (s *Server) sendToPeerAt(addr netip.Addr, port uint16, message []byte) error {
+	sock, err := net.DialUDP("udp", nil, udpAddrOf(addr, port))
 	if err != nil {
 		return err
 	}
@@ -127,11 +232,20 @@ func (s *Server) Port() int {
 }
 
 // HandleMessage does exactly what it says. It expects parameters to be passed by value because
-// it is assumed it will be run concurrently.
+// it is assumed it will be run concurrently. Datagrams that cannot be parsed are counted (see
+// DroppedDatagrams) and dropped without an error.
 func (s *Server) HandleMessage(message []byte, conn *net.UDPConn, returnAddr *net.UDPAddr) error {
 	parsedMessage, err := messages.Parse(message)
 	if err != nil {
-		return err
+		s.countDropped(err)
+		return nil
+	}
+	// presence announcements say which port their sender listens on, so they update the peer
+	// table themselves
+	if _, ok := parsedMessage.(*messages.PresenceAnnouncement); !ok {
+		if addr, err := addrOf(returnAddr); err == nil {
+			s.seeAddress(addr)
+		}
 	}
 
 	switch msg := parsedMessage.(type) {
@@ -143,35 +257,105 @@ func (s *Server) HandleMessage(message []byte, conn *net.UDPConn, returnAddr *ne
 		return s.StartUpload(msg, conn, returnAddr)
 	case *messages.DataPacketAck:
 		return s.ContinueUpload(msg, conn, returnAddr)
+	case *messages.CloseConnectionRequest:
+		return s.StopUpload(msg, returnAddr)
+	case *messages.ChunkHashesRequest:
+		return s.RespondToChunkHashes(msg, conn, returnAddr)
+	case *messages.MerkleProofRequest:
+		return s.RespondToMerkleProof(msg, conn, returnAddr)
+	case *messages.HelloRequest:
+		return s.RespondToHello(msg, conn, returnAddr)
+	case *messages.HaveAnnouncement:
+		return s.RespondToHave(msg, returnAddr)
+	case *messages.PingRequest:
+		return s.RespondToPing(msg, conn, returnAddr)
+	case *messages.PresenceAnnouncement:
+		return s.RespondToPresence(msg, returnAddr)
 	case *messages.DiscoverHostResponse:
+		msg.Address = withZone(msg.Address, returnAddr)
 		return s.deliverResponse(msg.RequestID, parsedMessage)
 	case *messages.ListFilesResponse:
 		return s.deliverResponse(msg.RequestID, parsedMessage)
+	case *messages.ChunkHashesResponse:
+		return s.deliverResponse(msg.RequestID, parsedMessage)
+	case *messages.MerkleProofResponse:
+		return s.deliverResponse(msg.RequestID, parsedMessage)
+	case *messages.HelloResponse:
+		return s.deliverResponse(msg.RequestID, parsedMessage)
+	case *messages.PingResponse:
+		return s.deliverResponse(msg.RequestID, parsedMessage)
 
-	// freak out if we don't know how to handle a parsed response
 	default:
-		panic("Rohan messed up! We parsed a message but couldn't handle it.")
+		return fmt.Errorf("no handler for message of type %d", parsedMessage.Type())
 	}
 }
 
-// LocalIP returns the IPV4 address of the running process (if available). This is not the loopback
-// address (192.168.0.1; 'localhost'), but the address assigned to this host by the LAN's router.
-func (s *Server) LocalIP() *net.IP {
-	addrs, err := net.InterfaceAddrs()
-	if err != nil {
-		panic(err)
+// DatagramStats counts datagrams that were dropped because they could not be parsed
+type DatagramStats struct {
+	Malformed    uint64 // truncated, failed their checksum, or otherwise garbled
+	Incompatible uint64 // sent by peers that speak a protocol version this daemon does not
+}
+
+// DroppedDatagrams returns the number of datagrams dropped since the daemon started
+func (s *Server) DroppedDatagrams() DatagramStats {
+	return DatagramStats{
+		Malformed:    atomic.LoadUint64(&s.dropped.Malformed),
+		Incompatible: atomic.LoadUint64(&s.dropped.Incompatible),
 	}
+}
 
-	for _, a := range addrs {
-		if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-			result := ipnet.IP.To4()
-			if result != nil {
-				return &result
+// countDropped counts a datagram that was dropped because messages.Parse returned err
+func (s *Server) countDropped(err error) {
+	if errors.Is(err, messages.ErrIncompatibleVersion) {
+		atomic.AddUint64(&s.dropped.Incompatible, 1)
+	} else {
+		atomic.AddUint64(&s.dropped.Malformed, 1)
+	}
+}
+
+// LocalIP returns the address of the running process (if available). This is not the loopback
+// address (127.0.0.1; 'localhost'), but the address assigned to this host by the LAN's router.
+// IPv4 addresses are preferred, then global IPv6 addresses, then link-local ones. On hosts with
+// several interfaces, it is an address on one hosts are discovered on. Peers should be told the
+// address on the interface that faces them instead (see localIPFor). Returns the zero Addr if
+// there is none.
+func (s *Server) LocalIP() netip.Addr {
+	candidates := []netip.Addr{}
+	for _, iface := range s.interfaces() {
+		candidates = append(candidates, iface.prefix.Addr())
+	}
+	if len(candidates) == 0 {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			panic(err)
+		}
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
+				if addr, ok := netip.AddrFromSlice(ipnet.IP); ok {
+					candidates = append(candidates, addr.Unmap())
+				}
 			}
 		}
 	}
 
-	return nil
+	// rank returns how unsuitable an address is
+	rank := func(addr netip.Addr) int {
+		switch {
+		case addr.Is4():
+			return 0
+		case !addr.IsLinkLocalUnicast():
+			return 1
+		default:
+			return 2
+		}
+	}
+	result := netip.Addr{}
+	for _, addr := range candidates {
+		if !result.IsValid() || rank(addr) < rank(result) {
+			result = addr
+		}
+	}
+	return result
 }
 
 func check(e error) {
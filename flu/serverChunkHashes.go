@@ -0,0 +1,126 @@
+package flu
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/flu-network/client/common"
+	"github.com/flu-network/client/flu/messages"
+)
+
+// chunkHashesAttempts is the number of times each page of chunk hashes (or merkle proof) is
+// requested before giving up on a host
+const chunkHashesAttempts = 3
+
+// FetchChunkHashes asks a remote host for the hash of every chunk of a file. Hosts send at most
+// messages.MaxChunkHashesPerResponse hashes at a time, so large files take several round trips.
+// Returns an error if the host does not know the file's chunk hashes, stops responding, or says the
+// file has some other number of chunks than chunkCount, which bounds the number of round trips.
+func (s *Server) FetchChunkHashes(
+	addr netip.Addr,
+	port uint16,
+	hash *common.Sha1Hash,
+	chunkCount int,
+) ([]common.Sha1Hash, error) {
+	targetAddr := udpAddrOf(addr, port)
+	conn, err := net.DialUDP("udp", nil, targetAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	result := make([]common.Sha1Hash, 0, chunkCount)
+	for len(result) < chunkCount {
+		req := messages.ChunkHashesRequest{
+			RequestID: s.generateRequestID(),
+			Sha1Hash:  hash,
+			Start:     uint32(len(result)),
+		}
+		msg, err := s.requestWithRetries(conn, &req, func(msg messages.Message) bool {
+			res, ok := msg.(*messages.ChunkHashesResponse)
+			return ok && res.RequestID == req.RequestID && res.Start == req.Start
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch chunk hashes from %v: %v", targetAddr.IP, err)
+		}
+		res := msg.(*messages.ChunkHashesResponse)
+		if res.Total == 0 {
+			return nil, fmt.Errorf("%v does not know the chunk hashes of %v", targetAddr.IP, hash)
+		}
+		if int64(res.Total) != int64(chunkCount) {
+			return nil, fmt.Errorf("%v says %v has %d chunks but it has %d", targetAddr.IP, hash,
+				res.Total, chunkCount)
+		}
+		if len(res.Hashes) == 0 {
+			return nil, fmt.Errorf("%v sent no chunk hashes after chunk %d", targetAddr.IP, req.Start)
+		}
+		result = append(result, res.Hashes...)
+	}
+	return result[:chunkCount], nil
+}
+
+// requestWithRetries sends req over conn and waits for a response that matches, resending the
+// request if none arrives in time. Datagrams that cannot be parsed are counted and ignored.
+func (s *Server) requestWithRetries(
+	conn *net.UDPConn,
+	req messages.Message,
+	matches func(messages.Message) bool,
+) (messages.Message, error) {
+	buffer := make([]byte, messages.MaxDatagramSize)
+	var err error
+	for attempt := 0; attempt < chunkHashesAttempts; attempt++ {
+		if _, err = conn.Write(req.Serialize()); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(time.Second * 2)
+		if err = conn.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+
+		for {
+			n, readErr := conn.Read(buffer)
+			if readErr != nil {
+				err = readErr
+				break // timed out; try again
+			}
+			msg, parseErr := messages.Parse(buffer[:n])
+			if parseErr != nil {
+				s.countDropped(parseErr)
+				continue
+			}
+			if !matches(msg) {
+				continue // a late response to an earlier attempt
+			}
+			return msg, nil
+		}
+	}
+	return nil, err
+}
+
+// RespondToChunkHashes sends the requested page of chunk hashes of a file. If the file is unknown
+// or its chunk hashes are not available, the response is empty with a Total of 0.
+func (s *Server) RespondToChunkHashes(
+	req *messages.ChunkHashesRequest,
+	conn *net.UDPConn,
+	returnAddr *net.UDPAddr,
+) error {
+	resp := messages.ChunkHashesResponse{
+		RequestID: req.RequestID,
+		Sha1Hash:  req.Sha1Hash,
+		Start:     req.Start,
+		Hashes:    []common.Sha1Hash{},
+	}
+
+	hashes, err := s.cat.ChunkHashes(req.Sha1Hash)
+	if err == nil {
+		resp.Total = uint32(len(hashes))
+		if int(req.Start) < len(hashes) {
+			resp.Hashes = hashes[req.Start:]
+		}
+	}
+
+	_, err = conn.WriteToUDP(resp.Serialize(), returnAddr)
+	return err
+}
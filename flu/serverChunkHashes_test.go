@@ -0,0 +1,55 @@
+package flu
+
+import (
+	"crypto/sha1"
+	"net"
+	"net/netip"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/flu-network/client/common"
+	"github.com/flu-network/client/flu/messages"
+)
+
+func TestFetchChunkHashes(t *testing.T) {
+	hash := &common.Sha1Hash{Data: sha1.Sum([]byte("file"))}
+	chunkHashes := make([]common.Sha1Hash, 10)
+	for i := range chunkHashes {
+		chunkHashes[i].Data = sha1.Sum([]byte{byte(i)})
+	}
+	// hosts answer with three hashes at a time, and say the file has total chunks
+	requests := int32(0)
+	serve := func(total uint32) uint16 {
+		return serveLoopback(t, func(msg messages.Message, conn *net.UDPConn, addr *net.UDPAddr) {
+			atomic.AddInt32(&requests, 1)
+			req := msg.(*messages.ChunkHashesRequest)
+			end := req.Start + 3
+			if end > uint32(len(chunkHashes)) {
+				end = uint32(len(chunkHashes))
+			}
+			resp := messages.ChunkHashesResponse{RequestID: req.RequestID, Sha1Hash: hash,
+				Start: req.Start, Total: total, Hashes: chunkHashes[req.Start:end]}
+			conn.WriteToUDP(resp.Serialize(), addr)
+		})
+	}
+	s := NewServer(0, nil)
+	localhost := netip.MustParseAddr("127.0.0.1")
+
+	result, err := s.FetchChunkHashes(localhost, serve(10), hash, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result, chunkHashes) {
+		t.Fatalf("Expected %v but got %v\n", chunkHashes, result)
+	}
+
+	// a host that claims the file has more chunks than it does is not asked for them
+	atomic.StoreInt32(&requests, 0)
+	if _, err := s.FetchChunkHashes(localhost, serve(4294967295), hash, 10); err == nil {
+		t.Fatal("Expected a host that lies about the number of chunks to be given up on")
+	}
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Fatalf("Expected a single request but got %d\n", got)
+	}
+}
@@ -12,7 +12,7 @@ func (s *Server) ContinueUpload(
 	conn *net.UDPConn,
 	returnAddr *net.UDPAddr,
 ) error {
-	remoteHostIP, err := newIpv4(&returnAddr.IP)
+	remoteHostIP, err := addrOf(returnAddr)
 	if err != nil {
 		return err
 	}
@@ -22,11 +22,16 @@ func (s *Server) ContinueUpload(
 		remotePort: uint16(returnAddr.Port),
 	}
 
+	s.transferLock.Lock()
 	sc, ok := s.uploads[key]
+	s.transferLock.Unlock()
 	if !ok {
 		return fmt.Errorf("no upload corresponds to %v:%d", key.remoteHost, key.remotePort)
 	}
 
-	sc.packetChan <- *ack
+	select {
+	case sc.packetChan <- *ack:
+	case <-sc.done: // the upload finished while we were looking it up
+	}
 	return nil
 }
@@ -1,44 +1,71 @@
 package flu
 
 import (
+	"fmt"
 	"net"
+	"net/netip"
 	"time"
 
 	"github.com/flu-network/client/common"
 	"github.com/flu-network/client/flu/messages"
 )
 
-// DiscoverHosts broadcasts a DiscoverHostRequest on the local network, collects responses for
-// a few seconds, and returns the collected results. Both arguments are optional and serve as
-// filters.
+// DiscoverHosts returns the hosts on the local network, including this one. Both hash and chunks
+// are optional and serve as filters: if a file is given, each host lists the chunks of it that it
+// has, or only those of the given chunks that it has.
+//
+// Hosts announce their presence, so they are normally looked up in the peer table along with what
+// they were last found to have of the file, and the result is immediate. The network is probed for
+// fresh answers instead, which takes a few seconds, if probe is set, if chunks are given, or if
+// nobody was asked about the file within discoveryTTL.
 func (s *Server) DiscoverHosts(
 	hash *common.Sha1Hash,
-	chunks []uint16,
+	chunks []uint32,
+	probe bool,
+) []messages.DiscoverHostResponse {
+	if !probe && len(chunks) == 0 {
+		if result, ok := s.cachedHosts(hash); ok {
+			return result
+		}
+	}
+	result := s.probeHosts(hash, chunks)
+	if len(chunks) == 0 && !hash.IsBlank() {
+		s.recordDiscovery(hash, result)
+	}
+	return result
+}
+
+// probeHosts broadcasts a DiscoverHostRequest on the local network, collects responses for the
+// discovery timeout, and returns the collected results.
+func (s *Server) probeHosts(
+	hash *common.Sha1Hash,
+	chunks []uint32,
 ) []messages.DiscoverHostResponse {
 	// construct a request
 	req := messages.DiscoverHostRequest{
 		Sha1Hash:  *hash,
 		RequestID: s.generateRequestID(),
+		Port:      uint16(s.port),
 		Chunks:    chunks,
 	}
+	if fit, truncated := messages.FitAvailability(chunks); truncated {
+		fmt.Printf("Chunks of %v are too fragmented to ask for: %d of %d ranges fit\n", hash,
+			len(fit)/2, len(chunks)/2)
+		req.Chunks = fit
+	}
 
 	// add a response harness for it
 	responseChan := s.registerResponseChan(req.RequestID, req.ResponseType())
 
-	// send it into the ether
-	var broadcastAddress = net.UDPAddr{
-		IP:   []byte{255, 255, 255, 255}, // broadcast IP
-		Port: s.port,                     // all hosts should use the same port
+	// send it into the ether, on every interface
+	if err := s.broadcast(req.Serialize()); err != nil {
+		fmt.Println(err)
 	}
 
-	conn, err := net.DialUDP("udp", nil, &broadcastAddress)
-	check(err)
-	defer conn.Close()
-	conn.Write(req.Serialize())
-
 	// set a timeout and wait for the response
-	waitChan := time.After(2 * time.Second)
+	waitChan := time.After(s.TransferConfig().DiscoveryTimeout)
 	result := make([]messages.DiscoverHostResponse, 0)
+	seen := make(map[peerKey]bool)
 
 	for {
 		select {
@@ -49,6 +76,12 @@ func (s *Server) DiscoverHosts(
 		case res := <-responseChan:
 			// else cast response into desired type
 			parsedResponse := res.(*messages.DiscoverHostResponse)
+			key := peerKey{address: parsedResponse.Address, port: parsedResponse.Port}
+			if seen[key] {
+				continue // a reply to the broadcast on another interface
+			}
+			seen[key] = true
+			s.seePeer(key)
 			result = append(result, *parsedResponse)
 		}
 	}
@@ -58,23 +91,43 @@ func (s *Server) RespondToDiscoverHosts(
 	req *messages.DiscoverHostRequest,
 	returnAddr *net.UDPAddr,
 ) error {
-	ip := s.LocalIP()
+	requester, err := addrOf(returnAddr)
+	if err != nil {
+		return err
+	}
+	// on hosts with several interfaces, only the address facing the requester is any use to it
+	resp := s.discoverHostResponse(&req.Sha1Hash, req.Chunks, s.localIPFor(requester))
+	resp.RequestID = req.RequestID
+	if chunks, truncated := messages.FitAvailability(resp.Chunks); truncated {
+		fmt.Printf("Chunks of %v are too fragmented to advertise: %d of %d ranges fit\n",
+			&req.Sha1Hash, len(chunks)/2, len(resp.Chunks)/2)
+		resp.Chunks = chunks
+	}
+	return s.sendToPeerAt(requester, req.Port, resp.Serialize())
+}
+
+// discoverHostResponse describes this daemon, at the given address, as a DiscoverHostResponse.
+// If a file is given, the response lists the chunks of it this daemon has, or only those of the
+// given chunks that it has.
+func (s *Server) discoverHostResponse(
+	hash *common.Sha1Hash,
+	chunks []uint32,
+	addr netip.Addr,
+) messages.DiscoverHostResponse {
 	resp := messages.DiscoverHostResponse{
-		Address:   [4]byte{(*ip)[0], (*ip)[1], (*ip)[2], (*ip)[3]},
-		Port:      uint16(s.port),
-		RequestID: req.RequestID,
-		Chunks:    []uint16{},
+		Address: addr,
+		Port:    uint16(s.port),
+		Chunks:  []uint32{},
 	}
 
-	if !req.Sha1Hash.IsBlank() {
-		if ir, err := s.cat.Contains(&req.Sha1Hash); err == nil {
-			if len(req.Chunks) > 0 { // if they asked for chunks
-				resp.Chunks = ir.Progress.Overlap(req.Chunks) // return overlap
+	if !hash.IsBlank() {
+		if ir, err := s.cat.Contains(hash); err == nil {
+			if len(chunks) > 0 { // if they asked for chunks
+				resp.Chunks = ir.Progress.Overlap(chunks) // return overlap
 			} else {
 				resp.Chunks = ir.Progress.Ranges() // return all ranges
 			}
 		}
 	}
-
-	return s.sendToPeer(returnAddr.IP, resp.Serialize())
+	return resp
 }
@@ -0,0 +1,104 @@
+package flu
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/flu-network/client/common"
+	"github.com/flu-network/client/flu/messages"
+)
+
+// haveAudienceTTL is how long a peer that requested chunks of a file keeps hearing about the
+// chunks of it this daemon completes
+const haveAudienceTTL = 2 * time.Minute
+
+// recordHaveAudience remembers that a peer requested chunks of a file, so that it is told about
+// the chunks of it this daemon completes while it is still interested. Since the peer's request
+// came from the port of its connection, the port it listens on is looked up in the peer table;
+// peers that are not in it yet are not told.
+func (s *Server) recordHaveAudience(hash *common.Sha1Hash, ip netip.Addr) {
+	peers := s.peersAt(ip)
+	s.transferLock.Lock()
+	defer s.transferLock.Unlock()
+	audience, ok := s.haveAudiences[*hash]
+	if !ok {
+		audience = make(map[peerKey]time.Time)
+		s.haveAudiences[*hash] = audience
+	}
+	for _, peer := range peers {
+		audience[peer] = time.Now()
+	}
+}
+
+// haveAudience returns the peers that recently requested chunks of a file, forgetting those that
+// have not done so for haveAudienceTTL
+func (s *Server) haveAudience(hash *common.Sha1Hash) []peerKey {
+	s.transferLock.Lock()
+	defer s.transferLock.Unlock()
+	audience := s.haveAudiences[*hash]
+	result := make([]peerKey, 0, len(audience))
+	for peer, at := range audience {
+		if time.Since(at) > haveAudienceTTL {
+			delete(audience, peer)
+		} else {
+			result = append(result, peer)
+		}
+	}
+	if len(audience) == 0 {
+		delete(s.haveAudiences, *hash)
+	}
+	return result
+}
+
+// announceHave tells peers that support HaveAnnouncements that this daemon now has a chunk of a
+// file: the given peers, which should be those it is downloading the file from, as well as those
+// that recently requested chunks of it. It returns immediately; the announcements are sent in the
+// background, saying hello to peers first if need be.
+func (s *Server) announceHave(hash *common.Sha1Hash, chunk uint32, peers []peerKey) {
+	targets := make(map[peerKey]bool)
+	for _, peer := range append(peers, s.haveAudience(hash)...) {
+		targets[peer] = true
+	}
+	announcement := messages.HaveAnnouncement{
+		Sha1Hash: (&common.Sha1Hash{}).FromSlice(hash.Slice()),
+		Port:     uint16(s.port),
+		Chunks:   []uint32{chunk, chunk},
+	}
+	data := announcement.Serialize()
+
+	go func() {
+		for peer := range targets {
+			capabilities, err := s.capabilities(peer.address, peer.port)
+			if err != nil || !capabilities.Has(messages.CapHaveAnnouncements) {
+				continue
+			}
+			if err := s.sendToPeerAt(peer.address, peer.port, data); err != nil {
+				fmt.Printf("Failed to announce chunk %d of %v to %v: %v\n", chunk, hash,
+					peer.address, err)
+			}
+		}
+	}()
+}
+
+// RespondToHave passes the chunks a peer announced to the download of the file, if one is running,
+// and remembers them in case the file is looked for later
+func (s *Server) RespondToHave(msg *messages.HaveAnnouncement, returnAddr *net.UDPAddr) error {
+	ip, err := addrOf(returnAddr)
+	if err != nil {
+		return err
+	}
+
+	peer := peerKey{address: ip, port: msg.Port}
+	s.seePeer(peer)
+	s.discoverHave(msg.Sha1Hash, peer, msg.Chunks)
+
+	s.transferLock.Lock()
+	sched, ok := s.schedulers[*msg.Sha1Hash]
+	s.transferLock.Unlock()
+	if ok {
+		sched.notifyHave(haveNotice{peer: peer, chunks: msg.Chunks})
+	}
+	return nil
+}
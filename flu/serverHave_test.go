@@ -0,0 +1,78 @@
+package flu
+
+import (
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/flu-network/client/common"
+	"github.com/flu-network/client/flu/messages"
+)
+
+func TestUnionRanges(t *testing.T) {
+	type testCase struct {
+		desc     string
+		a, b     []uint32
+		expected []uint32
+	}
+	testCases := []testCase{
+		{"empty", nil, nil, []uint32{}},
+		{"disjoint", []uint32{0, 3, 10, 12}, []uint32{6, 6}, []uint32{0, 3, 6, 6, 10, 12}},
+		{"adjacent", []uint32{0, 3}, []uint32{4, 4}, []uint32{0, 4}},
+		{"contained", []uint32{0, 9}, []uint32{4, 4}, []uint32{0, 9}},
+		{"bridging", []uint32{0, 3, 6, 9}, []uint32{2, 7}, []uint32{0, 9}},
+		{"unsorted and inverted", []uint32{8, 9, 5, 1, 0, 0}, []uint32{}, []uint32{0, 0, 8, 9}},
+		{"largest chunk", []uint32{0, 4294967295}, []uint32{4294967295, 4294967295},
+			[]uint32{0, 4294967295}},
+	}
+	for _, c := range testCases {
+		if actual := unionRanges(c.a, c.b); !reflect.DeepEqual(actual, c.expected) {
+			t.Fatalf("%s: expected %v but got %v\n", c.desc, c.expected, actual)
+		}
+	}
+}
+
+func TestSchedulerHaves(t *testing.T) {
+	s := NewServer(61690, nil)
+	hash := common.Sha1Hash{}
+	seeder := &messages.DiscoverHostResponse{Address: netip.MustParseAddr("10.0.0.2"), Port: 61690,
+		Chunks: []uint32{0, 9}}
+	leecher := &messages.DiscoverHostResponse{Address: netip.MustParseAddr("10.0.0.3"), Port: 61690,
+		Chunks: []uint32{0, 1}}
+	sc := newScheduler(s, &hash, netip.MustParseAddr("10.0.0.1"), DefaultSchedulerConfig(), 10,
+		[]*messages.DiscoverHostResponse{seeder, leecher})
+	s.schedulers[hash] = sc
+
+	partial := sc.partialPeers()
+	if len(partial) != 1 || partial[0].address != leecher.Address {
+		t.Fatalf("Expected only the leecher to be told about new chunks but got %v\n", partial)
+	}
+
+	// a known peer completes a chunk, and a new one turns up with another
+	announce := func(ip net.IP, chunk uint32) {
+		msg := &messages.HaveAnnouncement{Sha1Hash: &hash, Port: 61690,
+			Chunks: []uint32{chunk, chunk}}
+		if err := s.RespondToHave(msg, &net.UDPAddr{IP: ip, Port: 50000}); err != nil {
+			t.Fatal(err)
+		}
+		sc.addHave(<-sc.haves)
+	}
+	announce(net.IP{10, 0, 0, 3}, 2)
+	announce(net.IP{10, 0, 0, 4}, 7)
+	announce(net.IP{10, 0, 0, 1}, 8) // ourselves
+
+	if !reflect.DeepEqual(leecher.Chunks, []uint32{0, 2}) {
+		t.Fatalf("Expected the leecher's chunks to grow but they are %v\n", leecher.Chunks)
+	}
+	if len(sc.peers) != 3 || sc.peers[2].Address != netip.MustParseAddr("10.0.0.4") {
+		t.Fatalf("Expected the new peer to be added but peers are %v\n", sc.peers)
+	}
+	expected := []int{2, 2, 2, 1, 1, 1, 1, 2, 1, 1}
+	for chunk, count := range expected {
+		if actual := sc.availability.Count(uint32(chunk)); actual != count {
+			t.Fatalf("Expected chunk %d to be held by %d peers but it is held by %d\n",
+				chunk, count, actual)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package flu
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/flu-network/client/flu/messages"
+)
+
+// helloTTL is how long what a peer said in a Hello is trusted before asking again, in case it has
+// been upgraded since
+const helloTTL = 10 * time.Minute
+
+// peerHello is what a peer said about itself in its latest Hello
+type peerHello struct {
+	version      uint8 // the protocol version both sides speak
+	capabilities messages.Capabilities
+	at           time.Time
+}
+
+// Hello introduces this daemon to a remote host, and returns the protocol version and the optional
+// features the two of them have in common. Returns an error wrapping
+// messages.ErrIncompatibleVersion if they have no protocol version in common.
+func (s *Server) Hello(
+	addr netip.Addr,
+	port uint16,
+) (uint8, messages.Capabilities, error) {
+	targetAddr := udpAddrOf(addr, port)
+	conn, err := net.DialUDP("udp", nil, targetAddr)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+
+	req := messages.HelloRequest{
+		RequestID:    s.generateRequestID(),
+		Version:      messages.ProtocolVersion,
+		Capabilities: messages.SupportedCapabilities,
+	}
+	msg, err := s.requestWithRetries(conn, &req, func(msg messages.Message) bool {
+		res, ok := msg.(*messages.HelloResponse)
+		return ok && res.RequestID == req.RequestID
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("%v did not respond to hello: %v", targetAddr.IP, err)
+	}
+	res := msg.(*messages.HelloResponse)
+	hello, err := s.recordHello(peerKey{address: addr, port: port}, res.Version, res.Capabilities)
+	if err != nil {
+		return 0, 0, err
+	}
+	return hello.version, hello.capabilities, nil
+}
+
+// RespondToHello tells a peer which protocol version and optional features this daemon supports.
+// What the peer said about itself is not remembered: Hellos are sent from a port of their own, so
+// the port the peer listens on is unknown. Returns an error wrapping
+// messages.ErrIncompatibleVersion if the two of them have no protocol version in common.
+func (s *Server) RespondToHello(
+	req *messages.HelloRequest,
+	conn *net.UDPConn,
+	returnAddr *net.UDPAddr,
+) error {
+	resp := messages.HelloResponse{
+		RequestID:    req.RequestID,
+		Version:      messages.ProtocolVersion,
+		Capabilities: messages.SupportedCapabilities,
+	}
+	if _, err := conn.WriteToUDP(resp.Serialize(), returnAddr); err != nil {
+		return err
+	}
+
+	peer, err := addrOf(returnAddr)
+	if err != nil {
+		return err
+	}
+	_, err = agreeHello(peer, req.Version, req.Capabilities)
+	return err
+}
+
+// capabilities returns the optional features this daemon and a peer have in common, saying hello
+// to the peer first unless it has done so recently.
+func (s *Server) capabilities(ip netip.Addr, port uint16) (messages.Capabilities, error) {
+	s.helloLock.Lock()
+	hello, ok := s.hellos[peerKey{address: ip, port: port}]
+	s.helloLock.Unlock()
+	if ok && time.Since(hello.at) < helloTTL {
+		return hello.capabilities, nil
+	}
+	_, capabilities, err := s.Hello(ip, port)
+	return capabilities, err
+}
+
+// requireCapabilities returns an error unless a peer has every one of the given capabilities
+func (s *Server) requireCapabilities(
+	ip netip.Addr,
+	port uint16,
+	required messages.Capabilities,
+) error {
+	capabilities, err := s.capabilities(ip, port)
+	if err != nil {
+		return err
+	}
+	if !capabilities.Has(required) {
+		return fmt.Errorf("%v does not support %s", ip, required&^capabilities)
+	}
+	return nil
+}
+
+// recordHello remembers the protocol version and capabilities a peer has in common with this
+// daemon, given those it says it supports
+func (s *Server) recordHello(
+	peer peerKey,
+	version uint8,
+	capabilities messages.Capabilities,
+) (peerHello, error) {
+	result, err := agreeHello(peer.address, version, capabilities)
+	if err != nil {
+		return result, err
+	}
+	s.helloLock.Lock()
+	defer s.helloLock.Unlock()
+	s.hellos[peer] = result
+	return result, nil
+}
+
+// agreeHello returns the protocol version and capabilities a peer has in common with this daemon,
+// given those it says it supports
+func agreeHello(
+	peer netip.Addr,
+	version uint8,
+	capabilities messages.Capabilities,
+) (peerHello, error) {
+	if version > messages.ProtocolVersion {
+		version = messages.ProtocolVersion
+	}
+	if version < messages.MinProtocolVersion {
+		return peerHello{}, fmt.Errorf("%w: %v speaks version %d but versions %d to %d are "+
+			"supported", messages.ErrIncompatibleVersion, peer, version,
+			messages.MinProtocolVersion, messages.ProtocolVersion)
+	}
+
+	return peerHello{
+		version:      version,
+		capabilities: capabilities & messages.SupportedCapabilities,
+		at:           time.Now(),
+	}, nil
+}
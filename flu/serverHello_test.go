@@ -0,0 +1,100 @@
+package flu
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/flu-network/client/flu/messages"
+)
+
+func TestRecordHello(t *testing.T) {
+	s := NewServer(0, nil)
+	peer := peerKey{address: netip.MustParseAddr("10.0.0.1"), port: 61690}
+
+	// newer peers are spoken to in our version, with only the features we both know
+	hello, err := s.recordHello(peer, messages.ProtocolVersion+1, 1<<31|messages.CapChunkHashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello.version != messages.ProtocolVersion || hello.capabilities != messages.CapChunkHashes {
+		t.Fatalf("Unexpected hello %+v\n", hello)
+	}
+	if err := s.requireCapabilities(peer.address, peer.port, messages.CapChunkHashes); err != nil {
+		t.Fatal(err)
+	}
+	err = s.requireCapabilities(peer.address, peer.port, messages.CapMerkleProofs)
+	if err == nil {
+		t.Fatalf("Expected peer without merkle proofs to be rejected\n")
+	}
+
+	// another daemon on the same host has capabilities of its own
+	other := peerKey{address: peer.address, port: 61691}
+	if _, err := s.recordHello(other, messages.ProtocolVersion, messages.CapMerkleProofs); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.requireCapabilities(other.address, other.port, messages.CapMerkleProofs); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.requireCapabilities(peer.address, peer.port, messages.CapChunkHashes); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.recordHello(peer, messages.MinProtocolVersion-1, messages.SupportedCapabilities)
+	if !errors.Is(err, messages.ErrIncompatibleVersion) {
+		t.Fatalf("Expected peer with an old version to be rejected but got %v\n", err)
+	}
+}
+
+func TestHelloFromVersion1Peer(t *testing.T) {
+	s := NewServer(0, nil)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	// version 1 peers send Hellos without a trailer
+	if _, err := peer.Write([]byte{0xF1, 12, 0x12, 0x34, 1, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, messages.MaxDatagramSize)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, returnAddr, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := messages.Parse(buf[:n])
+	if err != nil {
+		t.Fatalf("Expected a version 1 hello to parse but got %v\n", err)
+	}
+	req := msg.(*messages.HelloRequest)
+	err = s.RespondToHello(req, conn, returnAddr)
+	if !errors.Is(err, messages.ErrIncompatibleVersion) {
+		t.Fatalf("Expected the peer's version to be rejected but got %v\n", err)
+	}
+
+	// the peer reads the response the way it reads its own, and learns our version
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	n, err = peer.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n < 9 || buf[0]&0xF0 != 0xF0 || buf[1] != 13 || buf[2] != 0x12 || buf[3] != 0x34 ||
+		buf[4] != messages.ProtocolVersion {
+		t.Fatalf("Expected a hello response the peer understands but got %v\n", buf[:n])
+	}
+	s.helloLock.Lock()
+	defer s.helloLock.Unlock()
+	if len(s.hellos) != 0 {
+		t.Fatalf("Expected nothing to be remembered about an incompatible peer but got %v\n",
+			s.hellos)
+	}
+}
@@ -0,0 +1,284 @@
+package flu
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// InterfaceFilter chooses the network interfaces hosts are discovered on. Patterns are matched
+// against interface names as by path.Match, e.g., "eth*" or "docker?". An interface is used if it
+// matches one of the Allow patterns, or there are none, and matches none of the Deny patterns.
+type InterfaceFilter struct {
+	Allow []string
+	Deny  []string
+}
+
+// ParseInterfaceFilter builds an InterfaceFilter from comma-separated lists of patterns, either of
+// which may be empty, e.g., ParseInterfaceFilter("eth*,wlan0", "docker*")
+func ParseInterfaceFilter(allow, deny string) (InterfaceFilter, error) {
+	result := InterfaceFilter{}
+	for _, list := range []struct {
+		spec     string
+		patterns *[]string
+	}{{allow, &result.Allow}, {deny, &result.Deny}} {
+		for _, pattern := range strings.Split(list.spec, ",") {
+			pattern = strings.TrimSpace(pattern)
+			if pattern == "" {
+				continue
+			}
+			if _, err := path.Match(pattern, ""); err != nil {
+				return InterfaceFilter{}, fmt.Errorf("invalid interface pattern %q: %v", pattern, err)
+			}
+			*list.patterns = append(*list.patterns, pattern)
+		}
+	}
+	return result, nil
+}
+
+// Allows returns true if hosts may be discovered on the named interface
+func (f InterfaceFilter) Allows(name string) bool {
+	allowed := len(f.Allow) == 0
+	for _, pattern := range f.Allow {
+		if matched, _ := path.Match(pattern, name); matched {
+			allowed = true
+			break
+		}
+	}
+	for _, pattern := range f.Deny {
+		if matched, _ := path.Match(pattern, name); matched {
+			return false
+		}
+	}
+	return allowed
+}
+
+// SetInterfaceFilter chooses the interfaces hosts are discovered on from now on
+func (s *Server) SetInterfaceFilter(filter InterfaceFilter) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	s.interfaceFilter = filter
+}
+
+// ParsePorts parses a comma-separated list of ports, e.g., "61697,61698". The list may be empty.
+func ParsePorts(spec string) ([]uint16, error) {
+	result := []uint16{}
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		port, err := strconv.ParseUint(field, 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("invalid port %q", field)
+		}
+		result = append(result, uint16(port))
+	}
+	return result, nil
+}
+
+// SetPeerPorts sets the ports, besides this daemon's own, that other daemons on the network may
+// listen on. Hosts are discovered on all of them from now on.
+func (s *Server) SetPeerPorts(ports []uint16) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	s.peerPorts = append([]uint16{}, ports...)
+}
+
+// discoveryPorts returns every port hosts are discovered on, starting with this daemon's own
+func (s *Server) discoveryPorts() []uint16 {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	result := []uint16{uint16(s.port)}
+	for _, port := range s.peerPorts {
+		if port != uint16(s.port) {
+			result = append(result, port)
+		}
+	}
+	return result
+}
+
+// multicastGroup is the link-local IPv6 multicast group every daemon joins, on each interface
+// hosts are discovered on. IPv6 has no broadcasts, so discovery messages are sent to it instead.
+var multicastGroup = netip.MustParseAddr("ff02::f100")
+
+// localInterface is an address of this daemon that hosts are discovered from
+type localInterface struct {
+	name   string
+	index  int
+	prefix netip.Prefix // this daemon's address, along with the length of its subnet's prefix
+	// broadcast is where to send messages meant for every host on the subnet: its subnet-directed
+	// broadcast address for IPv4, or the multicast group on this interface for IPv6
+	broadcast netip.Addr
+}
+
+// interfaces returns the addresses of every interface hosts are discovered on: those that are up,
+// are not loopbacks and are allowed by the interface filter. IPv4 addresses are used if the
+// interface supports broadcasts, unless they are on point-to-point subnets (/31 and /32), which
+// have no broadcast address. IPv6 addresses are used if it supports multicast.
+func (s *Server) interfaces() []localInterface {
+	s.peerLock.Lock()
+	filter := s.interfaceFilter
+	s.peerLock.Unlock()
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	result := make([]localInterface, 0, len(ifaces))
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 ||
+			!filter.Allows(iface.Name) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip, ok := netip.AddrFromSlice(ipnet.IP)
+			if !ok {
+				continue
+			}
+			ip = ip.Unmap()
+			ones, _ := ipnet.Mask.Size()
+			local := localInterface{
+				name:   iface.Name,
+				index:  iface.Index,
+				prefix: netip.PrefixFrom(ip, ones),
+			}
+
+			if ip.Is4() {
+				if iface.Flags&net.FlagBroadcast == 0 || ones >= 31 {
+					continue
+				}
+				broadcast := ip.As4()
+				mask := net.CIDRMask(ones, 32)
+				for i := range broadcast {
+					broadcast[i] |= ^mask[i]
+				}
+				local.broadcast = netip.AddrFrom4(broadcast)
+			} else {
+				if iface.Flags&net.FlagMulticast == 0 {
+					continue
+				}
+				local.broadcast = multicastGroup.WithZone(iface.Name)
+			}
+			result = append(result, local)
+		}
+	}
+	return result
+}
+
+// broadcast sends a message to every host on the local network: as a subnet-directed broadcast on
+// each IPv4 subnet hosts are discovered on, and to the multicast group on each interface with IPv6.
+// If there are none, the limited broadcast address is used instead, which only reaches the subnet
+// of the default interface. It is sent to each port hosts are discovered on.
+func (s *Server) broadcast(message []byte) error {
+	targets := []netip.Addr{}
+	seen := make(map[netip.Addr]bool)
+	for _, iface := range s.interfaces() {
+		if !seen[iface.broadcast] {
+			seen[iface.broadcast] = true
+			targets = append(targets, iface.broadcast)
+		}
+	}
+	if len(targets) == 0 {
+		targets = append(targets, netip.AddrFrom4([4]byte{255, 255, 255, 255}))
+	}
+
+	failed := []string{}
+	for _, port := range s.discoveryPorts() {
+		for _, addr := range targets {
+			if err := s.sendToPeerAt(addr, port, message); err != nil {
+				failed = append(failed, fmt.Sprintf("%v (%v)", netip.AddrPortFrom(addr, port), err))
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to broadcast to %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// JoinMulticastGroup makes the socket that datagrams are read from for HandleMessage receive
+// those sent to the multicast group, on every interface hosts are discovered on over IPv6. The
+// socket must be bound to the daemon's port on every address, IPv4 and IPv6.
+func (s *Server) JoinMulticastGroup(conn *net.UDPConn) error {
+	joined := make(map[int]bool)
+	failed := []string{}
+	for _, iface := range s.interfaces() {
+		if iface.prefix.Addr().Is4() || joined[iface.index] {
+			continue
+		}
+		joined[iface.index] = true
+		if err := joinGroup(conn, multicastGroup, iface.index); err != nil {
+			failed = append(failed, fmt.Sprintf("%s (%v)", iface.name, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to join %v on %s", multicastGroup, strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// localIPFor returns this daemon's address on the interface that faces a remote address: the one
+// on the same subnet if there is one, or else the one the kernel would send replies from. IPv6
+// addresses are preferred to be of the same scope as the remote address, so that link-local
+// addresses are answered with link-local addresses. Returns the zero Addr if there is none.
+func (s *Server) localIPFor(remote netip.Addr) netip.Addr {
+	remote = remote.Unmap()
+	for _, iface := range s.interfaces() {
+		local := iface.prefix.Addr()
+		if remote.IsLinkLocalUnicast() {
+			if local.IsLinkLocalUnicast() && remote.Zone() == iface.name {
+				return local
+			}
+		} else if iface.prefix.Contains(remote) {
+			return local
+		}
+	}
+	// connecting a UDP socket sends nothing, but it does choose a source address
+	conn, err := net.DialUDP("udp", nil, udpAddrOf(remote, uint16(s.port)))
+	if err == nil {
+		defer conn.Close()
+		local, err := addrOf(conn.LocalAddr().(*net.UDPAddr))
+		if err == nil && !local.IsUnspecified() {
+			return local.WithZone("")
+		}
+	}
+	return s.LocalIP()
+}
+
+// isLocalAddress returns true if the address belongs to one of this daemon's (non-loopback)
+// interfaces, whether or not hosts are discovered on it
+func (s *Server) isLocalAddress(addr netip.Addr) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap().WithZone("")
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() {
+			continue
+		}
+		if local, ok := netip.AddrFromSlice(ipnet.IP); ok && local.Unmap() == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// isSelf returns true if a peer is this daemon. Other daemons may run on the same host, so it
+// must listen on this daemon's port as well as at one of its addresses.
+func (s *Server) isSelf(peer peerKey) bool {
+	return peer.port == uint16(s.port) && s.isLocalAddress(peer.address)
+}
@@ -0,0 +1,106 @@
+package flu
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestInterfaceFilter(t *testing.T) {
+	type testCase struct {
+		allow, deny string
+		allowed     []string
+		denied      []string
+	}
+	testCases := []testCase{
+		{"", "", []string{"eth0", "docker0"}, []string{}},
+		{"eth*, wlan0", "", []string{"eth0", "eth1", "wlan0"}, []string{"wlan1", "docker0"}},
+		{"", "docker*,br-*", []string{"eth0"}, []string{"docker0", "br-1a2b"}},
+		{"e*", "eth1", []string{"eth0", "enp3s0"}, []string{"eth1", "wlan0"}},
+	}
+	for _, c := range testCases {
+		filter, err := ParseInterfaceFilter(c.allow, c.deny)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range c.allowed {
+			if !filter.Allows(name) {
+				t.Fatalf("Expected %+v to allow %s\n", filter, name)
+			}
+		}
+		for _, name := range c.denied {
+			if filter.Allows(name) {
+				t.Fatalf("Expected %+v to deny %s\n", filter, name)
+			}
+		}
+	}
+
+	if _, err := ParseInterfaceFilter("eth[", ""); err == nil {
+		t.Fatal("Expected an invalid pattern to be rejected")
+	}
+}
+
+func TestInterfaces(t *testing.T) {
+	s := NewServer(61690, nil)
+	for _, iface := range s.interfaces() {
+		addr := iface.prefix.Addr()
+		if addr.Is4() {
+			if !iface.prefix.Contains(iface.broadcast) || iface.broadcast == addr {
+				t.Fatalf("%s: %v is not the broadcast address of %v\n", iface.name,
+					iface.broadcast, iface.prefix)
+			}
+		} else if iface.broadcast != multicastGroup.WithZone(iface.name) {
+			t.Fatalf("%s: expected IPv6 to be multicast but got %v\n", iface.name, iface.broadcast)
+		}
+
+		// a neighbour on the same subnet, as a host would see it
+		neighbour := iface.prefix.Masked().Addr().Next()
+		if neighbour == addr {
+			neighbour = neighbour.Next()
+		}
+		if addr.IsLinkLocalUnicast() {
+			neighbour = neighbour.WithZone(iface.name)
+		}
+		if actual := s.localIPFor(neighbour); actual.Is4() != addr.Is4() ||
+			actual.IsLinkLocalUnicast() != addr.IsLinkLocalUnicast() {
+			t.Fatalf("%s: expected an address like %v to face %v but got %v\n", iface.name, addr,
+				neighbour, actual)
+		}
+		if !s.isLocalAddress(addr) {
+			t.Fatalf("%s: expected %v to be local\n", iface.name, addr)
+		}
+		if !s.isSelf(peerKey{address: addr, port: 61690}) ||
+			s.isSelf(peerKey{address: addr, port: 61691}) {
+			t.Fatalf("%s: expected only the daemon on this port to be this one\n", iface.name)
+		}
+	}
+
+	s.SetInterfaceFilter(InterfaceFilter{Deny: []string{"*"}})
+	if ifaces := s.interfaces(); len(ifaces) != 0 {
+		t.Fatalf("Expected every interface to be denied but got %v\n", ifaces)
+	}
+	loopback := netip.MustParseAddr("127.0.0.1")
+	if actual := s.localIPFor(loopback); actual != loopback {
+		t.Fatalf("Expected replies to loopback to come from loopback but got %v\n", actual)
+	}
+}
+
+func TestPeerPorts(t *testing.T) {
+	if _, err := ParsePorts("61697,0"); err == nil {
+		t.Fatal("Expected port 0 to be rejected")
+	}
+	if _, err := ParsePorts("61697,65536"); err == nil {
+		t.Fatal("Expected ports beyond 65535 to be rejected")
+	}
+	ports, err := ParsePorts(" 61697, 61690,,61698")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(61690, nil)
+	s.SetPeerPorts(ports)
+	expected := []uint16{61690, 61697, 61698}
+	if actual := s.discoveryPorts(); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("Expected hosts to be discovered on ports %v but got %v\n", expected, actual)
+	}
+}
@@ -1,69 +1,82 @@
 package flu
 
 import (
+	"bytes"
 	"fmt"
-	"log"
 	"net"
+	"net/netip"
 	"path"
-	"time"
+	"sort"
 
 	"github.com/flu-network/client/catalogue"
 	"github.com/flu-network/client/common"
 	"github.com/flu-network/client/flu/messages"
 )
 
-// ListFilesOnHost sends a request for a list of files from a remote host and returns the response.
-// The request times out if not fulfilled in a few seconds
+// maxListFilesPages bounds the number of pages fetched from a host, and so the memory a host that
+// claims there are always more files can make us use. Each page fills at most one datagram.
+const maxListFilesPages = 1000
+
+// ListFilesOnHost requests the list of files on a remote host and returns them all in a single
+// response. Hosts send as many files as fit in a datagram at a time, so the list is fetched page by
+// page, each page being retried a few times if it does not arrive within a few seconds. Hosts that
+// list more than maxListFilesPages pages are given up on.
 func (s *Server) ListFilesOnHost(
-	ipv4 [4]byte,
+	addr netip.Addr,
 	port uint16,
 	hash *common.Sha1Hash,
 ) (*messages.ListFilesResponse, error) {
-	// construct a request and set up UDP harness
-	req := messages.ListFilesRequest{RequestID: s.generateRequestID(), Sha1Hash: hash}
-	targetAddr := net.UDPAddr{IP: ipv4[:], Port: int(port)}
-	conn, err := net.DialUDP("udp", nil, &targetAddr)
-	check(err)
+	targetAddr := udpAddrOf(addr, port)
+	conn, err := net.DialUDP("udp", nil, targetAddr)
+	if err != nil {
+		return nil, err
+	}
 	defer conn.Close()
 
-	// setup response harness. Buffered so we don't deadlock
-	responseChan := make(chan []byte, 1)
-	errorChan := make(chan error, 1)
-
-	// send the request and catch the response
-	go func() {
-		err = conn.SetReadDeadline(time.Now().Add(time.Second * 2))
-		if err != nil {
-			errorChan <- err
-		} else {
-			conn.Write(req.Serialize())
-			rawResponseBuffer := make([]byte, 1024)
-			_, err = conn.Read(rawResponseBuffer)
-			if err != nil {
-				errorChan <- err
-			} else {
-				responseChan <- rawResponseBuffer
-			}
+	result := &messages.ListFilesResponse{Files: []messages.ListFilesEntry{}}
+	var after *common.Sha1Hash
+	for pages := 0; ; pages++ {
+		if pages == maxListFilesPages {
+			return nil, fmt.Errorf("host %v listed more than %d pages of files", targetAddr.IP,
+				maxListFilesPages)
 		}
-	}()
-
-	// parse and return the response
-	select {
-	case rawResponse := <-responseChan:
-		parsedResponse, err := messages.Parse(rawResponse)
+		req := &messages.ListFilesRequest{
+			RequestID: s.generateRequestID(),
+			Sha1Hash:  hash,
+			After:     after,
+		}
+		msg, err := s.requestWithRetries(conn, req, func(msg messages.Message) bool {
+			res, ok := msg.(*messages.ListFilesResponse)
+			return ok && res.RequestID == req.RequestID
+		})
 		if err != nil {
 			return nil, err
 		}
-		result, ok := parsedResponse.(*messages.ListFilesResponse)
-		if !ok {
-			return nil, fmt.Errorf("wrong response type received for ListFilesRequest: %v", result)
+		page := msg.(*messages.ListFilesResponse)
+
+		// every page must pick up where the last left off, or a misbehaving host could keep us
+		// paging forever
+		for i := range page.Files {
+			if after != nil && bytes.Compare(page.Files[i].Sha1Hash.Slice(), after.Slice()) <= 0 {
+				return nil, fmt.Errorf("host %v listed files out of order", targetAddr.IP)
+			}
+			after = page.Files[i].Sha1Hash
+		}
+		result.RequestID = page.RequestID
+		result.Files = append(result.Files, page.Files...)
+		if !page.More {
+			return result, nil
+		}
+		if len(page.Files) == 0 {
+			return nil, fmt.Errorf("host %v sent an empty page of files with more to come",
+				targetAddr.IP)
 		}
-		return result, nil
-	case err = <-errorChan:
-		return nil, err
 	}
 }
 
+// RespondToListFilesOnHost sends the page of files the request asks for: those with a hash greater
+// than its cursor, in ascending order of hash, as many as fit in a datagram. If a specific file was
+// requested and is unknown, the response is empty.
 func (s *Server) RespondToListFilesOnHost(
 	req *messages.ListFilesRequest,
 	conn *net.UDPConn,
@@ -75,24 +88,26 @@ func (s *Server) RespondToListFilesOnHost(
 	if req.Sha1Hash.IsBlank() {
 		files, err = s.cat.ListFiles()
 		if err != nil {
-			log.Fatal(err)
-		}
-	} else {
-		file, err := s.cat.Contains(req.Sha1Hash)
-		if err != nil {
-			log.Fatal(err)
+			return err
 		}
+	} else if file, err := s.cat.Contains(req.Sha1Hash); err == nil {
 		files = append(files, *file)
 	}
 
-	resp := messages.ListFilesResponse{
-		RequestID: req.RequestID,
-		Files:     make([]messages.ListFilesEntry, len(files)),
+	sort.Slice(files, func(i, j int) bool {
+		return bytes.Compare(files[i].Sha1Hash.Slice(), files[j].Sha1Hash.Slice()) < 0
+	})
+	if req.After != nil {
+		files = files[sort.Search(len(files), func(i int) bool {
+			return bytes.Compare(files[i].Sha1Hash.Slice(), req.After.Slice()) > 0
+		}):]
 	}
+
+	entries := make([]messages.ListFilesEntry, len(files))
 	for i, f := range files {
 		_, fileName := path.Split(f.FilePath)
 		hash := (&common.Sha1Hash{}).FromSlice(f.Sha1Hash.Slice())
-		resp.Files[i] = messages.ListFilesEntry{
+		entries[i] = messages.ListFilesEntry{
 			SizeInBytes:      uint64(f.SizeInBytes),
 			ChunkCount:       uint32(f.Progress.Size()),
 			ChunkSizeInBytes: uint32(f.ChunkSize),
@@ -102,6 +117,12 @@ func (s *Server) RespondToListFilesOnHost(
 		}
 	}
 
+	fit := messages.FitListFilesEntries(entries)
+	resp := messages.ListFilesResponse{
+		RequestID: req.RequestID,
+		More:      fit < len(entries),
+		Files:     entries[:fit],
+	}
 	_, err = conn.WriteToUDP(resp.Serialize(), returnAddr)
 	return err
 }
@@ -0,0 +1,103 @@
+package flu
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/flu-network/client/catalogue"
+	"github.com/flu-network/client/common"
+	"github.com/flu-network/client/flu/messages"
+)
+
+// serveLoopback answers the datagrams sent to a loopback port with handle until the test ends,
+// and returns the port
+func serveLoopback(
+	t *testing.T,
+	handle func(msg messages.Message, conn *net.UDPConn, returnAddr *net.UDPAddr),
+) uint16 {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, messages.MaxDatagramSize)
+		for {
+			n, returnAddr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if msg, err := messages.Parse(buf[:n]); err == nil {
+				handle(msg, conn, returnAddr)
+			}
+		}
+	}()
+	return uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+func TestListFilesOnHost(t *testing.T) {
+	dir := t.TempDir()
+	cat, err := catalogue.NewCat(filepath.Join(dir, "catalogue"), filepath.Join(dir, "downloads"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cat.Init(); err != nil {
+		t.Fatal(err)
+	}
+	const fileCount = 100
+	for i := 0; i < fileCount; i++ {
+		hash := &common.Sha1Hash{Data: sha1.Sum([]byte{byte(i)})}
+		name := fmt.Sprintf("a file with a long enough name %d.bin", i)
+		if _, err := cat.RegisterDownload(8, 2, 4, hash, name, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	host := NewServer(0, cat)
+	port := serveLoopback(t, func(msg messages.Message, conn *net.UDPConn, addr *net.UDPAddr) {
+		host.RespondToListFilesOnHost(msg.(*messages.ListFilesRequest), conn, addr)
+	})
+	localhost := netip.MustParseAddr("127.0.0.1")
+
+	// the files take several datagrams, and every one of them is listed once
+	s := NewServer(0, nil)
+	res, err := s.ListFilesOnHost(localhost, port, (&common.Sha1Hash{}).Blank())
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := map[common.Sha1Hash]bool{}
+	for _, f := range res.Files {
+		listed[*f.Sha1Hash] = true
+	}
+	if len(res.Files) != fileCount || len(listed) != fileCount {
+		t.Fatalf("Expected %d files but got %d, of which %d are different\n", fileCount,
+			len(res.Files), len(listed))
+	}
+	if fit := messages.FitListFilesEntries(res.Files); fit >= fileCount {
+		t.Fatalf("Expected the files not to fit in one datagram but %d do\n", fit)
+	}
+
+	// a host that always claims to have more files is given up on
+	pages := int32(0)
+	port = serveLoopback(t, func(msg messages.Message, conn *net.UDPConn, addr *net.UDPAddr) {
+		hash := &common.Sha1Hash{}
+		binary.BigEndian.PutUint32(hash.Data[16:], uint32(atomic.AddInt32(&pages, 1)))
+		resp := messages.ListFilesResponse{
+			RequestID: msg.(*messages.ListFilesRequest).RequestID,
+			More:      true,
+			Files:     []messages.ListFilesEntry{{Sha1Hash: hash, FileName: "more.bin"}},
+		}
+		conn.WriteToUDP(resp.Serialize(), addr)
+	})
+	if _, err := s.ListFilesOnHost(localhost, port, (&common.Sha1Hash{}).Blank()); err == nil {
+		t.Fatal("Expected a host that never stops listing files to be given up on")
+	}
+	if got := atomic.LoadInt32(&pages); got != maxListFilesPages {
+		t.Fatalf("Expected %d pages to be asked for but got %d\n", maxListFilesPages, got)
+	}
+}
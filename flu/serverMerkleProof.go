@@ -0,0 +1,140 @@
+package flu
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/flu-network/client/common"
+	"github.com/flu-network/client/flu/messages"
+)
+
+// FetchMerkleProof asks a remote host for the merkle root of a file and the inclusion proof of one
+// of its chunks. The response is whatever the host claims, so callers must check the root against
+// one they trust. Returns an error if the host does not know the file's merkle tree or stops
+// responding.
+func (s *Server) FetchMerkleProof(
+	addr netip.Addr,
+	port uint16,
+	hash *common.Sha1Hash,
+	chunk uint32,
+) (*messages.MerkleProofResponse, error) {
+	targetAddr := udpAddrOf(addr, port)
+	conn, err := net.DialUDP("udp", nil, targetAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	req := messages.MerkleProofRequest{
+		RequestID: s.generateRequestID(),
+		Sha1Hash:  hash,
+		Chunk:     chunk,
+	}
+	msg, err := s.requestWithRetries(conn, &req, func(msg messages.Message) bool {
+		res, ok := msg.(*messages.MerkleProofResponse)
+		return ok && res.RequestID == req.RequestID && res.Chunk == req.Chunk
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch merkle proof from %v: %v", targetAddr.IP, err)
+	}
+	res := msg.(*messages.MerkleProofResponse)
+	if res.ChunkCount == 0 {
+		return nil, fmt.Errorf("%v does not know the merkle tree of %v", targetAddr.IP, hash)
+	}
+	return res, nil
+}
+
+// RespondToMerkleProof sends the merkle root of a file and the inclusion proof of the requested
+// chunk. If the file is unknown or its merkle tree is not available, the response has a
+// ChunkCount of 0.
+func (s *Server) RespondToMerkleProof(
+	req *messages.MerkleProofRequest,
+	conn *net.UDPConn,
+	returnAddr *net.UDPAddr,
+) error {
+	resp := messages.MerkleProofResponse{
+		RequestID: req.RequestID,
+		Sha1Hash:  req.Sha1Hash,
+		Root:      &common.Sha1Hash{},
+		Chunk:     req.Chunk,
+		Proof:     []common.Sha1Hash{},
+	}
+
+	root, chunkCount, proof, err := s.cat.MerkleProof(req.Sha1Hash, int(req.Chunk))
+	if err == nil {
+		resp.Root = root
+		resp.ChunkCount = uint32(chunkCount)
+		resp.Proof = proof
+	}
+
+	_, err = conn.WriteToUDP(resp.Serialize(), returnAddr)
+	return err
+}
+
+// chunkProof returns the inclusion proof that a chunk downloaded from the given peer needs before
+// it can be saved, or nil if the file's chunk hashes are known and no proof is needed. The proof
+// is fetched from the peer that sent the chunk, but only a proof against the root recorded in the
+// catalogue is of any use.
+func (s *Server) chunkProof(
+	ip netip.Addr,
+	port uint16,
+	hash *common.Sha1Hash,
+	chunk uint32,
+) ([]common.Sha1Hash, error) {
+	record, err := s.cat.Contains(hash)
+	if err != nil {
+		return nil, err
+	} else if !record.NeedsProofs() {
+		return nil, nil
+	}
+	if err := s.requireCapabilities(ip, port, messages.CapMerkleProofs); err != nil {
+		return nil, err
+	}
+	res, err := s.FetchMerkleProof(ip, port, hash, chunk)
+	if err != nil {
+		return nil, err
+	}
+	if *res.Root != *record.MerkleRoot || int(res.ChunkCount) != record.Progress.Size() {
+		return nil, fmt.Errorf("%v:%d sent a proof of chunk %d against the wrong merkle root",
+			ip, port, chunk)
+	}
+	return res.Proof, nil
+}
+
+// fetchMerkleRoot asks hosts, in order, for the merkle root of a file. It is only as trustworthy
+// as the first host able to supply it. Hosts that supply the rejected root, if given, which is
+// known not to be the file's, are ignored. Returns nil if none can.
+func (s *Server) fetchMerkleRoot(
+	hash *common.Sha1Hash,
+	chunkCount int,
+	hosts []*messages.DiscoverHostResponse,
+	rejected *common.Sha1Hash,
+) *common.Sha1Hash {
+	if chunkCount == 0 {
+		return nil
+	}
+	for _, host := range hosts {
+		err := s.requireCapabilities(host.Address, host.Port, messages.CapMerkleProofs)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		res, err := s.FetchMerkleProof(host.Address, host.Port, hash, 0)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		if int(res.ChunkCount) != chunkCount {
+			fmt.Printf("%v claims %v has %d chunks but it has %d\n",
+				host.Address, hash, res.ChunkCount, chunkCount)
+			continue
+		}
+		if rejected != nil && *res.Root == *rejected {
+			fmt.Printf("%v sent the wrong merkle root for %v\n", host.Address, hash)
+			continue
+		}
+		return res.Root
+	}
+	return nil
+}
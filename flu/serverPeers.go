@@ -0,0 +1,195 @@
+package flu
+
+import (
+	"net/netip"
+	"sort"
+	"time"
+)
+
+// peerExpiry is how long a peer that has not been heard from stays in the peer table. Running
+// peers announce their presence every presenceInterval, so this allows for a few to go missing.
+const peerExpiry = 4 * presenceInterval
+
+// pingInterval is how often MaintainPeers pings the peers in the peer table
+const pingInterval = 30 * time.Second
+
+// peerSmoothing is the weight of each new sample in a peer's smoothed RTT and throughput
+const peerSmoothing = 0.125
+
+// PeerStats is what the peer table knows about a peer. Peers are added when this daemon learns
+// which port they listen on: when they announce their presence or chunks they have, or answer a
+// discovery. They are forgotten when they leave or once they have been silent for a while.
+type PeerStats struct {
+	Address             netip.Addr
+	Port                uint16
+	LastSeen            time.Time     // when the peer last sent this daemon anything
+	RTT                 time.Duration // smoothed round trip time of pings. 0 if never measured
+	Throughput          float64       // smoothed speed of chunk downloads in bytes per second
+	Chunks              int           // chunks downloaded from the peer
+	Failures            int           // chunks that could not be downloaded from the peer
+	ConsecutiveFailures int           // failures since the last chunk that was downloaded
+}
+
+// Peers returns the peer table, ordered by address
+func (s *Server) Peers() []PeerStats {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	result := make([]PeerStats, 0, len(s.peers))
+	for _, p := range s.peers {
+		result = append(result, *p)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Address != result[j].Address {
+			return result[i].Address.Less(result[j].Address)
+		}
+		return result[i].Port < result[j].Port
+	})
+	return result
+}
+
+// MaintainPeers forgets peers that have been silent for too long, files discovered too long ago
+// and the bandwidth limits of peers not uploaded to for too long, and pings the remaining peers in
+// the background. It does so at most once every pingInterval, and is meant to be called regularly.
+func (s *Server) MaintainPeers() {
+	s.peerLock.Lock()
+	if time.Since(s.peersMaintainedAt) < pingInterval {
+		s.peerLock.Unlock()
+		return
+	}
+	s.peersMaintainedAt = time.Now()
+	peers := make([]peerKey, 0, len(s.peers))
+	for key, p := range s.peers {
+		if time.Since(p.LastSeen) > peerExpiry {
+			s.forgetPeerLocked(key)
+		} else {
+			peers = append(peers, key)
+		}
+	}
+	for hash, d := range s.discoveries {
+		if time.Since(d.at) > discoveryTTL {
+			delete(s.discoveries, hash)
+		}
+	}
+	s.peerLock.Unlock()
+	s.forgetIdleUploadBuckets()
+
+	for _, peer := range peers {
+		go s.Ping(peer.address, peer.port)
+	}
+}
+
+// seePeer records that a peer was just heard from, adding it to the peer table if it is new.
+// This daemon never adds itself.
+func (s *Server) seePeer(peer peerKey) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	s.seePeerLocked(peer)
+}
+
+func (s *Server) seePeerLocked(peer peerKey) {
+	if p, ok := s.peers[peer]; ok {
+		p.LastSeen = time.Now()
+		return
+	}
+	if s.isSelf(peer) {
+		return
+	}
+	s.peers[peer] = &PeerStats{Address: peer.address, Port: peer.port, LastSeen: time.Now()}
+}
+
+// seeAddress records that a message arrived from an address. Since messages are not always sent
+// from the port their sender listens on, every peer at the address is considered seen. Nobody is
+// added to the peer table, since the port the sender listens on is unknown.
+func (s *Server) seeAddress(ip netip.Addr) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	for key, p := range s.peers {
+		if key.address == ip {
+			p.LastSeen = time.Now()
+		}
+	}
+}
+
+// peersAt returns the peers in the peer table at an address, if any
+func (s *Server) peersAt(ip netip.Addr) []peerKey {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	result := []peerKey{}
+	for key := range s.peers {
+		if key.address == ip {
+			result = append(result, key)
+		}
+	}
+	return result
+}
+
+// recordRTT adds a round trip time measured to a peer to its smoothed RTT
+func (s *Server) recordRTT(peer peerKey, rtt time.Duration) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	s.seePeerLocked(peer)
+	if p, ok := s.peers[peer]; ok {
+		p.RTT = time.Duration(smooth(float64(p.RTT), float64(rtt)))
+	}
+}
+
+// recordChunk records that a chunk of the given size was downloaded from a peer in elapsed time
+func (s *Server) recordChunk(peer peerKey, size int, elapsed time.Duration) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	s.seePeerLocked(peer)
+	if p, ok := s.peers[peer]; ok && elapsed > 0 {
+		p.Throughput = smooth(p.Throughput, float64(size)/elapsed.Seconds())
+		p.Chunks++
+		p.ConsecutiveFailures = 0
+	}
+}
+
+// recordFailure records that a chunk could not be downloaded from a peer
+func (s *Server) recordFailure(peer peerKey) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	if p, ok := s.peers[peer]; ok {
+		p.Failures++
+		p.ConsecutiveFailures++
+	}
+}
+
+// peerStats returns what the peer table knows about each of the given peers. Peers it does not
+// know are missing from the result.
+func (s *Server) peerStats(peers []peerKey) map[peerKey]PeerStats {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	result := make(map[peerKey]PeerStats, len(peers))
+	for _, key := range peers {
+		if p, ok := s.peers[key]; ok {
+			result[key] = *p
+		}
+	}
+	return result
+}
+
+// smooth returns the exponentially weighted moving average of samples after adding sample to
+// average. An average of 0 means there were no samples before this one.
+func smooth(average, sample float64) float64 {
+	if average == 0 {
+		return sample
+	}
+	return (1-peerSmoothing)*average + peerSmoothing*sample
+}
+
+// fasterPeer returns true if a healthy, fast peer a should be asked for chunks before peer b.
+// Peers with fewer consecutive failures come first, then those that have downloaded faster, then
+// those with a shorter round trip time. Unmeasured throughput and RTT count as the worst.
+func fasterPeer(a, b PeerStats) bool {
+	if a.ConsecutiveFailures != b.ConsecutiveFailures {
+		return a.ConsecutiveFailures < b.ConsecutiveFailures
+	}
+	if a.Throughput != b.Throughput {
+		return a.Throughput > b.Throughput
+	}
+	if a.RTT != b.RTT {
+		return b.RTT == 0 || (a.RTT != 0 && a.RTT < b.RTT)
+	}
+	return false
+}
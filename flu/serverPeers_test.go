@@ -0,0 +1,102 @@
+package flu
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/flu-network/client/common"
+	"github.com/flu-network/client/flu/messages"
+)
+
+func TestPeerTable(t *testing.T) {
+	s := NewServer(61690, nil)
+	a := peerKey{address: netip.MustParseAddr("10.0.0.2"), port: 61690}
+	b := peerKey{address: netip.MustParseAddr("10.0.0.3"), port: 61691}
+
+	s.seePeer(a)
+	s.recordRTT(b, 20*time.Millisecond)
+	s.recordRTT(b, 100*time.Millisecond)
+	s.recordChunk(a, 1<<20, time.Second)
+	s.recordFailure(a)
+	s.recordFailure(a)
+	s.recordChunk(a, 3<<20, time.Second)
+	s.recordFailure(a)
+	// unknown peers are ignored
+	s.recordFailure(peerKey{address: netip.MustParseAddr("10.0.0.4"), port: 61690})
+
+	peers := s.Peers()
+	if len(peers) != 2 {
+		t.Fatalf("Expected 2 peers but got %v\n", peers)
+	}
+	if peers[0].Address != a.address || peers[0].Port != a.port {
+		t.Fatalf("Expected %v but got %v\n", a, peers[0])
+	}
+	if peers[0].Chunks != 2 || peers[0].Failures != 3 || peers[0].ConsecutiveFailures != 1 {
+		t.Fatalf("Unexpected counts %v\n", peers[0])
+	}
+	if expected := float64(1<<20)*7/8 + float64(3<<20)/8; peers[0].Throughput != expected {
+		t.Fatalf("Expected throughput %v but got %v\n", expected, peers[0].Throughput)
+	}
+	if expected := 30 * time.Millisecond; peers[1].RTT != expected {
+		t.Fatalf("Expected RTT %v but got %v\n", expected, peers[1].RTT)
+	}
+
+	// messages from an address keep its peers alive, but add none, since the port their sender
+	// listens on is unknown
+	s.peers[a].LastSeen = time.Now().Add(-time.Minute)
+	s.seeAddress(a.address)
+	s.seeAddress(netip.MustParseAddr("10.0.0.5"))
+	if peers := s.Peers(); len(peers) != 2 || time.Since(peers[0].LastSeen) > time.Second {
+		t.Fatalf("Expected the peer at the address to be seen and no other but got %v\n", peers)
+	}
+
+	// stale peers are forgotten
+	s.peers[a].LastSeen = time.Now().Add(-peerExpiry - time.Second)
+	s.peers[b].LastSeen = time.Now().Add(-peerExpiry - time.Second)
+	s.MaintainPeers()
+	if peers := s.Peers(); len(peers) != 0 {
+		t.Fatalf("Expected stale peers to be forgotten but got %v\n", peers)
+	}
+}
+
+func TestPickPeerPrefersFastHealthyPeers(t *testing.T) {
+	s := NewServer(61690, nil)
+	hash := common.Sha1Hash{}
+	// IPv4 and IPv6 peers alike
+	addresses := []netip.Addr{netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("fd00::3"),
+		netip.MustParseAddr("10.0.0.4"), netip.MustParseAddr("fe80::5%eth0")}
+	hosts := []*messages.DiscoverHostResponse{}
+	for _, address := range addresses {
+		hosts = append(hosts, &messages.DiscoverHostResponse{Address: address, Port: 61690,
+			Chunks: []uint32{0, 9}})
+		s.seePeer(peerKey{address: address, port: 61690})
+	}
+	key := func(i int) peerKey { return peerKey{address: addresses[i], port: 61690} }
+	sc := newScheduler(s, &hash, netip.MustParseAddr("10.0.0.1"), DefaultSchedulerConfig(), 10,
+		hosts)
+
+	expect := func(desc string, i int) {
+		peer, ok := sc.pickPeer(0, s.peerStats(sc.peerKeys()))
+		if !ok {
+			t.Fatal("Expected a peer to be picked")
+		}
+		if peer.address != addresses[i] {
+			t.Fatalf("%s: expected %v but got %v\n", desc, addresses[i], peer.address)
+		}
+	}
+
+	expect("nothing measured, first peer", 0)
+	s.recordRTT(key(2), 5*time.Millisecond)
+	s.recordRTT(key(3), time.Millisecond)
+	expect("lowest RTT", 3)
+	s.recordChunk(key(1), 1<<20, time.Second)
+	expect("any measured throughput beats RTT", 1)
+	s.recordChunk(key(2), 4<<20, time.Second)
+	expect("highest throughput", 2)
+	s.recordFailure(key(2))
+	expect("failing peers last", 1)
+	sc.peerLoad[key(1)] = 1
+	s.recordChunk(key(0), 1<<20, time.Second)
+	expect("ties go to the least loaded", 0)
+}
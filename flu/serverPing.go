@@ -0,0 +1,66 @@
+package flu
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/flu-network/client/flu/messages"
+)
+
+// pingTimeout is how long Ping waits for an answer
+const pingTimeout = 2 * time.Second
+
+// Ping measures the round trip time to a peer and records it in the peer table. Peers that do not
+// support pings are not sent one; an error is returned instead.
+func (s *Server) Ping(addr netip.Addr, port uint16) (time.Duration, error) {
+	if err := s.requireCapabilities(addr, port, messages.CapPing); err != nil {
+		return 0, err
+	}
+
+	targetAddr := udpAddrOf(addr, port)
+	conn, err := net.DialUDP("udp", nil, targetAddr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	req := messages.PingRequest{RequestID: s.generateRequestID()}
+	start := time.Now()
+	if err := conn.SetReadDeadline(start.Add(pingTimeout)); err != nil {
+		return 0, err
+	}
+	if _, err := conn.Write(req.Serialize()); err != nil {
+		return 0, err
+	}
+
+	buffer := make([]byte, messages.MaxDatagramSize)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return 0, fmt.Errorf("%v did not respond to ping: %v", targetAddr.IP, err)
+		}
+		msg, err := messages.Parse(buffer[:n])
+		if err != nil {
+			s.countDropped(err)
+			continue
+		}
+		if res, ok := msg.(*messages.PingResponse); ok && res.RequestID == req.RequestID {
+			rtt := time.Since(start)
+			s.recordRTT(peerKey{address: addr, port: port}, rtt)
+			return rtt, nil
+		}
+	}
+}
+
+// RespondToPing answers a ping straight away
+func (s *Server) RespondToPing(
+	req *messages.PingRequest,
+	conn *net.UDPConn,
+	returnAddr *net.UDPAddr,
+) error {
+	resp := messages.PingResponse{RequestID: req.RequestID}
+	_, err := conn.WriteToUDP(resp.Serialize(), returnAddr)
+	return err
+}
@@ -0,0 +1,158 @@
+package flu
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/flu-network/client/common"
+	"github.com/flu-network/client/flu/messages"
+)
+
+// presenceInterval is how often a daemon announces that it is still running
+const presenceInterval = 30 * time.Second
+
+// discoveryTTL is how long what the hosts on the network were found to have of a file is trusted
+// before DiscoverHosts probes the network for it again
+const discoveryTTL = time.Minute
+
+// discovery is what a probe found out about which hosts have a file. Have announcements keep it up
+// to date until it expires.
+type discovery struct {
+	at    time.Time
+	hosts map[peerKey][]uint32 // the chunks each host has, as inclusive [start, end] pairs
+}
+
+// AnnouncePresence broadcasts that this daemon is running, at most once every presenceInterval.
+// The first announcement says that it is joining, so that the hosts that hear it reply at once.
+// It is meant to be called regularly.
+func (s *Server) AnnouncePresence() {
+	s.peerLock.Lock()
+	if time.Since(s.presenceAnnouncedAt) < presenceInterval {
+		s.peerLock.Unlock()
+		return
+	}
+	status := messages.PresenceAlive
+	if s.presenceAnnouncedAt.IsZero() {
+		status = messages.PresenceJoining
+	}
+	s.presenceAnnouncedAt = time.Now()
+	s.peerLock.Unlock()
+
+	announcement := messages.PresenceAnnouncement{Port: uint16(s.port), Status: status}
+	if err := s.broadcast(announcement.Serialize()); err != nil {
+		fmt.Printf("Failed to announce presence: %v\n", err)
+	}
+}
+
+// Leave broadcasts that this daemon is shutting down, so that other hosts forget it straight away
+func (s *Server) Leave() error {
+	announcement := messages.PresenceAnnouncement{
+		Port:   uint16(s.port),
+		Status: messages.PresenceLeaving,
+	}
+	return s.broadcast(announcement.Serialize())
+}
+
+// RespondToPresence adds hosts that join or announce themselves to the peer table, and removes
+// those that leave, abandoning any chunks being downloaded from them. Hosts that join are told
+// about this daemon straight away.
+func (s *Server) RespondToPresence(
+	msg *messages.PresenceAnnouncement,
+	returnAddr *net.UDPAddr,
+) error {
+	ip, err := addrOf(returnAddr)
+	if err != nil {
+		return err
+	}
+	peer := peerKey{address: ip, port: msg.Port}
+	if s.isSelf(peer) {
+		return nil // our own broadcast
+	}
+
+	if msg.Status == messages.PresenceLeaving {
+		s.peerLock.Lock()
+		s.forgetPeerLocked(peer)
+		s.peerLock.Unlock()
+		s.abandonDownloadsFrom(peer)
+		return nil
+	}
+
+	s.peerLock.Lock()
+	if _, ok := s.peers[peer]; !ok {
+		// a new host may have any file, so what was found out about files no longer holds
+		s.discoveries = make(map[common.Sha1Hash]*discovery)
+	}
+	s.seePeerLocked(peer)
+	s.peerLock.Unlock()
+
+	if msg.Status == messages.PresenceJoining {
+		reply := messages.PresenceAnnouncement{Port: uint16(s.port), Status: messages.PresenceAlive}
+		return s.sendToPeerAt(ip, msg.Port, reply.Serialize())
+	}
+	return nil
+}
+
+// forgetPeerLocked removes a peer from the peer table and from everything discovered about it.
+// The caller must hold peerLock.
+func (s *Server) forgetPeerLocked(peer peerKey) {
+	delete(s.peers, peer)
+	for _, d := range s.discoveries {
+		delete(d.hosts, peer)
+	}
+}
+
+// recordDiscovery remembers which hosts were found to have a file, except for this daemon, whose
+// own chunks are always looked up afresh
+func (s *Server) recordDiscovery(hash *common.Sha1Hash, hosts []messages.DiscoverHostResponse) {
+	d := &discovery{at: time.Now(), hosts: make(map[peerKey][]uint32, len(hosts))}
+	for _, host := range hosts {
+		key := peerKey{address: host.Address, port: host.Port}
+		if !s.isSelf(key) {
+			d.hosts[key] = host.Chunks
+		}
+	}
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	s.discoveries[*hash] = d
+}
+
+// discoverHave adds the chunks a peer announced to what it was found to have of a file, if the
+// file was discovered recently
+func (s *Server) discoverHave(hash *common.Sha1Hash, peer peerKey, chunks []uint32) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	if d, ok := s.discoveries[*hash]; ok {
+		d.hosts[peer] = unionRanges(d.hosts[peer], chunks)
+	}
+}
+
+// cachedHosts returns every live host in the peer table, along with the chunks of the file each
+// was last found to have, as DiscoverHosts would. Returns false if the file was not discovered in
+// the last discoveryTTL, since nothing is known about who has it.
+func (s *Server) cachedHosts(hash *common.Sha1Hash) ([]messages.DiscoverHostResponse, bool) {
+	s.peerLock.Lock()
+	d, ok := s.discoveries[*hash]
+	if !hash.IsBlank() && (!ok || time.Since(d.at) > discoveryTTL) {
+		s.peerLock.Unlock()
+		return nil, false
+	}
+	result := make([]messages.DiscoverHostResponse, 0, len(s.peers)+1)
+	for key, p := range s.peers {
+		if time.Since(p.LastSeen) > peerExpiry {
+			continue
+		}
+		host := messages.DiscoverHostResponse{Address: key.address, Port: key.port,
+			Chunks: []uint32{}}
+		if d != nil && d.hosts[key] != nil {
+			host.Chunks = d.hosts[key]
+		}
+		result = append(result, host)
+	}
+	s.peerLock.Unlock()
+
+	if ownIP := s.LocalIP(); ownIP.IsValid() {
+		result = append(result, s.discoverHostResponse(hash, nil, ownIP))
+	}
+	return result, true
+}
@@ -0,0 +1,115 @@
+package flu
+
+import (
+	"net"
+	"net/netip"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/flu-network/client/catalogue"
+	"github.com/flu-network/client/common"
+	"github.com/flu-network/client/flu/messages"
+)
+
+func TestPresence(t *testing.T) {
+	s := NewServer(61690, nil)
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	port := uint16(listener.LocalAddr().(*net.UDPAddr).Port)
+	peer := peerKey{address: netip.MustParseAddr("127.0.0.1"), port: port}
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+	s.discoveries[common.Sha1Hash{}] = &discovery{at: time.Now()}
+
+	// a joining host is added, and told about this one straight away
+	join := &messages.PresenceAnnouncement{Port: port, Status: messages.PresenceJoining}
+	if err := s.RespondToPresence(join, from); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.peers[peer]; !ok {
+		t.Fatalf("Expected the joining host to be in the peer table but got %v\n", s.Peers())
+	}
+	if len(s.discoveries) != 0 {
+		t.Fatal("Expected a joining host to invalidate discovered files")
+	}
+	buffer := make([]byte, messages.MaxDatagramSize)
+	listener.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := listener.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := messages.Parse(buffer[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &messages.PresenceAnnouncement{Port: 61690, Status: messages.PresenceAlive}
+	if !reflect.DeepEqual(reply, expected) {
+		t.Fatalf("Expected reply %v but got %v\n", expected, reply)
+	}
+
+	// a leaving host is forgotten
+	leave := &messages.PresenceAnnouncement{Port: port, Status: messages.PresenceLeaving}
+	if err := s.RespondToPresence(leave, from); err != nil {
+		t.Fatal(err)
+	}
+	if peers := s.Peers(); len(peers) != 0 {
+		t.Fatalf("Expected the leaving host to be forgotten but got %v\n", peers)
+	}
+}
+
+func TestCachedDiscovery(t *testing.T) {
+	dir := t.TempDir()
+	cat, err := catalogue.NewCat(filepath.Join(dir, "catalogue"), filepath.Join(dir, "downloads"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cat.Init(); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(61690, cat)
+	if !s.LocalIP().IsValid() {
+		t.Skip("no network interface to discover hosts on")
+	}
+	hash := common.Sha1Hash{}
+	seeder := peerKey{address: netip.MustParseAddr("10.0.0.2"), port: 61690}
+	leecher := peerKey{address: netip.MustParseAddr("10.0.0.3"), port: 61691}
+	s.seePeer(seeder)
+	s.seePeer(leecher)
+
+	// hosts are known without a discovery, but not what they have
+	if hosts, ok := s.cachedHosts((&common.Sha1Hash{}).Blank()); !ok || len(hosts) != 3 {
+		t.Fatalf("Expected both peers and this daemon but got %v\n", hosts)
+	}
+	if _, ok := s.cachedHosts(&hash); ok {
+		t.Fatal("Expected an undiscovered file to need a probe")
+	}
+
+	s.recordDiscovery(&hash, []messages.DiscoverHostResponse{
+		{Address: seeder.address, Port: seeder.port, Chunks: []uint32{0, 9}},
+		{Address: leecher.address, Port: leecher.port, Chunks: []uint32{}},
+	})
+	s.discoverHave(&hash, leecher, []uint32{4, 4})
+	s.discoverHave(&hash, leecher, []uint32{5, 5})
+	start := time.Now()
+	hosts := s.DiscoverHosts(&hash, nil, false)
+	if time.Since(start) > time.Second {
+		t.Fatal("Expected a discovered file to be looked up without probing")
+	}
+	chunks := make(map[peerKey][]uint32)
+	for _, host := range hosts {
+		chunks[peerKey{address: host.Address, port: host.Port}] = host.Chunks
+	}
+	if len(chunks) != 3 || !reflect.DeepEqual(chunks[seeder], []uint32{0, 9}) ||
+		!reflect.DeepEqual(chunks[leecher], []uint32{4, 5}) {
+		t.Fatalf("Unexpected cached hosts %v\n", hosts)
+	}
+
+	s.discoveries[hash].at = time.Now().Add(-discoveryTTL - time.Second)
+	if _, ok := s.cachedHosts(&hash); ok {
+		t.Fatal("Expected an expired discovery to need a probe")
+	}
+}
@@ -0,0 +1,88 @@
+package flu
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/flu-network/client/common"
+	"github.com/flu-network/client/flu/picker"
+)
+
+// Bounds on how long to wait before retrying a download that has no peers
+const minResumeBackoff = 5 * time.Second
+const maxResumeBackoff = 5 * time.Minute
+
+// ResumeIncompleteDownloads restarts every download in the catalogue that is neither complete nor
+// paused, using the same scheduler as StartDownload. Files that have no peers right now are
+// retried in the background with exponential backoff until a peer shows up or the download is
+// paused or cancelled. Intended to be called once, when the daemon starts.
+func (s *Server) ResumeIncompleteDownloads() error {
+	files, err := s.cat.ListFiles()
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if f.Progress.Full() || f.Paused {
+			continue
+		}
+
+		hash := f.Sha1Hash
+		ctx, cancel := context.WithCancel(context.Background())
+		s.transferLock.Lock()
+		s.resuming[hash] = cancel
+		s.transferLock.Unlock()
+
+		go func() {
+			s.resumeWithBackoff(ctx, &hash)
+			s.transferLock.Lock()
+			delete(s.resuming, hash)
+			s.transferLock.Unlock()
+			cancel()
+		}()
+	}
+
+	return nil
+}
+
+// resumeWithBackoff tries to start the download until it succeeds or ctx is cancelled, doubling
+// the wait between attempts.
+func (s *Server) resumeWithBackoff(ctx context.Context, hash *common.Sha1Hash) {
+	backoff := minResumeBackoff
+	for {
+		err := s.startDownload(ctx, hash, picker.Default, nil)
+		if ctx.Err() != nil {
+			return // paused or cancelled while we were looking for peers
+		}
+		if err == nil {
+			fmt.Printf("Resumed download: %v\n", hash)
+			return
+		}
+		fmt.Printf("Could not resume %v (retrying in %v): %v\n", hash, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.after(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxResumeBackoff {
+			backoff = maxResumeBackoff
+		}
+	}
+}
+
+// stopResuming stops retrying to resume the specified download, and reports whether it was
+// being retried.
+func (s *Server) stopResuming(hash *common.Sha1Hash) bool {
+	s.transferLock.Lock()
+	defer s.transferLock.Unlock()
+	cancel, ok := s.resuming[*hash]
+	if ok {
+		cancel()
+		delete(s.resuming, *hash)
+	}
+	return ok
+}
@@ -0,0 +1,109 @@
+package flu
+
+import (
+	"crypto/sha1"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/flu-network/client/common"
+)
+
+// expectRetry waits for a download to be retried after the given wait, and lets the wait pass
+func expectRetry(t *testing.T, clock *fakeClock, wait time.Duration) {
+	eventually(t, "a retry to be scheduled", func() bool { return len(clock.waits()) == 1 })
+	if waits := clock.waits(); !reflect.DeepEqual(waits, []time.Duration{wait}) {
+		t.Fatalf("Expected to retry in %v but got %v\n", wait, waits)
+	}
+	clock.advance(wait)
+}
+
+func TestResumeIncompleteDownloads(t *testing.T) {
+	s, hash := newTestDownload(t, 8)
+	if !s.LocalIP().IsValid() {
+		t.Skip("no network interface to download over")
+	}
+	clock := &fakeClock{t: time.Now()}
+	s.after = clock.after
+	paused := &common.Sha1Hash{Data: sha1.Sum([]byte("paused"))}
+	if _, err := s.cat.RegisterDownload(8, 2, testChunkSize, paused, "paused.bin", nil,
+		nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.cat.SetPaused(paused, true); err != nil {
+		t.Fatal(err)
+	}
+	s.recordDiscovery(hash, nil) // nobody has the file yet
+
+	if err := s.ResumeIncompleteDownloads(); err != nil {
+		t.Fatal(err)
+	}
+	s.transferLock.Lock()
+	_, resuming := s.resuming[*hash]
+	_, resumingPaused := s.resuming[*paused]
+	s.transferLock.Unlock()
+	if !resuming || resumingPaused {
+		t.Fatalf("Expected only the unpaused download to be resumed but got %v, %v\n",
+			resuming, resumingPaused)
+	}
+
+	// the wait between retries doubles, up to a limit
+	for _, wait := range []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second,
+		40 * time.Second, 80 * time.Second, 160 * time.Second, 5 * time.Minute, 5 * time.Minute} {
+		expectRetry(t, clock, wait)
+	}
+
+	// until a peer turns up
+	eventually(t, "a retry to be scheduled", func() bool { return len(clock.waits()) == 1 })
+	newStubPeers(s, hash, 8, 1)
+	expectRetry(t, clock, maxResumeBackoff)
+	eventually(t, "the download to be resumed", func() bool {
+		s.transferLock.Lock()
+		defer s.transferLock.Unlock()
+		return len(s.resuming) == 0
+	})
+	eventually(t, "the download to complete", func() bool {
+		complete, _ := s.cat.FileComplete(hash)
+		return complete
+	})
+	if len(clock.waits()) != 0 {
+		t.Fatalf("Expected no more retries but got %v\n", clock.waits())
+	}
+}
+
+func TestStopResuming(t *testing.T) {
+	stops := map[string]func(s *Server, hash *common.Sha1Hash) error{
+		"pause":  (*Server).PauseDownload,
+		"cancel": func(s *Server, hash *common.Sha1Hash) error { return s.CancelDownload(hash, false) },
+	}
+	for name, stop := range stops {
+		t.Run(name, func(t *testing.T) {
+			s, hash := newTestDownload(t, 8)
+			clock := &fakeClock{t: time.Now()}
+			s.after = clock.after
+			s.recordDiscovery(hash, nil)
+			if err := s.ResumeIncompleteDownloads(); err != nil {
+				t.Fatal(err)
+			}
+			eventually(t, "a retry to be scheduled", func() bool { return len(clock.waits()) == 1 })
+
+			if err := stop(s, hash); err != nil {
+				t.Fatal(err)
+			}
+			s.transferLock.Lock()
+			resuming := len(s.resuming)
+			s.transferLock.Unlock()
+			if resuming != 0 {
+				t.Fatal("Expected the download to stop being resumed")
+			}
+
+			// a peer turning up makes no difference
+			newStubPeers(s, hash, 8, 1)
+			clock.advance(maxResumeBackoff)
+			time.Sleep(50 * time.Millisecond)
+			if s.isDownloading(hash) || len(clock.waits()) != 0 {
+				t.Fatalf("Expected no more retries but got %v\n", clock.waits())
+			}
+		})
+	}
+}
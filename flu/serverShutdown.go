@@ -0,0 +1,65 @@
+package flu
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errShuttingDown is returned when a transfer is asked for after Shutdown was called
+var errShuttingDown = errors.New("the daemon is shutting down")
+
+// Shutdown stops every transfer and tells the network this daemon is leaving. Downloads are
+// stopped without being paused, so they are resumed when the daemon next starts, and their senders
+// are told to stop sending. Uploads are abandoned, and the hosts receiving them give up on them
+// when they hear that this daemon has left. No transfers can be started afterwards. Blocks until
+// every transfer has stopped, after which nothing more is written to the catalogue.
+func (s *Server) Shutdown() error {
+	s.transferLock.Lock()
+	s.closing = true
+	for hash, cancel := range s.resuming {
+		cancel()
+		delete(s.resuming, hash)
+	}
+	schedulers := make([]*scheduler, 0, len(s.schedulers))
+	for _, sched := range s.schedulers {
+		schedulers = append(schedulers, sched)
+	}
+	uploads := make([]*SenderConnection, 0, len(s.uploads))
+	for _, sc := range s.uploads {
+		uploads = append(uploads, sc)
+	}
+	s.transferLock.Unlock()
+
+	// every scheduler abandons its in-flight chunks at once, so stop them all before waiting
+	for _, sched := range schedulers {
+		sched.cancel()
+	}
+	for _, sched := range schedulers {
+		<-sched.stopped
+	}
+	for _, sc := range uploads {
+		sc.terminate()
+	}
+	for _, sc := range uploads {
+		<-sc.done
+	}
+
+	if err := s.Leave(); err != nil {
+		return fmt.Errorf("stopped %d downloads and %d uploads but could not say so: %v",
+			len(schedulers), len(uploads), err)
+	}
+	return nil
+}
+
+// abandonDownloadsFrom closes the connections of every chunk being downloaded from a peer, so that
+// their schedulers ask other peers for them straight away instead of waiting for the connections
+// to time out
+func (s *Server) abandonDownloadsFrom(peer peerKey) {
+	s.transferLock.Lock()
+	defer s.transferLock.Unlock()
+	for key, conn := range s.downloads {
+		if key.remoteHost == peer {
+			conn.Close() // the peer has gone, so there is no point telling it to stop
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package flu
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/flu-network/client/catalogue"
+	"github.com/flu-network/client/common"
+	"github.com/flu-network/client/flu/messages"
+)
+
+func TestShutdown(t *testing.T) {
+	dir := t.TempDir()
+	cat, err := catalogue.NewCat(filepath.Join(dir, "catalogue"), filepath.Join(dir, "downloads"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cat.Init(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "file.bin")
+	if err := os.WriteFile(path, bytes.Repeat([]byte("flu"), 1<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := cat.ShareFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(61690, cat)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	receiver, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+	to := receiver.LocalAddr().(*net.UDPAddr)
+
+	// an upload that is never acknowledged, and a download that is waiting for peers
+	open := &messages.OpenConnectionRequest{Sha1Hash: &rec.Sha1Hash, Chunk: 0, WindowCap: 4}
+	if err := s.StartUpload(open, conn, to); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.resuming[common.Sha1Hash{}] = cancel
+
+	done := make(chan error)
+	go func() {
+		done <- s.Shutdown()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Log(err) // there may be no network to say goodbye on
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Shutdown to return once every transfer has stopped")
+	}
+	if ctx.Err() == nil || len(s.resuming) != 0 {
+		t.Fatal("Expected downloads waiting for peers to stop being resumed")
+	}
+	if err := s.StartUpload(open, conn, to); !errors.Is(err, errShuttingDown) {
+		t.Fatalf("Expected no uploads to start after Shutdown but got %v\n", err)
+	}
+	if rec, err := cat.Contains(&rec.Sha1Hash); err != nil || rec.Paused {
+		t.Fatalf("Expected Shutdown to leave downloads unpaused but got %v, %v\n", rec, err)
+	}
+}
+
+func TestLeavingPeerAbandonsDownloads(t *testing.T) {
+	s := NewServer(61690, nil)
+	peer := peerKey{address: netip.MustParseAddr("127.0.0.1"), port: 50001}
+	other := peerKey{address: netip.MustParseAddr("127.0.0.1"), port: 50002}
+	conns := make(map[peerKey]*RecvConnection)
+	for _, p := range []peerKey{peer, other} {
+		udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[p] = &RecvConnection{conn: udp, closed: make(chan struct{})}
+		defer conns[p].Close()
+		s.downloads[downloadKey{remoteHost: p}] = conns[p]
+	}
+
+	leave := &messages.PresenceAnnouncement{Port: peer.port, Status: messages.PresenceLeaving}
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+	if err := s.RespondToPresence(leave, from); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := conns[peer].Read(); ok {
+		t.Fatal("Expected the download from the leaving peer to be abandoned")
+	}
+	select {
+	case <-conns[other].closed:
+		t.Fatal("Expected downloads from other peers to carry on")
+	default:
+	}
+}
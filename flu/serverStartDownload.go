@@ -1,28 +1,63 @@
 package flu
 
 import (
+	"context"
 	"crypto/sha1"
+	"errors"
 	"fmt"
+	"net/netip"
 	"time"
 
+	"github.com/flu-network/client/catalogue"
 	"github.com/flu-network/client/common"
 	"github.com/flu-network/client/flu/messages"
+	"github.com/flu-network/client/flu/picker"
+	"github.com/flu-network/client/flu/ratelimit"
 )
 
+// errWrongFile is returned when a complete download does not match the hash it was downloaded by
+var errWrongFile = errors.New("downloaded the wrong file")
+
 // StartDownload creates a progressfile for the specified file, adds it to the catalogue, and
 // begins the download. A name for the file is chosen arbitrarily from one of the hosts who have
-// that file.
-func (s *Server) StartDownload(hash *common.Sha1Hash) error {
+// that file. Chunks are requested in the order dictated by policy; picker.Default uses the
+// policy in the server's SchedulerConfig. merkleRoot is optional: if given, it is trusted over
+// anything peers say, and every chunk is verified against it before it is saved.
+func (s *Server) StartDownload(
+	hash *common.Sha1Hash,
+	policy picker.Policy,
+	merkleRoot *common.Sha1Hash,
+) error {
+	return s.startDownload(context.Background(), hash, policy, merkleRoot)
+}
+
+// startDownload is StartDownload, except that it gives up without starting anything if ctx is
+// cancelled before the download begins.
+func (s *Server) startDownload(
+	ctx context.Context,
+	hash *common.Sha1Hash,
+	policy picker.Policy,
+	merkleRoot *common.Sha1Hash,
+) error {
+	if s.isDownloading(hash) {
+		return nil
+	}
+
 	extantRecord, _ := s.cat.Contains(hash)
+	if extantRecord != nil && merkleRoot != nil {
+		if err := s.cat.SetMerkleRoot(hash, merkleRoot); err != nil {
+			return err
+		}
+		extantRecord, _ = s.cat.Contains(hash)
+	}
 
 	ownIP := s.LocalIP()
-	ownIPV4, err := newIpv4(ownIP)
-	if err != nil {
-		return err
+	if !ownIP.IsValid() {
+		return fmt.Errorf("no network interface to download %v over", hash)
 	}
 
 	// list hosts that know of this file
-	goodHosts := s.getGoodHosts(hash, []uint16{}, ownIPV4)
+	goodHosts := s.getGoodHosts(hash, []uint32{}, ownIP)
 	if len(goodHosts) == 0 {
 		return fmt.Errorf("no good hosts found for hash %v", hash)
 	}
@@ -34,52 +69,168 @@ func (s *Server) StartDownload(hash *common.Sha1Hash) error {
 		if err != nil {
 			return err
 		}
+		chunkCount := int(fileMeta.ChunkCount)
+		chunkHashes := s.fetchChunkHashes(hash, chunkCount, goodHosts, merkleRoot, nil)
+		if chunkHashes == nil && merkleRoot == nil {
+			// proofs against a root from a peer at least keep other peers from corrupting chunks
+			merkleRoot = s.fetchMerkleRoot(hash, chunkCount, goodHosts, nil)
+		}
+		if chunkHashes == nil && merkleRoot != nil {
+			fmt.Printf("Chunks of %v will be verified against merkle root %v\n", hash, merkleRoot)
+		}
 		extantRecord, err = s.cat.RegisterDownload(
 			fileMeta.SizeInBytes,
 			fileMeta.ChunkCount,
 			fileMeta.ChunkSizeInBytes,
 			fileMeta.Sha1Hash,
 			fileMeta.FileName,
+			chunkHashes,
+			merkleRoot,
 		)
 		if err != nil {
 			return err
 		}
+	} else if !extantRecord.HasChunkHashes && !extantRecord.Progress.Full() {
+		// downloads registered before chunk hashes existed can still be checked from now on
+		chunkHashes := s.fetchChunkHashes(hash, extantRecord.Progress.Size(), goodHosts,
+			extantRecord.MerkleRoot, nil)
+		if chunkHashes != nil {
+			if err := s.cat.SetChunkHashes(hash, chunkHashes); err != nil {
+				return err
+			}
+		}
+	}
+
+	// if this file started downloading while we were busy discovering, leave that download alone
+	s.transferLock.Lock()
+	defer s.transferLock.Unlock()
+	if _, ok := s.schedulers[*hash]; ok {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if s.closing {
+		return errShuttingDown
+	}
+
+	cfg := s.schedulerConfig
+	if policy != picker.Default {
+		cfg.Policy = policy
+	}
+	// explicitly getting a paused file resumes it
+	if err := s.cat.SetPaused(hash, false); err != nil {
+		return err
 	}
+	delete(s.paused, *hash)
 
-	go func() { // TODO: make interruptiple with a channel
-		for !s.cat.FileComplete(hash) {
+	chunkCount := extantRecord.Progress.Size()
+	sched := newScheduler(s, hash, ownIP, cfg, chunkCount, goodHosts)
+	s.schedulers[*hash] = sched
 
-			// MARK: MASSIVE HACK. Fix this first!
-			wantedChunks := s.cat.MissingChunks(hash, 1) // TOOD: something much better than just
-			// getting the next wanted chunk. This runs the entire download serially!
-			// Find the least-known chunk from each host and download them
-			c := wantedChunks[0]
-			goodHosts = s.getGoodHosts(hash, []uint16{c.Start, c.End}, ownIPV4)
+	go func() {
+		sched.run()
+		s.forgetScheduler(sched)
+	}()
 
-			// we should really make a slice of host,chunk pairs.
-			for _, hostResponse := range goodHosts {
-				ip, port := hostResponse.Address, hostResponse.Port
-				key := downloadKey{hash: *hash, remoteHost: hostResponse.Address}
+	return nil
+}
 
-				// start downloading from this host if not doing that already
-				s.transferLock.Lock()
-				if _, ok := s.downloads[key]; !ok {
-					fmt.Printf("Getting chunk: %v\n", c.Start)
-					s.downloads[key] = struct{}{}
-					s.downloadChunk(ip, port, hash, c.Start) // TODO: make concurrent
-				}
-				s.transferLock.Unlock()
-			}
+// fetchChunkHashes fetches the hash of every chunk of a file from the first of hosts able to supply
+// them. If merkleRoot is given, chunk hashes that do not match it are ignored. So are chunk hashes
+// whose merkle root is rejected, if given, which are known not to be the file's. Returns nil
+// (after saying so) if no host can supply them, in which case chunks can only be checked against
+// the merkle root, if any, or else the hash their sender claims for them.
+func (s *Server) fetchChunkHashes(
+	hash *common.Sha1Hash,
+	chunkCount int,
+	hosts []*messages.DiscoverHostResponse,
+	merkleRoot *common.Sha1Hash,
+	rejected *common.Sha1Hash,
+) []common.Sha1Hash {
+	for _, host := range hosts {
+		err := s.requireCapabilities(host.Address, host.Port, messages.CapChunkHashes)
+		if err != nil {
+			fmt.Println(err)
+			continue
 		}
-		fmt.Println("Download complete")
-	}()
+		chunkHashes, err := s.FetchChunkHashes(host.Address, host.Port, hash, chunkCount)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		if merkleRoot != nil && *common.MerkleRoot(chunkHashes) != *merkleRoot {
+			fmt.Printf("%v sent chunk hashes for %v that do not match merkle root %v\n",
+				host.Address, hash, merkleRoot)
+			continue
+		}
+		if rejected != nil && *common.MerkleRoot(chunkHashes) == *rejected {
+			fmt.Printf("%v sent the wrong chunk hashes for %v\n", host.Address, hash)
+			continue
+		}
+		return chunkHashes
+	}
+	fmt.Printf("No peer could supply chunk hashes for %v\n", hash)
+	return nil
+}
 
+// verifyDownload checks that a complete download matches the hash it was downloaded by. Chunks are
+// only ever checked against chunk hashes or a merkle root supplied by peers, so a peer that
+// supplied the wrong ones can get the wrong file past them, but not past this.
+func (s *Server) verifyDownload(hash *common.Sha1Hash) error {
+	actual, err := s.cat.Rehash(hash)
+	if err != nil {
+		return err
+	}
+	if actual.Data != hash.Data {
+		return fmt.Errorf("%w: the downloaded file has hash %v instead of %v", errWrongFile,
+			actual, hash)
+	}
 	return nil
 }
 
+// restartDownload throws away a download that did not match its hash, along with the chunk hashes
+// or merkle root its chunks were checked against, which cannot be the file's. They are fetched
+// again from hosts, ignoring any that supply the same ones again.
+func (s *Server) restartDownload(
+	hash *common.Sha1Hash,
+	hosts []*messages.DiscoverHostResponse,
+) error {
+	rec, err := s.cat.Contains(hash)
+	if err != nil {
+		return err
+	}
+	chunkCount := rec.Progress.Size()
+	chunkHashes := s.fetchChunkHashes(hash, chunkCount, hosts, nil, rec.MerkleRoot)
+	var merkleRoot *common.Sha1Hash
+	if chunkHashes == nil {
+		merkleRoot = s.fetchMerkleRoot(hash, chunkCount, hosts, rec.MerkleRoot)
+	}
+	return s.cat.RestartDownload(hash, chunkHashes, merkleRoot)
+}
+
+// forgetScheduler removes a scheduler that has stopped running, unless it has already been
+// replaced by another one.
+func (s *Server) forgetScheduler(sched *scheduler) {
+	s.transferLock.Lock()
+	defer s.transferLock.Unlock()
+	if s.schedulers[*sched.hash] == sched {
+		delete(s.schedulers, *sched.hash)
+		s.forgetDownloadBucket(sched.hash)
+	}
+}
+
+// isDownloading returns true if a scheduler is already running for the given file
+func (s *Server) isDownloading(hash *common.Sha1Hash) bool {
+	s.transferLock.Lock()
+	defer s.transferLock.Unlock()
+	_, ok := s.schedulers[*hash]
+	return ok
+}
+
 func (s *Server) downloadMetaData(
 	hash *common.Sha1Hash,
-	addr [4]byte,
+	addr netip.Addr,
 	port uint16,
 ) (*messages.ListFilesEntry, error) {
 	fileMetaList, err := s.ListFilesOnHost(addr, port, hash)
@@ -94,66 +245,153 @@ func (s *Server) downloadMetaData(
 	return &fileMeta, nil
 }
 
-func (s *Server) downloadChunk(ip [4]byte, port uint16, sha1Hash *common.Sha1Hash, chunk uint16) {
-	conn, err := DialPeer(ip, port, sha1Hash, chunk)
+// downloadChunk downloads a single chunk from a single peer and saves it to the catalogue. It
+// blocks until the chunk is saved, the connection fails or ctx is cancelled. If ctx is cancelled
+// the peer is told to stop sending and ctx.Err() is returned.
+func (s *Server) downloadChunk(
+	ctx context.Context,
+	ip netip.Addr,
+	port uint16,
+	sha1Hash *common.Sha1Hash,
+	chunk uint32,
+) error {
+	// a peer that cannot be asked still gets cumulative acks, which every version understands
+	capabilities, _ := s.capabilities(ip, port)
+
+	conn, err := DialPeer(ip, port, sha1Hash, chunk, s.TransferConfig(), s.countDropped)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Cancel()
+		case <-conn.closed:
+		}
+	}()
+
+	key := downloadKey{hash: *sha1Hash, remoteHost: peerKey{address: ip, port: port}, chunk: chunk}
+	s.transferLock.Lock()
+	s.downloads[key] = conn
+	s.transferLock.Unlock()
+	defer func() {
+		s.transferLock.Lock()
+		delete(s.downloads, key)
+		s.transferLock.Unlock()
+	}()
+
+	// the peer says how long the chunk is, but we know better
+	length, err := s.cat.ChunkLength(sha1Hash, chunk)
 	if err != nil {
-		panic(err) // TODO: log somewhere and move on...
+		return err
 	}
 
 	start := time.Now()
+	buckets := s.downloadBuckets(sha1Hash)
+	scoreboard := sackScoreboard{cumulativeOnly: !capabilities.Has(messages.CapSelectiveAck)}
+	early := make(map[uint32][]byte) // data that arrived before the 0-offset packet
+	earlyBytes := 0                  // held in early, which never holds more than the chunk
 
-	for { // returns false when done or errored
+	for {
 		packet, ok := conn.Read() // blocks execution
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if !ok {
-			break
+			return fmt.Errorf("connection to %v:%d closed before chunk %d completed", ip, port, chunk)
+		}
+		// holding back the ack slows the sender down to the download limit
+		if err := ratelimit.Wait(ctx, len(packet.Data), buckets...); err != nil {
+			return err
 		}
 
+		data := packet.Data
 		if packet.Offset == 0 {
 			// By convention the 0-offset packet contains the hash and chunk size
-			hash, size, data := packet.Split()
-			conn.hash = hash
-			conn.buffer = make([]byte, size)
-			copy(conn.buffer, data) // start at zero offset
-			conn.bytesReceived += len(data)
-		} else {
-			conn.bytesReceived += len(packet.Data)
-			if len(packet.Data) > 0 {
-				copy(conn.buffer[packet.Offset:], packet.Data)
-			} else {
-				// empty packet == download complete
-				hash := sha1.New()
-				hash.Write(conn.buffer)
-				finalHash := (&common.Sha1Hash{}).FromSlice(hash.Sum(nil))
-				if finalHash.Data != conn.hash.Data {
-					// TODO: Handle this a little more gracefully...
-					fmt.Println("Sha1 hashes did not match. Download was corrupted. Retrying.")
+			if len(packet.Data) < firstPacketHeaderSize {
+				return fmt.Errorf("chunk %d: malformed 0-offset packet", chunk)
+			}
+			hash, size, firstData := packet.Split()
+			data = firstData
+			if conn.buffer == nil {
+				if int64(size) != int64(length) {
+					return fmt.Errorf("%w: chunk %d from %v:%d is %d bytes long instead of %d",
+						catalogue.ErrCorruptChunk, chunk, ip, port, size, length)
 				}
-				err = s.cat.SaveChunk(sha1Hash, chunk, conn.buffer)
-				if err != nil {
-					panic(err)
+				conn.hash = hash
+				conn.buffer = make([]byte, size)
+				for offset, d := range early {
+					if err := conn.write(offset, d); err != nil {
+						return err
+					}
 				}
-				downloadTime := float64(time.Since(start).Seconds())
-				speed := 4.0 / downloadTime
-				fmt.Printf("Chunk %d complete at %.2f mbps\n", chunk, speed)
-				break
+				early = nil
 			}
 		}
-		conn.Ack(packet.Offset)
-	}
 
-	delete(s.downloads, downloadKey{hash: *sha1Hash, remoteHost: ip})
+		if conn.buffer == nil {
+			if int64(packet.Offset)+int64(len(data)) > int64(length) {
+				return fmt.Errorf("chunk %d: %d bytes at offset %d overflow %d-byte chunk",
+					chunk, len(data), packet.Offset, length)
+			}
+			earlyBytes += len(data) - len(early[packet.Offset])
+			if earlyBytes > length {
+				return fmt.Errorf("chunk %d: more data arrived ahead of its first packet than it holds",
+					chunk)
+			}
+			early[packet.Offset] = data
+		} else if err := conn.write(packet.Offset, data); err != nil {
+			return err
+		}
+
+		// acknowledge everything received so far, so the sender can fill any gaps
+		scoreboard.add(packet.Offset, packet.Offset+uint32(len(data)))
+		conn.Ack(scoreboard.ack())
+
+		if conn.buffer != nil && scoreboard.cumulative >= uint32(len(conn.buffer)) {
+			// tell the sender we're done, in case our final ack gets lost
+			conn.Cancel()
+
+			hash := sha1.New()
+			hash.Write(conn.buffer)
+			finalHash := (&common.Sha1Hash{}).FromSlice(hash.Sum(nil))
+			if finalHash.Data != conn.hash.Data {
+				// damaged in transit. The catalogue also checks the chunk against its trusted
+				// chunk hash, which catches peers that serve bad data along with a matching hash
+				return fmt.Errorf("%w: chunk %d from %v:%d does not match the hash it was sent with",
+					catalogue.ErrCorruptChunk, chunk, ip, port)
+			}
+			proof, err := s.chunkProof(ip, port, sha1Hash, chunk)
+			if err != nil {
+				return err
+			}
+			err = s.cat.SaveChunk(sha1Hash, chunk, conn.buffer, proof)
+			if err != nil {
+				return err
+			}
+			s.recordChunk(peerKey{address: ip, port: port}, len(conn.buffer), time.Since(start))
+			downloadTime := float64(time.Since(start).Seconds())
+			speed := float64(len(conn.buffer)) / (1 << 20) / downloadTime
+			fmt.Printf("Chunk %d complete at %.2f MB/s\n", chunk, speed)
+			return nil
+		}
+	}
 }
 
 func (s *Server) getGoodHosts(
 	hash *common.Sha1Hash,
-	chunks []uint16,
-	ownIP [4]byte,
+	chunks []uint32,
+	ownIP netip.Addr,
 ) []*messages.DiscoverHostResponse {
-	resps := s.DiscoverHosts(hash, make([]uint16, 0))
+	ownPeer := peerKey{address: ownIP, port: uint16(s.port)}
+	resps := s.DiscoverHosts(hash, make([]uint32, 0), false)
 	result := make([]*messages.DiscoverHostResponse, 0, len(resps))
 	for i := 0; i < len(resps); i++ {
 		// skip hosts that know nothing about the file we want
-		if len(resps[i].Chunks) > 0 && resps[i].Address != ownIP {
+		host := peerKey{address: resps[i].Address, port: resps[i].Port}
+		if len(resps[i].Chunks) > 0 && host != ownPeer && !s.isSelf(host) {
 			result = append(result, &resps[i])
 		}
 	}
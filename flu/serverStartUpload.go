@@ -29,19 +29,42 @@ func (s *Server) StartUpload(
 		return err
 	}
 
-	remoteHostIP, err := newIpv4(&returnAddr.IP)
+	remoteHostIP, err := addrOf(returnAddr)
 	if err != nil {
 		return err
 	}
 
+	s.recordHaveAudience(msg.Sha1Hash, remoteHostIP)
+
 	key := uploadKey{
 		remoteHost: remoteHostIP,
 		remotePort: uint16(returnAddr.Port),
 	}
 
-	if _, ok := s.uploads[key]; !ok {
-		s.uploads[key] = NewSenderConnection(reader, msg.WindowCap, conn, returnAddr)
+	s.transferLock.Lock()
+	if s.closing {
+		s.transferLock.Unlock()
+		return errShuttingDown
+	}
+	sc, ok := s.uploads[key]
+	if !ok {
+		sc = NewSenderConnection(reader, msg.WindowCap, conn, returnAddr,
+			s.uploadBuckets(remoteHostIP))
+		s.uploads[key] = sc
 	}
+	s.transferLock.Unlock()
+
+	if ok {
+		return nil // duplicate request for a connection that is already running
+	}
+
+	// forget the upload once the sender is done with it
+	go func() {
+		<-sc.done
+		s.transferLock.Lock()
+		delete(s.uploads, key)
+		s.transferLock.Unlock()
+	}()
 
-	return s.uploads[key].kickstart(&reader.Hash, int64(reader.Size))
+	return sc.kickstart(&reader.Hash, int64(reader.Size))
 }
@@ -0,0 +1,92 @@
+package flu
+
+import (
+	"fmt"
+
+	"github.com/flu-network/client/common"
+	"github.com/flu-network/client/flu/picker"
+)
+
+// PauseDownload stops downloading the specified file. In-flight chunks are abandoned and their
+// senders are told to stop, but everything downloaded so far is kept. The download can be picked
+// up again with ResumeDownload, and is not resumed automatically when the daemon restarts. Blocks
+// until the download has stopped.
+func (s *Server) PauseDownload(hash *common.Sha1Hash) error {
+	if s.stopResuming(hash) && !s.isDownloading(hash) {
+		// it was still waiting for peers; nothing is in flight
+		return s.cat.SetPaused(hash, true)
+	}
+
+	s.transferLock.Lock()
+	sched, ok := s.schedulers[*hash]
+	if !ok {
+		s.transferLock.Unlock()
+		return fmt.Errorf("no download in progress for %v", hash)
+	}
+	delete(s.schedulers, *hash)
+	s.paused[*hash] = sched.cfg
+	s.transferLock.Unlock()
+
+	sched.stop()
+	return s.cat.SetPaused(hash, true)
+}
+
+// ResumeDownload restarts a download previously stopped with PauseDownload, using the same policy
+// it was started with (or the default policy, if it was paused before the daemon restarted). The
+// download stays paused if it cannot be restarted.
+func (s *Server) ResumeDownload(hash *common.Sha1Hash) error {
+	s.transferLock.Lock()
+	cfg, ok := s.paused[*hash]
+	s.transferLock.Unlock()
+	if !ok {
+		rec, err := s.cat.Contains(hash)
+		if err != nil || !rec.Paused {
+			return fmt.Errorf("no paused download for %v", hash)
+		}
+		cfg.Policy = picker.Default
+	}
+
+	return s.StartDownload(hash, cfg.Policy, nil)
+}
+
+// CancelDownload stops downloading the specified file, whether it is running or paused, and removes
+// it from the catalogue. Unlike a paused download, a cancelled one cannot be resumed: its progress
+// is forgotten, and getting the file again downloads it from scratch. If deleteData is true, the
+// partially-downloaded file is deleted too; otherwise it is left on disk. Blocks until the
+// download has stopped.
+func (s *Server) CancelDownload(hash *common.Sha1Hash, deleteData bool) error {
+	resuming := s.stopResuming(hash)
+
+	s.transferLock.Lock()
+	sched, running := s.schedulers[*hash]
+	delete(s.schedulers, *hash)
+	_, paused := s.paused[*hash]
+	delete(s.paused, *hash)
+	s.transferLock.Unlock()
+
+	if running {
+		sched.stop()
+	}
+
+	if !running && !paused && !resuming {
+		// the download may have been paused before the daemon restarted
+		rec, err := s.cat.Contains(hash)
+		paused = err == nil && rec.Paused
+	}
+
+	if !deleteData {
+		if !running && !paused && !resuming {
+			return fmt.Errorf("no download in progress for %v", hash)
+		}
+		return s.cat.UnshareFile(hash)
+	}
+
+	rec, err := s.cat.Contains(hash)
+	if err != nil {
+		return err
+	}
+	if rec.Progress.Full() {
+		return fmt.Errorf("refusing to delete %s: it has been downloaded completely", rec.FilePath)
+	}
+	return s.cat.DeleteDownload(hash)
+}
@@ -0,0 +1,148 @@
+package flu
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/flu-network/client/flu/picker"
+)
+
+// eventually waits up to a few seconds for cond to hold
+func eventually(t *testing.T, desc string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s\n", desc)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// hangAfterFirstChunk has stub peers send chunk 0, and then hang on every other chunk until the
+// download stops
+func hangAfterFirstChunk(ctx context.Context, peer peerKey, chunk uint32) error {
+	if chunk == 0 {
+		return nil
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestPauseAndResume(t *testing.T) {
+	s, hash := newTestDownload(t, 8)
+	if !s.LocalIP().IsValid() {
+		t.Skip("no network interface to download over")
+	}
+	peers := newStubPeers(s, hash, 8, 2)
+	peers.fail = hangAfterFirstChunk
+	if err := s.StartDownload(hash, picker.Sequential, nil); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "chunk 0 to be downloaded", func() bool { return s.cat.Get(hash).Progress.Get(0) })
+
+	// pausing stops the scheduler and keeps what was downloaded
+	s.transferLock.Lock()
+	sched := s.schedulers[*hash]
+	s.transferLock.Unlock()
+	if err := s.PauseDownload(hash); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-sched.stopped:
+	default:
+		t.Fatal("Expected the scheduler to have stopped once the download is paused")
+	}
+	if s.isDownloading(hash) {
+		t.Fatal("Expected the paused download to be forgotten by the server")
+	}
+	if rec := s.cat.Get(hash); !rec.Paused || rec.Progress.Count() != 1 {
+		t.Fatalf("Expected a paused download of chunk 0 but got paused %v, chunks %v\n",
+			rec.Paused, rec.Progress.Ranges())
+	}
+	if err := s.PauseDownload(hash); err == nil {
+		t.Fatal("Expected a paused download not to be paused again")
+	}
+
+	// resuming restarts it with the policy it was started with
+	if err := s.ResumeDownload(hash); err != nil {
+		t.Fatal(err)
+	}
+	s.transferLock.Lock()
+	sched, ok := s.schedulers[*hash]
+	s.transferLock.Unlock()
+	if !ok || sched.cfg.Policy != picker.Sequential {
+		t.Fatalf("Expected the download to resume with the sequential policy but got %v\n", sched)
+	}
+	if rec := s.cat.Get(hash); rec.Paused || rec.Progress.Count() != 1 {
+		t.Fatalf("Expected a running download of chunk 0 but got paused %v, chunks %v\n",
+			rec.Paused, rec.Progress.Ranges())
+	}
+
+	// cancelling forgets the download, which can then no longer be resumed, but keeps its data
+	path := s.cat.Get(hash).FilePath
+	if err := s.CancelDownload(hash, false); err != nil {
+		t.Fatal(err)
+	}
+	if s.isDownloading(hash) {
+		t.Fatal("Expected the cancelled download to have stopped")
+	}
+	if rec, err := s.cat.Contains(hash); err == nil {
+		t.Fatalf("Expected the cancelled download to be forgotten but got %v\n", rec)
+	}
+	if err := s.ResumeDownload(hash); err == nil {
+		t.Fatal("Expected a cancelled download not to be resumable")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Expected the partial file to be kept but got %v\n", err)
+	}
+}
+
+func TestCancelAndDelete(t *testing.T) {
+	s, hash := newTestDownload(t, 8)
+	if !s.LocalIP().IsValid() {
+		t.Skip("no network interface to download over")
+	}
+	peers := newStubPeers(s, hash, 8, 2)
+	peers.fail = hangAfterFirstChunk
+	if err := s.StartDownload(hash, picker.Sequential, nil); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "chunk 0 to be downloaded", func() bool { return s.cat.Get(hash).Progress.Get(0) })
+
+	path := s.cat.Get(hash).FilePath
+	if err := s.CancelDownload(hash, true); err != nil {
+		t.Fatal(err)
+	}
+	if s.isDownloading(hash) {
+		t.Fatal("Expected the cancelled download to have stopped")
+	}
+	if rec, err := s.cat.Contains(hash); err == nil {
+		t.Fatalf("Expected the cancelled download to be forgotten but got %v\n", rec)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Expected the partial file to be deleted but got %v\n", err)
+	}
+
+	// a complete file is never deleted
+	s, hash = newTestDownload(t, 8)
+	newStubPeers(s, hash, 8, 2)
+	if err := s.StartDownload(hash, picker.Default, nil); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the download to complete", func() bool {
+		complete, _ := s.cat.FileComplete(hash)
+		return complete && !s.isDownloading(hash)
+	})
+	path = s.cat.Get(hash).FilePath
+	if err := s.CancelDownload(hash, true); err == nil {
+		t.Fatal("Expected a complete download not to be deleted")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Expected the complete file to be kept but got %v\n", err)
+	}
+	if _, err := s.cat.Contains(hash); err != nil {
+		t.Fatalf("Expected the complete file to stay in the catalogue but got %v\n", err)
+	}
+}
@@ -0,0 +1,32 @@
+package flu
+
+import (
+	"net"
+
+	"github.com/flu-network/client/flu/messages"
+)
+
+// StopUpload terminates the upload to the peer that sent the request, if there is one.
+func (s *Server) StopUpload(
+	msg *messages.CloseConnectionRequest,
+	returnAddr *net.UDPAddr,
+) error {
+	remoteHostIP, err := addrOf(returnAddr)
+	if err != nil {
+		return err
+	}
+
+	key := uploadKey{
+		remoteHost: remoteHostIP,
+		remotePort: uint16(returnAddr.Port),
+	}
+
+	s.transferLock.Lock()
+	sc, ok := s.uploads[key]
+	s.transferLock.Unlock()
+	if ok {
+		sc.terminate()
+	}
+	// otherwise the upload already finished: receivers send this when they have everything too
+	return nil
+}
@@ -0,0 +1,45 @@
+package flu
+
+import "time"
+
+// TransferConfig tunes how long peers are waited for and how much they may send at once
+type TransferConfig struct {
+	WindowCap        uint16        // packets of a chunk a peer may send ahead of acknowledgements
+	ReadTimeout      time.Duration // how long a chunk download waits for the next packet
+	DiscoveryTimeout time.Duration // how long a discovery probe collects responses for
+}
+
+// DefaultTransferConfig returns timeouts that allow for a busy LAN, and a window large enough to
+// keep a fast one full
+func DefaultTransferConfig() TransferConfig {
+	return TransferConfig{
+		WindowCap:        1024,
+		ReadTimeout:      5 * time.Second,
+		DiscoveryTimeout: 2 * time.Second,
+	}
+}
+
+// SetTransferConfig changes the window and timeouts used by transfers and discoveries started
+// after this call. A window cap of 0 is raised to 1, and timeouts below a millisecond to a
+// millisecond.
+func (s *Server) SetTransferConfig(cfg TransferConfig) {
+	if cfg.WindowCap < 1 {
+		cfg.WindowCap = 1
+	}
+	if cfg.ReadTimeout < time.Millisecond {
+		cfg.ReadTimeout = time.Millisecond
+	}
+	if cfg.DiscoveryTimeout < time.Millisecond {
+		cfg.DiscoveryTimeout = time.Millisecond
+	}
+	s.transferLock.Lock()
+	defer s.transferLock.Unlock()
+	s.transferConfig = cfg
+}
+
+// TransferConfig returns the window and timeouts transfers and discoveries are started with
+func (s *Server) TransferConfig() TransferConfig {
+	s.transferLock.Lock()
+	defer s.transferLock.Unlock()
+	return s.transferConfig
+}
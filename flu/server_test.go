@@ -0,0 +1,44 @@
+package flu
+
+import (
+	"testing"
+	"time"
+
+	"github.com/flu-network/client/flu/messages"
+)
+
+func TestDeliverResponse(t *testing.T) {
+	s := NewServer(0, nil)
+	res := &messages.DiscoverHostResponse{RequestID: 1}
+	responses := s.registerResponseChan(1, res.Type())
+
+	// a duplicate response waits for the request to read it, or to stop waiting
+	if err := s.deliverResponse(1, res); err != nil {
+		t.Fatal(err)
+	}
+	delivered := make(chan error)
+	go func() { delivered <- s.deliverResponse(1, res) }()
+	time.Sleep(10 * time.Millisecond)
+	s.unregisterResponseChan(1, res.Type())
+	select {
+	case err := <-delivered:
+		if err == nil {
+			t.Fatal("Expected a response to an expired request to be dropped")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a response to an expired request not to block")
+	}
+	if len(responses) != 1 {
+		t.Fatalf("Expected only the first response to be delivered but got %d\n", len(responses))
+	}
+
+	// and other requests are still answered
+	other := s.registerResponseChan(2, res.Type())
+	defer s.unregisterResponseChan(2, res.Type())
+	if err := s.deliverResponse(2, &messages.DiscoverHostResponse{RequestID: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-other; msg.(*messages.DiscoverHostResponse).RequestID != 2 {
+		t.Fatalf("Unexpected response %v\n", msg)
+	}
+}
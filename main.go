@@ -1,98 +1,103 @@
 package main
 
 import (
-	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"net/rpc"
 	"os"
-	"path"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/flu-network/client/catalogue"
 	"github.com/flu-network/client/cli"
 	"github.com/flu-network/client/flu"
+	"github.com/flu-network/client/flu/messages"
 
 	_ "net/http/pprof"
 )
 
-// Defaults. Can be overridden by user
-const downloadsDirSuffix = "/.flu-network/downloads"
-const catalogueDirSuffix = "/.flu-network/catalogue" // TODO: make cross-platform
-const sockaddr = "/tmp/flu-network.sock"             // for cli communication
-const udpPort = 61696                                // port "f100" in hex
-
 func main() {
-	daemonMode := flag.Bool("d", false, "-d")
-	flag.Parse()
+	settings, err := loadSettings(os.Args[1:])
+	if err != nil {
+		fmt.Println(err) // the CLI only needs to find the daemon
+		if settings.daemonMode {
+			os.Exit(exitFailed) // e.g., the config file is invalid
+		}
+	}
 
-	if *daemonMode {
+	if settings.daemonMode {
 		go func() {
 			log.Println(http.ListenAndServe("localhost:6060", nil))
 			// head to http://localhost:6060/debug/pprof/ to get started
 			// go tool pprof client http://localhost:6060/debug/pprof/profile
 			// https://jvns.ca/blog/2017/09/24/profiling-go-with-pprof/
 		}()
-		startDaemon()
+		startDaemon(settings)
 	} else {
-		args := os.Args[1:] // first arg is pathToBinary. Should be ignored in a CLI.
 		// cliClient is designed to be a short-lived process that executes a single CLI command,
 		// waits for the result, prints it and then exits.
-		cli.NewClient(sockaddr).Run(args)
+		cli.NewClient(settings.sockaddr).Run(settings.args)
 	}
 }
 
-func startDaemon() {
-	homeDir, err := os.UserHomeDir()
-	failHard(err)
-	calatogueDir := path.Join(homeDir, catalogueDirSuffix)
-	downloadsDir := path.Join(homeDir, downloadsDirSuffix)
-
-	cat, err := catalogue.NewCat(calatogueDir, downloadsDir)
+func startDaemon(settings settings) {
+	sockaddr, udpPort := settings.sockaddr, settings.port
+	cat, err := catalogue.NewCat(settings.catalogueDir, settings.downloadsDir)
 	failHard(err)
-	failHard(cat.Init())
+	if err := cat.Init(); err != nil {
+		fmt.Println(err) // e.g., another daemon is using the catalogue
+		os.Exit(exitFailed)
+	}
 	fluServer := flu.NewServer(udpPort, cat)
-	/*
-		TODO: set up harnessing: e.g.,
-			- handle OS signals properly
-			- set up channels for control signals between goroutines (e.g., to stop a transfer)
-	*/
+	d := &daemon{cat: cat, server: fluServer}
+	d.apply(settings) // nothing is in force yet, so every subsystem is told about every setting
 
 	// Expose CLI interface (RPC over unix domain sockets)
+	failHard(os.RemoveAll(sockaddr))
+	unixAddr, err := net.ResolveUnixAddr("unixgram", sockaddr)
+	failHard(err)
+	rpcServer := rpc.NewServer()
+	rpcServer.Register(cli.NewMethods(cat, fluServer, d))
+	listener, err := net.ListenUnix("unix", unixAddr)
+	failHard(err)
+	fmt.Printf("UNIX Interface available at: %s\n", sockaddr)
 	go func() {
-		err := os.RemoveAll(sockaddr)
-		failHard(err)
-
-		addr, err := net.ResolveUnixAddr("unixgram", sockaddr)
-		failHard(err)
-
-		rpcServer := rpc.NewServer()
-		cliMethods := cli.NewMethods(cat, fluServer)
-		rpcServer.Register(cliMethods)
-		listener, e := net.ListenUnix("unix", addr)
-		failHard(e)
-		fmt.Printf("UNIX Interface available at: %s\n", sockaddr)
-
-		rpcServer.Accept(listener)
-		listener.Close()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return // the listener was closed
+			}
+			go rpcServer.ServeConn(conn)
+		}
 	}()
 
-	// expose p2p interface (UDP)
+	// expose p2p interface (UDP). The socket is bound before anything else is started so that
+	// resumed downloads can hear back from their peers.
+	addr := net.UDPAddr{IP: nil, Port: udpPort, Zone: ""}
+	c1, err := net.ListenUDP("udp", &addr)
+	failHard(err)
+	fmt.Printf("UDP Interface available at: %s:%d\n", fluServer.LocalIP().String(), udpPort)
+	if err := fluServer.JoinMulticastGroup(c1); err != nil {
+		fmt.Println(err) // hosts can still be discovered over IPv4
+	}
+	stopping := make(chan struct{}) // closed when the daemon starts shutting down
 	go func() {
-		addr := net.UDPAddr{IP: nil, Port: udpPort, Zone: ""}
-		c1, err := net.ListenUDP("udp", &addr)
-		failHard(err)
-		defer c1.Close()
-		fmt.Printf("UDP Interface available at: %s:%d\n", fluServer.LocalIP().String(), udpPort)
-
 		for {
-			buffer := make([]byte, 1024)
-			_, returnAddress, err := c1.ReadFromUDP(buffer)
-			failHard(err)
+			buffer := make([]byte, messages.MaxDatagramSize)
+			n, returnAddress, err := c1.ReadFromUDP(buffer)
+			if err != nil {
+				select {
+				case <-stopping:
+					return
+				default:
+					failHard(err)
+				}
+			}
 			go func() {
-				err := fluServer.HandleMessage(buffer, c1, returnAddress)
+				err := fluServer.HandleMessage(buffer[:n], c1, returnAddress)
 				if err != nil {
 					fmt.Println(err)
 				}
@@ -100,10 +105,89 @@ func startDaemon() {
 		}
 	}()
 
+	// let other hosts know we're here, and find out who else is
+	fluServer.AnnouncePresence()
+
+	// stop gracefully when asked to
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	// reload the settings when asked to
+	reloads := make(chan os.Signal, 1)
+	notifyReload(reloads)
+	go func() {
+		for range reloads {
+			d.reload()
+		}
+	}()
+
+	// pick up where we left off before the daemon last stopped. Shared files are served either
+	// way, and downloads that were not resumed can still be started from the CLI
+	if err := fluServer.ResumeIncompleteDownloads(); err != nil {
+		fmt.Printf("Could not resume downloads: %v\n", err)
+	}
+
+	ticker := time.NewTicker(time.Millisecond * 1000)
 	for {
-		// TODO: Download files that need downloading
-		time.Sleep(time.Millisecond * 1000)
+		select {
+		case <-ticker.C:
+			if err := cat.RenewLease(); err != nil {
+				fmt.Printf("Failed to renew the lease on the catalogue: %v\n", err)
+			}
+			fluServer.ApplySchedule()
+			fluServer.MaintainPeers()
+			fluServer.AnnouncePresence()
+		case sig := <-signals:
+			fmt.Printf("Received %v. Shutting down (send it again to exit immediately)\n", sig)
+			go func() {
+				<-signals
+				fmt.Println("Exiting without shutting down")
+				os.Exit(exitForced)
+			}()
+			close(stopping)
+			os.Exit(stopDaemon(listener, sockaddr, c1, fluServer, cat))
+		}
+	}
+}
+
+// Exit statuses of the daemon once it is told to stop
+const (
+	exitStopped = 0 // everything was shut down
+	exitFailed  = 1 // some of it could not be
+	exitForced  = 2 // a second signal cut the shutdown short
+)
+
+// stopDaemon stops accepting RPCs and datagrams, stops every transfer, saves the catalogue and
+// removes the unix socket, carrying on past any step that fails. Returns the status to exit with.
+func stopDaemon(
+	listener *net.UnixListener,
+	sockaddr string,
+	conn *net.UDPConn,
+	fluServer *flu.Server,
+	cat *catalogue.Cat,
+) int {
+	failed := false
+	step := func(what string, err error) {
+		if err != nil {
+			fmt.Printf("Failed to %s: %v\n", what, err)
+			failed = true
+		}
+	}
+
+	step("stop accepting CLI commands", listener.Close())
+	step("stop accepting datagrams", conn.Close())
+	step("stop transfers", fluServer.Shutdown())
+	step("save the catalogue", cat.Close())
+	if err := os.Remove(sockaddr); err != nil && !os.IsNotExist(err) {
+		step("remove "+sockaddr, err) // closing the listener normally removes it
+	}
+
+	if failed {
+		fmt.Println("Daemon stopped with errors")
+		return exitFailed
 	}
+	fmt.Println("Daemon stopped")
+	return exitStopped
 }
 
 func failHard(err error) {
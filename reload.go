@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/flu-network/client/catalogue"
+	"github.com/flu-network/client/cli"
+	"github.com/flu-network/client/config"
+	"github.com/flu-network/client/flu"
+)
+
+// daemon is a running daemon along with the settings it runs with. Its settings can be reloaded
+// while it runs, and each subsystem is told about the settings of its that changed.
+type daemon struct {
+	cat      *catalogue.Cat
+	server   *flu.Server
+	settings settings
+	lock     sync.Mutex // guards settings, and keeps changes to them from interleaving
+}
+
+// apply tells every subsystem whose settings differ from those in force about them, and makes
+// them the settings in force. Returns the names of the settings that were applied, and of those
+// that changed but only take effect when the daemon restarts. Callers must hold lock.
+func (d *daemon) apply(s settings) (applied, restart []string) {
+	changed := s.changed(d.settings)
+	anyChanged := func(names ...string) bool {
+		for _, name := range names {
+			if changed[name] {
+				return true
+			}
+		}
+		return false
+	}
+
+	if anyChanged("chunk-size") {
+		d.cat.SetChunkSize(s.chunkSize)
+	}
+	if anyChanged("peer-chunks", "file-chunks", "policy") {
+		d.server.SetSchedulerConfig(s.scheduler)
+	}
+	if anyChanged("window-cap", "read-timeout", "discovery-timeout") {
+		d.server.SetTransferConfig(s.transfer)
+	}
+	if anyChanged("max-upload", "max-download", "max-peer-upload", "max-file-download") {
+		d.server.SetLimits(s.limits)
+	}
+	if anyChanged("schedule") {
+		d.server.SetSchedule(s.schedule)
+	}
+	if anyChanged("interfaces", "exclude-interfaces") {
+		d.server.SetInterfaceFilter(s.interfaces)
+	}
+	if anyChanged("peer-ports") {
+		d.server.SetPeerPorts(s.peerPorts)
+	}
+
+	for name := range changed {
+		if restartSettings[name] {
+			restart = append(restart, name)
+		} else if name != "config" {
+			applied = append(applied, name)
+		}
+	}
+	sort.Strings(applied)
+	sort.Strings(restart)
+
+	// settings that need a restart keep the values in force, so that they are reported until then
+	if d.settings.values != nil {
+		for name := range restartSettings {
+			s.values[name] = d.settings.values[name]
+		}
+	}
+	d.settings = s
+	return applied, restart
+}
+
+// reload reads the environment and the config file again, and applies the settings that changed
+func (d *daemon) reload() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	s, err := loadSettings(os.Args[1:])
+	if err != nil {
+		fmt.Printf("Failed to reload settings, keeping the current ones: %v\n", err)
+		return
+	}
+	applied, restart := d.apply(s)
+	fmt.Printf("Reloaded settings from %s\n", s.config.Path)
+	if len(applied) > 0 {
+		fmt.Printf("Applied: %s\n", strings.Join(applied, ", "))
+	}
+	if len(restart) > 0 {
+		fmt.Printf("Applied when the daemon restarts: %s\n", strings.Join(restart, ", "))
+	}
+}
+
+// SetConfig implements cli.Configurer
+func (d *daemon) SetConfig(req cli.ConfigRequest) (cli.ConfigResponse, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	s, err := parseSettings(os.Args[1:], func(file *config.File) {
+		if req.Unset {
+			delete(file.Settings, req.Name)
+		} else {
+			file.Settings[req.Name] = req.Value
+		}
+	})
+	if err != nil {
+		return cli.ConfigResponse{}, err
+	}
+	if err := s.config.Write(); err != nil {
+		return cli.ConfigResponse{}, err
+	}
+	result := cli.ConfigResponse{Path: s.config.Path, Overridden: s.given[req.Name]}
+	result.Applied, result.Restart = d.apply(s)
+	return result, nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/flu-network/client/catalogue"
+	"github.com/flu-network/client/config"
+	"github.com/flu-network/client/flu"
+	"github.com/flu-network/client/flu/picker"
+	"github.com/flu-network/client/flu/ratelimit"
+)
+
+// Defaults. Can be overridden by flags, FLU_* environment variables or the config file
+const fluDirName = ".flu-network"
+const defaultSockaddr = "/tmp/flu-network.sock" // for cli communication
+const defaultUDPPort = 61696                    // port "f100" in hex
+const configFileName = "config.json"            // in the catalogue directory
+
+// restartSettings only take effect when the daemon is restarted. The rest are applied as soon as
+// they change.
+var restartSettings = map[string]bool{
+	"socket":    true,
+	"port":      true,
+	"catalogue": true,
+	"downloads": true,
+}
+
+// settings are what the daemon and the CLI run with
+type settings struct {
+	daemonMode bool
+	args       []string          // the CLI command and its arguments
+	config     *config.File      // the config file the settings were read from
+	given      map[string]bool   // settings given on the command line or in the environment
+	values     map[string]string // the value of every setting, by name
+
+	sockaddr     string
+	port         int
+	peerPorts    []uint16
+	catalogueDir string
+	downloadsDir string
+	chunkSize    int
+
+	scheduler  flu.SchedulerConfig
+	transfer   flu.TransferConfig
+	limits     flu.Limits
+	schedule   flu.Schedule
+	interfaces flu.InterfaceFilter
+}
+
+// loadSettings parses the command line. Settings that are not given on it are taken from their
+// FLU_* environment variables, or failing that from the config file.
+func loadSettings(args []string) (settings, error) {
+	return parseSettings(args, nil)
+}
+
+// parseSettings parses the command line, the environment and the config file like loadSettings,
+// but lets edit change the config file's settings before they are used. The file is not written.
+// If the settings are invalid, those parsed so far are returned along with the error, so that the
+// CLI can still find the daemon and have it fix its config file.
+func parseSettings(args []string, edit func(*config.File)) (settings, error) {
+	homeDir, _ := os.UserHomeDir() // if there is none, the directories are relative to this one
+	fluDir := filepath.Join(homeDir, fluDirName)
+	defaults := flu.DefaultSchedulerConfig()
+	transferDefaults := flu.DefaultTransferConfig()
+
+	flags := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ExitOnError)
+	daemonMode := flags.Bool("d", false, "-d")
+	configPath := flags.String("config", "",
+		"JSON config file giving any of these settings. Default: "+configFileName+
+			" in the catalogue directory")
+	sockaddr := flags.String("socket", defaultSockaddr, "unix socket the CLI talks to the daemon on")
+	port := flags.Int("port", defaultUDPPort, "UDP port to listen for other hosts on")
+	peerPorts := flags.String("peer-ports", "",
+		"comma-separated ports other hosts may listen on besides this one's, e.g., '61697,61698'")
+	catalogueDir := flags.String("catalogue", filepath.Join(fluDir, "catalogue"),
+		"directory of the index of shared files")
+	downloadsDir := flags.String("downloads", filepath.Join(fluDir, "downloads"),
+		"directory files are downloaded to")
+	chunkSize := flags.Int("chunk-size", catalogue.DefaultChunkSize,
+		"size in bytes of the chunks files are split into when they are shared")
+	peerChunks := flags.Int("peer-chunks", defaults.MaxInFlightPerPeer,
+		"max chunks downloaded concurrently from a single peer")
+	fileChunks := flags.Int("file-chunks", defaults.MaxInFlightPerFile,
+		"max chunks downloaded concurrently for a single file")
+	policyName := flags.String("policy", defaults.Policy.String(),
+		"default chunk selection policy: rarest, sequential or random")
+	windowCap := flags.Int("window-cap", int(transferDefaults.WindowCap),
+		"max packets of a chunk a peer may send ahead of acknowledgements")
+	readTimeout := flags.Duration("read-timeout", transferDefaults.ReadTimeout,
+		"how long a chunk download waits for the next packet before giving up on the peer")
+	discoveryTimeout := flags.Duration("discovery-timeout", transferDefaults.DiscoveryTimeout,
+		"how long hosts are given to answer a discovery probe")
+	maxUpload := flags.String("max-upload", "off", "total upload limit, e.g., 500K or 2M per second")
+	maxDownload := flags.String("max-download", "off", "total download limit per second")
+	maxPeerUpload := flags.String("max-peer-upload", "off", "upload limit per peer per second")
+	maxFileDownload := flags.String("max-file-download", "off", "download limit per file per second")
+	schedule := flags.String("schedule", "",
+		"bandwidth schedule, e.g., 'weekdays 09:00-18:00 upload=1M; daily 00:00-07:00 download=off'")
+	allowInterfaces := flags.String("interfaces", "",
+		"comma-separated interfaces to discover hosts on, e.g., 'eth0,wlan*'. Default: all")
+	denyInterfaces := flags.String("exclude-interfaces", "",
+		"comma-separated interfaces not to discover hosts on, e.g., 'docker*,tun*'")
+	flags.Parse(args)
+	result := settings{daemonMode: *daemonMode, args: flags.Args(), sockaddr: *sockaddr}
+
+	// the config file is found through the settings given on the command line and in the
+	// environment alone, and the mode is only chosen on the command line, or every CLI command
+	// would start a daemon
+	commandLineMode := *daemonMode
+	given, err := config.LoadEnv(flags)
+	result.sockaddr = *sockaddr
+	if err != nil {
+		return result, err
+	}
+	if *daemonMode != commandLineMode {
+		return result, fmt.Errorf("%s cannot be set in the environment", config.EnvName("d"))
+	}
+	if *configPath == "" {
+		*configPath = filepath.Join(*catalogueDir, configFileName)
+	}
+	file, err := config.ReadFile(*configPath)
+	if err != nil {
+		return result, err
+	}
+	if edit != nil {
+		edit(file)
+	}
+	for _, name := range []string{"d", "config"} {
+		if _, ok := file.Settings[name]; ok {
+			return result, fmt.Errorf("%s: %s cannot be set in the config file", file.Path, name)
+		}
+	}
+	err = file.Apply(flags, given)
+	result.sockaddr = *sockaddr
+	if err != nil {
+		return result, err
+	}
+
+	result.config, result.given, result.values = file, given, make(map[string]string)
+	result.port, result.chunkSize = *port, *chunkSize
+	result.catalogueDir, result.downloadsDir = *catalogueDir, *downloadsDir
+	flags.VisitAll(func(f *flag.Flag) {
+		result.values[f.Name] = f.Value.String()
+	})
+
+	if result.port < 1 || result.port > 65535 {
+		return result, fmt.Errorf("invalid port %d", result.port)
+	}
+	if result.peerPorts, err = flu.ParsePorts(*peerPorts); err != nil {
+		return result, err
+	}
+	if result.chunkSize < catalogue.MinChunkSize || result.chunkSize > catalogue.MaxChunkSize {
+		return result, fmt.Errorf("invalid chunk size %d. Expected %d to %d bytes",
+			result.chunkSize, catalogue.MinChunkSize, catalogue.MaxChunkSize)
+	}
+	policy, err := picker.ParsePolicy(*policyName)
+	if err != nil {
+		return result, err
+	}
+	result.scheduler = flu.SchedulerConfig{
+		MaxInFlightPerPeer: *peerChunks,
+		MaxInFlightPerFile: *fileChunks,
+		Policy:             policy,
+	}
+	if *windowCap < 1 || *windowCap > 65535 {
+		return result, fmt.Errorf("invalid window cap %d. Expected 1 to 65535", *windowCap)
+	}
+	if *readTimeout <= 0 || *discoveryTimeout <= 0 {
+		return result, fmt.Errorf("timeouts must be positive")
+	}
+	result.transfer = flu.TransferConfig{
+		WindowCap:        uint16(*windowCap),
+		ReadTimeout:      *readTimeout,
+		DiscoveryTimeout: *discoveryTimeout,
+	}
+	for rate, limit := range map[*string]*int64{
+		maxUpload:       &result.limits.Upload,
+		maxDownload:     &result.limits.Download,
+		maxPeerUpload:   &result.limits.UploadPerPeer,
+		maxFileDownload: &result.limits.DownloadPerFile,
+	} {
+		if *limit, err = ratelimit.ParseRate(*rate); err != nil {
+			return result, err
+		}
+	}
+	if result.schedule, err = flu.ParseSchedule(*schedule); err != nil {
+		return result, err
+	}
+	result.interfaces, err = flu.ParseInterfaceFilter(*allowInterfaces, *denyInterfaces)
+	if err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// changed returns the names of the settings whose values differ from those of other
+func (s settings) changed(other settings) map[string]bool {
+	result := make(map[string]bool)
+	for name, value := range s.values {
+		if other.values[name] != value {
+			result[name] = true
+		}
+	}
+	return result
+}
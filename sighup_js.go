@@ -0,0 +1,7 @@
+package main
+
+import "os"
+
+// notifyReload does nothing, since there are no signals that ask the daemon to reload its
+// settings on this platform
+func notifyReload(c chan<- os.Signal) {}